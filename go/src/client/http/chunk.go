@@ -0,0 +1,164 @@
+package client
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Layout of a V3 training record, as written by lczero: version, 1858 move
+// probabilities, 104 input planes, castling rights and side to move, rule50
+// and move counts, then the game result.  See Training::dump_training_v2.
+const (
+	v3Version          = 3
+	v3RecordSize       = 8276
+	v3ProbsOffset      = 4
+	v3ProbsCount       = 1858
+	v3SideToMoveOffset = v3RecordSize - 4
+	v3ResultOffset     = v3RecordSize - 1
+
+	probsSumEpsilon = 0.01
+)
+
+// ChunkSummary describes a training chunk that passed validation.
+type ChunkSummary struct {
+	// Number of positions, one per ply.
+	Plies int
+	// Game result from white's point of view: 1, 0 or -1.
+	Result int
+}
+
+// ParseTrainingChunk checks that the gzipped training chunk read from r is a
+// complete V3 game: whole records only, sane probabilities, alternating side
+// to move and one result for the whole game.  Truncated files, e.g. from a
+// full disk or a crashed engine, fail here.
+func ParseTrainingChunk(r io.Reader) (*ChunkSummary, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("no training records")
+	}
+	if len(data)%v3RecordSize != 0 {
+		return nil, fmt.Errorf("%d bytes is not a whole number of records", len(data))
+	}
+
+	summary := &ChunkSummary{Plies: len(data) / v3RecordSize}
+	for i := 0; i < summary.Plies; i++ {
+		record := data[i*v3RecordSize : (i+1)*v3RecordSize]
+		if version := binary.LittleEndian.Uint32(record); version != v3Version {
+			return nil, fmt.Errorf("record %d has version %d", i, version)
+		}
+
+		var sum float64
+		for j := 0; j < v3ProbsCount; j++ {
+			bits := binary.LittleEndian.Uint32(record[v3ProbsOffset+4*j:])
+			prob := float64(math.Float32frombits(bits))
+			if math.IsNaN(prob) || prob < 0 {
+				return nil, fmt.Errorf("record %d has invalid probabilities", i)
+			}
+			sum += prob
+		}
+		if math.Abs(sum-1) > probsSumEpsilon {
+			return nil, fmt.Errorf("record %d probabilities sum to %f", i, sum)
+		}
+
+		// Games started from an opening line may begin with black to move.
+		sideToMove := int(record[v3SideToMoveOffset])
+		if sideToMove != (int(data[v3SideToMoveOffset])+i)%2 {
+			return nil, fmt.Errorf("record %d has the wrong side to move", i)
+		}
+
+		// Results are stored from the side to move's point of view.
+		result := int(int8(record[v3ResultOffset]))
+		if result < -1 || result > 1 {
+			return nil, fmt.Errorf("record %d has result %d", i, result)
+		}
+		if sideToMove == 1 {
+			result = -result
+		}
+		if i == 0 {
+			summary.Result = result
+		} else if result != summary.Result {
+			return nil, fmt.Errorf("record %d disagrees on the game result", i)
+		}
+	}
+	return summary, nil
+}
+
+func readChunkRecords(r io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%v3RecordSize != 0 {
+		return nil, fmt.Errorf("%d bytes is not a whole number of records", len(data))
+	}
+	return data, nil
+}
+
+// InterleaveTrainingChunks writes to w the gzipped training chunk of a game
+// played by two engines, from the chunks each engine wrote of its own moves.
+// first is the chunk of the engine that moved first.
+func InterleaveTrainingChunks(first io.Reader, second io.Reader, w io.Writer) error {
+	firstData, err := readChunkRecords(first)
+	if err != nil {
+		return err
+	}
+	secondData, err := readChunkRecords(second)
+	if err != nil {
+		return err
+	}
+	firstCount, secondCount := len(firstData)/v3RecordSize, len(secondData)/v3RecordSize
+	if firstCount != secondCount && firstCount != secondCount+1 {
+		return fmt.Errorf("engines recorded %d and %d moves", firstCount, secondCount)
+	}
+
+	gz := gzip.NewWriter(w)
+	for i := 0; i < firstCount; i++ {
+		_, err = gz.Write(firstData[i*v3RecordSize : (i+1)*v3RecordSize])
+		if err == nil && i < secondCount {
+			_, err = gz.Write(secondData[i*v3RecordSize : (i+1)*v3RecordSize])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// ChunkProbabilities returns the move probabilities of each record of the
+// gzipped training chunk read from r, indexed like the engine's policy output.
+func ChunkProbabilities(r io.Reader) ([][]float32, error) {
+	data, err := readChunkRecords(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]float32, len(data)/v3RecordSize)
+	for i := range result {
+		record := data[i*v3RecordSize : (i+1)*v3RecordSize]
+		probs := make([]float32, v3ProbsCount)
+		for j := range probs {
+			probs[j] = math.Float32frombits(binary.LittleEndian.Uint32(record[v3ProbsOffset+4*j:]))
+		}
+		result[i] = probs
+	}
+	return result, nil
+}
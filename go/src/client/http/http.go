@@ -2,6 +2,9 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,9 +18,45 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func postParams(httpClient *http.Client, uri string, data map[string]string, target interface{}) error {
+// Time limits of each call, on top of any deadline of the context passed in.
+var (
+	NextGameTimeout = time.Minute
+	UploadTimeout   = 5 * time.Minute
+	// Networks are large, and some clients are on slow links.
+	DownloadTimeout = 30 * time.Minute
+)
+
+// An error response of the server.
+type ServerError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Quote it when reporting a problem, so it can be found in the server
+	// logs.
+	RequestID string `json:"request_id"`
+}
+
+func (e *ServerError) Error() string {
+	if len(e.RequestID) == 0 {
+		return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%d: %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+}
+
+// Servers from before structured errors answer in plain text.
+func parseServerError(statusCode int, body []byte) *ServerError {
+	e := &ServerError{}
+	if json.Unmarshal(body, e) != nil || len(e.Message) == 0 {
+		e = &ServerError{Message: strings.TrimSpace(string(body))}
+	}
+	e.StatusCode = statusCode
+	return e
+}
+
+func newFormRequest(uri string, data map[string]string) (*http.Request, error) {
 	var encoded string
 	if data != nil {
 		values := url.Values{}
@@ -26,12 +65,28 @@ func postParams(httpClient *http.Client, uri string, data map[string]string, tar
 		}
 		encoded = values.Encode()
 	}
-	r, err := httpClient.Post(uri, "application/x-www-form-urlencoded", strings.NewReader(encoded))
+	req, err := http.NewRequest("POST", uri, strings.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func postParams(ctx context.Context, httpClient *http.Client, uri string, data map[string]string, target interface{}) error {
+	req, err := newFormRequest(uri, data)
+	if err != nil {
+		return err
+	}
+	r, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
 	defer r.Body.Close()
 	b, _ := ioutil.ReadAll(r.Body)
+	if r.StatusCode >= 400 {
+		return parseServerError(r.StatusCode, b)
+	}
 	if target != nil {
 		err = json.Unmarshal(b, target)
 		if err != nil {
@@ -73,6 +128,42 @@ func BuildUploadRequest(uri string, params map[string]string, paramName, path st
 	return req, err
 }
 
+// RunConfig describes how selfplay games of a training run are played, as
+// set by the run's engine parameters.
+type RunConfig struct {
+	Variant string `json:"variant"`
+	// Search limits, 0 meaning no limit.
+	Visits   int `json:"visits"`
+	Playouts int `json:"playouts"`
+	// Resign below this winrate, -1 meaning never.
+	ResignPercent int               `json:"resignPercent"`
+	Temperature   TemperatureConfig `json:"temperature"`
+	Noise         NoiseConfig       `json:"noise"`
+}
+
+// TemperatureConfig is how moves are picked after search.  With Randomize,
+// in proportion to their visits, at a temperature of 1 / (1 + ln(1 + (ply +
+// 1) * Decay / 50)), or 1 when Decay is 0.
+type TemperatureConfig struct {
+	Randomize bool `json:"randomize"`
+	Decay     int  `json:"decay"`
+}
+
+// NoiseConfig is the Dirichlet noise added to the root policy.
+type NoiseConfig struct {
+	Enabled bool    `json:"enabled"`
+	Epsilon float64 `json:"epsilon"`
+	Alpha   float64 `json:"alpha"`
+}
+
+// VersionWarning tells a client that its version will stop being accepted at
+// Deadline.
+type VersionWarning struct {
+	Message     string    `json:"message"`
+	Deadline    time.Time `json:"deadline"`
+	DownloadUrl string    `json:"downloadUrl"`
+}
+
 type NextGameResponse struct {
 	Type         string
 	TrainingId   uint
@@ -82,11 +173,25 @@ type NextGameResponse struct {
 	Params       string
 	Flip         bool
 	MatchGameId  uint
+	// For match games, whether to also upload the game's training data.
+	TrainingData bool
+	// For selfplay games of runs with an opening book, the line to start
+	// from, in long algebraic notation.  OpeningId is sent back with the
+	// game if it was played.
+	Opening   string
+	OpeningId uint
+	Config    *RunConfig
+	Warning   *VersionWarning
 }
 
-func NextGame(httpClient *http.Client, hostname string, params map[string]string) (NextGameResponse, error) {
+func NextGame(ctx context.Context, httpClient *http.Client, hostname string, params map[string]string) (NextGameResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, NextGameTimeout)
+	defer cancel()
 	resp := NextGameResponse{}
-	err := postParams(httpClient, hostname+"/next_game", params, &resp)
+	err := postParams(ctx, httpClient, hostname+"/next_game", params, &resp)
+	if err != nil {
+		return resp, err
+	}
 
 	if len(resp.Sha) == 0 {
 		return resp, errors.New("Server gave back empty SHA")
@@ -95,27 +200,257 @@ func NextGame(httpClient *http.Client, hostname string, params map[string]string
 	return resp, err
 }
 
-func UploadMatchResult(httpClient *http.Client, hostname string, match_game_id uint, result int, pgn string, params map[string]string) error {
+// Whether a training run is active and its best network.
+type WorkStatus struct {
+	Run           uint   `json:"run"`
+	Active        bool   `json:"active"`
+	BestNetworkID uint   `json:"best_network_id"`
+	BestSha       string `json:"best_sha"`
+	// Of the response, so an unchanged status isn't sent again.
+	ETag string `json:"-"`
+}
+
+// Fetches the status of run, a cheap call to poll.  previous is the status
+// last returned for run, returned again if it hasn't changed.
+func GetWorkStatus(ctx context.Context, httpClient *http.Client, hostname string, run uint, previous WorkStatus) (WorkStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, NextGameTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/work_status?run=%d", hostname, run), nil)
+	if err != nil {
+		return previous, err
+	}
+	if len(previous.ETag) > 0 {
+		req.Header.Set("If-None-Match", previous.ETag)
+	}
+	r, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return previous, err
+	}
+	defer r.Body.Close()
+	b, _ := ioutil.ReadAll(r.Body)
+	if r.StatusCode == http.StatusNotModified {
+		return previous, nil
+	}
+	if r.StatusCode >= 400 {
+		return previous, parseServerError(r.StatusCode, b)
+	}
+	status := WorkStatus{}
+	err = json.Unmarshal(b, &status)
+	if err != nil {
+		return previous, err
+	}
+	status.ETag = r.Header.Get("ETag")
+	return status, nil
+}
+
+// What the client should do about an upload, see UploadResponse.
+const (
+	ActionNone    = "none"
+	ActionRetry   = "retry"
+	ActionDrop    = "drop"
+	ActionUpgrade = "upgrade"
+	ActionStop    = "stop"
+)
+
+// The server's answer to an upload_game or match_result upload.
+type UploadResponse struct {
+	// "ok", "rejected" or "error".
+	Status    string
+	Code      string
+	Message   string
+	Retryable bool
+	Action    string
+	RequestID string `json:"request_id"`
+}
+
+// Decodes the response to an upload.  Servers from before structured
+// responses answer in plain text, so their answers are told apart by the
+// status code alone.
+func ParseUploadResponse(statusCode int, body []byte) UploadResponse {
+	response := UploadResponse{}
+	if json.Unmarshal(body, &response) == nil && len(response.Action) > 0 {
+		return response
+	}
+	response = UploadResponse{Message: strings.TrimSpace(string(body))}
+	switch {
+	case statusCode < 300:
+		response.Status = "ok"
+		response.Action = ActionNone
+	case statusCode >= 500 || statusCode == http.StatusTooManyRequests:
+		response.Status = "error"
+		response.Retryable = true
+		response.Action = ActionRetry
+	default:
+		response.Status = "rejected"
+		response.Action = ActionDrop
+	}
+	return response
+}
+
+func UploadMatchResult(ctx context.Context, httpClient *http.Client, hostname string, match_game_id uint, result int, pgn string, params map[string]string) (UploadResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, UploadTimeout)
+	defer cancel()
 	params["match_game_id"] = strconv.Itoa(int(match_game_id))
 	params["result"] = strconv.Itoa(result)
 	params["pgn"] = pgn
-	return postParams(httpClient, hostname+"/match_result", params, nil)
+	req, err := newFormRequest(hostname+"/match_result", params)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	r, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	return ParseUploadResponse(r.StatusCode, b), nil
 }
 
-func DownloadNetwork(httpClient *http.Client, hostname string, networkPath string, sha string) error {
-	uri := hostname + fmt.Sprintf("/get_network?sha=%s", sha)
-	r, err := httpClient.Get(uri)
+// Uploads the training data of a match game, the gzipped chunk at path.
+func UploadMatchTrainingData(ctx context.Context, httpClient *http.Client, hostname string, match_game_id uint, path string, params map[string]string) (UploadResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, UploadTimeout)
+	defer cancel()
+	params["match_game_id"] = strconv.Itoa(int(match_game_id))
+	req, err := BuildUploadRequest(hostname+"/match_training_data", params, "file", path)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	r, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return UploadResponse{}, err
+	}
 	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	return ParseUploadResponse(r.StatusCode, b), nil
+}
+
+// Tells the server the engine crashed, which counts against the user's
+// reliability.
+func ReportCrash(ctx context.Context, httpClient *http.Client, hostname string, message string, params map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, UploadTimeout)
+	defer cancel()
+	params["message"] = message
+	return postParams(ctx, httpClient, hostname+"/crash_report", params, nil)
+}
+
+// Download progress, reported to a ProgressFunc.
+type Progress struct {
+	Bytes int64
+	// Size of the whole download, -1 if the server didn't say.
+	Total       int64
+	Percent     float64
+	BytesPerSec float64
+}
+
+type ProgressFunc func(Progress)
+
+// How often downloads report progress, besides once when they finish.
+var ProgressInterval = time.Second
+
+type progressWriter struct {
+	progress ProgressFunc
+	start    time.Time
+	reported time.Time
+	current  Progress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.current.Bytes += int64(len(p))
+	if time.Since(w.reported) >= ProgressInterval {
+		w.report()
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) report() {
+	w.reported = time.Now()
+	if w.current.Total > 0 {
+		w.current.Percent = 100 * float64(w.current.Bytes) / float64(w.current.Total)
+	}
+	if elapsed := w.reported.Sub(w.start).Seconds(); elapsed > 0 {
+		w.current.BytesPerSec = float64(w.current.Bytes) / elapsed
+	}
+	w.progress(w.current)
+}
+
+// Hashes the decompressed contents of a network file, which is what its sha
+// is of.
+func networkSha(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, zr); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Streams a network to networkPath, calling progress (if not nil) as it
+// arrives.  The download is checked against sha once complete, and an error
+// returned if it doesn't match, leaving the file for the caller to remove.
+func DownloadNetwork(ctx context.Context, httpClient *http.Client, hostname string, networkPath string, sha string, progress ProgressFunc) error {
+	ctx, cancel := context.WithTimeout(ctx, DownloadTimeout)
+	defer cancel()
+	uri := hostname + fmt.Sprintf("/get_network?sha=%s", sha)
+	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return err
 	}
+	// Asking for gzip explicitly stops the transport from decompressing the
+	// network, which is stored compressed.
+	req.Header.Set("Accept-Encoding", "gzip")
+	r, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Downloading network %s: %s", sha, r.Status)
+	}
 
 	out, err := os.Create(networkPath)
-	defer out.Close()
 	if err != nil {
 		return err
 	}
+	var dst io.Writer = out
+	var pw *progressWriter
+	if progress != nil {
+		now := time.Now()
+		pw = &progressWriter{progress: progress, start: now, reported: now}
+		pw.current.Total = r.ContentLength
+		dst = io.MultiWriter(out, pw)
+	}
+	_, err = io.Copy(dst, r.Body)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if pw != nil {
+		pw.report()
+	}
 
-	_, err = io.Copy(out, r.Body)
-	return err
+	downloaded, err := networkSha(networkPath)
+	if err != nil {
+		return fmt.Errorf("Verifying network %s: %v", sha, err)
+	}
+	if downloaded != sha {
+		return fmt.Errorf("Downloaded network %s has sha %s", sha, downloaded)
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Called after every request sent through a client from NewHTTPClient, with
+// the time until the response headers arrived.  resp is nil when err isn't.
+type RequestHook func(req *http.Request, resp *http.Response, err error, elapsed time.Duration)
+
+type TransportOptions struct {
+	// PEM file of extra certificate authorities to trust, for servers
+	// behind a private CA.
+	CAFile             string
+	InsecureSkipVerify bool
+	Hooks              []RequestHook
+}
+
+type instrumentedTransport struct {
+	base  http.RoundTripper
+	hooks []RequestHook
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start)
+	for _, hook := range t.hooks {
+		hook(req, resp, err, elapsed)
+	}
+	return resp, err
+}
+
+// Returns the client all calls to the server should share, so connections
+// to it are kept alive and reused between games.
+func NewHTTPClient(options TransportOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+	if len(options.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			// Not available on Windows before go 1.18.
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		// Uploads from several workers go to the same host.
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: &instrumentedTransport{base: transport, hooks: options.Hooks},
+	}, nil
+}
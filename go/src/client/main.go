@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,13 +11,20 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"client/http"
@@ -27,8 +35,15 @@ import (
 var HOSTNAME = flag.String("hostname", "http://162.217.248.187", "Address of the server")
 var USER = flag.String("user", "", "Username")
 var PASSWORD = flag.String("password", "", "Password")
+var CREATE_ACCOUNT = flag.Bool("create-account", false, "Create the account if the username doesn't exist yet")
 var GPU = flag.Int("gpu", -1, "ID of the OpenCL device to use (-1 for default, or no GPU)")
 var DEBUG = flag.Bool("debug", false, "Enable debug mode to see verbose output and save logs")
+var MIN_FREE = flag.Int("min-free-mb", 500, "Pause when the disk has less free space than this, in MiB (0 to disable)")
+var UPLOAD_WORKERS = flag.Int("upload-workers", 2, "Number of uploads sent at the same time")
+var UPLOAD_QUEUE = flag.Int("upload-queue", 100, "Number of uploads waiting for a worker before new games wait for them")
+var RUNS = flag.String("runs", "", "Comma separated IDs of the training runs to contribute to, e.g. \"1,2\" (default any active run)")
+var CA_FILE = flag.String("ca-file", "", "PEM file of extra certificate authorities to trust for https servers")
+var INSECURE_TLS = flag.Bool("insecure-tls", false, "Skip verifying the certificate of https servers (testing only)")
 
 type Settings struct {
 	User string
@@ -75,15 +90,22 @@ func readSettings(path string) (string, string) {
 }
 
 func getExtraParams() map[string]string {
-	return map[string]string{
+	params := map[string]string{
 		"user":     *USER,
 		"password": *PASSWORD,
 		"version":  "10",
 	}
+	if *CREATE_ACCOUNT {
+		params["allow_create"] = "1"
+	}
+	return params
 }
 
-func uploadGame(httpClient *http.Client, path string, pgn string, nextGame client.NextGameResponse, version string, retryCount uint) error {
+func uploadGame(ctx context.Context, httpClient *http.Client, path string, pgn string, nextGame client.NextGameResponse, version string, metadata map[string]string) error {
 	extraParams := getExtraParams()
+	for key, val := range metadata {
+		extraParams[key] = val
+	}
 	extraParams["training_id"] = strconv.Itoa(int(nextGame.TrainingId))
 	extraParams["network_id"] = strconv.Itoa(int(nextGame.NetworkId))
 	extraParams["pgn"] = pgn
@@ -92,24 +114,36 @@ func uploadGame(httpClient *http.Client, path string, pgn string, nextGame clien
 	if err != nil {
 		return err
 	}
-	resp, err := httpClient.Do(request)
-	if err != nil {
-		return err
-	}
+	uploadCtx, cancel := context.WithTimeout(ctx, client.UploadTimeout)
+	defer cancel()
 	body := &bytes.Buffer{}
-	_, err = body.ReadFrom(resp.Body)
+	resp, err := httpClient.Do(request.WithContext(uploadCtx))
+	if err == nil {
+		_, err = body.ReadFrom(resp.Body)
+		resp.Body.Close()
+	}
 	if err != nil {
-		log.Print(err)
-		log.Print("Error uploading, retrying...")
-		time.Sleep(time.Second * (2 << retryCount))
-		err = uploadGame(httpClient, path, pgn, nextGame, version, retryCount+1)
-		return err
+		// Shutting down, the game is sent on the next start.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &retryableError{err}
 	}
-	resp.Body.Close()
 	fmt.Println(resp.StatusCode)
 	fmt.Println(resp.Header)
 	fmt.Println(body)
 
+	response := client.ParseUploadResponse(resp.StatusCode, body.Bytes())
+	switch response.Action {
+	case client.ActionRetry:
+		// The server is shedding load or out of disk, keep the game and try
+		// again later.
+		return &retryableError{fmt.Errorf("server busy: %s", response.Message)}
+	case client.ActionStop:
+		// Nothing wrong with the game, it's sent on the next start.
+		log.Fatalf("Upload refused: %s", response.Message)
+	}
+
 	train_dir := filepath.Dir(path)
 	if _, err := os.Stat(train_dir); err == nil {
 		files, err := ioutil.ReadDir(train_dir)
@@ -126,15 +160,230 @@ func uploadGame(httpClient *http.Client, path string, pgn string, nextGame clien
 		}
 	}
 
+	switch response.Action {
+	case client.ActionUpgrade:
+		log.Fatalf("Upload rejected: %s", response.Message)
+	case client.ActionDrop:
+		return fmt.Errorf("game dropped, rejected by the server (%s, request %s): %s", response.Code, response.RequestID, response.Message)
+	}
 	return nil
 }
 
+// Uploads waiting for a worker.  Games are only played while there is room
+// in the queue, so a slow connection holds up new games instead of piling
+// up uploads.
+var uploadQueue chan *queuedUpload
+
+type queuedUpload struct {
+	// The training data directory or match game uploaded, so a game isn't
+	// queued twice.  Empty for uploads that aren't games.
+	key  string
+	send func() error
+}
+
+// Keys of the uploads queued or in progress.
+var queuedUploads = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// Returned by uploads that may go through when sent again later.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// Retry policy of all uploads.  An outage fails every upload, so a failure
+// holds up the others too, waiting twice as long after each failure in a
+// row.  Games given up on stay on disk and are sent on the next start,
+// match results are never given up on.
+const (
+	uploadRetryDelay    = 2 * time.Second
+	maxUploadRetryDelay = 10 * time.Minute
+	maxUploadAttempts   = 10
+)
+
+var uploadBackoff struct {
+	sync.Mutex
+	failures uint
+	until    time.Time
+}
+
+var uploadStats struct {
+	queued, active, done, failed int64
+}
+
+// Requests to the server, failed ones being those without a response or
+// with a server error.
+var requestStats struct {
+	sent, failed int64
+}
+
+const uploadStatsInterval = 5 * time.Minute
+
+// Starts -upload-workers workers sending queued uploads, and periodically
+// prints how they are doing.
+func startUploads(ctx context.Context) {
+	if *UPLOAD_WORKERS < 1 || *UPLOAD_QUEUE < 0 {
+		log.Fatal("Need at least one upload worker and a non-negative upload queue length")
+	}
+	uploadQueue = make(chan *queuedUpload, *UPLOAD_QUEUE)
+	for i := 0; i < *UPLOAD_WORKERS; i++ {
+		go uploadWorker(ctx)
+	}
+	go func() {
+		for {
+			time.Sleep(uploadStatsInterval)
+			log.Printf("Uploads: %d queued, %d in progress, %d done, %d failed",
+				atomic.LoadInt64(&uploadStats.queued), atomic.LoadInt64(&uploadStats.active),
+				atomic.LoadInt64(&uploadStats.done), atomic.LoadInt64(&uploadStats.failed))
+			log.Printf("Requests: %d sent, %d failed",
+				atomic.LoadInt64(&requestStats.sent), atomic.LoadInt64(&requestStats.failed))
+		}
+	}()
+}
+
+// Queues an upload, waiting while the queue is full.  Does nothing if the
+// upload of key is already queued or in progress.
+func enqueueUpload(key string, send func() error) {
+	if len(key) > 0 {
+		queuedUploads.Lock()
+		queued := queuedUploads.keys[key]
+		queuedUploads.keys[key] = true
+		queuedUploads.Unlock()
+		if queued {
+			log.Printf("Upload of %s already queued", key)
+			return
+		}
+	}
+	atomic.AddInt64(&uploadStats.queued, 1)
+	uploadQueue <- &queuedUpload{key: key, send: send}
+}
+
+func countRequest(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	atomic.AddInt64(&requestStats.sent, 1)
+	if err != nil || resp.StatusCode >= 500 {
+		atomic.AddInt64(&requestStats.failed, 1)
+	}
+}
+
+func logRequest(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	if err != nil {
+		log.Printf("%s %s failed after %s: %v", req.Method, req.URL.Path, elapsed, err)
+		return
+	}
+	log.Printf("%s %s: %s in %s", req.Method, req.URL.Path, resp.Status, elapsed)
+}
+
+func newHTTPClient() *http.Client {
+	hooks := []client.RequestHook{countRequest}
+	if *DEBUG {
+		hooks = append(hooks, logRequest)
+	}
+	httpClient, err := client.NewHTTPClient(client.TransportOptions{
+		CAFile:             *CA_FILE,
+		InsecureSkipVerify: *INSECURE_TLS,
+		Hooks:              hooks,
+	})
+	if err != nil {
+		log.Fatal("Error setting up the HTTP client ", err)
+	}
+	return httpClient
+}
+
+func uploadWorker(ctx context.Context) {
+	for upload := range uploadQueue {
+		atomic.AddInt64(&uploadStats.queued, -1)
+		atomic.AddInt64(&uploadStats.active, 1)
+		err := sendUpload(ctx, upload.send, maxUploadAttempts)
+		atomic.AddInt64(&uploadStats.active, -1)
+		if len(upload.key) > 0 {
+			queuedUploads.Lock()
+			delete(queuedUploads.keys, upload.key)
+			queuedUploads.Unlock()
+		}
+		if err != nil {
+			log.Printf("Upload failed: %v", err)
+			atomic.AddInt64(&uploadStats.failed, 1)
+		} else {
+			atomic.AddInt64(&uploadStats.done, 1)
+		}
+	}
+}
+
+// Sends an upload, retrying under the retry policy shared by all uploads.
+// Gives up after attempts tries, or never when attempts is 0.
+func sendUpload(ctx context.Context, send func() error, attempts int) error {
+	for attempt := 1; ; attempt++ {
+		uploadBackoff.Lock()
+		wait := time.Until(uploadBackoff.until)
+		uploadBackoff.Unlock()
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := send()
+		retry, ok := err.(*retryableError)
+		if !ok {
+			if err == nil {
+				uploadBackoff.Lock()
+				uploadBackoff.failures = 0
+				uploadBackoff.Unlock()
+			}
+			return err
+		}
+		if attempts > 0 && attempt >= attempts {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, retry.err)
+		}
+		log.Printf("Upload failed (%v), retrying in %s", retry.err, backOffUploads())
+	}
+}
+
+// Holds up all uploads after a failure, returning for how long.
+func backOffUploads() time.Duration {
+	uploadBackoff.Lock()
+	defer uploadBackoff.Unlock()
+	delay := maxUploadRetryDelay
+	if uploadBackoff.failures < 16 {
+		delay = uploadRetryDelay << uploadBackoff.failures
+		uploadBackoff.failures++
+	}
+	if delay > maxUploadRetryDelay {
+		delay = maxUploadRetryDelay
+	}
+	until := time.Now().Add(delay)
+	if until.After(uploadBackoff.until) {
+		uploadBackoff.until = until
+	}
+	return delay
+}
+
 type CmdWrapper struct {
 	Cmd      *exec.Cmd
 	Pgn      string
 	Input    io.WriteCloser
 	BestMove chan string
 	Version  string
+	// Moves played in a training game, in UCI notation.
+	Moves []string
+	// Evals of the moves in Moves the engine reported one for, by ply.
+	Evals []moveEval
+	// OpenCL device picked by the engine, empty for CPU builds.
+	Device string
+	// Opening line a training game was started from, empty if the engine
+	// didn't confirm one.
+	Opening string
+	// Working directory of the engine, the client's when empty.
+	Dir string
 }
 
 func (c *CmdWrapper) openInput() {
@@ -157,6 +406,7 @@ func (c *CmdWrapper) launch(networkPath string, args []string, input bool) {
 	if !*DEBUG {
 		c.Cmd.Args = append(c.Cmd.Args, "--quiet")
 	}
+	c.Cmd.Dir = c.Dir
 	fmt.Printf("Args: %v\n", c.Cmd.Args)
 
 	stdout, err := c.Cmd.StdoutPipe()
@@ -183,6 +433,16 @@ func (c *CmdWrapper) launch(networkPath string, args []string, input bool) {
 				c.Pgn += line + "\n"
 			} else if strings.HasPrefix(line, "bestmove ") {
 				c.BestMove <- strings.Split(line, " ")[1]
+			} else if strings.HasPrefix(line, "move played ") {
+				fields := strings.Split(line, " ")
+				c.Moves = append(c.Moves, fields[2])
+				if eval, ok := parseMoveEval(fields[3:]); ok {
+					c.Evals = append(c.Evals, eval)
+				}
+			} else if strings.HasPrefix(line, "opening ") {
+				c.Opening = strings.TrimPrefix(line, "opening ")
+			} else if strings.HasPrefix(line, "Selected device: ") {
+				c.Device = strings.TrimPrefix(line, "Selected device: ")
 			} else if strings.HasPrefix(line, "id name lczero ") {
 				c.Version = strings.Split(line, " ")[3]
 			}
@@ -206,7 +466,10 @@ func (c *CmdWrapper) launch(networkPath string, args []string, input bool) {
 	}
 }
 
-func playMatch(baselinePath string, candidatePath string, params []string, flip bool) (int, string, string, error) {
+// Plays a match game.  With a trainingDir, each engine also writes the
+// training data of its own moves to a subdirectory of it, "first" for the
+// engine that moved first and "second" for the other.
+func playMatch(baselinePath string, candidatePath string, params []string, flip bool, trainingDir string) (int, string, string, error) {
 	baseline := CmdWrapper{}
 	baseline.launch(baselinePath, params, true)
 	defer baseline.Input.Close()
@@ -226,21 +489,20 @@ func playMatch(baselinePath string, candidatePath string, params []string, flip
 	io.WriteString(candidate.Input, "uci\n")
 
 	// Play a game using UCI
-	var result int
+	var result, whiteResult int
 	game := chess.NewGame(chess.UseNotation(chess.LongAlgebraicNotation{}))
 	move_history := ""
 	turn := 0
 	for {
 		if turn >= 450 || game.Outcome() != chess.NoOutcome || len(game.EligibleDraws()) > 1 {
 			if game.Outcome() == chess.WhiteWon {
-				result = 1
+				whiteResult = 1
 			} else if game.Outcome() == chess.BlackWon {
-				result = -1
-			} else {
-				result = 0
+				whiteResult = -1
 			}
 
 			// Always report the result relative to the candidate engine (which defaults to white, unless flip = true)
+			result = whiteResult
 			if flip {
 				result = -result
 			}
@@ -274,16 +536,69 @@ func playMatch(baselinePath string, candidatePath string, params []string, flip
 		}
 	}
 
+	if len(trainingDir) > 0 {
+		// Commands are handled in order, so once the engines exit on the
+		// end of their input the data is written.
+		fmt.Fprintf(p1.Input, "savetraining %s %d\n", filepath.Join(trainingDir, "first"), whiteResult)
+		fmt.Fprintf(p2.Input, "savetraining %s %d\n", filepath.Join(trainingDir, "second"), whiteResult)
+		for _, p := range []*CmdWrapper{p1, p2} {
+			p.Input.Close()
+			p.Cmd.Wait()
+		}
+	}
+
 	chess.UseNotation(chess.AlgebraicNotation{})(game)
 	return result, game.String(), candidate.Version, nil
 }
 
-func train(networkPath string, count int, params []string) (string, string, string) {
+// Combines the training data the engines wrote of a match game in dir
+// into dir/training.0.gz, ready for upload.
+func matchTrainingData(dir string) (string, error) {
+	first, err := os.Open(filepath.Join(dir, "first", "training.0.gz"))
+	if err != nil {
+		return "", err
+	}
+	defer first.Close()
+	second, err := os.Open(filepath.Join(dir, "second", "training.0.gz"))
+	if err != nil {
+		return "", err
+	}
+	defer second.Close()
+
+	path := filepath.Join(dir, "training.0.gz")
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = client.InterleaveTrainingChunks(first, second, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = parseTrainingChunk(path)
+	return path, err
+}
+
+// Directory the files of a training run are kept in, so runs don't share
+// networks or training data.
+func runDir(trainingID uint) string {
+	dir, _ := os.Getwd()
+	return path.Join(dir, fmt.Sprintf("run%d", trainingID))
+}
+
+// Plays a training game, from the opening if there is one.  The moves
+// returned include the opening's, which is returned too if the engine played
+// it.
+func train(networkPath string, trainingID uint, count int, params []string, opening string) (string, string, string, []string, []moveEval, string, string) {
 	// pid is intended for use in multi-threaded training
 	pid := os.Getpid()
 
 	dir, _ := os.Getwd()
-	train_dir := path.Join(dir, fmt.Sprintf("data-%v-%v", pid, count))
+	work_dir := runDir(trainingID)
+	os.MkdirAll(work_dir, os.ModePerm)
+	train_dir := path.Join(work_dir, fmt.Sprintf("data-%v-%v", pid, count))
 	if *DEBUG {
 		logs_dir := path.Join(dir, fmt.Sprintf("logs-%v", pid))
 		os.MkdirAll(logs_dir, os.ModePerm)
@@ -293,9 +608,12 @@ func train(networkPath string, count int, params []string) (string, string, stri
 
 	num_games := 1
 	train_cmd := fmt.Sprintf("--start=train %v-%v %v", pid, count, num_games)
+	if len(opening) > 0 {
+		train_cmd += " " + opening
+	}
 	params = append(params, train_cmd)
 
-	c := CmdWrapper{}
+	c := CmdWrapper{Dir: work_dir}
 	c.launch(networkPath, params, false)
 
 	err := c.Cmd.Wait()
@@ -303,78 +621,833 @@ func train(networkPath string, count int, params []string) (string, string, stri
 		log.Fatal(err)
 	}
 
-	return path.Join(train_dir, "training.0.gz"), c.Pgn, c.Version
+	moves := c.Moves
+	if len(c.Opening) > 0 {
+		moves = append(strings.Fields(c.Opening), moves...)
+	}
+	return path.Join(train_dir, "training.0.gz"), c.Pgn, c.Version, moves, c.Evals, c.Device, c.Opening
+}
+
+func parseTrainingChunk(path string) (*client.ChunkSummary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return client.ParseTrainingChunk(file)
+}
+
+// A decisive game that didn't end in checkmate was resigned.
+func wasResigned(moves []string, result int) bool {
+	if result == 0 {
+		return false
+	}
+	game := chess.NewGame(chess.UseNotation(chess.LongAlgebraicNotation{}))
+	for _, move := range moves {
+		if err := game.MoveStr(move); err != nil {
+			log.Printf("Unable to replay game: %v", err)
+			return false
+		}
+	}
+	return game.Method() != chess.Checkmate
+}
+
+// Describes the machine for the active users page.
+func systemInfo(device string) map[string]string {
+	backend := "cpu"
+	if len(device) > 0 {
+		backend = "opencl"
+	}
+	return map[string]string{
+		"backend": backend,
+		"system":  strings.TrimSpace(fmt.Sprintf("%s/%s %s", runtime.GOOS, runtime.GOARCH, device)),
+	}
+}
+
+// Resign thresholds, in percent as for the engine's --resignpct, that played
+// out games are checked against.
+var resignThresholds = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 15, 20}
+
+// Same as the engine's default minimum number of moves before resigning.
+const minResignPly = 20
+
+// Share of training games played with resigning disabled, whose evals are
+// analysed.  Games played with resigning enabled only get to the end when no
+// threshold was reached, so they can't tell how often resigning is wrong.
+const resignAnalysisRate = 0.1
+
+// Eval of a move from the mover's view, as reported by the engine.
+type moveEval struct {
+	// Plies played before the move, counting the opening.
+	ply  int
+	eval float64
+}
+
+// Parses the "eval <eval> ply <ply>" following "move played <move>".  Evals
+// without a ply, from older engines, can't be told apart from the opening's
+// moves, so they aren't used.
+func parseMoveEval(fields []string) (moveEval, bool) {
+	if len(fields) < 4 || fields[0] != "eval" || fields[2] != "ply" {
+		return moveEval{}, false
+	}
+	eval, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(eval) {
+		return moveEval{}, false
+	}
+	ply, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return moveEval{}, false
+	}
+	return moveEval{ply: ply, eval: eval}, true
+}
+
+// Disables resigning in params for a resignAnalysisRate share of games,
+// returning whether it did.
+func sampleResignAnalysis(params []string) ([]string, bool) {
+	if rand.Float64() >= resignAnalysisRate {
+		return params, false
+	}
+	params, _ = removeOptions(params, map[string]bool{"resignpct": true, "r": true})
+	return append(params, "--resignpct=-1"), true
+}
+
+// For each threshold, checks whether the game would have been resigned had
+// resigning been enabled, and whether that would have been wrong (the side
+// resigning didn't go on to lose).  Encoded as "pct:would:wrong,...", empty
+// if the engine didn't report evals.  Only meaningful for games played with
+// resigning disabled.
+func resignAnalysis(evals []moveEval, result int) string {
+	if len(evals) == 0 {
+		return ""
+	}
+	entries := []string{}
+	for _, threshold := range resignThresholds {
+		would, wrong := 0, 0
+		for _, eval := range evals {
+			if eval.ply <= minResignPly || eval.eval >= float64(threshold)/100 {
+				continue
+			}
+			// White moves on even plies.
+			loser := 1
+			if eval.ply%2 == 0 {
+				loser = -1
+			}
+			would = 1
+			if result != loser {
+				wrong = 1
+			}
+			break
+		}
+		entries = append(entries, fmt.Sprintf("%d:%d:%d", threshold, would, wrong))
+	}
+	return strings.Join(entries, ",")
+}
+
+func printProgress(progress client.Progress) {
+	if progress.Total > 0 {
+		fmt.Printf("\rDownloading network... %.0f%% (%.0f KiB/s)", progress.Percent, progress.BytesPerSec/1024)
+	} else {
+		fmt.Printf("\rDownloading network... %d KiB (%.0f KiB/s)", progress.Bytes/1024, progress.BytesPerSec/1024)
+	}
 }
 
-func getNetwork(httpClient *http.Client, sha string, clearOld bool) (string, error) {
+// Returns the path of a network of a training run, downloading it unless
+// it is cached already.  The path is absolute, as training games run in the
+// run's directory.
+func getNetwork(ctx context.Context, httpClient *http.Client, trainingID uint, sha string) (string, error) {
+	networks := filepath.Join(runDir(trainingID), "networks")
 	// Sha already exists?
-	path := filepath.Join("networks", sha)
+	path := filepath.Join(networks, sha)
 	if stat, err := os.Stat(path); err == nil {
 		if stat.Size() != 0 {
 			return path, nil
 		}
 	}
+	os.MkdirAll(networks, os.ModePerm)
+	waitForDiskSpace(nil)
 
-	if clearOld {
-		// Clean out any old networks
-		os.RemoveAll("networks")
+	fmt.Printf("Downloading network...")
+	// Otherwise, let's download it.  The download only takes the network's
+	// place once complete, so an interrupted one is never mistaken for it.
+	partial := path + ".part"
+	err := client.DownloadNetwork(ctx, httpClient, *HOSTNAME, partial, sha, printProgress)
+	fmt.Printf("\n")
+	if err != nil {
+		os.Remove(partial)
+		return "", err
 	}
-	os.MkdirAll("networks", os.ModePerm)
-
-	fmt.Printf("Downloading network...\n")
-	// Otherwise, let's download it
-	err := client.DownloadNetwork(httpClient, *HOSTNAME, path, sha)
+	err = os.Rename(partial, path)
 	if err != nil {
 		return "", err
 	}
 	return path, nil
 }
 
-func nextGame(httpClient *http.Client, count int) error {
-	nextGame, err := client.NextGame(httpClient, *HOSTNAME, getExtraParams())
+// The engine's command line help, listing the options it supports.
+var engineHelp string
+
+func engineSupports(option string) (bool, error) {
+	if len(engineHelp) == 0 {
+		dir, _ := os.Getwd()
+		out, err := exec.Command(path.Join(dir, "lczero"), "--help").CombinedOutput()
+		if err != nil && len(out) == 0 {
+			return false, err
+		}
+		engineHelp = string(out)
+	}
+	return strings.Contains(engineHelp, "--"+option+" ") || strings.Contains(engineHelp, "--"+option+"]"), nil
+}
+
+// Engine options by long and short name, and whether they take a value.
+var engineOptions = map[string]bool{
+	"nodes": true, "v": true, "visits": true,
+	"playouts": true, "p": true,
+	"resignpct": true, "r": true,
+	"tempdecay": true, "d": true,
+	"randomize": false, "m": false,
+	"noise": false, "n": false,
+	"uci": false,
+}
+
+// Options selfplayArgs sets from the run configuration.
+var runConfigOptions = map[string]bool{
+	"nodes": true, "v": true, "visits": true,
+	"playouts": true, "p": true,
+	"resignpct": true, "r": true,
+	"tempdecay": true, "d": true,
+	"randomize": true, "m": true,
+	"noise": true, "n": true,
+}
+
+// Options that only make sense in selfplay: noise is for exploring new
+// moves, and match games are adjudicated here rather than resigned.
+var selfplayOnlyOptions = map[string]bool{
+	"noise": true, "n": true,
+	"resignpct": true, "r": true,
+}
+
+// Options that only make sense for engines driven over UCI.
+var matchOnlyOptions = map[string]bool{
+	"uci": true,
+}
+
+// Splits params into the arguments for options not in options, and those
+// for options in it.
+func removeOptions(params []string, options map[string]bool) ([]string, []string) {
+	kept := []string{}
+	removed := []string{}
+	for i := 0; i < len(params); i++ {
+		name := strings.TrimLeft(params[i], "-")
+		hasValue := strings.Contains(name, "=")
+		if strings.HasPrefix(params[i], "--") {
+			name = strings.SplitN(name, "=", 2)[0]
+		} else if len(name) > 1 {
+			name, hasValue = name[:1], true
+		}
+		if !options[name] {
+			kept = append(kept, params[i])
+			continue
+		}
+		removed = append(removed, params[i])
+		if engineOptions[name] && !hasValue && i+1 < len(params) {
+			i++
+			removed = append(removed, params[i])
+		}
+	}
+	return kept, removed
+}
+
+// Engine arguments for match games, without selfplay only options.
+func matchArgs(params []string) []string {
+	args, removed := removeOptions(params, selfplayOnlyOptions)
+	if len(removed) > 0 {
+		log.Printf("Ignoring selfplay options in match parameters: %v", removed)
+	}
+	return args
+}
+
+// Engine arguments for training games, without match only options, and
+// with the server's run configuration, if it sent one, replacing the same
+// options in params.  Fails if the local engine can't play games as
+// configured.
+func selfplayArgs(config *client.RunConfig, params []string) ([]string, error) {
+	params, removed := removeOptions(params, matchOnlyOptions)
+	if len(removed) > 0 {
+		log.Printf("Ignoring match options in training parameters: %v", removed)
+	}
+	if config == nil {
+		return params, nil
+	}
+
+	if config.Variant != "standard" {
+		return nil, fmt.Errorf("Server requires variant %q, the engine only plays standard chess", config.Variant)
+	}
+	if config.Noise.Enabled && (config.Noise.Epsilon != 0.25 || config.Noise.Alpha != 0.3) {
+		return nil, fmt.Errorf("Server requires noise epsilon %g and alpha %g, the engine only supports 0.25 and 0.3", config.Noise.Epsilon, config.Noise.Alpha)
+	}
+
+	args := []string{}
+	if config.Visits > 0 {
+		args = append(args, fmt.Sprintf("--nodes=%d", config.Visits))
+	}
+	if config.Playouts > 0 {
+		args = append(args, fmt.Sprintf("--playouts=%d", config.Playouts))
+	}
+	args = append(args, fmt.Sprintf("--resignpct=%d", config.ResignPercent))
+	if config.Temperature.Decay > 0 {
+		args = append(args, fmt.Sprintf("--tempdecay=%d", config.Temperature.Decay))
+	} else if config.Temperature.Randomize {
+		args = append(args, "--randomize")
+	}
+	if config.Noise.Enabled {
+		args = append(args, "--noise")
+	}
+	for _, arg := range args {
+		option := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)[0]
+		supported, err := engineSupports(option)
+		if err != nil {
+			return nil, err
+		}
+		if !supported {
+			return nil, fmt.Errorf("Server requires engine option --%s, which this engine doesn't support", option)
+		}
+	}
+
+	params, _ = removeOptions(params, runConfigOptions)
+	return append(args, params...), nil
+}
+
+// Prints the server's warning about this client version, in a way that
+// stands out from the engine output.
+func showVersionWarning(warning *client.VersionWarning) {
+	banner := strings.Repeat("*", 72)
+	fmt.Printf("\n%s\n%s\n", banner, warning.Message)
+	if len(warning.DownloadUrl) > 0 {
+		fmt.Printf("Download the new client from %s\n", warning.DownloadUrl)
+	}
+	fmt.Printf("Time left: %s\n%s\n\n", time.Until(warning.Deadline).Round(time.Minute), banner)
+}
+
+// Optional parts of next_game responses this client understands, so the
+// server leaves out the others.
+const supportedFeatures = "config,opening,training_data,warning"
+
+// An assignment from the server, with its networks downloaded.
+type work struct {
+	game          client.NextGameResponse
+	params        []string
+	networkPath   string
+	candidatePath string
+}
+
+// Gets the next assignment from the server and downloads what it needs, so
+// it can start as soon as the engine is free.
+func fetchWork(ctx context.Context, httpClient *http.Client) (*work, error) {
+	extraParams := getExtraParams()
+	extraParams["features"] = supportedFeatures
+	if len(*RUNS) > 0 {
+		extraParams["training_ids"] = *RUNS
+	}
+	nextGame, err := client.NextGame(ctx, httpClient, *HOSTNAME, extraParams)
+	if serverErr, ok := err.(*client.ServerError); ok {
+		switch serverErr.Code {
+		case "unknown_user":
+			log.Fatalf("%s.  Check the username, or run with -create-account to create it.", serverErr.Message)
+		case "wrong_password":
+			log.Fatalf("%s.  Check the password, or pick another username if it's someone else's.", serverErr.Message)
+		}
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if nextGame.Warning != nil {
+		showVersionWarning(nextGame.Warning)
 	}
-	var params []string
-	err = json.Unmarshal([]byte(nextGame.Params), &params)
+	w := &work{game: nextGame}
+	err = json.Unmarshal([]byte(nextGame.Params), &w.params)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if nextGame.Type != "match" && nextGame.Type != "train" {
+		return nil, errors.New("Unknown game type: " + nextGame.Type)
 	}
 
+	w.networkPath, err = getNetwork(ctx, httpClient, nextGame.TrainingId, nextGame.Sha)
+	if err != nil {
+		return nil, err
+	}
 	if nextGame.Type == "match" {
-		networkPath, err := getNetwork(httpClient, nextGame.Sha, false)
+		w.candidatePath, err = getNetwork(ctx, httpClient, nextGame.TrainingId, nextGame.CandidateSha)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+const workStatusInterval = 60 * time.Second
+
+// Last known status of each training run the client got work for, kept
+// current by watchWorkStatus.
+var workStatus = struct {
+	sync.Mutex
+	runs map[uint]client.WorkStatus
+}{runs: make(map[uint]client.WorkStatus)}
+
+// Polls the status of the runs worked on, so work prefetched for a network
+// replaced meanwhile isn't played.
+func watchWorkStatus(ctx context.Context, httpClient *http.Client) {
+	for {
+		select {
+		case <-time.After(workStatusInterval):
+		case <-ctx.Done():
+			return
 		}
-		candidatePath, err := getNetwork(httpClient, nextGame.CandidateSha, false)
+		workStatus.Lock()
+		runs := make(map[uint]client.WorkStatus, len(workStatus.runs))
+		for run, status := range workStatus.runs {
+			runs[run] = status
+		}
+		workStatus.Unlock()
+		for run, previous := range runs {
+			status, err := client.GetWorkStatus(ctx, httpClient, *HOSTNAME, run, previous)
+			if err != nil {
+				log.Printf("Checking the status of run %d: %v", run, err)
+				continue
+			}
+			workStatus.Lock()
+			workStatus.runs[run] = status
+			workStatus.Unlock()
+		}
+	}
+}
+
+// Reports whether w trains a network that is no longer the best of its run,
+// as far as the last poll knows.  Starts watching runs seen for the first
+// time.
+func outdatedWork(w *work) bool {
+	workStatus.Lock()
+	defer workStatus.Unlock()
+	status, ok := workStatus.runs[w.game.TrainingId]
+	if !ok {
+		workStatus.runs[w.game.TrainingId] = client.WorkStatus{Run: w.game.TrainingId}
+		return false
+	}
+	return w.game.Type == "train" && len(status.BestSha) > 0 && status.BestSha != w.game.Sha
+}
+
+// Removes the networks of w's training run other than the ones it plays
+// with.  Only called while no download is in progress.
+func pruneNetworks(w *work) {
+	networks := filepath.Join(runDir(w.game.TrainingId), "networks")
+	files, err := ioutil.ReadDir(networks)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		path := filepath.Join(networks, file.Name())
+		if path != w.networkPath && path != w.candidatePath {
+			os.Remove(path)
+		}
+	}
+}
+
+// Seconds between free space checks while paused for a full disk.
+const diskFullPause = 60
+
+// Deletes the networks of all runs, except the ones keep plays with.  Nothing
+// is deleted when keep is nil, as a download may be in progress.  Training
+// data waiting to be uploaded and debug logs are left alone.
+func cleanCaches(keep *work) {
+	if keep == nil {
+		return
+	}
+	dir, _ := os.Getwd()
+	paths, _ := filepath.Glob(filepath.Join(dir, "run*", "networks", "*"))
+	for _, path := range paths {
+		if path != keep.networkPath && path != keep.candidatePath {
+			os.Remove(path)
+		}
+	}
+}
+
+// Waits until the client's disk has at least -min-free-mb free, cleaning
+// caches first.  The engine writes truncated training data, without
+// failing, when it runs out of space.
+func waitForDiskSpace(keep *work) {
+	minFree := uint64(*MIN_FREE) << 20
+	cleaned := false
+	for minFree > 0 {
+		free, err := freeSpace(".")
 		if err != nil {
-			return err
+			log.Printf("Unable to check free disk space: %v", err)
+			return
+		}
+		if free >= minFree {
+			return
+		}
+		if !cleaned {
+			cleanCaches(keep)
+			cleaned = true
+			continue
+		}
+		log.Printf("Only %d MiB of disk space left, %d MiB needed.  Free some space, paused until then...", free>>20, *MIN_FREE)
+		time.Sleep(diskFullPause * time.Second)
+	}
+}
+
+func uploadMatchResult(ctx context.Context, httpClient *http.Client, matchGameID uint, result int, pgn string, extraParams map[string]string) error {
+	response, err := client.UploadMatchResult(ctx, httpClient, *HOSTNAME, matchGameID, result, pgn, extraParams)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &retryableError{err}
+	}
+	switch response.Action {
+	case client.ActionRetry:
+		return &retryableError{fmt.Errorf("server busy: %s", response.Message)}
+	case client.ActionUpgrade, client.ActionStop:
+		log.Fatalf("Match result refused: %s", response.Message)
+	case client.ActionDrop:
+		return fmt.Errorf("match result dropped, rejected by the server (%s, request %s): %s", response.Code, response.RequestID, response.Message)
+	}
+	return nil
+}
+
+// A match result not uploaded yet, saved so it can be sent on the next start
+// if the client stops first.
+type pendingMatchResult struct {
+	MatchGameID uint
+	Result      int
+	Pgn         string
+	Metadata    map[string]string
+}
+
+// Directory this process saves its pending match results in.
+func matchResultsDir() string {
+	return fmt.Sprintf("results-%d", os.Getpid())
+}
+
+func (result *pendingMatchResult) save(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	// Renamed into place, so matchResultWorker never reads a partial file.
+	path := filepath.Join(dir, fmt.Sprintf("match_game.%d.json", result.MatchGameID))
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (result *pendingMatchResult) upload(ctx context.Context, httpClient *http.Client) error {
+	params := getExtraParams()
+	for key, value := range result.Metadata {
+		params[key] = value
+	}
+	return uploadMatchResult(ctx, httpClient, result.MatchGameID, result.Result, result.Pgn, params)
+}
+
+// Wakes matchResultWorker when a match result was saved.
+var matchResultsSaved = make(chan struct{}, 1)
+
+func wakeMatchResultWorker() {
+	select {
+	case matchResultsSaved <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the match results saved in matchResultsDir one at a time, deleting
+// each once the server took or rejected it.  Results are retried until the
+// client stops, not given up on like games, and those left are sent on the
+// next start.
+func matchResultWorker(ctx context.Context, httpClient *http.Client) {
+	for {
+		files, _ := filepath.Glob(filepath.Join(matchResultsDir(), "*.json"))
+		for _, file := range files {
+			result := &pendingMatchResult{}
+			data, err := ioutil.ReadFile(file)
+			if err == nil {
+				err = json.Unmarshal(data, result)
+			}
+			if err != nil {
+				log.Printf("Discarding unreadable match result %s: %v", file, err)
+				os.Remove(file)
+				continue
+			}
+			atomic.AddInt64(&uploadStats.active, 1)
+			err = sendUpload(ctx, func() error {
+				return result.upload(ctx, httpClient)
+			}, 0)
+			atomic.AddInt64(&uploadStats.active, -1)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Upload failed: %v", err)
+				atomic.AddInt64(&uploadStats.failed, 1)
+			} else {
+				atomic.AddInt64(&uploadStats.done, 1)
+			}
+			os.Remove(file)
+		}
+		select {
+		case <-matchResultsSaved:
+		case <-ctx.Done():
+			return
 		}
-		result, pgn, version, err := playMatch(networkPath, candidatePath, params, nextGame.Flip)
+	}
+}
+
+func uploadMatchTrainingData(ctx context.Context, httpClient *http.Client, matchGameID uint, path string) error {
+	response, err := client.UploadMatchTrainingData(ctx, httpClient, *HOSTNAME, matchGameID, path, getExtraParams())
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &retryableError{err}
+	}
+	if response.Action == client.ActionRetry {
+		return &retryableError{fmt.Errorf("server busy: %s", response.Message)}
+	}
+	os.RemoveAll(filepath.Dir(path))
+	if response.Action != client.ActionNone {
+		return fmt.Errorf("match training data dropped, rejected by the server (%s, request %s): %s", response.Code, response.RequestID, response.Message)
+	}
+	return nil
+}
+
+// Reports an engine crash to the server, in the background.
+func reportCrash(ctx context.Context, httpClient *http.Client, crash error) {
+	enqueueUpload("", func() error {
+		return client.ReportCrash(ctx, httpClient, *HOSTNAME, crash.Error(), getExtraParams())
+	})
+}
+
+// Plays an assignment.  Results are uploaded in the background.
+func playWork(ctx context.Context, httpClient *http.Client, w *work, count int) error {
+	nextGame := w.game
+	params := w.params
+	if nextGame.Type == "match" {
+		// Relative, as the engine reads it up to the first space.
+		trainingDir := ""
+		if nextGame.TrainingData {
+			trainingDir = filepath.Join(fmt.Sprintf("run%d", nextGame.TrainingId), fmt.Sprintf("data-%v-%v", os.Getpid(), count))
+		}
+		start := time.Now()
+		result, pgn, version, err := playMatch(w.networkPath, w.candidatePath, matchArgs(params), nextGame.Flip, trainingDir)
 		if err != nil {
+			os.RemoveAll(trainingDir)
+			reportCrash(ctx, httpClient, err)
 			return err
 		}
-		extraParams := getExtraParams()
-		extraParams["engineVersion"] = version
-		go client.UploadMatchResult(httpClient, *HOSTNAME, nextGame.MatchGameId, result, pgn, extraParams)
+		pending := &pendingMatchResult{
+			MatchGameID: nextGame.MatchGameId,
+			Result:      result,
+			Pgn:         pgn,
+			Metadata: map[string]string{
+				"engineVersion": version,
+				"time_spent":    strconv.Itoa(int(time.Since(start).Seconds())),
+			},
+		}
+		err = pending.save(matchResultsDir())
+		if err == nil {
+			wakeMatchResultWorker()
+		} else {
+			log.Printf("Unable to save match result, it is lost if the client stops: %v", err)
+			enqueueUpload(fmt.Sprintf("match_game %d", pending.MatchGameID), func() error {
+				return pending.upload(ctx, httpClient)
+			})
+		}
+		if len(trainingDir) > 0 {
+			trainFile, err := matchTrainingData(trainingDir)
+			if err != nil {
+				// Older engines can't save the training data of match games.
+				log.Printf("Discarding training data of match game %d: %v", nextGame.MatchGameId, err)
+				os.RemoveAll(trainingDir)
+				return nil
+			}
+			upload := pendingUpload{Game: nextGame}
+			err = upload.save(trainingDir)
+			if err != nil {
+				log.Printf("Unable to save upload details, the training data is lost if the client stops: %v", err)
+			}
+			enqueueUpload(trainingDir, func() error {
+				return uploadMatchTrainingData(ctx, httpClient, nextGame.MatchGameId, trainFile)
+			})
+		}
 		return nil
-	} else if nextGame.Type == "train" {
-		networkPath, err := getNetwork(httpClient, nextGame.Sha, true)
+	}
+
+	params, err := selfplayArgs(nextGame.Config, params)
+	if err != nil {
+		log.Fatal(err)
+	}
+	params, analyseResign := sampleResignAnalysis(params)
+	start := time.Now()
+	trainFile, pgn, version, moves, evals, device, opening := train(w.networkPath, nextGame.TrainingId, count, params, nextGame.Opening)
+	timeSpent := time.Since(start)
+	summary, err := parseTrainingChunk(trainFile)
+	if err != nil {
+		// Don't upload broken data, just drop the game.
+		log.Printf("Discarding corrupt training data %s: %v", trainFile, err)
+		os.RemoveAll(filepath.Dir(trainFile))
+		reportCrash(ctx, httpClient, err)
+		return nil
+	}
+	resigned := "0"
+	if wasResigned(moves, summary.Result) {
+		resigned = "1"
+	}
+	metadata := map[string]string{
+		"result":     strconv.Itoa(summary.Result),
+		"plies":      strconv.Itoa(summary.Plies),
+		"resigned":   resigned,
+		"time_spent": strconv.Itoa(int(timeSpent.Seconds())),
+	}
+	for key, value := range systemInfo(device) {
+		metadata[key] = value
+	}
+	if len(nextGame.Opening) > 0 {
+		if opening == nextGame.Opening {
+			metadata["opening_id"] = strconv.Itoa(int(nextGame.OpeningId))
+		} else {
+			log.Printf("Engine didn't play the opening %q, upgrade it to play assigned openings", nextGame.Opening)
+		}
+	}
+	if analyseResign {
+		metadata["resign_analysis"] = resignAnalysis(evals, summary.Result)
+	}
+	upload := pendingUpload{Game: nextGame, Pgn: pgn, Version: version, Metadata: metadata}
+	err = upload.save(filepath.Dir(trainFile))
+	if err != nil {
+		log.Printf("Unable to save upload details, the game is lost if the client stops: %v", err)
+	}
+	enqueueUpload(filepath.Dir(trainFile), func() error {
+		return uploadGame(ctx, httpClient, trainFile, pgn, nextGame, version, metadata)
+	})
+	return nil
+}
+
+// What uploadGame needs besides the training data, saved next to it so games
+// not uploaded before the client stopped can be sent on the next start.  Of
+// match games only Game is saved, for uploadMatchTrainingData.
+type pendingUpload struct {
+	Game     client.NextGameResponse
+	Pgn      string
+	Version  string
+	Metadata map[string]string
+}
+
+const pendingUploadFile = "upload.json"
+
+func (upload *pendingUpload) save(dir string) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, pendingUploadFile), data, 0644)
+}
+
+// Returns the pid in a data-<pid>-<count>, logs-<pid> or results-<pid>
+// directory name.
+func directoryPid(name string) (int, bool) {
+	fields := strings.Split(name, "-")
+	if len(fields) < 2 || (fields[0] != "data" && fields[0] != "logs" && fields[0] != "results") {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(fields[1])
+	return pid, err == nil
+}
+
+// Takes over the match results a stopped client left in dir, moving them to
+// this process's directory for matchResultWorker.
+func recoverMatchResults(dir string) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
 		if err != nil {
-			return err
+			continue
 		}
-		trainFile, pgn, version := train(networkPath, count, params)
-		go uploadGame(httpClient, trainFile, pgn, nextGame, version, 0)
-		return nil
+		result := &pendingMatchResult{}
+		if err := json.Unmarshal(data, result); err != nil {
+			log.Printf("Discarding unreadable match result %s: %v", file, err)
+			continue
+		}
+		err = result.save(matchResultsDir())
+		if err != nil {
+			log.Printf("Unable to take over match result %s: %v", file, err)
+			continue
+		}
+		os.Remove(file)
+		log.Printf("Uploading match result of match game %d left behind in %s", result.MatchGameID, dir)
 	}
+	wakeMatchResultWorker()
+}
 
-	return errors.New("Unknown game type: " + nextGame.Type)
+// Uploads the complete games, match training data and match results left
+// behind by clients that didn't exit cleanly, in the background, and deletes
+// the rest of their data and log directories.
+func recoverOrphanedData(ctx context.Context, httpClient *http.Client) {
+	dir, _ := os.Getwd()
+	dirs := []string{}
+	for _, pattern := range []string{"data-*", "logs-*", "results-*", filepath.Join("run*", "data-*")} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		dirs = append(dirs, matches...)
+	}
+	for _, orphan := range dirs {
+		pid, ok := directoryPid(filepath.Base(orphan))
+		if !ok || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		if strings.HasPrefix(filepath.Base(orphan), "results-") {
+			recoverMatchResults(orphan)
+		}
+		trainFile := filepath.Join(orphan, "training.0.gz")
+		data, err := ioutil.ReadFile(filepath.Join(orphan, pendingUploadFile))
+		if err == nil {
+			upload := pendingUpload{}
+			err = json.Unmarshal(data, &upload)
+			if err == nil {
+				_, err = parseTrainingChunk(trainFile)
+			}
+			if err == nil && upload.Game.Type == "match" {
+				log.Printf("Uploading match training data left behind in %s", orphan)
+				enqueueUpload(orphan, func() error {
+					return uploadMatchTrainingData(ctx, httpClient, upload.Game.MatchGameId, trainFile)
+				})
+				continue
+			}
+			if err == nil {
+				log.Printf("Uploading game left behind in %s", orphan)
+				enqueueUpload(orphan, func() error {
+					return uploadGame(ctx, httpClient, trainFile, upload.Pgn, upload.Game, upload.Version, upload.Metadata)
+				})
+				continue
+			}
+		}
+		log.Printf("Removing %s left behind by process %d", orphan, pid)
+		os.RemoveAll(orphan)
+	}
 }
 
 func main() {
 	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
 
 	if len(*USER) == 0 || len(*PASSWORD) == 0 {
+		// The prompt of a first start promises to create the account.
+		if _, err := os.Stat("settings.json"); os.IsNotExist(err) {
+			*CREATE_ACCOUNT = true
+		}
 		*USER, *PASSWORD = readSettings("settings.json")
 	}
 
@@ -385,11 +1458,69 @@ func main() {
 		log.Fatal("You must specify a non-empty password")
 	}
 
-	httpClient := &http.Client{}
+	// Cancelled on shutdown, abandoning network calls in flight.  Games not
+	// uploaded yet are sent on the next start.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Print("Shutting down...")
+		cancel()
+	}()
+
+	httpClient := newHTTPClient()
+	startUploads(ctx)
+	recoverOrphanedData(ctx, httpClient)
+	go matchResultWorker(ctx, httpClient)
+
+	type fetched struct {
+		w   *work
+		err error
+	}
+	next := make(chan fetched, 1)
+	prefetch := func() {
+		w, err := fetchWork(ctx, httpClient)
+		next <- fetched{w, err}
+	}
+	go prefetch()
+	go watchWorkStatus(ctx, httpClient)
+
 	start := time.Now()
-	for i := 0; ; i++ {
-		err := nextGame(httpClient, i)
+	for i := 0; ctx.Err() == nil; i++ {
+		var f fetched
+		select {
+		case f = <-next:
+		case <-ctx.Done():
+			return
+		}
+		if f.err == nil && outdatedWork(f.w) {
+			// Only refetched once, the status may be older than the work.
+			log.Printf("Network %s was replaced while waiting, fetching new work", f.w.game.Sha)
+			f.w, f.err = fetchWork(ctx, httpClient)
+		}
+		if f.err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Print(f.err)
+			log.Print("Sleeping for 30 seconds...")
+			time.Sleep(30 * time.Second)
+			go prefetch()
+			continue
+		}
+		if f.w.game.Type == "train" {
+			pruneNetworks(f.w)
+		}
+		waitForDiskSpace(f.w)
+		// The next assignment is fetched while this one plays, so the
+		// engine doesn't wait on the server in between.
+		go prefetch()
+		err := playWork(ctx, httpClient, f.w, i)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Print(err)
 			log.Print("Sleeping for 30 seconds...")
 			time.Sleep(30 * time.Second)
@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// Reports whether a process with the given pid is running.  Finding a process
+// opens it on Windows, which fails once it has exited.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
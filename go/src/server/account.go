@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"server/config"
+	"server/db"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Checks the fields of a new account.  Accounts are still created implicitly
+// on first upload, registering just reserves the name up front and allows
+// attaching an email address.
+func validateRegistration(username, password, email string) error {
+	if len(username) == 0 {
+		return errors.New("No user supplied")
+	}
+	if len(username) > 32 {
+		return errors.New("Username too long")
+	}
+	if username == publicUsername("", true) {
+		return errors.New("Username is reserved")
+	}
+	if len(password) == 0 {
+		return errors.New("You must specify a non-empty password")
+	}
+	if strings.ContainsAny(username, "\r\n") {
+		return errors.New("Username can't contain line breaks")
+	}
+	// The address goes into an email header.
+	if len(email) > 0 && (len(email) > 254 || !strings.Contains(email, "@") || strings.ContainsAny(email, "\r\n")) {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}
+
+func registerForm(c *gin.Context) {
+	c.HTML(http.StatusOK, "register", gin.H{})
+}
+
+func register(c *gin.Context) {
+	username := c.PostForm("user")
+	email := strings.TrimSpace(c.PostForm("email"))
+	err := validateRegistration(username, c.PostForm("password"), email)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "register", gin.H{"error": err.Error(), "user": username, "email": email})
+		return
+	}
+
+	var count int
+	err = db.GetDB().Model(&db.User{}).Where("username = ?", username).Count(&count).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	if count > 0 {
+		c.HTML(http.StatusBadRequest, "register", gin.H{"error": "Username already taken", "email": email})
+		return
+	}
+
+	user := db.User{
+		Username:  username,
+		Password:  c.PostForm("password"),
+		Email:     email,
+		Anonymous: c.PostForm("anonymous") == "1",
+	}
+	err = db.GetDB().Create(&user).Error
+	if err != nil && isUsernameTaken(err) {
+		// Taken since the check above.
+		c.HTML(http.StatusBadRequest, "register", gin.H{"error": "Username already taken", "email": email})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("Registered user %s\n", username)
+	c.HTML(http.StatusOK, "register", gin.H{"registered": username})
+}
+
+// Password reset links are valid this long.
+const passwordResetExpiry = time.Hour
+
+// Reset emails sent to one account per passwordResetExpiry, so the form
+// can't be used to flood someone's inbox.
+const maxPasswordResets = 3
+
+func hashResetToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func sendEmail(to string, subject string, body string) error {
+	email := config.Config.Email
+	if len(email.SMTPAddress) == 0 {
+		return errors.New("Email is not configured")
+	}
+	var auth smtp.Auth
+	if len(email.Username) > 0 {
+		host := strings.Split(email.SMTPAddress, ":")[0]
+		auth = smtp.PlainAuth("", email.Username, email.Password, host)
+	}
+	// A line break in a header would let the value add headers of its own.
+	for _, header := range []string{email.From, to, subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return errors.New("Line break in email header")
+		}
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", email.From, to, subject, body)
+	return smtp.SendMail(email.SMTPAddress, auth, email.From, []string{to}, []byte(msg))
+}
+
+// Creates a reset token for user, returning the token to put in the link.
+func createPasswordReset(user *db.User) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	reset := db.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashResetToken(token),
+		ExpiresAt: time.Now().Add(passwordResetExpiry),
+	}
+	return token, db.GetDB().Create(&reset).Error
+}
+
+func passwordResetForm(c *gin.Context) {
+	c.HTML(http.StatusOK, "password_reset", gin.H{"token": c.Param("token")})
+}
+
+const passwordResetSent = "If the account has an email address, a reset link has been sent to it.  Otherwise, ask an admin to reset the password."
+
+// Emails a reset link if the account has an address.  The response is the
+// same either way, so it can't be used to probe for emails.
+func requestPasswordReset(c *gin.Context) {
+	var users []db.User
+	err := db.GetDB().Where("username = ?", c.PostForm("user")).Limit(1).Find(&users).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	if len(users) > 0 && len(users[0].Email) > 0 {
+		user := &users[0]
+		var recent int
+		err = db.GetDB().Model(&db.PasswordReset{}).Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-passwordResetExpiry)).Count(&recent).Error
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		if recent >= maxPasswordResets {
+			log.Printf("Too many password resets for %s, not sending another", user.Username)
+			c.HTML(http.StatusOK, "password_reset", gin.H{"message": passwordResetSent})
+			return
+		}
+		token, err := createPasswordReset(user)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		link := fmt.Sprintf("%s/password_reset/%s", strings.TrimRight(config.Config.Email.BaseURL, "/"), token)
+		body := fmt.Sprintf("A password reset was requested for LCZero user %s.\r\n\r\nSet a new password here, within the next hour:\r\n%s\r\n\r\nIf you didn't request this, ignore this email.", user.Username, link)
+		err = sendEmail(user.Email, "LCZero password reset", body)
+		if err != nil {
+			log.Printf("Sending password reset to %s: %v", user.Username, err)
+		}
+	}
+
+	c.HTML(http.StatusOK, "password_reset", gin.H{"message": passwordResetSent})
+}
+
+func resetPassword(c *gin.Context) {
+	token := c.Param("token")
+	password := c.PostForm("password")
+	if len(password) == 0 {
+		c.HTML(http.StatusBadRequest, "password_reset", gin.H{"token": token, "error": "You must specify a non-empty password"})
+		return
+	}
+
+	var reset db.PasswordReset
+	err := db.GetDB().Where("token_hash = ? AND used = false AND expires_at > ?", hashResetToken(token), time.Now()).First(&reset).Error
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "password_reset", gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+
+	tx := db.GetDB().Begin()
+	err = tx.Model(&reset).Update("used", true).Error
+	if err == nil {
+		err = tx.Model(&db.User{}).Where("id = ?", reset.UserID).Update("password", password).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("Password reset for user %d\n", reset.UserID)
+	c.HTML(http.StatusOK, "password_reset", gin.H{"message": "Password changed.  Update it in your client settings too."})
+}
+
+// Lets a user toggle anonymous mode, authenticating like the client does.
+func setAnonymous(c *gin.Context) {
+	var users []db.User
+	err := db.GetDB().Where("username = ?", c.PostForm("user")).Limit(1).Find(&users).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	if len(users) == 0 || users[0].Password != c.PostForm("password") {
+		c.String(http.StatusBadRequest, "Incorrect username or password")
+		return
+	}
+
+	anonymous := c.PostForm("anonymous") == "1"
+	err = db.GetDB().Model(&users[0]).Update("anonymous", anonymous).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("Anonymous mode for %s set to %v.", users[0].Username, anonymous))
+}
@@ -0,0 +1,1467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"server/config"
+	"server/db"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/go-version"
+	"github.com/jinzhu/gorm"
+)
+
+func setTrainingRunWeight(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+
+	weight, err := strconv.ParseFloat(c.PostForm("weight"), 64)
+	if err != nil || weight < 0.0 {
+		c.String(http.StatusBadRequest, "Invalid weight")
+		return
+	}
+
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	err = db.GetDB().Model(trainingRun).Update("weight", weight).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set weight of training run %d to %f\n", c.GetString(gin.AuthUserKey), trainingRun.ID, weight)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d weight set to %g.", trainingRun.ID, weight))
+}
+
+func setTrainingRunGamesTarget(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+
+	target, err := strconv.ParseUint(c.PostForm("games_target"), 10, 32)
+	if err != nil || target == 0 {
+		c.String(http.StatusBadRequest, "Invalid games_target")
+		return
+	}
+
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	err = db.GetDB().Model(trainingRun).Update("games_target", target).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set games target of training run %d to %d\n", c.GetString(gin.AuthUserKey), trainingRun.ID, target)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d games target set to %d.", trainingRun.ID, target))
+}
+
+func setTrainingRunOpeningBook(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	// An empty path turns openings off for the run.
+	path := c.PostForm("path")
+	if len(path) > 0 {
+		// Drop any cached copy, so an edited book is picked up.
+		openingBooks.Lock()
+		delete(openingBooks.lines, path)
+		openingBooks.Unlock()
+
+		openings, err := loadOpeningBook(path)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusBadRequest, "Unable to load opening book")
+			return
+		}
+		log.Printf("Loaded %d openings from %s\n", len(openings), path)
+	}
+
+	err = db.GetDB().Model(trainingRun).Update("opening_book", path).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set opening book of training run %d to %q\n", c.GetString(gin.AuthUserKey), trainingRun.ID, path)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d opening book set to %q.", trainingRun.ID, path))
+}
+
+func setTrainParameters(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+
+	params := c.PostForm("params")
+	err = validateTrainParameters(params)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	change := db.TrainParametersChange{
+		TrainingRunID: trainingRun.ID,
+		OldParameters: trainingRun.TrainParameters,
+		NewParameters: params,
+		ChangedBy:     c.GetString(gin.AuthUserKey),
+	}
+	tx := db.GetDB().Begin()
+	err = tx.Model(trainingRun).Update("train_parameters", params).Error
+	if err == nil {
+		err = tx.Create(&change).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s changed train parameters of training run %d from %s to %s\n", change.ChangedBy, trainingRun.ID, change.OldParameters, params)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d parameters set to %s.", trainingRun.ID, params))
+}
+
+func trainParametersHistory(c *gin.Context) {
+	var changes []db.TrainParametersChange
+	err := db.GetDB().Where("training_run_id = ?", c.Param("id")).Order("id desc").Find(&changes).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	json := []gin.H{}
+	for _, change := range changes {
+		json = append(json, gin.H{
+			"old":        change.OldParameters,
+			"new":        change.NewParameters,
+			"changed_by": change.ChangedBy,
+			"created_at": change.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, json)
+}
+
+// Changes the engine parameters of a running match.  Games already assigned
+// keep the old parameters, the change records the last of them.
+func setMatchParameters(c *gin.Context) {
+	var params []string
+	err := json.Unmarshal([]byte(c.PostForm("params")), &params)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Parameters must be a JSON array of strings")
+		return
+	}
+	err = validateEngineParameters(params)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	newParams, err := json.Marshal(params)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	match := db.Match{}
+	err = db.GetDB().Where("id = ?", c.Param("id")).First(&match).Error
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid match")
+		return
+	}
+	if match.Done {
+		c.String(http.StatusBadRequest, "Match is already done")
+		return
+	}
+
+	change := db.MatchParametersChange{
+		MatchID:       match.ID,
+		OldParameters: match.Parameters,
+		NewParameters: string(newParams),
+		ChangedBy:     c.GetString(gin.AuthUserKey),
+	}
+	tx := db.GetDB().Begin()
+	err = tx.Model(&match).Update("parameters", change.NewParameters).Error
+	if err == nil {
+		var lastGame []db.MatchGame
+		err = tx.Where("match_id = ?", match.ID).Order("id desc").Limit(1).Find(&lastGame).Error
+		if len(lastGame) > 0 {
+			change.LastGameID = lastGame[0].ID
+		}
+	}
+	if err == nil {
+		// Shadow duplicates would be played with different parameters than
+		// the games they repeat.
+		err = tx.Model(&db.MatchGame{}).Where("match_id = ? AND shadow_wanted = true", match.ID).Update("shadow_wanted", false).Error
+	}
+	if err == nil {
+		err = tx.Create(&change).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s changed parameters of match %d from %s to %s after game %d\n", change.ChangedBy, match.ID, change.OldParameters, change.NewParameters, change.LastGameID)
+	c.String(http.StatusOK, fmt.Sprintf("Match %d parameters set to %s.", match.ID, change.NewParameters))
+}
+
+// Counts the scored results of match games with IDs in (after, upTo], upTo
+// 0 meaning no upper bound.
+func matchSegmentScore(matchID uint, after uint64, upTo uint64) (gin.H, error) {
+	query := db.GetDB().Model(&db.MatchGame{}).
+		Select("result, count(*)").
+		Where("match_id = ? AND done = true AND excluded = false AND shadow_of = 0 AND id > ?", matchID, after)
+	if upTo != 0 {
+		query = query.Where("id <= ?", upTo)
+	}
+	rows, err := query.Group("result").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wins, losses, draws int
+	for rows.Next() {
+		var result, count int
+		err = rows.Scan(&result, &count)
+		if err != nil {
+			return nil, err
+		}
+		if result == 1 {
+			wins = count
+		} else if result == -1 {
+			losses = count
+		} else {
+			draws = count
+		}
+	}
+	return gin.H{"wins": wins, "losses": losses, "draws": draws}, nil
+}
+
+// Lists the parameter changes of a match, with the score of the games played
+// with each set of parameters.
+func matchParametersHistory(c *gin.Context) {
+	match := db.Match{}
+	err := db.GetDB().Where("id = ?", c.Param("id")).First(&match).Error
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid match")
+		return
+	}
+
+	var changes []db.MatchParametersChange
+	err = db.GetDB().Where("match_id = ?", match.ID).Order("id").Find(&changes).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	segments := []gin.H{}
+	params := match.Parameters
+	if len(changes) > 0 {
+		params = changes[0].OldParameters
+	}
+	var after uint64
+	for i := 0; i <= len(changes); i++ {
+		var upTo uint64
+		segment := gin.H{"parameters": params, "after_game": after}
+		if i < len(changes) {
+			upTo = changes[i].LastGameID
+			segment["through_game"] = upTo
+		}
+		score, err := matchSegmentScore(match.ID, after, upTo)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		segment["score"] = score
+		if i > 0 {
+			segment["changed_by"] = changes[i-1].ChangedBy
+			segment["changed_at"] = changes[i-1].CreatedAt
+		}
+		segments = append(segments, segment)
+		if i < len(changes) {
+			params = changes[i].NewParameters
+			after = upTo
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"match": match.ID, "segments": segments})
+}
+
+func setEngineVersionRule(c *gin.Context) {
+	engineVersion := c.PostForm("version")
+	if _, err := version.NewVersion(engineVersion); err != nil {
+		c.String(http.StatusBadRequest, "Invalid version")
+		return
+	}
+
+	// Replaces the rule of the same version, however it's spelled.
+	rule := db.EngineVersionRule{}
+	err := whereEngineVersion(db.GetDB().Unscoped(), engineVersion).Or("version = ?", engineVersion).Delete(&rule).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	action := c.PostForm("action")
+	if action == "remove" {
+		c.String(http.StatusOK, fmt.Sprintf("Removed rule for %s.", engineVersion))
+		return
+	}
+	if action != "allow" && action != "deny" {
+		c.String(http.StatusBadRequest, "action must be allow, deny or remove")
+		return
+	}
+
+	rule = db.EngineVersionRule{
+		Version: engineVersion,
+		Denied:  action == "deny",
+		Reason:  c.PostForm("reason"),
+	}
+	rule.EngineMajor, rule.EngineMinor, rule.EnginePatch = engineVersionSegments(engineVersion)
+	err = db.GetDB().Create(&rule).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set %s rule for engine version %s\n", c.GetString(gin.AuthUserKey), action, engineVersion)
+	c.String(http.StatusOK, fmt.Sprintf("Engine version %s set to %s.", engineVersion, action))
+}
+
+func engineVersionRules(c *gin.Context) {
+	var rules []db.EngineVersionRule
+	err := db.GetDB().Order("engine_major, engine_minor, engine_patch").Find(&rules).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	json := []gin.H{}
+	for _, rule := range rules {
+		json = append(json, gin.H{
+			"version": rule.Version,
+			"denied":  rule.Denied,
+			"reason":  rule.Reason,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"min_engine_version": config.Config.Clients.MinEngineVersion,
+		"rules":              json,
+	})
+}
+
+// Returns the match parameters for one sweep variation: base, with any flag
+// that the variation sets replaced by the variation's value.
+func sweepParameters(base []interface{}, variation []string) []string {
+	flagName := func(arg string) string {
+		return strings.SplitN(arg, "=", 2)[0]
+	}
+	overridden := map[string]bool{}
+	for _, arg := range variation {
+		overridden[flagName(arg)] = true
+	}
+
+	params := []string{}
+	for _, param := range base {
+		arg := fmt.Sprint(param)
+		if !overridden[flagName(arg)] {
+			params = append(params, arg)
+		}
+	}
+	return append(params, variation...)
+}
+
+// Creates a Sweep, with one TestOnly match per parameter variation between
+// the same two networks.  variations is a JSON list of argument lists, eg.
+// [["--tempdecay=0"], ["--tempdecay=5"], ["--tempdecay=10"]].
+func createSweep(c *gin.Context) {
+	candidateID, err := strconv.ParseUint(c.PostForm("candidate_id"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid candidate_id")
+		return
+	}
+	currentID, err := strconv.ParseUint(c.PostForm("current_id"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid current_id")
+		return
+	}
+
+	var candidate, current db.Network
+	err = db.GetDB().Where("id = ?", candidateID).First(&candidate).Error
+	if err == nil {
+		err = db.GetDB().Where("id = ?", currentID).First(&current).Error
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid network")
+		return
+	}
+
+	var variations [][]string
+	err = json.Unmarshal([]byte(c.PostForm("variations")), &variations)
+	if err != nil || len(variations) == 0 {
+		c.String(http.StatusBadRequest, "variations must be a non-empty JSON list of argument lists")
+		return
+	}
+	for _, variation := range variations {
+		err = validateEngineParameters(sweepParameters(config.Config.Matches.Parameters, variation))
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Variation %q: %v", strings.Join(variation, " "), err))
+			return
+		}
+	}
+
+	games := config.Config.Matches.Games
+	if len(c.PostForm("games")) > 0 {
+		games, err = strconv.Atoi(c.PostForm("games"))
+		if err != nil || games <= 0 {
+			c.String(http.StatusBadRequest, "Invalid games")
+			return
+		}
+	}
+
+	sweep := db.Sweep{
+		TrainingRunID: candidate.TrainingRunID,
+		CandidateID:   candidate.ID,
+		CurrentBestID: current.ID,
+		Description:   c.PostForm("description"),
+		CreatedBy:     c.GetString(gin.AuthUserKey),
+	}
+	tx := db.GetDB().Begin()
+	err = tx.Create(&sweep).Error
+	for _, variation := range variations {
+		if err != nil {
+			break
+		}
+		var params []byte
+		params, err = json.Marshal(sweepParameters(config.Config.Matches.Parameters, variation))
+		if err != nil {
+			break
+		}
+		match := db.Match{
+			TrainingRunID: sweep.TrainingRunID,
+			CandidateID:   sweep.CandidateID,
+			CurrentBestID: sweep.CurrentBestID,
+			GameCap:       games,
+			Parameters:    string(params),
+			TestOnly:      true,
+			SweepID:       sweep.ID,
+		}
+		err = tx.Create(&match).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s created sweep %d of %d matches between networks %d and %d\n", sweep.CreatedBy, sweep.ID, len(variations), sweep.CandidateID, sweep.CurrentBestID)
+	c.JSON(http.StatusOK, gin.H{
+		"id":      sweep.ID,
+		"matches": len(variations),
+		"url":     fmt.Sprintf("/sweep/%d", sweep.ID),
+	})
+}
+
+// Creates a tournament between the networks in network_ids (comma
+// separated), with one TestOnly match of games games per pairing.
+func createTournament(c *gin.Context) {
+	format := c.PostForm("format")
+	if format != "gauntlet" && format != "round_robin" {
+		c.String(http.StatusBadRequest, "format must be gauntlet or round_robin")
+		return
+	}
+
+	var networks []db.Network
+	for _, idStr := range strings.Split(c.PostForm("network_ids"), ",") {
+		var network db.Network
+		err := db.GetDB().Where("id = ?", strings.TrimSpace(idStr)).First(&network).Error
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Invalid network %q", idStr))
+			return
+		}
+		networks = append(networks, network)
+	}
+	if len(networks) < 2 {
+		c.String(http.StatusBadRequest, "A tournament needs at least two networks")
+		return
+	}
+
+	games := config.Config.Matches.Games
+	if len(c.PostForm("games")) > 0 {
+		var err error
+		games, err = strconv.Atoi(c.PostForm("games"))
+		if err != nil || games <= 0 {
+			c.String(http.StatusBadRequest, "Invalid games")
+			return
+		}
+	}
+
+	params, err := json.Marshal(config.Config.Matches.Parameters)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	pairings := [][2]db.Network{}
+	for i := range networks {
+		for j := i + 1; j < len(networks); j++ {
+			if format == "gauntlet" && i > 0 {
+				break
+			}
+			pairings = append(pairings, [2]db.Network{networks[i], networks[j]})
+		}
+	}
+
+	tournament := db.Tournament{
+		TrainingRunID: networks[0].TrainingRunID,
+		Format:        format,
+		Description:   c.PostForm("description"),
+		CreatedBy:     c.GetString(gin.AuthUserKey),
+	}
+	tx := db.GetDB().Begin()
+	err = tx.Create(&tournament).Error
+	for _, pairing := range pairings {
+		if err != nil {
+			break
+		}
+		match := db.Match{
+			TrainingRunID: tournament.TrainingRunID,
+			CandidateID:   pairing[0].ID,
+			CurrentBestID: pairing[1].ID,
+			GameCap:       games,
+			Parameters:    string(params),
+			TestOnly:      true,
+			TournamentID:  tournament.ID,
+		}
+		err = tx.Create(&match).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s created %s tournament %d of %d matches\n", tournament.CreatedBy, format, tournament.ID, len(pairings))
+	c.JSON(http.StatusOK, gin.H{
+		"id":      tournament.ID,
+		"matches": len(pairings),
+		"url":     fmt.Sprintf("/tournament/%d", tournament.ID),
+	})
+}
+
+// Keeps the last lines written to the log, for the dashboard.  Installed as
+// the log output in main.
+type logBuffer struct {
+	sync.Mutex
+	lines []string
+}
+
+const logBufferLines = 50
+
+var recentLogs logBuffer
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.lines = append(b.lines, strings.TrimRight(string(p), "\n"))
+	if len(b.lines) > logBufferLines {
+		b.lines = b.lines[len(b.lines)-logBufferLines:]
+	}
+	return len(p), nil
+}
+
+func (b *logBuffer) recent() []string {
+	b.Lock()
+	defer b.Unlock()
+	lines := make([]string, len(b.lines))
+	for i, line := range b.lines {
+		lines[len(lines)-1-i] = line
+	}
+	return lines
+}
+
+// Match games handed out this long ago without a result are considered lost.
+const staleAssignmentAge = time.Hour
+
+func adminDashboard(c *gin.Context) {
+	var trainingRuns []db.TrainingRun
+	err := db.GetDB().Order("id").Find(&trainingRuns).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	runs := []gin.H{}
+	for _, run := range trainingRuns {
+		var gamesHour int
+		err = db.GetDB().Model(&db.TrainingGame{}).Where("training_run_id = ? AND created_at >= ?", run.ID, time.Now().Add(-time.Hour)).Count(&gamesHour).Error
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		var tracks []db.ArchitectureTrack
+		err = db.GetDB().Where("training_run_id = ?", run.ID).Order("architecture").Find(&tracks).Error
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		others := []string{}
+		for _, track := range tracks {
+			others = append(others, fmt.Sprintf("%s: %d", track.Architecture, track.BestNetworkID))
+		}
+		runs = append(runs, gin.H{
+			"id":                   run.ID,
+			"description":          run.Description,
+			"active":               run.Active,
+			"best_network":         run.BestNetworkID,
+			"primary_architecture": run.PrimaryArchitecture,
+			"tracks":               strings.Join(others, ", "),
+			"games_hour":           gamesHour,
+		})
+	}
+
+	var pendingMatches []db.Match
+	err = db.GetDB().Where("done = false").Order("id").Find(&pendingMatches).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	matches := []gin.H{}
+	for _, match := range pendingMatches {
+		matches = append(matches, gin.H{
+			"id":           match.ID,
+			"run":          match.TrainingRunID,
+			"candidate_id": match.CandidateID,
+			"current_id":   match.CurrentBestID,
+			"architecture": match.Architecture,
+			"games":        match.Wins + match.Losses + match.Draws,
+			"game_cap":     match.GameCap,
+			"test_only":    match.TestOnly,
+		})
+	}
+
+	var staleAssignments int
+	err = db.GetDB().Model(&db.MatchGame{}).Where("done = false AND created_at < ?", time.Now().Add(-staleAssignmentAge)).Count(&staleAssignments).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	var resultMismatches int
+	err = db.GetDB().Model(&db.MatchGame{}).Where("result_mismatch = true AND created_at >= ?", time.Now().Add(-24*time.Hour)).Count(&resultMismatches).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	disk := []gin.H{}
+	for _, dir := range uploadVolumes {
+		free, err := volumeFreeSpace(dir)
+		disk = append(disk, gin.H{
+			"dir":     dir,
+			"free_mb": free >> 20,
+			"low":     err == nil && config.Config.Limits.MinFreeSpace > 0 && free < uint64(config.Config.Limits.MinFreeSpace),
+			"known":   err == nil,
+		})
+	}
+
+	// Users uploading games from networks flagged as stale in the last day.
+	rows, err := db.GetDB().Raw(`SELECT users.username, count(*) FROM training_games
+LEFT JOIN users ON users.id = training_games.user_id
+WHERE training_games.stale = true AND training_games.created_at >= ?
+GROUP BY users.username ORDER BY count DESC LIMIT 20`, time.Now().Add(-24*time.Hour)).Rows()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	defer rows.Close()
+	flaggedUsers := []gin.H{}
+	for rows.Next() {
+		var username string
+		var count int
+		rows.Scan(&username, &count)
+		flaggedUsers = append(flaggedUsers, gin.H{"user": username, "stale_games": count})
+	}
+
+	sharedOrigins, roamingUsers, err := suspiciousOrigins()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	var corruptNetworks []db.Network
+	err = db.GetDB().Where("verify_error != ''").Order("id desc").Find(&corruptNetworks).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	failedNetworks := []gin.H{}
+	for _, network := range corruptNetworks {
+		failedNetworks = append(failedNetworks, gin.H{
+			"id":          network.ID,
+			"run":         network.TrainingRunID,
+			"error":       network.VerifyError,
+			"verified_at": network.VerifiedAt.Format("2006-01-02 15:04"),
+		})
+	}
+
+	unreliableUsers, err := leastReliableUsers(20)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	failingUsers, err := usersOverFailureThresholds()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin", gin.H{
+		"runs":              runs,
+		"matches":           matches,
+		"stale_assignments": staleAssignments,
+		"result_mismatches": resultMismatches,
+		"disk":              disk,
+		"flagged_users":     flaggedUsers,
+		"shared_origins":    sharedOrigins,
+		"roaming_users":     roamingUsers,
+		"recent_logs":       recentLogs.recent(),
+		"compaction":        compaction.summary(),
+		"failed_networks":   failedNetworks,
+		"unreliable_users":  unreliableUsers,
+		"failing_users":     failingUsers,
+		"reliability_days":  int(reliabilityWindow().Hours() / 24),
+	})
+}
+
+// Finds origins many accounts uploaded from in the last day, and accounts
+// that uploaded from implausibly many origins in the last hour.
+func suspiciousOrigins() ([]gin.H, []gin.H, error) {
+	maxAccounts := config.Config.Clients.MaxAccountsPerOrigin
+	if maxAccounts <= 0 {
+		maxAccounts = 5
+	}
+	maxOrigins := config.Config.Clients.MaxOriginsPerAccount
+	if maxOrigins <= 0 {
+		maxOrigins = 10
+	}
+
+	rows, err := db.GetDB().Raw(`SELECT training_games.origin_hash, count(DISTINCT users.id), string_agg(DISTINCT users.username, ', ')
+FROM training_games
+LEFT JOIN users ON users.id = training_games.user_id
+WHERE training_games.origin_hash != '' AND training_games.created_at >= ?
+GROUP BY training_games.origin_hash
+HAVING count(DISTINCT users.id) > ?
+ORDER BY count(DISTINCT users.id) DESC LIMIT 20`, time.Now().Add(-24*time.Hour), maxAccounts).Rows()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	sharedOrigins := []gin.H{}
+	for rows.Next() {
+		var origin, usernames string
+		var accounts int
+		err = rows.Scan(&origin, &accounts, &usernames)
+		if err != nil {
+			return nil, nil, err
+		}
+		sharedOrigins = append(sharedOrigins, gin.H{"origin": origin[:8], "accounts": accounts, "users": usernames})
+	}
+
+	// Addresses within one network change all the time, so those with a
+	// known AS count as one origin.
+	rows, err = db.GetDB().Raw(`SELECT users.username, count(DISTINCT COALESCE(NULLIF(training_games.origin_asn_hash, ''), training_games.origin_hash))
+FROM training_games
+LEFT JOIN users ON users.id = training_games.user_id
+WHERE training_games.origin_hash != '' AND training_games.created_at >= ?
+GROUP BY users.username
+HAVING count(DISTINCT COALESCE(NULLIF(training_games.origin_asn_hash, ''), training_games.origin_hash)) > ?
+ORDER BY 2 DESC LIMIT 20`, time.Now().Add(-time.Hour), maxOrigins).Rows()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	roamingUsers := []gin.H{}
+	for rows.Next() {
+		var username string
+		var origins int
+		err = rows.Scan(&username, &origins)
+		if err != nil {
+			return nil, nil, err
+		}
+		roamingUsers = append(roamingUsers, gin.H{"user": username, "origins": origins})
+	}
+	return sharedOrigins, roamingUsers, nil
+}
+
+func setTrainingRunActive(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	active := c.PostForm("active") == "1"
+	err = db.GetDB().Model(trainingRun).Update("active", active).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set training run %d active=%v\n", c.GetString(gin.AuthUserKey), trainingRun.ID, active)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d active set to %v.", trainingRun.ID, active))
+}
+
+func setTrainingRunGatingPolicy(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	policy := c.PostForm("policy")
+	if policy != gatingParallel && policy != gatingSerialize && policy != gatingRevalidate {
+		c.String(http.StatusBadRequest, "Invalid policy")
+		return
+	}
+	err = db.GetDB().Model(trainingRun).Update("gating_policy", policy).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set gating policy of training run %d to %q\n", c.GetString(gin.AuthUserKey), trainingRun.ID, policy)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d gating policy set to %q.", trainingRun.ID, policy))
+}
+
+// Returns the engine parameters of the named template, "" being the default
+// match parameters.
+func matchParameterTemplate(name string) ([]string, bool) {
+	if len(name) == 0 {
+		params := []string{}
+		for _, param := range config.Config.Matches.Parameters {
+			params = append(params, fmt.Sprint(param))
+		}
+		return params, true
+	}
+	params, ok := config.Config.Matches.ParameterTemplates[name]
+	return params, ok
+}
+
+// Checks the configured match parameters and templates, so that a typo in
+// the config doesn't end up in every match.
+func validateMatchTemplates() error {
+	defaultParams, _ := matchParameterTemplate("")
+	err := validateEngineParameters(defaultParams)
+	if err != nil {
+		return fmt.Errorf("Invalid match parameters: %v", err)
+	}
+	for name, params := range config.Config.Matches.ParameterTemplates {
+		err = validateEngineParameters(params)
+		if err != nil {
+			return fmt.Errorf("Invalid match parameter template %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func newMatchForm(c *gin.Context) {
+	var networks []db.Network
+	err := db.GetDB().Order("id desc").Limit(200).Find(&networks).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	networksJson := []gin.H{}
+	for _, network := range networks {
+		networksJson = append(networksJson, gin.H{
+			"id":  network.ID,
+			"run": network.TrainingRunID,
+			"sha": network.Sha,
+		})
+	}
+
+	templates := []gin.H{}
+	defaultParams, _ := matchParameterTemplate("")
+	templates = append(templates, gin.H{"name": "", "params": strings.Join(defaultParams, " ")})
+	for name, params := range config.Config.Matches.ParameterTemplates {
+		templates = append(templates, gin.H{"name": name, "params": strings.Join(params, " ")})
+	}
+
+	c.HTML(http.StatusOK, "admin_new_match", gin.H{
+		"networks":  networksJson,
+		"templates": templates,
+		"games":     config.Config.Matches.Games,
+	})
+}
+
+// Creates a match between two networks.  Engine parameters come from the
+// named template, game cap and test_only are optional.
+func createMatch(c *gin.Context) {
+	candidateID, err := strconv.ParseUint(c.PostForm("candidate_id"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid candidate_id")
+		return
+	}
+	currentID, err := strconv.ParseUint(c.PostForm("current_id"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid current_id")
+		return
+	}
+	if candidateID == currentID {
+		c.String(http.StatusBadRequest, "Candidate and current network must differ")
+		return
+	}
+
+	var candidate, current db.Network
+	err = db.GetDB().Where("id = ?", candidateID).First(&candidate).Error
+	if err == nil {
+		err = db.GetDB().Where("id = ?", currentID).First(&current).Error
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid network")
+		return
+	}
+
+	// Engine parameters given as a JSON array take precedence over the
+	// template.
+	var templateParams []string
+	if len(c.PostForm("parameters")) > 0 {
+		err = json.Unmarshal([]byte(c.PostForm("parameters")), &templateParams)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Parameters must be a JSON array of strings")
+			return
+		}
+	} else {
+		var ok bool
+		templateParams, ok = matchParameterTemplate(c.PostForm("template"))
+		if !ok {
+			c.String(http.StatusBadRequest, "Unknown parameter template")
+			return
+		}
+	}
+	err = validateEngineParameters(templateParams)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	params, err := json.Marshal(templateParams)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	games := config.Config.Matches.Games
+	if len(c.PostForm("games")) > 0 {
+		games, err = strconv.Atoi(c.PostForm("games"))
+		if err != nil || games <= 0 {
+			c.String(http.StatusBadRequest, "Invalid games")
+			return
+		}
+	}
+
+	// Only a win against the best network of the candidate's own run and
+	// track may promote, other head to head matches are always test only.
+	architecture := networkArchitecture(candidate.Layers, candidate.Filters)
+	againstBest := false
+	if candidate.TrainingRunID == current.TrainingRunID {
+		trainingRun, err := getTrainingRun(candidate.TrainingRunID)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		bestID, err := trackBestNetworkID(trainingRun, architecture)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		againstBest = bestID == current.ID
+	}
+	match := db.Match{
+		TrainingRunID: candidate.TrainingRunID,
+		CandidateID:   candidate.ID,
+		CurrentBestID: current.ID,
+		Architecture:  architecture,
+		GameCap:       games,
+		Parameters:    string(params),
+		TestOnly:      c.PostForm("test_only") == "1" || !againstBest,
+		TrainingData:  c.PostForm("training_data") == "1",
+	}
+	err = db.GetDB().Create(&match).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	invalidatePages(pageEventMatch)
+
+	log.Printf("%s created match %d between networks %d and %d\n", c.GetString(gin.AuthUserKey), match.ID, match.CandidateID, match.CurrentBestID)
+	c.String(http.StatusOK, fmt.Sprintf("Match %d created.", match.ID))
+}
+
+// Wakes the compaction loop.  Compaction takes a lock itself, so triggering
+// it twice is harmless.
+func triggerCompaction(c *gin.Context) {
+	select {
+	case compactionTrigger <- struct{}{}:
+	default:
+	}
+	log.Printf("%s triggered compaction\n", c.GetString(gin.AuthUserKey))
+	c.String(http.StatusOK, "Compaction started.")
+}
+
+func compactionProgress(c *gin.Context) {
+	c.JSON(http.StatusOK, compaction.summary())
+}
+
+func getUserByName(username string) (*db.User, error) {
+	user := &db.User{}
+	err := db.GetDB().Where("username = ?", username).First(user).Error
+	return user, err
+}
+
+func renameUser(c *gin.Context) {
+	user, err := getUserByName(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Unknown user")
+		return
+	}
+
+	newName := c.PostForm("new_name")
+	if len(newName) == 0 || len(newName) > 32 {
+		c.String(http.StatusBadRequest, "Invalid new_name")
+		return
+	}
+	if _, err := getUserByName(newName); err == nil {
+		c.String(http.StatusBadRequest, "Username already taken, merge the accounts instead")
+		return
+	}
+
+	err = db.GetDB().Model(user).Update("username", newName).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s renamed user %s to %s\n", c.GetString(gin.AuthUserKey), c.Param("name"), newName)
+	c.String(http.StatusOK, fmt.Sprintf("User %s renamed to %s.", c.Param("name"), newName))
+}
+
+// Moves all games of one user to another and deletes the emptied account, so
+// contributors who ended up with two accounts get their stats in one place.
+func mergeUser(c *gin.Context) {
+	source, err := getUserByName(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Unknown user")
+		return
+	}
+	target, err := getUserByName(c.PostForm("into"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Unknown target user")
+		return
+	}
+	if source.ID == target.ID {
+		c.String(http.StatusBadRequest, "Can't merge a user into itself")
+		return
+	}
+
+	// Everything recorded of the source's clients moves along, so the
+	// target's trust and reliability cover it.
+	tx := db.GetDB().Begin()
+	for _, table := range []string{"training_games", "match_games", "reliability_events", "spot_checks", "opening_assignments"} {
+		err = tx.Exec(fmt.Sprintf("UPDATE %s SET user_id = ? WHERE user_id = ?", table), target.ID, source.ID).Error
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Exec("UPDATE users SET shadow_checks = shadow_checks + ?, shadow_disagreements = shadow_disagreements + ? WHERE id = ?",
+			source.ShadowChecks, source.ShadowDisagreements, target.ID).Error
+	}
+	if err == nil {
+		err = tx.Where("user_id = ?", source.ID).Delete(&db.PasswordReset{}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(source).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	gameCountsCache.Lock()
+	delete(gameCountsCache.users, target.ID)
+	gameCountsCache.Unlock()
+	reliabilityCache.Lock()
+	delete(reliabilityCache.users, target.ID)
+	reliabilityCache.Unlock()
+
+	log.Printf("%s merged user %s into %s\n", c.GetString(gin.AuthUserKey), source.Username, target.Username)
+	c.String(http.StatusOK, fmt.Sprintf("User %s merged into %s.", source.Username, target.Username))
+}
+
+// Builds the filter for excludeGames from the form.  At least one of user,
+// version, engine_version, from and to must be given, so a typo can't exclude
+// every game.
+func excludeGamesFilter(c *gin.Context) (func(*gorm.DB) *gorm.DB, error) {
+	conditions := []func(*gorm.DB) *gorm.DB{}
+
+	if name := c.PostForm("user"); len(name) > 0 {
+		user, err := getUserByName(name)
+		if err != nil {
+			return nil, errors.New("Unknown user")
+		}
+		conditions = append(conditions, func(q *gorm.DB) *gorm.DB {
+			return q.Where("user_id = ?", user.ID)
+		})
+	}
+	if v := c.PostForm("version"); len(v) > 0 {
+		version, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid version")
+		}
+		conditions = append(conditions, func(q *gorm.DB) *gorm.DB {
+			return q.Where("version = ?", version)
+		})
+	}
+	if engineVersion := c.PostForm("engine_version"); len(engineVersion) > 0 {
+		// Versions that don't parse can only be matched as reported.
+		if _, err := version.NewVersion(engineVersion); err != nil {
+			conditions = append(conditions, func(q *gorm.DB) *gorm.DB {
+				return q.Where("engine_version = ?", engineVersion)
+			})
+		} else {
+			conditions = append(conditions, func(q *gorm.DB) *gorm.DB {
+				return whereEngineVersion(q, engineVersion)
+			})
+		}
+	}
+	for _, field := range []string{"from", "to"} {
+		value := c.PostForm(field)
+		if len(value) == 0 {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s date", field)
+		}
+		op := ">="
+		if field == "to" {
+			op = "<"
+		}
+		conditions = append(conditions, func(q *gorm.DB) *gorm.DB {
+			return q.Where("created_at "+op+" ?", t)
+		})
+	}
+
+	if len(conditions) == 0 {
+		return nil, errors.New("Specify at least one of user, version, engine_version, from or to")
+	}
+	return func(q *gorm.DB) *gorm.DB {
+		for _, condition := range conditions {
+			q = condition(q)
+		}
+		return q
+	}, nil
+}
+
+// Marks the training and match games matching the filter as excluded (or
+// restores them with excluded=0), then recounts the networks' games_played
+// and the scores and assigned slots of the affected matches.  Matches that
+// already finished are rescored but not re-decided.
+func excludeGames(c *gin.Context) {
+	filter, err := excludeGamesFilter(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	excluded := c.DefaultPostForm("excluded", "1") == "1"
+
+	tx := db.GetDB().Begin()
+	var networkIDs, matchIDs []uint
+	err = filter(tx.Model(&db.TrainingGame{})).Where("excluded = ?", !excluded).Pluck("DISTINCT network_id", &networkIDs).Error
+	if err == nil {
+		err = filter(tx.Model(&db.MatchGame{})).Where("excluded = ?", !excluded).Pluck("DISTINCT match_id", &matchIDs).Error
+	}
+	var trainingGames, matchGames int64
+	if err == nil {
+		update := filter(tx.Model(&db.TrainingGame{})).Where("excluded = ?", !excluded).Update("excluded", excluded)
+		err, trainingGames = update.Error, update.RowsAffected
+	}
+	if err == nil {
+		update := filter(tx.Model(&db.MatchGame{})).Where("excluded = ?", !excluded).Update("excluded", excluded)
+		err, matchGames = update.Error, update.RowsAffected
+	}
+	if err == nil && len(networkIDs) > 0 {
+		err = tx.Exec(`UPDATE networks SET games_played =
+(SELECT count(*) FROM training_games WHERE network_id = networks.id AND excluded = false)
+WHERE id IN (?)`, networkIDs).Error
+	}
+	if err == nil && len(matchIDs) > 0 {
+		err = tx.Exec(`UPDATE matches SET
+wins = (SELECT count(*) FROM match_games WHERE match_id = matches.id AND done = true AND excluded = false AND shadow_of = 0 AND result = 1),
+losses = (SELECT count(*) FROM match_games WHERE match_id = matches.id AND done = true AND excluded = false AND shadow_of = 0 AND result = -1),
+draws = (SELECT count(*) FROM match_games WHERE match_id = matches.id AND done = true AND excluded = false AND shadow_of = 0 AND result = 0),
+games_created = CASE WHEN done THEN games_created ELSE `+liveMatchGames+` END
+WHERE id IN (?)`, time.Now().Add(-staleAssignmentAge), matchIDs).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s set excluded=%v on %d training games and %d match games (%v)\n", c.GetString(gin.AuthUserKey), excluded, trainingGames, matchGames, c.Request.PostForm)
+	c.String(http.StatusOK, fmt.Sprintf("Set excluded=%v on %d training games and %d match games.", excluded, trainingGames, matchGames))
+}
+
+// Reverts the best network of a run to network_id, after a promotion turned
+// out to be based on bad match data.  The match that promoted the current
+// best (or match_id, if given) is marked invalidated.
+func rollbackPromotion(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+
+	network := db.Network{}
+	err = db.GetDB().Where("id = ? AND training_run_id = ?", c.PostForm("network_id"), trainingRun.ID).First(&network).Error
+	if err != nil {
+		c.String(http.StatusBadRequest, "Unknown network")
+		return
+	}
+	if network.ID == trainingRun.BestNetworkID {
+		c.String(http.StatusBadRequest, "Network is already the best")
+		return
+	}
+
+	match := db.Match{}
+	query := db.GetDB().Where("training_run_id = ?", trainingRun.ID)
+	if matchID := c.PostForm("match_id"); len(matchID) > 0 {
+		query = query.Where("id = ?", matchID)
+	} else {
+		query = query.Where("candidate_id = ? AND passed = true AND test_only = false", trainingRun.BestNetworkID).Order("id desc")
+	}
+	err = query.First(&match).Error
+	if err != nil {
+		c.String(http.StatusBadRequest, "Unknown match")
+		return
+	}
+
+	_, elos, err := getProgress(db.GetDB(), trainingRun.ID)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	tx := db.GetDB().Begin()
+	err = tx.Model(trainingRun).Update("best_network_id", network.ID).Error
+	if err == nil {
+		err = tx.Model(&match).Update("invalidated", true).Error
+	}
+	if err == nil {
+		err = tx.Create(&db.PromotionEvent{
+			TrainingRunID:     trainingRun.ID,
+			NetworkID:         network.ID,
+			PreviousNetworkID: trainingRun.BestNetworkID,
+			MatchID:           match.ID,
+			Elo:               elos[network.ID],
+			Rollback:          true,
+			Reason:            c.PostForm("reason"),
+			CreatedBy:         c.GetString(gin.AuthUserKey),
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("%s rolled back training run %d to network %d, invalidating match %d\n", c.GetString(gin.AuthUserKey), trainingRun.ID, network.ID, match.ID)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d rolled back to network %d, match %d invalidated.", trainingRun.ID, network.ID, match.ID))
+}
+
+func setupAdminRoutes(admin *gin.RouterGroup) {
+	admin.GET("/", adminDashboard)
+	admin.POST("/training_run/:id/active", setTrainingRunActive)
+	admin.POST("/training_run/:id/rollback", rollbackPromotion)
+	admin.GET("/matches/new", newMatchForm)
+	admin.POST("/matches", createMatch)
+	admin.POST("/match/:id/parameters", setMatchParameters)
+	admin.GET("/match/:id/parameters", matchParametersHistory)
+	admin.POST("/compact", triggerCompaction)
+	admin.GET("/compaction", compactionProgress)
+	admin.GET("/storage", viewStorageStats)
+	admin.GET("/storage_stats", apiStorageStats)
+	admin.POST("/users/:name/rename", renameUser)
+	admin.POST("/users/:name/merge", mergeUser)
+	admin.POST("/exclude_games", excludeGames)
+	admin.POST("/training_run/:id/weight", setTrainingRunWeight)
+	admin.POST("/training_run/:id/games_target", setTrainingRunGamesTarget)
+	admin.POST("/training_run/:id/gating_policy", setTrainingRunGatingPolicy)
+	admin.POST("/training_run/:id/primary_architecture", setPrimaryArchitecture)
+	admin.POST("/training_run/:id/opening_book", setTrainingRunOpeningBook)
+	admin.POST("/training_run/:id/train_parameters", setTrainParameters)
+	admin.GET("/training_run/:id/train_parameters", trainParametersHistory)
+	admin.POST("/network/:id/tags", setNetworkTags)
+	admin.POST("/engine_versions", setEngineVersionRule)
+	admin.GET("/engine_versions", engineVersionRules)
+	admin.GET("/spot_checks", spotCheckSummary)
+	admin.POST("/sweeps", createSweep)
+	admin.POST("/tournaments", createTournament)
+}
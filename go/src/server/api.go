@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"server/config"
+	"server/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getUserStats(user *db.User) (gin.H, error) {
+	windows := currentStatWindows()
+	row := db.GetDB().Raw(`SELECT count(*),
+  count(*) FILTER (WHERE created_at >= ?),
+  count(*) FILTER (WHERE created_at >= ?),
+  count(*) FILTER (WHERE created_at >= ?),
+  count(*) FILTER (WHERE created_at >= ?),
+  MIN(created_at), MAX(created_at)
+FROM training_games
+WHERE user_id = ? AND excluded = false`, windows.Rolling, windows.TodayUTC, windows.Week, windows.Now.AddDate(0, -1, 0), user.ID).Row()
+
+	var total, day, today, week, month uint64
+	var first, last *time.Time
+	err := row.Scan(&total, &day, &today, &week, &month, &first, &last)
+	if err != nil {
+		return nil, err
+	}
+
+	var matchGames uint64
+	err = db.GetDB().Model(&db.MatchGame{}).Where("user_id = ? AND done = true AND excluded = false", user.ID).Count(&matchGames).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Version of the most recent upload, if there is one.
+	var latest []db.TrainingGame
+	err = db.GetDB().Where("user_id = ?", user.ID).Order("id desc").Limit(1).Find(&latest).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Average seconds from assignment to result of the week's match games,
+	// NULL without any.
+	var turnaround *float64
+	err = db.GetDB().Raw(`SELECT AVG(EXTRACT(EPOCH FROM completed_at - created_at)) FROM match_games
+WHERE user_id = ? AND completed_at IS NOT NULL AND created_at >= ?`, user.ID, windows.Week).Row().Scan(&turnaround)
+	if err != nil {
+		return nil, err
+	}
+
+	trust, err := userTrust(user)
+	if err != nil {
+		return nil, err
+	}
+
+	result := gin.H{
+		"user":               user.Username,
+		"trust":              trustNames[trust],
+		"games":              total,
+		"games_day":          day,
+		"games_today_utc":    today,
+		"games_week":         week,
+		"games_month":        month,
+		"match_games":        matchGames,
+		"match_turnaround":   turnaround,
+		"first_contribution": first,
+		"last_contribution":  last,
+		"windows":            windows,
+		"version":            nil,
+		"engine":             nil,
+	}
+	if len(latest) > 0 {
+		result["version"] = latest[0].Version
+		result["engine"] = latest[0].EngineVersion
+	}
+	return result, nil
+}
+
+func apiUser(c *gin.Context) {
+	user := db.User{}
+	err := db.GetDB().Where("username = ?", c.Param("name")).First(&user).Error
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown user"})
+		return
+	}
+
+	stats, err := getUserStats(&user)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func apiActiveUsers(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+
+	users, err := getActiveUsers(trainingRun.ID, -1)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	users["run"] = trainingRun.ID
+	c.JSON(http.StatusOK, users)
+}
+
+func apiUserGames(c *gin.Context) {
+	user := db.User{}
+	err := db.GetDB().Where("username = ?", c.Param("name")).First(&user).Error
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown user"})
+		return
+	}
+
+	page, networkID, err := getUserGamesQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	games, total, err := getUserGames(&user, page, networkID)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":    total,
+		"page":     page,
+		"per_page": userGamesPerPage,
+		"games":    games,
+	})
+}
+
+func networkURL(network *db.Network) string {
+	return config.Config.URLs.NetworkLocation + network.Sha
+}
+
+func apiDownloadNetworkByID(c *gin.Context) {
+	network := db.Network{}
+	err := db.GetDB().Where("id = ?", c.Param("id")).First(&network).Error
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown network"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, networkURL(&network))
+}
+
+func apiBestNetwork(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+
+	network := db.Network{}
+	err = db.GetDB().Where("id = ?", trainingRun.BestNetworkID).First(&network).Error
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Training run has no best network"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run": trainingRun.ID,
+		"id":  network.ID,
+		"sha": network.Sha,
+		"url": networkURL(&network),
+	})
+}
+
+// How long clients and proxies may reuse a work status.
+const workStatusMaxAge = 10
+
+// What clients poll to learn whether the network they play is still the
+// best, far cheaper than a next_game.
+func apiWorkStatus(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+
+	status := gin.H{
+		"run":             trainingRun.ID,
+		"active":          trainingRun.Active,
+		"best_network_id": nil,
+		"best_sha":        nil,
+	}
+	if trainingRun.BestNetworkID != 0 {
+		network := db.Network{}
+		err = db.GetReadDB().Select("id, sha").Where("id = ?", trainingRun.BestNetworkID).First(&network).Error
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		status["best_network_id"] = network.ID
+		status["best_sha"] = network.Sha
+	}
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", workStatusMaxAge))
+	respondJSONWithETag(c, status)
+}
+
+// Reports whether an If-None-Match header matches etag.  The header may hold
+// several, possibly weak, ETags or "*".
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes obj as JSON with a strong ETag hashed from its content, or a 304 if
+// the client already has it.
+func respondJSONWithETag(c *gin.Context, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(body))
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// The Elo progress of a run, as plotted on the front page.
+func apiProgress(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+
+	progress, _, err := getProgress(db.GetReadDB(), trainingRun.ID)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	if c.DefaultQuery("full_elo", "0") == "0" {
+		progress = filterProgress(progress)
+	}
+
+	respondJSONWithETag(c, gin.H{
+		"run":      trainingRun.ID,
+		"progress": progress,
+	})
+}
+
+func apiNetworksManifest(c *gin.Context) {
+	q, err := whereNetworkTag(c, db.GetDB())
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	var networks []db.Network
+	err = q.Order("id").Find(&networks).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	json := []gin.H{}
+	for _, network := range networks {
+		// Networks uploaded before checksums were recorded are listed once
+		// backfillNetworkChecksums gets to them.
+		if len(network.FileChecksum) == 0 {
+			continue
+		}
+		entry := gin.H{
+			"id":       network.ID,
+			"sha":      network.Sha,
+			"size":     network.FileSize,
+			"checksum": network.FileChecksum,
+			"url":      networkURL(&network),
+			"tags":     networkTags(&network),
+			"notes":    network.Notes,
+		}
+		if len(network.ProtoPath) > 0 {
+			entry["proto"] = gin.H{
+				"size":     network.ProtoSize,
+				"checksum": network.ProtoChecksum,
+				"url":      networkURL(&network) + protoSuffix,
+			}
+		}
+		json = append(json, entry)
+	}
+
+	mirrors := config.Config.URLs.Mirrors
+	if mirrors == nil {
+		mirrors = []string{}
+	}
+	respondJSONWithETag(c, gin.H{
+		"networks": json,
+		"mirrors":  mirrors,
+	})
+}
+
+const (
+	defaultTrainingWindow = 500000
+	maxTrainingWindow     = 10000000
+)
+
+// Describes the most recent games of a run that aren't excluded, and the
+// game archives holding them, so training can fetch exactly that window.
+// Chunks that aren't compacted yet have no URL.
+func apiTrainingWindow(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+	games := defaultTrainingWindow
+	if len(c.Query("games")) > 0 {
+		games, err = strconv.Atoi(c.Query("games"))
+		if err != nil || games <= 0 || games > maxTrainingWindow {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid games"})
+			return
+		}
+	}
+
+	var firstID, lastID uint64
+	var count int
+	row := db.GetReadDB().Raw(`SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0), count(*) FROM (
+  SELECT id FROM training_games WHERE training_run_id = ? AND excluded = false ORDER BY id DESC LIMIT ?
+) window_games`, trainingRun.ID, games).Row()
+	err = row.Scan(&firstID, &lastID, &count)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	storage := config.RunStorageOf(trainingRun.ID)
+	chunkSize := uint64(storage.GamesChunkSize)
+	chunks := []gin.H{}
+	if count > 0 {
+		rows, err := db.GetReadDB().Raw(`SELECT id / ?, count(*), bool_and(compacted) FROM training_games
+WHERE training_run_id = ? AND excluded = false AND id >= ?
+GROUP BY 1 ORDER BY 1`, chunkSize, trainingRun.ID, firstID).Rows()
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var chunk uint64
+			var chunkGames int
+			var compacted bool
+			err = rows.Scan(&chunk, &chunkGames, &compacted)
+			if err != nil {
+				log.Println(err)
+				c.String(500, "Internal error")
+				return
+			}
+			url := ""
+			if compacted && len(storage.GamesURL) > 0 {
+				url = fmt.Sprintf("%sgames%d.tar.gz", storage.GamesURL, chunk*chunkSize)
+			}
+			chunks = append(chunks, gin.H{
+				"first_id":  chunk * chunkSize,
+				"games":     chunkGames,
+				"compacted": compacted,
+				"url":       url,
+			})
+		}
+	}
+
+	respondJSONWithETag(c, gin.H{
+		"run":      trainingRun.ID,
+		"first_id": firstID,
+		"last_id":  lastID,
+		"games":    count,
+		"chunks":   chunks,
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"server/config"
+	"server/db"
+	"time"
+)
+
+const staleMatchCheckInterval = 15 * time.Minute
+
+func cancelMatch(match *db.Match, reason string) error {
+	log.Printf("Cancelling match %d: %s\n", match.ID, reason)
+	err := db.GetDB().Model(match).Updates(map[string]interface{}{
+		"done":      true,
+		"passed":    false,
+		"cancelled": true,
+	}).Error
+	if err != nil {
+		return err
+	}
+	invalidatePages(pageEventMatch)
+	return nil
+}
+
+// Frees the slots of lost assignments, then cancels pending matches that
+// stopped receiving games, or whose baseline was replaced as best.  Matches whose SPRT is already decided are closed
+// with that result instead, once the games still out are lost.
+func cancelStaleMatches() error {
+	err := recountMatchSlots()
+	if err != nil {
+		return err
+	}
+	var matches []db.Match
+	err = db.GetDB().Where("done = false").Order("id").Find(&matches).Error
+	if err != nil {
+		return err
+	}
+
+	idleHours := config.Config.Matches.IdleHours
+	cutoff := time.Now().Add(-time.Duration(idleHours) * time.Hour)
+	for _, match := range matches {
+		if config.Config.Matches.CancelSuperseded && !match.TestOnly {
+			trainingRun, err := getTrainingRun(match.TrainingRunID)
+			if err != nil {
+				return err
+			}
+			bestID, err := trackBestNetworkID(trainingRun, match.Architecture)
+			if err != nil {
+				return err
+			}
+			if trainingRun.GatingPolicy == gatingParallel && bestID != match.CurrentBestID {
+				err = cancelMatch(&match, "baseline is no longer the best network")
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if sprtDecision(&match) != 0 {
+			err = checkMatchFinished(match.ID)
+			if err != nil {
+				return err
+			}
+			invalidatePages(pageEventMatch)
+			continue
+		}
+
+		if idleHours <= 0 || match.CreatedAt.After(cutoff) {
+			continue
+		}
+		var recent int
+		err = db.GetDB().Model(&db.MatchGame{}).Where("match_id = ? AND created_at >= ?", match.ID, cutoff).Count(&recent).Error
+		if err != nil {
+			return err
+		}
+		if recent > 0 {
+			continue
+		}
+		err = cancelMatch(&match, "idle")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts the stale match cleanup job.  It always runs, as without it the
+// slots of lost assignments are never handed out again.
+func startMatchCleanup() {
+	go func() {
+		for {
+			err := cancelStaleMatches()
+			if err != nil {
+				log.Println(err)
+			}
+			time.Sleep(staleMatchCheckInterval)
+		}
+	}()
+}
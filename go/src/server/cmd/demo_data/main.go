@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"server/config"
+	"server/db"
+	"time"
+)
+
+// Time between two networks of the demo run.
+const networkInterval = 6 * time.Hour
+
+var adjectives = []string{"quiet", "sharp", "gentle", "rapid", "clever", "bold", "patient", "lucky", "silent", "brave"}
+var nouns = []string{"knight", "bishop", "rook", "pawn", "castle", "gambit", "fianchetto", "zugzwang", "endgame", "tempo"}
+
+// Short games keyed by result, from white's side.
+var pgns = map[int]string{
+	1:  "1. e4 e5 2. Qh5 Nc6 3. Bc4 Nf6 4. Qxf7# 1-0",
+	-1: "1. f3 e5 2. g4 Qh4# 0-1",
+	0:  "1. e4 e5 2. Nf3 Nc6 3. Bb5 a6 4. Ba4 Nf6 5. O-O Be7 1/2-1/2",
+}
+
+var pgnResults = map[int]string{1: "1-0", -1: "0-1", 0: "1/2-1/2"}
+
+// Elo difference of a wins/losses/draws score, as on the match pages.
+func elo(wins, losses, draws int) float64 {
+	n := wins + losses + draws
+	if n == 0 {
+		return 0
+	}
+	mu := (float64(wins) + float64(draws)/2) / float64(n)
+	return -400 * math.Log10(1/mu-1)
+}
+
+// Plays a game between networks eloDiff apart with the given draw rate,
+// returning 1, -1 or 0 from the stronger side's view when eloDiff > 0.
+func playGame(eloDiff float64, drawRate float64) int {
+	expected := 1 / (1 + math.Pow(10, -eloDiff/400))
+	r := rand.Float64()
+	if r < drawRate {
+		return 0
+	}
+	// Split the decisive games so the expected score comes out right.
+	if (r-drawRate)/(1-drawRate) < (expected-drawRate/2)/(1-drawRate) {
+		return 1
+	}
+	return -1
+}
+
+func createUsers(count int) []db.User {
+	start := time.Now().Add(-90 * 24 * time.Hour)
+	users := []db.User{}
+	for i := 0; i < count; i++ {
+		user := db.User{
+			Username: fmt.Sprintf("%s_%s%d", adjectives[i%len(adjectives)], nouns[i/len(adjectives)%len(nouns)], i),
+			Password: "demo",
+			// Some accounts are hidden on the public pages.
+			Anonymous: i%10 == 9,
+		}
+		user.CreatedAt = start.Add(time.Duration(rand.Int63n(int64(30 * 24 * time.Hour))))
+		err := db.GetDB().Create(&user).Error
+		if err != nil {
+			log.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+// Picks a user, the first ones contributing the most like on the real
+// leaderboards.
+func pickUser(users []db.User) uint {
+	return users[int(math.Pow(rand.Float64(), 3)*float64(len(users)))].ID
+}
+
+// Creates games selfplay games of network, uploaded over the networkInterval
+// starting at from.
+func createTrainingGames(network *db.Network, from time.Time, users []db.User, games int) {
+	tx := db.GetDB().Begin()
+	for i := 0; i < games; i++ {
+		result := playGame(0, 0.3)
+		resigned := result != 0 && rand.Intn(3) == 0
+		game := db.TrainingGame{
+			CreatedAt:     from.Add(time.Duration(rand.Int63n(int64(networkInterval)))),
+			UserID:        pickUser(users),
+			TrainingRunID: network.TrainingRunID,
+			NetworkID:     network.ID,
+			Version:       3,
+			Result:        result,
+			Plies:         60 + rand.Intn(200),
+			Resigned:      resigned,
+			TimeSpent:     30 + rand.Intn(120),
+			Backend:       []string{"cpu", "opencl"}[rand.Intn(2)],
+			System:        []string{"linux/amd64", "windows/amd64", "darwin/amd64"}[rand.Intn(3)],
+			EngineVersion: "v0.7",
+		}
+		err := tx.Create(&game).Error
+		if err != nil {
+			tx.Rollback()
+			log.Fatal(err)
+		}
+		if result == 1 {
+			network.WhiteWins++
+		} else if result == -1 {
+			network.BlackWins++
+		} else {
+			network.Draws++
+		}
+		if resigned {
+			network.Resigns++
+		}
+		network.Plies += int64(game.Plies)
+	}
+	network.GamesPlayed += games
+	err := tx.Save(network).Error
+	if err != nil {
+		tx.Rollback()
+		log.Fatal(err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Plays up to games games of a gating match, the candidate being eloDiff
+// stronger than the current best.
+func createMatch(candidate *db.Network, best *db.Network, users []db.User, games int, gameCap int, eloDiff float64) db.Match {
+	match := db.Match{
+		TrainingRunID: candidate.TrainingRunID,
+		CandidateID:   candidate.ID,
+		CurrentBestID: best.ID,
+		GameCap:       gameCap,
+		Parameters:    `["--visits=800"]`,
+	}
+	match.CreatedAt = candidate.CreatedAt.Add(10 * time.Minute)
+	tx := db.GetDB().Begin()
+	err := tx.Create(&match).Error
+	for i := 0; i < games && err == nil; i++ {
+		result := playGame(eloDiff, 0.4)
+		if result == 1 {
+			match.Wins++
+		} else if result == -1 {
+			match.Losses++
+		} else {
+			match.Draws++
+		}
+		flip := i%2 == 1
+		white := result
+		if flip {
+			white = -result
+		}
+		err = tx.Create(&db.MatchGame{
+			CreatedAt:     match.CreatedAt.Add(time.Duration(i) * time.Minute),
+			UserID:        pickUser(users),
+			MatchID:       match.ID,
+			Version:       10,
+			Pgn:           fmt.Sprintf("[Result \"%s\"]\n\n%s\n", pgnResults[white], pgns[white]),
+			Result:        result,
+			Done:          true,
+			Flip:          flip,
+			EngineVersion: "v0.7",
+		}).Error
+	}
+	match.GamesCreated = games
+	if games >= gameCap {
+		match.Done = true
+		match.Passed = elo(match.Wins, match.Losses, match.Draws) > config.Config.Matches.Threshold
+	}
+	if err == nil {
+		err = tx.Save(&match).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Fatal(err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	return match
+}
+
+// Creates the materialized views of the front page leaderboards, see the
+// README, and refreshes them.
+func refreshLeaderboards() {
+	views := map[string]string{
+		"games_month": "WHERE training_games.created_at >= now() - INTERVAL '1 month' AND training_games.excluded = false",
+		"games_all":   "WHERE training_games.excluded = false",
+	}
+	for name, where := range views {
+		err := db.GetDB().Exec(fmt.Sprintf(`CREATE MATERIALIZED VIEW IF NOT EXISTS %s AS SELECT user_id, username, count(*) FROM training_games
+LEFT JOIN users ON users.id = training_games.user_id
+%s
+GROUP BY user_id, username
+ORDER BY count DESC`, name, where)).Error
+		if err == nil {
+			err = db.GetDB().Exec("REFRESH MATERIALIZED VIEW " + name).Error
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Fills a fresh database with made up users, networks, matches and games,
+// for developing the web pages without production data.  No files are
+// written, so networks and games can't be downloaded.
+func main() {
+	userCount := flag.Int("users", 40, "Number of users")
+	networkCount := flag.Int("networks", 300, "Number of networks")
+	gamesPerNetwork := flag.Int("games", 200, "Average number of training games per network")
+	matchGames := flag.Int("match-games", 200, "Games of each gating match")
+	seed := flag.Int64("seed", 1, "Random seed, the same one giving the same data")
+	flag.Parse()
+	if *userCount < 1 || *networkCount < 1 || *gamesPerNetwork < 0 || *matchGames < 1 {
+		log.Fatal("Need at least one user, network and match game")
+	}
+	rand.Seed(*seed)
+
+	db.Init()
+	defer db.Close()
+	db.SetupDB()
+
+	var runs int
+	err := db.GetDB().Model(&db.TrainingRun{}).Count(&runs).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	if runs > 0 {
+		log.Fatal("The database already has training runs, demo data only goes into a fresh one")
+	}
+
+	trainingRun := db.CreateTrainingRun("Demo run")
+	trainingRun.Active = true
+	trainingRun.TrainParameters = `["--randomize", "-n", "-v800"]`
+	trainingRun.GamesTarget = *gamesPerNetwork
+	err = db.GetDB().Save(trainingRun).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users := createUsers(*userCount)
+	start := time.Now().Add(-time.Duration(*networkCount) * networkInterval)
+	var best db.Network
+	promotions := 0
+	runElo := 0.0
+	for i := 0; i < *networkCount; i++ {
+		network := db.Network{
+			CreatedAt:     start.Add(time.Duration(i) * networkInterval),
+			TrainingRunID: trainingRun.ID,
+			Sha:           fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("demo network %d %d", *seed, i)))),
+			Layers:        6,
+			Filters:       64,
+		}
+		// The run moved to a bigger network halfway.
+		if i >= *networkCount/2 {
+			network.Layers = 10
+			network.Filters = 128
+		}
+		err = db.GetDB().Create(&network).Error
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		promoted := i == 0
+		if i > 0 {
+			// Most candidates are a little stronger, some regress.
+			eloDiff := rand.NormFloat64()*30 + 10
+			games := *matchGames
+			if i == *networkCount-1 {
+				// Leave the latest match running.
+				games = *matchGames / 3
+			}
+			match := createMatch(&network, &best, users, games, *matchGames, eloDiff)
+			if match.Passed {
+				promoted = true
+				promotions++
+				runElo += elo(match.Wins, match.Losses, match.Draws)
+				err = db.GetDB().Create(&db.PromotionEvent{
+					CreatedAt:         match.CreatedAt.Add(time.Duration(games) * time.Minute),
+					TrainingRunID:     trainingRun.ID,
+					NetworkID:         network.ID,
+					PreviousNetworkID: best.ID,
+					MatchID:           match.ID,
+					Elo:               runElo,
+					CreatedBy:         "demo",
+				}).Error
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		if promoted {
+			best = network
+			err = db.GetDB().Model(trainingRun).Update("best_network_id", network.ID).Error
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// Only the best network plays selfplay games.
+		games := *gamesPerNetwork/2 + rand.Intn(*gamesPerNetwork+1)
+		createTrainingGames(&best, network.CreatedAt, users, games)
+	}
+
+	refreshLeaderboards()
+	fmt.Printf("Created training run %d with %d users, %d networks and %d promotions\n", trainingRun.ID, len(users), *networkCount, promotions)
+}
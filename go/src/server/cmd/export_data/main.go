@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"server/db"
+	"strings"
+	"time"
+)
+
+// Tables that can be exported, each filtered on created_at.
+var exports = map[string]string{
+	"matches":     `SELECT * FROM matches WHERE created_at >= ? AND created_at < ?`,
+	"match_games": `SELECT * FROM match_games WHERE created_at >= ? AND created_at < ?`,
+	"networks":    `SELECT * FROM networks WHERE created_at >= ? AND created_at < ?`,
+	// Aggregates of the selfplay games of each network.
+	"network_stats": `SELECT network_id, count(*) AS games,
+  count(*) FILTER (WHERE plies > 0 AND result = 1) AS white_wins,
+  count(*) FILTER (WHERE plies > 0 AND result = -1) AS black_wins,
+  count(*) FILTER (WHERE plies > 0 AND result = 0) AS draws,
+  count(*) FILTER (WHERE resigned) AS resigns,
+  AVG(plies) FILTER (WHERE plies > 0) AS avg_plies,
+  AVG(time_spent) FILTER (WHERE time_spent > 0) AS avg_time_spent,
+  count(DISTINCT user_id) AS users,
+  MIN(created_at) AS first_game, MAX(created_at) AS last_game
+FROM training_games
+WHERE excluded = false AND created_at >= ? AND created_at < ?
+GROUP BY network_id`,
+}
+
+func parseDate(value string, fallback time.Time) time.Time {
+	if len(value) == 0 {
+		return fallback
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		log.Fatalf("Invalid date %s: %v", value, err)
+	}
+	return t
+}
+
+// Returns the columns of the query, or the requested subset of them.
+func selectColumns(query string, requested []string) []string {
+	rows, err := db.GetDB().Raw(fmt.Sprintf("SELECT * FROM (%s) AS t LIMIT 0", query), time.Time{}, time.Time{}).Rows()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(requested) == 0 {
+		return columns
+	}
+
+	known := map[string]bool{}
+	for _, column := range columns {
+		known[column] = true
+	}
+	for _, column := range requested {
+		if !known[column] {
+			log.Fatalf("Unknown column %s, expected one of %s", column, strings.Join(columns, ","))
+		}
+	}
+	return requested
+}
+
+func exportTable(name string, columns []string, from, to time.Time, dir string) {
+	query := fmt.Sprintf(`SELECT "%s" FROM (%s) AS t`, strings.Join(columns, `","`), exports[name])
+	rows, err := db.GetDB().Raw(query, from, to).Rows()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	path := filepath.Join(dir, name+".csv")
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write(columns)
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	count := 0
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, value := range values {
+			switch v := value.(type) {
+			case nil:
+				record[i] = ""
+			case []byte:
+				record[i] = string(v)
+			case time.Time:
+				record[i] = v.UTC().Format(time.RFC3339)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		w.Write(record)
+		count++
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %d rows to %s\n", count, path)
+}
+
+// Exports match, network and per-network selfplay data as CSV files, for
+// offline analysis of a run.
+func main() {
+	tables := flag.String("tables", "matches,match_games,networks,network_stats", "Comma separated tables to export")
+	columns := flag.String("columns", "", "Comma separated table.column list, all columns of a table when none are given")
+	from := flag.String("from", "", "Only rows created on or after this date (YYYY-MM-DD)")
+	to := flag.String("to", "", "Only rows created before this date (YYYY-MM-DD)")
+	out := flag.String("out", ".", "Output directory")
+	flag.Parse()
+
+	requested := map[string][]string{}
+	if len(*columns) > 0 {
+		for _, column := range strings.Split(*columns, ",") {
+			parts := strings.SplitN(strings.TrimSpace(column), ".", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Invalid column %s, expected table.column", column)
+			}
+			requested[parts[0]] = append(requested[parts[0]], parts[1])
+		}
+	}
+	fromTime := parseDate(*from, time.Time{})
+	toTime := parseDate(*to, time.Now().Add(24*time.Hour))
+
+	db.Init()
+	defer db.Close()
+
+	for _, name := range strings.Split(*tables, ",") {
+		if _, ok := exports[name]; !ok {
+			log.Fatalf("Unknown table %s", name)
+		}
+		exportTable(name, selectColumns(exports[name], requested[name]), fromTime, toTime, *out)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"server/db"
+)
+
+// Sets a user's password, for accounts without an email address.
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Printf("Usage: %s <username> <new password>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	db.Init()
+	defer db.Close()
+
+	result := db.GetDB().Model(&db.User{}).Where("username = ?", os.Args[1]).Update("password", os.Args[2])
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		log.Fatalf("No user %s", os.Args[1])
+	}
+	fmt.Printf("Password for %s updated\n", os.Args[1])
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"server/config"
+	"server/db"
+	"strconv"
+	"strings"
+)
+
+// Archive kinds written by the server's compaction, see compaction.go.
+type archiveKind struct {
+	prefix    string
+	chunkSize uint64
+	// Returns the game id of an archive member, or false if it isn't a game.
+	gameID func(name string) (uint64, bool)
+	// Only games of the run matching this are expected in the archives.
+	condition string
+	// First game id archived, e.g. PgnArchivesFrom.
+	from uint64
+}
+
+// The kinds of archives compaction writes for a run, as configured in its
+// storage.  Kinds without a destination aren't compacted.
+func runKinds(storage config.RunStorage) []archiveKind {
+	kinds := []archiveKind{}
+	if len(storage.GamesDestination) > 0 {
+		kinds = append(kinds, archiveKind{
+			prefix:    "games",
+			chunkSize: uint64(storage.GamesChunkSize),
+			gameID: func(name string) (uint64, bool) {
+				if !strings.HasPrefix(name, "training.") {
+					return 0, false
+				}
+				id, err := strconv.ParseUint(strings.TrimPrefix(name, "training."), 10, 64)
+				return id, err == nil
+			},
+			condition: "compacted = true AND excluded = false",
+		})
+	}
+	if len(storage.PgnDestination) > 0 {
+		kinds = append(kinds, archiveKind{
+			prefix:    "pgn",
+			chunkSize: uint64(storage.PgnChunkSize),
+			gameID: func(name string) (uint64, bool) {
+				id, err := strconv.ParseUint(strings.TrimSuffix(name, ".pgn"), 10, 64)
+				return id, err == nil && strings.HasSuffix(name, ".pgn")
+			},
+			condition: "true",
+			from:      uint64(storage.PgnArchivesFrom),
+		})
+	}
+	return kinds
+}
+
+func archiveName(kind archiveKind, start uint64) string {
+	return fmt.Sprintf("%s%d.tar.gz", kind.prefix, start)
+}
+
+// Fetches name into dir with the download command, if one is given.
+func fetch(download []string, dir string, name string) error {
+	if len(download) == 0 {
+		return os.ErrNotExist
+	}
+	params := make([]string, len(download))
+	for i, param := range download {
+		param = strings.Replace(param, "%NAME%", name, -1)
+		params[i] = strings.Replace(param, "%PATH%", filepath.Join(dir, name), -1)
+	}
+	cmd := exec.Command(params[0], params[1:]...)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func readManifest(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			sums[fields[1]] = fields[0]
+		}
+	}
+	return sums, scanner.Err()
+}
+
+// Returns the sha256 of every member of the archive.
+func readArchive(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	sums := map[string]string{}
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+		sums[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// Checks one archive against its manifest and the games the database expects
+// in its range.  Returns the problems found.
+func verifyArchive(trainingRunID uint, kind archiveKind, start uint64, dir string, download []string) []string {
+	var ids []uint64
+	err := db.GetDB().Model(&db.TrainingGame{}).Where("training_run_id = ?", trainingRunID).Where(kind.condition).
+		Where("id >= ? AND id < ?", start, start+kind.chunkSize).Pluck("id", &ids).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ids) == 0 {
+		// Nothing to archive in this range.
+		return nil
+	}
+
+	name := archiveName(kind, start)
+	path := filepath.Join(dir, name)
+	for _, file := range []string{name, name + ".sha256"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); os.IsNotExist(err) {
+			if err := fetch(download, dir, file); err != nil {
+				return []string{fmt.Sprintf("missing %s", file)}
+			}
+		}
+	}
+
+	members, err := readArchive(path)
+	if err != nil {
+		return []string{fmt.Sprintf("corrupt archive: %v", err)}
+	}
+	manifest, err := readManifest(path + ".sha256")
+	if err != nil {
+		return []string{fmt.Sprintf("unreadable manifest: %v", err)}
+	}
+
+	problems := []string{}
+	for member, sum := range manifest {
+		actual, ok := members[member]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s listed in manifest but not archived", member))
+		} else if actual != sum {
+			problems = append(problems, fmt.Sprintf("%s checksum mismatch", member))
+		}
+	}
+	archived := map[uint64]bool{}
+	for member := range members {
+		if _, ok := manifest[member]; !ok {
+			problems = append(problems, fmt.Sprintf("%s not in manifest", member))
+		}
+		if id, ok := kind.gameID(member); ok {
+			archived[id] = true
+		}
+	}
+
+	missing := 0
+	for _, id := range ids {
+		if !archived[id] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		problems = append(problems, fmt.Sprintf("%d of %d games in the database not archived", missing, len(ids)))
+	}
+	return problems
+}
+
+// Verifies the compacted archives of a training run, and their sha256
+// manifests, before the original files are deleted.  Chunk sizes are read
+// from the run's storage in serverconfig.json.  Archives not found in -dir
+// are fetched with the -download command, with %NAME% and %PATH%
+// substituted.
+func main() {
+	run := flag.Uint("run", 1, "Training run whose archives are verified")
+	dir := flag.String("dir", ".", "Directory holding (or receiving) the archives")
+	downloadCmd := flag.String("download", "", `Command fetching a missing file, e.g. "aws s3 cp s3://lczero/training/%NAME% %PATH%"`)
+	from := flag.Uint64("from", 0, "First game id to verify, e.g. the first archived with a manifest")
+	to := flag.Uint64("to", 0, "Verify chunks ending before this game id, defaults to the last compacted game")
+	flag.Parse()
+
+	var download []string
+	if len(*downloadCmd) > 0 {
+		download = strings.Fields(*downloadCmd)
+	}
+
+	db.Init()
+	defer db.Close()
+
+	maxID := *to
+	if maxID == 0 {
+		row := db.GetDB().Model(&db.TrainingGame{}).Where("training_run_id = ? AND compacted = true", *run).Select("COALESCE(MAX(id), 0)").Row()
+		if err := row.Scan(&maxID); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	kinds := runKinds(config.RunStorageOf(*run))
+	if len(kinds) == 0 {
+		log.Fatalf("Training run %d has no storage configured", *run)
+	}
+
+	failed := 0
+	for _, kind := range kinds {
+		first := *from
+		if kind.from > first {
+			first = kind.from
+		}
+		// Only full chunks, the last one may still be in progress.
+		for start := first / kind.chunkSize * kind.chunkSize; start+kind.chunkSize <= maxID; start += kind.chunkSize {
+			problems := verifyArchive(uint(*run), kind, start, *dir, download)
+			if len(problems) == 0 {
+				continue
+			}
+			failed++
+			fmt.Printf("%s:\n", archiveName(kind, start))
+			for _, problem := range problems {
+				fmt.Printf("  %s\n", problem)
+			}
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d archives with problems\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("All archives verified")
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"server/config"
+	"server/db"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	compactionLock = "compaction"
+	// Renewed after every archive, so only needs to cover building and
+	// uploading one.
+	compactionLockTTL = 30 * time.Minute
+)
+
+// Progress of the compaction in this process, for the admin dashboard.
+type compactionStatus struct {
+	sync.Mutex
+	running      bool
+	run          uint
+	stage        string
+	archives     int
+	lastStarted  time.Time
+	lastFinished time.Time
+	lastError    string
+}
+
+var compaction compactionStatus
+
+// Wakes the compaction loop for an immediate compaction.
+var compactionTrigger = make(chan struct{}, 1)
+
+func (s *compactionStatus) setStage(run uint, stage string) {
+	s.Lock()
+	defer s.Unlock()
+	s.run = run
+	s.stage = stage
+}
+
+func (s *compactionStatus) archived() {
+	s.Lock()
+	defer s.Unlock()
+	s.archives++
+}
+
+func (s *compactionStatus) summary() gin.H {
+	s.Lock()
+	defer s.Unlock()
+	return gin.H{
+		"running":       s.running,
+		"run":           s.run,
+		"stage":         s.stage,
+		"archives":      s.archives,
+		"last_started":  s.lastStarted,
+		"last_finished": s.lastFinished,
+		"last_error":    s.lastError,
+	}
+}
+
+// Identifies this process as the holder of the compaction lock.
+func compactionHolder() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// Returned once another process took over a job's lock, e.g. after a step
+// of the job took longer than the lock's TTL.
+var errLockLost = errors.New("lock lost to another process")
+
+// Extends a job lock taken with compactionHolder, failing if it was lost.
+func renewLock(name string, ttl time.Duration) error {
+	locked, err := db.TryLock(name, compactionHolder(), ttl)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errLockLost
+	}
+	return nil
+}
+
+// Copies an archive to destination with the configured upload command.
+func uploadArchive(path string, destination string) error {
+	command := config.Config.Compaction.UploadCommand
+	if len(command) == 0 {
+		command = []string{"aws", "s3", "cp", "%FILE_PATH%", "%DESTINATION%"}
+	}
+	cmdParams := make([]string, len(command))
+	for i, param := range command {
+		param = strings.Replace(param, "%FILE_PATH%", path, -1)
+		cmdParams[i] = strings.Replace(param, "%DESTINATION%", destination, -1)
+	}
+	out, err := exec.Command(cmdParams[0], cmdParams[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("uploading %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Writes a tar.gz archive of members, and a sha256sum style manifest of it
+// next to it for verify_archives, then uploads and removes both.
+func writeArchive(name string, destination string, members []string, read func(member string) ([]byte, error)) error {
+	dir := config.Config.Compaction.WorkDir
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	outputPath := filepath.Join(dir, name)
+	manifestPath := outputPath + ".sha256"
+	defer os.Remove(outputPath)
+	defer os.Remove(manifestPath)
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	gw := gzip.NewWriter(output)
+	tw := tar.NewWriter(gw)
+	manifest := &bytes.Buffer{}
+	for _, member := range members {
+		data, err := read(member)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    member,
+			Size:    int64(len(data)),
+			Mode:    0644,
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(manifest, "%x  %s\n", sha256.Sum256(data), member)
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	if err = output.Close(); err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(manifestPath, manifest.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{outputPath, manifestPath} {
+		err = uploadArchive(path, destination)
+		if err != nil {
+			return err
+		}
+	}
+	compaction.archived()
+	return nil
+}
+
+// Archives the run's oldest chunk of uncompacted games, returning false once
+// no complete chunk is left.
+func compactGamesChunk(trainingRunID uint, storage config.RunStorage) (bool, error) {
+	chunkSize := uint64(storage.GamesChunkSize)
+	var games []db.TrainingGame
+	err := db.GetDB().Where("training_run_id = ? AND compacted = false", trainingRunID).
+		Order("id").Limit(chunkSize).Find(&games).Error
+	if err != nil || len(games) == 0 {
+		return false, err
+	}
+	start := games[0].ID / chunkSize * chunkSize
+	for idx, game := range games {
+		if game.ID >= start+chunkSize {
+			games = games[0:idx]
+			break
+		}
+	}
+	// Other runs' games take up some of the IDs, so the chunk is complete
+	// once any game past it was uploaded.
+	var later int
+	err = db.GetDB().Model(&db.TrainingGame{}).Where("id >= ?", start+chunkSize).Count(&later).Error
+	if err != nil || later == 0 {
+		return false, err
+	}
+
+	paths := map[string]string{}
+	members := []string{}
+	ids := []uint64{}
+	for _, game := range games {
+		ids = append(ids, game.ID)
+		// Excluded games are left out of the training data, but still
+		// marked compacted along with the rest of the chunk.
+		if game.Excluded || len(game.Path) == 0 {
+			continue
+		}
+		member := fmt.Sprintf("training.%d", game.ID)
+		paths[member] = game.Path
+		members = append(members, member)
+	}
+	err = writeArchive(fmt.Sprintf("games%d.tar.gz", start), storage.GamesDestination, members, func(member string) ([]byte, error) {
+		file, err := os.Open(paths[member])
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		gzr, err := gzip.NewReader(file)
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", paths[member], err)
+			return nil, nil
+		}
+		defer gzr.Close()
+		return ioutil.ReadAll(gzr)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Recorded along with the games, so the training pipeline can claim it.
+	chunk := db.TrainingChunk{
+		TrainingRunID: trainingRunID,
+		FirstGameID:   start,
+		LastGameID:    ids[len(ids)-1],
+		Games:         len(members),
+	}
+	if len(storage.GamesURL) > 0 {
+		chunk.URL = fmt.Sprintf("%sgames%d.tar.gz", storage.GamesURL, start)
+	}
+	tx := db.GetDB().Begin()
+	err = tx.Model(&db.TrainingGame{}).Where("id IN (?)", ids).Update("compacted", true).Error
+	if err == nil {
+		err = tx.Create(&chunk).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	err = tx.Commit().Error
+	return err == nil, err
+}
+
+// Game IDs of the files in dir named like training.<id>.gz or <id>.pgn.
+func listGameFiles(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(file.Name(), "training."), ".gz")
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".pgn"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// Archives and deletes the run's PGNs, except for the most recent ones.
+func compactPgns(trainingRunID uint, storage config.RunStorage) error {
+	dir := fmt.Sprintf("pgns/run%d", trainingRunID)
+	ids, err := listGameFiles(dir)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	chunkSize := storage.PgnChunkSize
+	last := ids[len(ids)-1] / chunkSize * chunkSize
+	for idx, id := range ids {
+		if id+storage.LeaveGames >= last {
+			ids = ids[0:idx]
+			break
+		}
+	}
+
+	for idx := 0; idx < len(ids); {
+		start := ids[idx] / chunkSize * chunkSize
+		end := idx
+		for end < len(ids) && ids[end] < start+chunkSize {
+			end++
+		}
+		members := []string{}
+		for _, id := range ids[idx:end] {
+			members = append(members, fmt.Sprintf("%d.pgn", id))
+		}
+		err = writeArchive(fmt.Sprintf("pgn%d.tar.gz", start), storage.PgnDestination, members, func(member string) ([]byte, error) {
+			return ioutil.ReadFile(filepath.Join(dir, member))
+		})
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			err = os.Remove(filepath.Join(dir, member))
+			if err != nil {
+				return err
+			}
+		}
+		if err = renewLock(compactionLock, compactionLockTTL); err != nil {
+			return err
+		}
+		idx = end
+	}
+	return nil
+}
+
+// Deletes the run's archived game files, except for the most recent ones.
+func deleteCompactedGames(trainingRunID uint, storage config.RunStorage) error {
+	dir := fmt.Sprintf("games/run%d", trainingRunID)
+	ids, err := listGameFiles(dir)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	var compacted []uint64
+	err = db.GetDB().Model(&db.TrainingGame{}).
+		Where("training_run_id = ? AND compacted = true AND id >= ? AND id + ? < ?", trainingRunID, ids[0], storage.LeaveGames, ids[len(ids)-1]).
+		Pluck("id", &compacted).Error
+	if err != nil {
+		return err
+	}
+	for _, id := range compacted {
+		err = os.Remove(filepath.Join(dir, fmt.Sprintf("training.%d.gz", id)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func compactRun(trainingRunID uint, storage config.RunStorage) error {
+	if len(storage.GamesDestination) > 0 {
+		compaction.setStage(trainingRunID, "games")
+		for {
+			more, err := compactGamesChunk(trainingRunID, storage)
+			if err != nil {
+				return err
+			}
+			if !more {
+				break
+			}
+			if err = renewLock(compactionLock, compactionLockTTL); err != nil {
+				return err
+			}
+		}
+		compaction.setStage(trainingRunID, "deleting games")
+		err := deleteCompactedGames(trainingRunID, storage)
+		if err != nil {
+			return err
+		}
+	}
+	if len(storage.PgnDestination) > 0 {
+		compaction.setStage(trainingRunID, "pgns")
+		err := compactPgns(trainingRunID, storage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Emails the configured addresses about a failed compaction.
+func alertCompactionFailure(trainingRunID uint, err error) {
+	for _, to := range config.Config.Compaction.AlertEmails {
+		mailErr := sendEmail(to, fmt.Sprintf("Compaction of training run %d failed", trainingRunID), err.Error())
+		if mailErr != nil {
+			log.Printf("Unable to send compaction alert to %s: %v", to, mailErr)
+		}
+	}
+}
+
+// Compacts every run with storage configured, unless another server process
+// is already compacting.
+func compactAll() {
+	holder := compactionHolder()
+	locked, err := db.TryLock(compactionLock, holder, compactionLockTTL)
+	if err != nil {
+		log.Printf("Unable to take the compaction lock: %v", err)
+		return
+	}
+	if !locked {
+		log.Println("Compaction is running elsewhere, skipping")
+		return
+	}
+	defer db.Unlock(compactionLock, holder)
+
+	var trainingRuns []db.TrainingRun
+	err = db.GetDB().Order("id").Find(&trainingRuns).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	compaction.Lock()
+	compaction.running = true
+	compaction.archives = 0
+	compaction.lastStarted = time.Now()
+	compaction.lastError = ""
+	compaction.Unlock()
+	log.Println("Compaction started")
+
+	failed := ""
+	for _, trainingRun := range trainingRuns {
+		err = compactRun(trainingRun.ID, config.RunStorageOf(trainingRun.ID))
+		if err != nil {
+			log.Printf("Compaction of training run %d failed: %v", trainingRun.ID, err)
+			failed += fmt.Sprintf("run %d: %v\n", trainingRun.ID, err)
+			alertCompactionFailure(trainingRun.ID, err)
+			if err == errLockLost {
+				break
+			}
+		}
+	}
+
+	compaction.Lock()
+	compaction.running = false
+	compaction.stage = ""
+	compaction.lastFinished = time.Now()
+	compaction.lastError = strings.TrimSpace(failed)
+	archives := compaction.archives
+	compaction.Unlock()
+	log.Printf("Compaction finished, %d archives written", archives)
+}
+
+// Starts the compaction loop, running every IntervalHours and whenever
+// triggered from the admin dashboard.
+func startCompaction() {
+	var tick <-chan time.Time
+	if config.Config.Compaction.IntervalHours > 0 {
+		tick = time.Tick(time.Duration(config.Config.Compaction.IntervalHours) * time.Hour)
+	}
+	go func() {
+		for {
+			select {
+			case <-tick:
+			case <-compactionTrigger:
+			}
+			compactAll()
+		}
+	}()
+}
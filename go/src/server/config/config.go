@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
+	"strconv"
 )
 
 // Config is a Server config.
@@ -12,23 +13,269 @@ var Config struct {
 		User     string
 		Dbname   string
 		Password string
+		// Connection pool limits, applied to the primary and each
+		// replica.  Unlimited open connections when 0, 10 idle ones when 0.
+		// ConnMaxLifetime is in seconds, connections are reused forever
+		// when 0.
+		MaxOpenConns    int
+		MaxIdleConns    int
+		ConnMaxLifetime int
+		// Connection strings of read replicas, e.g. "host=replica1
+		// user=gorm dbname=gorm sslmode=disable password=...".  The public
+		// pages read from them, writes always go to the primary.
+		Replicas []string
 	}
 	Clients struct {
 		MinClientVersion uint64
 		MinEngineVersion string
+		// Clients older than DeprecatedBefore are warned in next_game
+		// responses until DeprecationDeadline (RFC 3339), and rejected
+		// like those older than MinClientVersion after it.  DownloadURL is
+		// where they are told to get a new client.
+		DeprecatedBefore    uint64
+		DeprecationDeadline string
+		DownloadURL         string
+		// Games from networks more than this many promotions behind the
+		// run's best are rejected, or only flagged if StaleNetworkPolicy is
+		// "flag".  Disabled when 0.
+		MaxStalePromotions int
+		StaleNetworkPolicy string
+		// Fill in the result and ply count from the uploaded training data
+		// when the client doesn't report them.
+		ExtractMetadata bool
+		// Salt for the hashes of the IP addresses games are uploaded from,
+		// which aren't recorded when empty.  The admin dashboard flags
+		// origins used by more than MaxAccountsPerOrigin accounts in a day,
+		// and accounts uploading from more than MaxOriginsPerAccount origins
+		// in an hour, 5 and 10 when 0.
+		OriginSalt           string
+		MaxAccountsPerOrigin int
+		MaxOriginsPerAccount int
+		// Addresses or CIDR ranges of the reverse proxies in front of the
+		// server, whose X-Forwarded-For entries are believed.  The header
+		// is ignored when empty, anyone could set it.
+		TrustedProxies []string
+		// ip2asn style TSV file (range start, range end, AS number, ...)
+		// mapping addresses to their network.  When set, the hash of the
+		// AS number is recorded too, and accounts are counted as roaming
+		// by networks rather than by addresses, which change within one.
+		AsnDatabase string
 	}
 	URLs struct {
 		OnNewNetwork    []string
 		NetworkLocation string
+		// Base URLs of community mirrors, advertised in the networks manifest.
+		Mirrors []string
+		// Command converting an uploaded network to the compressed protobuf
+		// format, with %NETWORK_PATH% and %OUTPUT_PATH% substituted.  Only
+		// the text format is published when empty.
+		ConvertNetwork []string
 	}
 	Matches struct {
 		Games      int
 		Parameters []interface{}
-		Threshold  float64
+		// Elo a candidate needs to pass, while the SPRT is disabled.
+		Threshold float64
+		// Extra games assigned beyond GameCap, covering assignments that
+		// never get a result back.
+		AssignmentBuffer int
+		// Named engine parameter sets offered when creating a match from
+		// the admin pages, in addition to Parameters.
+		ParameterTemplates map[string][]string
+		// Gating matches stop early once the SPRT of Elo0 vs Elo1 is
+		// decided, and fail if it's still undecided at their game cap.
+		// Disabled unless Elo1 > Elo0.  Alpha and Beta default to 0.05,
+		// an LLR within Epsilon of a bound counts as decided.
+		SPRT struct {
+			Elo0, Elo1  float64
+			Alpha, Beta float64
+			Epsilon     float64
+		}
+		// Pending matches that handed out no game for this many hours are
+		// cancelled.  Disabled when 0.
+		IdleHours int
+		// Cancel pending gating matches against a network that is no
+		// longer the run's best, for runs with the parallel gating policy.
+		CancelSuperseded bool
+		// Fraction of match games also assigned to a second user, to
+		// cross-check the reported results.
+		ShadowRate float64
+		// Results disagreeing with the outcome of the uploaded PGN are
+		// rejected, or stored but left out of the match score when this is
+		// "flag".
+		ResultMismatchPolicy string
+		// Gating matches of uploaded networks collect the training data of
+		// their games, see Match.TrainingData.
+		TrainingData bool
+	}
+	Trust struct {
+		// Non-excluded games and account age in days needed to receive
+		// match games (established) and re-validation matches (trusted).
+		// Everyone is trusted when all are 0.
+		EstablishedGames, EstablishedDays int
+		TrustedGames, TrustedDays         int
+		// Users with a larger percentage of their games excluded, or of
+		// their shadow match games disagreeing, stay new.  Disabled when 0.
+		MaxExcludedPercent     float64
+		MaxDisagreementPercent float64
+	}
+	Reliability struct {
+		// Days of history reliability scores cover, 7 when 0.
+		WindowDays int
+		// Users with a lower reliability score (a percentage) are held
+		// back to the new and established trust tiers respectively.
+		// Disabled when 0.
+		MinEstablishedScore float64
+		MinTrustedScore     float64
+		// Failure rates (percentages) over the last day or the window
+		// above which users are listed on the admin dashboard.  Disabled
+		// when 0.
+		MaxRejectionRate  float64
+		MaxInvalidPgnRate float64
+		MaxTimeoutRate    float64
+		MaxCrashRate      float64
+		// Whether users above any of them are held back to the new trust
+		// tier, which gets no match games.
+		ThrottleMatches bool
+	}
+	Replication struct {
+		// Command run to copy a file to object storage, with %FILE_PATH%
+		// and %KEY% substituted.  Replication is disabled when empty.
+		Command []string
+		Workers int
+	}
+	SpotCheck struct {
+		// Server side engine and flags, e.g. ["./lczero", "-t1"], run
+		// with the game's network and the run's selfplay parameters.
+		// Spot checks are disabled when empty.
+		Command []string
+		// Games checked per hour, and positions replayed per game.
+		GamesPerHour int
+		Positions    int
+		// Total variation distance between the uploaded and replayed
+		// probabilities above which a position counts as a discrepancy,
+		// 0.3 when 0.
+		Tolerance float64
+	}
+	Compaction struct {
+		// Hours between compactions of the runs with storage configured,
+		// which only run when triggered from the admin dashboard when 0.
+		IntervalHours int
+		// Command copying an archive to its destination, with %FILE_PATH%
+		// and %DESTINATION% substituted, "aws s3 cp" when empty.
+		UploadCommand []string
+		// Directory archives are built in, the system's temporary
+		// directory when empty.
+		WorkDir string
+		// Addresses emailed when a compaction fails.
+		AlertEmails []string
+	}
+	Webhooks struct {
+		// URLs POSTed to whenever a training run accumulates another
+		// NewGames accepted games since its latest network, e.g. to start
+		// training.  Disabled when empty or NewGames is 0.
+		NewGamesURLs []string
+		NewGames     int
+	}
+	NetworkVerification struct {
+		// Hours between re-hashing the stored network files, disabled
+		// when 0.
+		IntervalHours int
+		// Command printing the sha256 of a network's copy in object
+		// storage, with %FILE_PATH% substituted.  Only the local files
+		// are checked when empty.
+		ChecksumCommand []string
+		// Addresses emailed when a network fails verification.
+		AlertEmails []string
+	}
+	Storage struct {
+		// Where the compaction tools archive each training run's games
+		// and PGNs, by run ID, e.g. "1".
+		Runs map[string]RunStorage
+	}
+	Ingestion struct {
+		// Uploads are persisted synchronously when Workers is 0.  Queued
+		// ones are spooled to the ingestion directory first, and requeued
+		// from it on the next start if the server stops before persisting
+		// them.
+		Workers   int
+		QueueSize int
+		// Queue depth above which uploads are refused with a 503.
+		BackpressureThreshold int
+	}
+	Limits struct {
+		// All in bytes, defaults apply when 0.
+		MultipartMemory int64
+		MaxNetworkSize  int64
+		MaxGameSize     int64
+		MaxPgnLength    int
+		// In-flight uploads allowed per user, unlimited when 0.
+		MaxConcurrentUploads int
+		// Uploads are refused while any upload volume has less free space
+		// than this, in bytes.  Disabled when 0.
+		MinFreeSpace int64
 	}
 	WebServer struct {
 		Address string
 	}
+	PageCache struct {
+		// Seconds the front page, matches and networks lists are served
+		// from memory, disabled when 0.  Uploads and match results expire
+		// them sooner.
+		TTLSeconds int
+		// Uploads and match results only expire pages older than this
+		// many seconds, so a busy server still gets cache hits.
+		MinAgeSeconds int
+	}
+	Email struct {
+		// SMTP server as host:port, emails are disabled when empty.
+		SMTPAddress string
+		Username    string
+		Password    string
+		From        string
+		// Public URL of the site, for links in emails.
+		BaseURL string
+	}
+	Admin struct {
+		// Username -> password for HTTP basic auth on the /admin routes.
+		Accounts map[string]string
+		// Username -> password of the training pipelines allowed to claim
+		// and consume training chunks, besides the admin accounts.
+		Trainers map[string]string
+	}
+}
+
+// RunStorage is where a training run's games and PGNs are archived.
+type RunStorage struct {
+	// Destinations the archives are copied to, e.g.
+	// "s3://lczero/training/", and the public URLs they are served from.
+	GamesDestination string
+	GamesURL         string
+	PgnDestination   string
+	PgnURL           string
+	// Games per archive, 10000 and 100000 when 0.
+	GamesChunkSize int
+	PgnChunkSize   int
+	// Games kept on the server after compaction, 500000 when 0.
+	LeaveGames int
+	// ID of the first game with archived PGNs.
+	PgnArchivesFrom int
+}
+
+// RunStorageOf returns the storage of a training run, with defaults filled
+// in.  Destinations are empty for runs not configured.
+func RunStorageOf(trainingRunID uint) RunStorage {
+	storage := Config.Storage.Runs[strconv.FormatUint(uint64(trainingRunID), 10)]
+	if storage.GamesChunkSize <= 0 {
+		storage.GamesChunkSize = 10000
+	}
+	if storage.PgnChunkSize <= 0 {
+		storage.PgnChunkSize = 100000
+	}
+	if storage.LeaveGames <= 0 {
+		storage.LeaveGames = 500000
+	}
+	return storage
 }
 
 func init() {
@@ -3,6 +3,8 @@ package db
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	// Importing to support postgre database.
@@ -13,6 +15,11 @@ import (
 var db *gorm.DB
 var err error
 
+// Read replicas, and whether each passed its last health check (1 if so).
+var replicas []*gorm.DB
+var replicaHealthy []int32
+var nextReplica uint32
+
 // Init initializes database.
 func Init() {
 	conn := fmt.Sprintf(
@@ -22,10 +29,44 @@ func Init() {
 		config.Config.Database.Dbname,
 		config.Config.Database.Password,
 	)
-	db, err = gorm.Open("postgres", conn)
+	// Postgres may still be starting, e.g. when both are restarted together.
+	err = Retry(func() error {
+		db, err = gorm.Open("postgres", conn)
+		return err
+	})
 	if err != nil {
 		log.Fatal("Unable to connect to DB", err)
 	}
+	configurePool(db)
+
+	// A missing replica only costs the primary some load, so the server
+	// starts without it.
+	for i, dsn := range config.Config.Database.Replicas {
+		replica, err := gorm.Open("postgres", dsn)
+		if err != nil {
+			log.Printf("Unable to connect to read replica %d: %v", i, err)
+			continue
+		}
+		configurePool(replica)
+		replicas = append(replicas, replica)
+		replicaHealthy = append(replicaHealthy, 1)
+	}
+}
+
+func maxIdleConns() int {
+	if config.Config.Database.MaxIdleConns > 0 {
+		return config.Config.Database.MaxIdleConns
+	}
+	return 10
+}
+
+// Applies the connection pool limits from the config.  A ConnMaxLifetime
+// below the NAT or firewall idle timeout avoids silently dropped connections.
+func configurePool(conn *gorm.DB) {
+	sqlDB := conn.DB()
+	sqlDB.SetMaxOpenConns(config.Config.Database.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(maxIdleConns())
+	sqlDB.SetConnMaxLifetime(time.Duration(config.Config.Database.ConnMaxLifetime) * time.Second)
 }
 
 // SetupDB setups DB.
@@ -36,6 +77,71 @@ func SetupDB() {
 	db.AutoMigrate(&Match{})
 	db.AutoMigrate(&MatchGame{})
 	db.AutoMigrate(&TrainingGame{})
+	db.AutoMigrate(&TrainParametersChange{})
+	db.AutoMigrate(&MatchParametersChange{})
+	db.AutoMigrate(&EngineVersionRule{})
+	db.AutoMigrate(&Sweep{})
+	db.AutoMigrate(&Tournament{})
+	db.AutoMigrate(&PasswordReset{})
+	db.AutoMigrate(&PromotionEvent{})
+	db.AutoMigrate(&ResignStat{})
+	db.AutoMigrate(&SpotCheck{})
+	db.AutoMigrate(&JobLock{})
+	db.AutoMigrate(&ThroughputHour{})
+	db.AutoMigrate(&GamesWebhook{})
+	db.AutoMigrate(&TrainingChunk{})
+	db.AutoMigrate(&TrainingClaim{})
+	db.AutoMigrate(&ReliabilityEvent{})
+	db.AutoMigrate(&ArchitectureTrack{})
+	db.AutoMigrate(&OpeningAssignment{})
+
+	// Duplicate uploads of the same game are only stored once.  Partial, as
+	// games uploaded before hashing was added have no hash.
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_training_games_run_sha256 ON training_games (training_run_id, sha256) WHERE sha256 != ''")
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_resign_stats_network_threshold ON resign_stats (network_id, threshold)")
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_throughput_hours_run_hour ON throughput_hours (training_run_id, hour)")
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_training_chunks_run_first_game ON training_chunks (training_run_id, first_game_id)")
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_architecture_tracks_run_architecture ON architecture_tracks (training_run_id, architecture)")
+	// Accounts are found by username, so two with the same one would split a
+	// user's games.  Deleted accounts don't hold on to their name.  Not
+	// created while duplicates from before the index remain, which are
+	// listed for an admin to rename or merge.
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username) WHERE deleted_at IS NULL").Error; err != nil {
+		log.Printf("Unable to create idx_users_username: %v", err)
+		logDuplicateUsernames()
+	}
+	// Splits the engine versions of rows from before they were stored split,
+	// left NULL when the columns were added.
+	for table, column := range map[string]string{"training_games": "engine_version", "match_games": "engine_version", "engine_version_rules": "version"} {
+		db.Exec(fmt.Sprintf(`UPDATE %[1]s SET
+  engine_major = substring(%[2]s from '^v?([0-9]+)')::int,
+  engine_minor = substring(%[2]s from '^v?[0-9]+\.([0-9]+)')::int,
+  engine_patch = COALESCE(substring(%[2]s from '^v?[0-9]+\.[0-9]+\.([0-9]+)'), '0')::int
+WHERE engine_major IS NULL AND %[2]s ~ '^v?[0-9]+\.[0-9]+'`, table, column))
+		db.Exec(fmt.Sprintf("UPDATE %s SET engine_major = 0, engine_minor = 0, engine_patch = 0 WHERE engine_major IS NULL", table))
+	}
+}
+
+// Logs the usernames held by more than one account, with their IDs.
+func logDuplicateUsernames() {
+	rows, err := db.Raw(`SELECT username, string_agg(id::text, ', ' ORDER BY id) FROM users
+WHERE deleted_at IS NULL
+GROUP BY username
+HAVING count(*) > 1
+ORDER BY username`).Rows()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username, ids string
+		if err := rows.Scan(&username, &ids); err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("Username %q is held by users %s", username, ids)
+	}
 }
 
 // CreateTrainingRun creates training run
@@ -53,7 +159,23 @@ func GetDB() *gorm.DB {
 	return db
 }
 
+// GetReadDB returns a database object for queries that can tolerate
+// replication lag: a healthy read replica if any are configured, otherwise
+// the primary.
+func GetReadDB() *gorm.DB {
+	for range replicas {
+		i := atomic.AddUint32(&nextReplica, 1) % uint32(len(replicas))
+		if atomic.LoadInt32(&replicaHealthy[i]) == 1 {
+			return replicas[i]
+		}
+	}
+	return db
+}
+
 // Close closes database
 func Close() {
+	for _, replica := range replicas {
+		replica.Close()
+	}
 	db.Close()
 }
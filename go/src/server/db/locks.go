@@ -0,0 +1,31 @@
+package db
+
+import (
+	"time"
+)
+
+// JobLock is a lease on a background job, so that only one of several
+// server processes sharing the database runs it at a time.
+type JobLock struct {
+	Name      string `gorm:"primary_key"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+// TryLock takes the named lock for holder until ttl from now, or extends it
+// if holder already has it.  It fails when another holder's lease hasn't
+// expired, e.g. a crashed process's lease only blocks others for ttl.
+func TryLock(name string, holder string, ttl time.Duration) (bool, error) {
+	result := db.Exec(`INSERT INTO job_locks (name, holder, expires_at) VALUES (?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+WHERE job_locks.expires_at < now() OR job_locks.holder = EXCLUDED.holder`, name, holder, time.Now().Add(ttl))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Unlock releases the named lock, if holder has it.
+func Unlock(name string, holder string) error {
+	return db.Exec("DELETE FROM job_locks WHERE name = ? AND holder = ?", name, holder).Error
+}
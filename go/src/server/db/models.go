@@ -11,6 +11,29 @@ type User struct {
 
 	Username string
 	Password string
+
+	// Optional, for password recovery and notifications.
+	Email string
+
+	// Hides the username on public pages, shown as "anonymous" instead.
+	Anonymous bool
+
+	// Shadow match games of this user compared with another user's, and
+	// how many of them had a different result.
+	ShadowChecks        int
+	ShadowDisagreements int
+}
+
+// PasswordReset is a single-use token emailed to a user to set a new
+// password.  Only the sha256 of the token is stored.
+type PasswordReset struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	UserID    uint
+	TokenHash string `gorm:"unique_index"`
+	ExpiresAt time.Time
+	Used      bool
 }
 
 type TrainingRun struct {
@@ -23,6 +46,70 @@ type TrainingRun struct {
 	Description     string
 	TrainParameters string
 	Active          bool
+
+	// Relative share of next_game assignments among the active runs.
+	Weight float64 `gorm:"default:1"`
+
+	// Games expected per network before the next one, for the front page
+	// progress bar.
+	GamesTarget int `gorm:"default:40000"`
+
+	// Optional path to a file of opening lines (one per line, in long
+	// algebraic notation) that selfplay games are started from.
+	OpeningBook string
+
+	// How gating matches of concurrently uploaded candidates are run: ""
+	// (in parallel), "serialize" (one at a time, in upload order) or
+	// "revalidate" (in parallel, re-matching a passing candidate whose
+	// opponent was replaced meanwhile against the new best).
+	GatingPolicy string
+
+	// Architecture, e.g. "10x128", of BestNetwork when candidates of other
+	// architectures are gated on tracks of their own, see
+	// ArchitectureTrack.  Empty when all candidates are gated against
+	// BestNetwork.
+	PrimaryArchitecture string
+	Tracks              []ArchitectureTrack
+}
+
+// ArchitectureTrack is the best network of a training run among the
+// networks of one architecture other than the primary one.  Selfplay is
+// only served from the primary track, the others just run gating matches.
+type ArchitectureTrack struct {
+	gorm.Model
+
+	TrainingRunID uint
+	Architecture  string
+	BestNetwork   Network
+	BestNetworkID uint
+}
+
+// TrainParametersChange records an edit of TrainingRun.TrainParameters, so
+// anomalies in the data can be traced back to parameter changes.
+type TrainParametersChange struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	TrainingRunID uint `gorm:"index"`
+
+	OldParameters string
+	NewParameters string
+	ChangedBy     string
+}
+
+// MatchParametersChange records an edit of a running Match's Parameters.
+// Games up to LastGameID were assigned with OldParameters, so results from
+// before and after the change can be told apart.
+type MatchParametersChange struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	MatchID uint `gorm:"index"`
+
+	OldParameters string
+	NewParameters string
+	LastGameID    uint64
+	ChangedBy     string
 }
 
 type Network struct {
@@ -34,23 +121,50 @@ type Network struct {
 	Sha  string
 	Path string
 
+	// Size and sha256 of the stored (compressed) file, for mirrors.
+	FileSize     int64
+	FileChecksum string
+
+	// The protobuf variant converted on upload, empty when conversion is
+	// disabled or failed.
+	ProtoPath     string
+	ProtoSize     int64
+	ProtoChecksum string
+
+	// Outcome of the last periodic check of the stored files against the
+	// hashes above, VerifyError is empty if they matched.
+	VerifiedAt  *time.Time
+	VerifyError string
+
 	Layers  int
 	Filters int
 
 	// Cached here, as expensive to do COUNT(*) on Postgresql
 	GamesPlayed int
 
+	// Selfplay outcome counters, only covering games uploaded with metadata.
+	WhiteWins int
+	BlackWins int
+	Draws     int
+	Resigns   int
+	Plies     int64
+
 	Elo float64
+
+	// Comma separated labels, e.g. "lr-drop", and free form notes of what
+	// is known about the network.
+	Tags  string
+	Notes string
 }
 
 type Match struct {
 	gorm.Model
 
-	TrainingRunID uint
+	TrainingRunID uint `gorm:"index"`
 	Parameters    string
 
 	Candidate     Network
-	CandidateID   uint
+	CandidateID   uint `gorm:"index"`
 	CurrentBest   Network
 	CurrentBestID uint
 
@@ -66,11 +180,87 @@ type Match struct {
 
 	// If true, this is not a promotion match
 	TestOnly bool
+
+	// Architecture track the candidate is gated on, see
+	// TrainingRun.PrimaryArchitecture.
+	Architecture string
+
+	// Clients are asked to also upload the training data of the games,
+	// see MatchGame.TrainingDataPath.
+	TrainingData bool
+
+	// Set for matches created as part of a parameter sweep.
+	SweepID uint `gorm:"index"`
+	// Set for the pairings of a tournament.
+	TournamentID uint `gorm:"index"`
+
+	// Set when the match data turned out to be bad and the promotion it
+	// caused was rolled back.
+	Invalidated bool
+
+	// For re-validation matches, the match the candidate originally passed.
+	RevalidationOf uint
+
+	// Set with Done when the match was abandoned without a result, see
+	// cancelStaleMatches.
+	Cancelled bool
+
+	// Chance the candidate is the stronger network, as of the final score.
+	LikelihoodOfSuperiority float64
+}
+
+// PromotionEvent records a change of TrainingRun.BestNetworkID.
+type PromotionEvent struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	TrainingRunID     uint `gorm:"index"`
+	NetworkID         uint
+	PreviousNetworkID uint
+	// The match that caused the promotion, or was invalidated by a rollback.
+	MatchID uint
+	// Elo of NetworkID at the time, as shown on the networks page.
+	Elo float64
+
+	Rollback  bool
+	Reason    string
+	CreatedBy string
+}
+
+// Sweep groups TestOnly matches between the same pair of networks that only
+// differ in engine parameters.
+type Sweep struct {
+	gorm.Model
+
+	TrainingRunID uint
+	CandidateID   uint
+	CurrentBestID uint
+
+	Description string
+	CreatedBy   string
+}
+
+// Tournament groups the TestOnly matches of a gauntlet or round-robin
+// between several networks.
+type Tournament struct {
+	gorm.Model
+
+	TrainingRunID uint
+	// "gauntlet" (the first network plays all others) or "round_robin".
+	Format string
+
+	Description string
+	CreatedBy   string
 }
 
 type MatchGame struct {
-	ID        uint64 `gorm:"primary_key"`
+	ID uint64 `gorm:"primary_key"`
+	// When the game was assigned.
 	CreatedAt time.Time
+	// When the client started playing, only known from clients reporting
+	// the time they spent on it, and when the result came in.
+	StartedAt   *time.Time
+	CompletedAt *time.Time
 
 	User    User
 	UserID  uint
@@ -83,7 +273,32 @@ type MatchGame struct {
 	Done    bool
 	Flip    bool
 
+	// Excluded from the match score, see TrainingGame.Excluded.
+	Excluded bool
+	// The reported result disagreed with the uploaded PGN, and the game
+	// was kept out of the match score.
+	ResultMismatch bool
+
+	// Set while this game waits for a shadow duplicate to be assigned to
+	// another user.
+	ShadowWanted bool
+	// For shadow duplicates, the game repeated.  Their results are only
+	// compared with the original, never counted in the match score.
+	ShadowOf uint64 `gorm:"index"`
+
+	// As reported, and split into its numbers, which are 0 if it doesn't
+	// parse.
 	EngineVersion string
+	EngineMajor   int `gorm:"index:idx_match_games_engine"`
+	EngineMinor   int `gorm:"index:idx_match_games_engine"`
+	EnginePatch   int `gorm:"index:idx_match_games_engine"`
+	// next_game response features the client was assigned the game with,
+	// see clientFeatures.
+	Features string
+
+	// Training data of the game, for matches collecting it.  Kept apart
+	// from the selfplay games, so training can choose whether to use it.
+	TrainingDataPath string
 }
 
 type TrainingGame struct {
@@ -100,8 +315,173 @@ type TrainingGame struct {
 	Version   uint
 	Path      string
 	Compacted bool
+	// Of the decompressed training data, empty if it couldn't be read.
+	// Unique per training run, see SetupDB.
+	Sha256 string
+
+	// Set once the .gz and pgn have been copied to object storage.
+	Replicated         bool `gorm:"index"`
+	ReplicationRetries int
+
+	// Game metadata reported by the client.  Plies is 0 when the client
+	// didn't send any, in which case Result and Resigned are meaningless.
+	Result   int
+	Plies    int
+	Resigned bool
+	// Seconds the client spent generating the game, 0 if not reported.
+	TimeSpent int
+
+	// Opening line the game was started from, if the run uses a book.
+	Opening string
+
+	// Reported by the client: "cpu" or "opencl", and the OS, architecture
+	// and device.  Empty for older clients.
+	Backend string
+	System  string
+
+	// Salted hash of the IP address the game was uploaded from, empty if
+	// not recorded.
+	OriginHash string `gorm:"index"`
+	// Salted hash of the AS number of that address, empty if not known.
+	OriginAsnHash string
+
+	// Played with a network too many promotions behind the run's best.
+	Stale bool
+
+	// Bad data (broken engine release, cheating) excluded from counts,
+	// leaderboards and compaction, but kept for reference.
+	Excluded bool `gorm:"index"`
 
+	// As reported, and split into its numbers, which are 0 if it doesn't
+	// parse.
 	EngineVersion string
+	EngineMajor   int `gorm:"index:idx_training_games_engine"`
+	EngineMinor   int `gorm:"index:idx_training_games_engine"`
+	EnginePatch   int `gorm:"index:idx_training_games_engine"`
+}
+
+// OpeningAssignment records the opening line a selfplay assignment was
+// started from, so uploads name the assignment rather than the line.
+type OpeningAssignment struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	UserID        uint
+	TrainingRunID uint
+	Opening       string
+}
+
+// ResignStat aggregates, per network and resign threshold (in percent), the
+// played out selfplay games that would have been resigned, and how many of
+// those wrongly.  Unique per network and threshold, see SetupDB.
+type ResignStat struct {
+	ID uint `gorm:"primary_key"`
+
+	NetworkID uint
+	Threshold int
+
+	Games          int
+	Resigns        int
+	FalsePositives int
+}
+
+// ThroughputHour counts the training games accepted and match games played
+// for a training run in the hour starting at Hour.
+type ThroughputHour struct {
+	ID uint `gorm:"primary_key"`
+
+	TrainingRunID uint
+	Hour          time.Time
+
+	TrainingGames int
+	MatchGames    int
+}
+
+// TrainingChunk is an archive of games written by compaction, for the
+// training pipeline to claim.  ClaimID is 0 while unclaimed.
+type TrainingChunk struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	TrainingRunID uint `gorm:"index"`
+	FirstGameID   uint64
+	LastGameID    uint64
+	// Games in the archive, excluded ones are left out.
+	Games int
+	URL   string
+
+	ClaimID uint `gorm:"index"`
+}
+
+// TrainingClaim is a batch of TrainingChunks claimed for a training step.
+// Once the step is done it is consumed, recording the network it produced.
+// Chunks of claims not consumed by ExpiresAt can be claimed again.
+type TrainingClaim struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	TrainingRunID uint
+	ClaimedBy     string
+	ExpiresAt     time.Time
+
+	ConsumedAt *time.Time
+	NetworkSha string `gorm:"index"`
+}
+
+// GamesWebhook tracks the new games webhook of a training run since its
+// latest network: the webhook fired Fired times, the last time at LastGameID.
+type GamesWebhook struct {
+	TrainingRunID uint `gorm:"primary_key"`
+	UpdatedAt     time.Time
+
+	NetworkID  uint
+	Fired      int
+	LastGameID uint64
+}
+
+// SpotCheck records the server side replay of a few positions of a training
+// game, and how many of them differed from the uploaded probabilities.
+type SpotCheck struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	TrainingGameID uint64 `gorm:"index"`
+	UserID         uint   `gorm:"index"`
+	Version        uint
+	EngineVersion  string
+
+	Positions     int
+	Discrepancies int
+	// Largest total variation distance between the uploaded and replayed
+	// probabilities of a position.
+	MaxDistance float64
+}
+
+// ReliabilityEvent records something a user's client got wrong, counted
+// against their reliability score.
+type ReliabilityEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+
+	UserID uint `gorm:"index"`
+	// "upload_rejected", "invalid_pgn", "result_mismatch",
+	// "shadow_disagreement" or "crash".
+	Kind   string
+	Detail string
+}
+
+// EngineVersionRule explicitly allows or denies a single engine version,
+// overriding the MinEngineVersion check.
+type EngineVersionRule struct {
+	gorm.Model
+
+	Version string `gorm:"unique_index"`
+	// Version split into its numbers, which rules are looked up by.
+	EngineMajor int `gorm:"index:idx_engine_version_rules_engine"`
+	EngineMinor int `gorm:"index:idx_engine_version_rules_engine"`
+	EnginePatch int `gorm:"index:idx_engine_version_rules_engine"`
+	Denied      bool
+	Reason      string
 }
 
 type ServerData struct {
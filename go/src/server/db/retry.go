@@ -0,0 +1,130 @@
+package db
+
+import (
+	"database/sql/driver"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const (
+	// Transient errors are retried this many times, backing off from
+	// retryBackoff.
+	maxRetries   = 3
+	retryBackoff = 100 * time.Millisecond
+
+	healthCheckInterval = 10 * time.Second
+)
+
+// Set while the last health check failed.
+var unhealthy int32
+
+// IsTransient reports whether err is worth retrying: serialization failures
+// and deadlocks, or a connection lost e.g. to a Postgres restart.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, e := range errs {
+			if IsTransient(e) {
+				return true
+			}
+		}
+		return false
+	}
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch {
+		case pqErr.Code.Class() == "08", pqErr.Code.Class() == "40":
+			// Connection exceptions, serialization failures and deadlocks.
+			return true
+		case pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03":
+			// Server shutting down, or not accepting connections yet.
+			return true
+		}
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset by peer") || strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection refused")
+}
+
+// Retry runs fn until it succeeds, fails with an error that isn't transient,
+// or runs out of attempts.  fn must be safe to run again: a read, or a whole
+// transaction.  A single write isn't, as it may have been applied before the
+// connection was lost.
+func Retry(fn func() error) error {
+	backoff := retryBackoff
+	err := fn()
+	for i := 0; i < maxRetries && IsTransient(err); i++ {
+		log.Printf("Retrying after transient database error: %v", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// Healthy reports whether the last health check reached the database.
+func Healthy() bool {
+	return atomic.LoadInt32(&unhealthy) == 0
+}
+
+// StartHealthCheck pings the database, and any read replicas, periodically.
+// When that fails, idle connections are dropped, so the pool reconnects once
+// Postgres is back instead of handing out dead connections.
+func StartHealthCheck() {
+	sqlDB := db.DB()
+	go func() {
+		for {
+			time.Sleep(healthCheckInterval)
+			err := sqlDB.Ping()
+			if err != nil {
+				if atomic.SwapInt32(&unhealthy, 1) == 0 {
+					log.Printf("Database health check failed: %v", err)
+				}
+				sqlDB.SetMaxIdleConns(0)
+				sqlDB.SetMaxIdleConns(maxIdleConns())
+				continue
+			}
+			if atomic.SwapInt32(&unhealthy, 0) == 1 {
+				log.Println("Database connection restored")
+			}
+		}
+	}()
+
+	for i := range replicas {
+		go checkReplica(i)
+	}
+}
+
+// Takes a replica out of GetReadDB while it can't be reached.
+func checkReplica(i int) {
+	sqlDB := replicas[i].DB()
+	for {
+		time.Sleep(healthCheckInterval)
+		err := sqlDB.Ping()
+		if err != nil {
+			if atomic.SwapInt32(&replicaHealthy[i], 0) == 1 {
+				log.Printf("Read replica %d health check failed: %v", i, err)
+			}
+			sqlDB.SetMaxIdleConns(0)
+			sqlDB.SetMaxIdleConns(maxIdleConns())
+			continue
+		}
+		if atomic.SwapInt32(&replicaHealthy[i], 1) == 0 {
+			log.Printf("Read replica %d restored", i)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"server/config"
+	"server/db"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Directories uploads are written to, which may be on separate volumes.
+var uploadVolumes = []string{"games", "pgns", "networks"}
+
+// Seconds clients are told to wait when the disk is full.
+const diskFullRetryAfter = 300
+
+// Returns the free space of dir's volume, falling back to the working
+// directory if dir doesn't exist yet.
+func volumeFreeSpace(dir string) (uint64, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		dir = "."
+	}
+	return freeSpace(dir)
+}
+
+// Returns the first upload volume below the configured minimum free space,
+// or "" if there is enough space everywhere (or the check is disabled).
+func lowDiskVolume() string {
+	minFree := config.Config.Limits.MinFreeSpace
+	if minFree <= 0 {
+		return ""
+	}
+	for _, dir := range uploadVolumes {
+		free, err := volumeFreeSpace(dir)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if free < uint64(minFree) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Refuses uploads while the disk is nearly full, with a status clients back
+// off on, instead of failing halfway through saving the upload.
+func requireDiskSpace(c *gin.Context) {
+	if dir := lowDiskVolume(); len(dir) > 0 {
+		log.Printf("Refusing upload, low disk space for %s", dir)
+		c.Header("Retry-After", strconv.Itoa(diskFullRetryAfter))
+		uploadUnavailable(c, http.StatusInsufficientStorage, "disk_full", "Server full, retry later")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func healthz(c *gin.Context) {
+	disk := gin.H{}
+	for _, dir := range uploadVolumes {
+		free, err := volumeFreeSpace(dir)
+		if err != nil {
+			disk[dir] = nil
+			continue
+		}
+		disk[dir] = free
+	}
+
+	status := http.StatusOK
+	result := gin.H{
+		"status":         "ok",
+		"disk_free":      disk,
+		"min_free_space": config.Config.Limits.MinFreeSpace,
+	}
+	if dir := lowDiskVolume(); len(dir) > 0 {
+		status = http.StatusServiceUnavailable
+		result["status"] = fmt.Sprintf("low disk space for %s", dir)
+	}
+	if !db.Healthy() {
+		status = http.StatusServiceUnavailable
+		result["status"] = "database unreachable"
+	}
+	c.JSON(status, result)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+	requestIDKey    = "request_id"
+)
+
+// Request ids passed in by a proxy in front of the server are kept if they
+// look like one.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Body of every error response.
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// Tags each request with an id, returned in the X-Request-Id header and in
+// error responses, and logged with server errors, so a failure a user
+// reports can be found in the logs.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			log.Println(err)
+		}
+		id = hex.EncodeToString(raw)
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+func respondError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, errorResponse{Code: code, Message: message, RequestID: c.GetString(requestIDKey)})
+}
+
+// Logs err, which the client isn't shown, and responds with a 500.
+func internalError(c *gin.Context, err error) {
+	log.Printf("Request %s: %s", c.GetString(requestIDKey), strings.TrimSpace(err.Error()))
+	respondError(c, http.StatusInternalServerError, "internal_error", "Internal error")
+}
+
+// Responds to err, a *clientError refusing the request or else a server
+// error.
+func requestFailed(c *gin.Context, err error) {
+	if e, ok := err.(*clientError); ok {
+		log.Println(strings.TrimSpace(e.message))
+		respondError(c, http.StatusBadRequest, e.code, e.message)
+		return
+	}
+	internalError(c, err)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/config"
+	"server/db"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A validated game upload, waiting to be persisted.
+type gameUpload struct {
+	game   db.TrainingGame
+	data   []byte
+	pgn    string
+	resign []resignSample
+	// The resign_analysis field resign was parsed from, and the spool file
+	// of a queued upload.
+	resignAnalysis string
+	spoolPath      string
+}
+
+// Queued uploads are written here before they are acknowledged, and removed
+// once persisted, so a restart doesn't lose them.
+const ingestionSpoolDir = "ingestion"
+
+// What a spool file holds.
+type spooledUpload struct {
+	Game           db.TrainingGame
+	Data           []byte
+	Pgn            string
+	ResignAnalysis string
+}
+
+func spoolUpload(upload *gameUpload) error {
+	os.MkdirAll(ingestionSpoolDir, os.ModePerm)
+	file, err := ioutil.TempFile(ingestionSpoolDir, "upload-")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(spooledUpload{
+		Game:           upload.game,
+		Data:           upload.data,
+		Pgn:            upload.pgn,
+		ResignAnalysis: upload.resignAnalysis,
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		// Only complete files are recovered.
+		upload.spoolPath = file.Name() + ".json"
+		err = os.Rename(file.Name(), upload.spoolPath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Reads the uploads spooled but not persisted before the last shutdown.
+func spooledUploads() []*gameUpload {
+	paths, _ := filepath.Glob(filepath.Join(ingestionSpoolDir, "*.json"))
+	uploads := []*gameUpload{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		spooled := spooledUpload{}
+		err = json.Unmarshal(data, &spooled)
+		var resign []resignSample
+		if err == nil {
+			resign, err = parseResignAnalysis(spooled.ResignAnalysis)
+		}
+		if err != nil {
+			log.Printf("Removing unreadable spooled upload %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		uploads = append(uploads, &gameUpload{
+			game:           spooled.Game,
+			data:           spooled.Data,
+			pgn:            spooled.Pgn,
+			resign:         resign,
+			resignAnalysis: spooled.ResignAnalysis,
+			spoolPath:      path,
+		})
+	}
+	return uploads
+}
+
+// Uploads accepted but not yet persisted.  This absorbs the burst of uploads
+// that follows a new network, instead of clients timing out on the database.
+var ingestionQueue chan *gameUpload
+
+// Counters for apiIngestionStats, updated atomically.
+var ingestionProcessed, ingestionFailed, ingestionRejected uint64
+
+// Seconds clients are told to wait when the queue is over the threshold.
+const ingestionRetryAfter = 30
+
+var errIngestionBusy = errors.New("Server busy, retry later")
+
+func ingestionEnabled() bool {
+	return config.Config.Ingestion.Workers > 0
+}
+
+func ingestionThreshold() int {
+	threshold := config.Config.Ingestion.BackpressureThreshold
+	if threshold <= 0 || threshold > cap(ingestionQueue) {
+		threshold = cap(ingestionQueue)
+	}
+	return threshold
+}
+
+// Spools and queues upload for persisting, or returns errIngestionBusy if
+// the queue is too deep.
+func enqueueIngestion(upload *gameUpload) error {
+	if len(ingestionQueue) >= ingestionThreshold() {
+		atomic.AddUint64(&ingestionRejected, 1)
+		return errIngestionBusy
+	}
+	err := spoolUpload(upload)
+	if err != nil {
+		return err
+	}
+	select {
+	case ingestionQueue <- upload:
+		return nil
+	default:
+		os.Remove(upload.spoolPath)
+		atomic.AddUint64(&ingestionRejected, 1)
+		return errIngestionBusy
+	}
+}
+
+func ingestionWorker() {
+	for upload := range ingestionQueue {
+		err := persistGame(upload)
+		if err == errDuplicateGame {
+			os.Remove(upload.spoolPath)
+			continue
+		}
+		if err != nil {
+			// The spool file is kept, to try again on the next start.
+			log.Printf("Persisting game from user %d: %v", upload.game.UserID, err)
+			atomic.AddUint64(&ingestionFailed, 1)
+			continue
+		}
+		os.Remove(upload.spoolPath)
+		atomic.AddUint64(&ingestionProcessed, 1)
+	}
+}
+
+// Starts the ingestion workers, if configured.
+func startIngestion() {
+	if !ingestionEnabled() {
+		return
+	}
+	size := config.Config.Ingestion.QueueSize
+	if size < 1 {
+		size = 1000
+	}
+	ingestionQueue = make(chan *gameUpload, size)
+	for i := 0; i < config.Config.Ingestion.Workers; i++ {
+		go ingestionWorker()
+	}
+
+	// Listed before any new uploads are spooled.
+	spooled := spooledUploads()
+	if len(spooled) > 0 {
+		log.Printf("Requeueing %d spooled uploads", len(spooled))
+		go func() {
+			for _, upload := range spooled {
+				ingestionQueue <- upload
+			}
+		}()
+	}
+}
+
+func apiIngestionStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":   ingestionEnabled(),
+		"depth":     len(ingestionQueue),
+		"capacity":  cap(ingestionQueue),
+		"threshold": ingestionThreshold(),
+		"workers":   config.Config.Ingestion.Workers,
+		"processed": atomic.LoadUint64(&ingestionProcessed),
+		"failed":    atomic.LoadUint64(&ingestionFailed),
+		"rejected":  atomic.LoadUint64(&ingestionRejected),
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"server/config"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMultipartMemory = 32 << 20 // 32 MiB
+	defaultMaxNetworkSize  = 128 << 20
+	defaultMaxGameSize     = 4 << 20
+	defaultMaxPgnLength    = 1 << 20
+
+	// Allowance for the non-file form fields of an upload.
+	formOverhead = 64 << 10
+)
+
+func limitOrDefault(limit int64, def int64) int64 {
+	if limit <= 0 {
+		return def
+	}
+	return limit
+}
+
+func multipartMemory() int64 {
+	return limitOrDefault(config.Config.Limits.MultipartMemory, defaultMultipartMemory)
+}
+
+func maxNetworkSize() int64 {
+	return limitOrDefault(config.Config.Limits.MaxNetworkSize, defaultMaxNetworkSize)
+}
+
+func maxGameSize() int64 {
+	return limitOrDefault(config.Config.Limits.MaxGameSize, defaultMaxGameSize)
+}
+
+func maxPgnLength() int {
+	return int(limitOrDefault(int64(config.Config.Limits.MaxPgnLength), defaultMaxPgnLength))
+}
+
+// Rejects request bodies over limit bytes before any of the body is read.
+// Uploads must declare their length up front, since a chunked body could
+// only be measured by reading it; MaxBytesReader still guards against a
+// client sending more than it declared.
+func limitBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength < 0 {
+			// Every released client sets it, so keep the upload for an
+			// updated client rather than dropping it.
+			respondUpload(c, http.StatusLengthRequired, uploadResponse{Status: "rejected", Code: "length_required", Message: "Request must set Content-Length", Action: uploadActionUpgrade})
+			c.Abort()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			uploadRejected(c, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Request body too large, limit is %d bytes", limit))
+			c.Abort()
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+var uploadsInFlight = struct {
+	sync.Mutex
+	users map[string]int
+}{users: make(map[string]int)}
+
+// Caps the uploads a single user may have in flight, so one account running
+// a large farm can't tie up all the server's connections.
+func limitConcurrentUploads(c *gin.Context) {
+	limit := config.Config.Limits.MaxConcurrentUploads
+	username := c.PostForm("user")
+	if limit <= 0 || len(username) == 0 {
+		c.Next()
+		return
+	}
+
+	uploadsInFlight.Lock()
+	if uploadsInFlight.users[username] >= limit {
+		uploadsInFlight.Unlock()
+		uploadUnavailable(c, http.StatusTooManyRequests, "too_many_uploads", fmt.Sprintf("Too many concurrent uploads, limit is %d", limit))
+		c.Abort()
+		return
+	}
+	uploadsInFlight.users[username]++
+	uploadsInFlight.Unlock()
+
+	defer func() {
+		uploadsInFlight.Lock()
+		defer uploadsInFlight.Unlock()
+		uploadsInFlight.users[username]--
+		if uploadsInFlight.users[username] == 0 {
+			delete(uploadsInFlight.users, username)
+		}
+	}()
+	c.Next()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/json"
@@ -10,6 +11,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -17,88 +19,384 @@ import (
 	"path/filepath"
 	"server/config"
 	"server/db"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"github.com/Tilps/chess"
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-gonic/gin"
 	"github.com/hashicorp/go-version"
+	"github.com/jinzhu/gorm"
+
+	"client/http"
 )
 
+// Authenticates the user of a client request.  Unknown users are only
+// created when the client asks with allow_create, so a mistyped username
+// doesn't quietly start a new account.
 func checkUser(c *gin.Context) (*db.User, uint64, error) {
-	if len(c.PostForm("user")) == 0 {
-		return nil, 0, errors.New("No user supplied")
+	username := c.PostForm("user")
+	if len(username) == 0 {
+		return nil, 0, &clientError{"invalid_user", "No user supplied", uploadActionStop}
 	}
-	if len(c.PostForm("user")) > 32 {
-		return nil, 0, errors.New("Username too long")
+	if len(username) > 32 {
+		return nil, 0, &clientError{"invalid_user", "Username too long", uploadActionStop}
 	}
 
-	user := &db.User{
-		Password: c.PostForm("password"),
+	user := &db.User{}
+	err := db.Retry(func() error {
+		return db.GetDB().Where("username = ?", username).First(user).Error
+	})
+	if err == gorm.ErrRecordNotFound {
+		if c.PostForm("allow_create") != "1" {
+			return nil, 0, &clientError{"unknown_user", fmt.Sprintf("Unknown user %s, register first or let the client create the account", username), uploadActionStop}
+		}
+		user, err = createUser(username, c.PostForm("password"))
 	}
-	err := db.GetDB().Where(db.User{Username: c.PostForm("user")}).FirstOrCreate(&user).Error
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// Ensure passwords match
 	if user.Password != c.PostForm("password") {
-		return nil, 0, errors.New("Incorrect password")
+		return nil, 0, &clientError{"wrong_password", fmt.Sprintf("Wrong password for user %s", username), uploadActionStop}
 	}
 
 	version, err := strconv.ParseUint(c.PostForm("version"), 10, 64)
 	if err != nil {
-		return nil, 0, errors.New("Invalid version")
+		return nil, 0, &clientError{"invalid_version", "Invalid version", uploadActionUpgrade}
 	}
 	if version < config.Config.Clients.MinClientVersion {
 		log.Printf("Rejecting old game from %s, version %d\n", user.Username, version)
-		return nil, 0, errors.New("you must upgrade to a newer version")
+		return nil, 0, unsupportedVersionError(version)
+	}
+	deadline, deprecated := clientDeprecation(version)
+	if deprecated && !time.Now().Before(deadline) {
+		log.Printf("Rejecting deprecated client of %s, version %d\n", user.Username, version)
+		return nil, 0, unsupportedVersionError(version)
 	}
 
 	return user, version, nil
 }
 
+// Creates an account for a client.  If a concurrent request of the same
+// client got there first, returns the account it created.
+func createUser(username string, password string) (*db.User, error) {
+	err := validateRegistration(username, password, "")
+	if err != nil {
+		return nil, &clientError{"invalid_user", err.Error(), uploadActionStop}
+	}
+	user := &db.User{Username: username, Password: password}
+	err = db.GetDB().Create(user).Error
+	if err != nil && isUsernameTaken(err) {
+		user = &db.User{}
+		err = db.GetDB().Where("username = ?", username).First(user).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Created user %s\n", username)
+	return user, nil
+}
+
+// Reports whether err is a violation of the unique index on usernames.
+func isUsernameTaken(err error) bool {
+	return strings.Contains(err.Error(), "idx_users_username")
+}
+
+func unsupportedVersionError(version uint64) error {
+	msg := fmt.Sprintf("Client version %d is no longer supported, please download the latest client", version)
+	if len(config.Config.Clients.DownloadURL) > 0 {
+		msg += " from " + config.Config.Clients.DownloadURL
+	}
+	return &clientError{"unsupported_client", msg, uploadActionUpgrade}
+}
+
+// Returns when a deprecated client version stops being accepted.
+func clientDeprecation(version uint64) (time.Time, bool) {
+	if version >= config.Config.Clients.DeprecatedBefore {
+		return time.Time{}, false
+	}
+	deadline, err := time.Parse(time.RFC3339, config.Config.Clients.DeprecationDeadline)
+	if err != nil {
+		log.Printf("Invalid deprecation deadline %q: %v", config.Config.Clients.DeprecationDeadline, err)
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// The warning next_game responses carry for clients that will be rejected
+// soon, nil for up to date ones.
+func clientVersionWarning(version uint64) gin.H {
+	deadline, deprecated := clientDeprecation(version)
+	if !deprecated {
+		return nil
+	}
+	return gin.H{
+		"message":     fmt.Sprintf("Client version %d will stop working on %s, please download the latest client", version, deadline.UTC().Format("2006-01-02 15:04 MST")),
+		"deadline":    deadline.UTC(),
+		"downloadUrl": config.Config.Clients.DownloadURL,
+	}
+}
+
+type trainParameterStage struct {
+	Games  int
+	Params []string
+}
+
+// TrainParameters is either a plain JSON array of engine arguments, or a
+// schedule of stages keyed on the number of games the current network has
+// played so far, eg. [{"games": 0, "params": [...]}, {"games": 100000, "params": [...]}].
+// The latest stage whose games threshold has been reached applies.
+func resolveTrainParameters(trainParameters string, gamesPlayed int) (string, error) {
+	if !strings.HasPrefix(strings.TrimLeft(trainParameters, " \t\n["), "{") {
+		return trainParameters, nil
+	}
+
+	var stages []trainParameterStage
+	err := json.Unmarshal([]byte(trainParameters), &stages)
+	if err != nil {
+		return "", err
+	}
+
+	var params []string
+	best := -1
+	for _, stage := range stages {
+		if stage.Games <= gamesPlayed && stage.Games > best {
+			best = stage.Games
+			params = stage.Params
+		}
+	}
+	if params == nil {
+		return "", errors.New("No train parameter stage applies")
+	}
+
+	resolved, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(resolved), nil
+}
+
+// Checks that parameters are either a plain array or a schedule of stages,
+// of engine flags that validateEngineParameters accepts.
+func validateTrainParameters(trainParameters string) error {
+	var params []string
+	if json.Unmarshal([]byte(trainParameters), &params) == nil {
+		return validateEngineParameters(params)
+	}
+	var stages []trainParameterStage
+	err := json.Unmarshal([]byte(trainParameters), &stages)
+	if err != nil {
+		return errors.New("Parameters must be a JSON array of strings or a schedule")
+	}
+	if len(stages) == 0 {
+		return errors.New("Schedule has no stages")
+	}
+	for _, stage := range stages {
+		err = validateEngineParameters(stage.Params)
+		if err != nil {
+			return fmt.Errorf("Stage from %d games: %v", stage.Games, err)
+		}
+	}
+	return nil
+}
+
+// Picks one of the active runs at random, in proportion to their weights.
+func pickTrainingRun(trainingRuns []db.TrainingRun) db.TrainingRun {
+	total := 0.0
+	for _, trainingRun := range trainingRuns {
+		total += math.Max(trainingRun.Weight, 0.0)
+	}
+	if total <= 0.0 {
+		return trainingRuns[0]
+	}
+	r := rand.Float64() * total
+	for _, trainingRun := range trainingRuns {
+		r -= math.Max(trainingRun.Weight, 0.0)
+		if r < 0.0 {
+			return trainingRun
+		}
+	}
+	return trainingRuns[len(trainingRuns)-1]
+}
+
+// Keeps the runs a client asked to contribute to, given as comma separated
+// IDs, or all of them if it didn't ask.
+func filterTrainingRuns(trainingRuns []db.TrainingRun, ids string) ([]db.TrainingRun, error) {
+	if len(ids) == 0 {
+		return trainingRuns, nil
+	}
+	wanted := map[uint]bool{}
+	for _, field := range strings.Split(ids, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid training_ids %q", ids)
+		}
+		wanted[uint(id)] = true
+	}
+	filtered := []db.TrainingRun{}
+	for _, trainingRun := range trainingRuns {
+		if wanted[trainingRun.ID] {
+			filtered = append(filtered, trainingRun)
+		}
+	}
+	return filtered, nil
+}
+
+// Optional parts of next_game responses, which clients list in the features
+// parameter when they understand them.
+const (
+	featureConfig       = "config"
+	featureWarning      = "warning"
+	featureOpening      = "opening"
+	featureTrainingData = "training_data"
+)
+
+var knownFeatures = []string{featureConfig, featureOpening, featureTrainingData, featureWarning}
+
+// What clients from before the features parameter get.  Features added since
+// are only sent to clients that ask for them.
+const legacyFeatures = featureConfig + "," + featureTrainingData
+
+// Returns the features to include in a client's next_game responses, and
+// the same as a sorted comma separated list to record.  Clients that don't
+// list any get legacyFeatures.
+func clientFeatures(requested string) (map[string]bool, string) {
+	if len(requested) == 0 {
+		requested = legacyFeatures
+	}
+	wanted := map[string]bool{}
+	for _, feature := range strings.Split(requested, ",") {
+		wanted[strings.TrimSpace(feature)] = true
+	}
+	features := map[string]bool{}
+	names := []string{}
+	for _, feature := range knownFeatures {
+		if wanted[feature] {
+			features[feature] = true
+			names = append(names, feature)
+		}
+	}
+	return features, strings.Join(names, ",")
+}
+
 func nextGame(c *gin.Context) {
-	user, _, err := checkUser(c)
+	user, version, err := checkUser(c)
 	if err != nil {
-		log.Println(strings.TrimSpace(err.Error()))
-		c.String(http.StatusBadRequest, err.Error())
+		requestFailed(c, err)
 		return
 	}
+	features, negotiated := clientFeatures(c.PostForm("features"))
+	var warning gin.H
+	if features[featureWarning] {
+		warning = clientVersionWarning(version)
+	}
 
-	trainingRun := db.TrainingRun{
-		Active: true,
+	var trainingRuns []db.TrainingRun
+	err = db.Retry(func() error {
+		return db.GetDB().Where(&db.TrainingRun{Active: true}).Order("id").Find(&trainingRuns).Error
+	})
+	if err != nil {
+		internalError(c, err)
+		return
 	}
-	// TODO(gary): Only really supports one training run right now...
-	err = db.GetDB().Where(&trainingRun).First(&trainingRun).Error
+	trainingRuns, err = filterTrainingRuns(trainingRuns, c.PostForm("training_ids"))
 	if err != nil {
-		log.Println(err)
-		c.String(http.StatusBadRequest, "Invalid training run")
+		respondError(c, http.StatusBadRequest, "invalid_training_run", err.Error())
 		return
 	}
+	if len(trainingRuns) == 0 {
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+	trainingRun := pickTrainingRun(trainingRuns)
 
 	network := db.Network{}
 	err = db.GetDB().Where("id = ?", trainingRun.BestNetworkID).First(&network).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error 1")
+		internalError(c, err)
 		return
 	}
 
 	if user != nil {
-		var match []db.Match
-		err = db.GetDB().Preload("Candidate").Where("done=false").Limit(1).Find(&match).Error
+		var matches []db.Match
+		err = db.GetDB().Preload("Candidate").Preload("CurrentBest").
+			Where("done=false AND training_run_id = ? AND games_created < game_cap + ?", trainingRun.ID, config.Config.Matches.AssignmentBuffer).
+			Order("id").Find(&matches).Error
 		if err != nil {
-			log.Println(err)
-			c.String(500, "Internal error 2")
+			internalError(c, err)
 			return
 		}
-		if len(match) > 0 {
+		if trainingRun.GatingPolicy == gatingSerialize {
+			matches, err = serializeGatingMatches(&trainingRun, matches)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+		}
+		trust := trustNew
+		if len(matches) > 0 || config.Config.Matches.ShadowRate > 0 {
+			trust, err = userTrust(user)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+		}
+		if trust >= trustEstablished && config.Config.Matches.ShadowRate > 0 {
+			shadow, err := assignShadowGame(user, &trainingRun, negotiated)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if shadow != nil {
+				params, err := shadowParameters(shadow.Match.Parameters, shadow.ShadowOf)
+				if err != nil {
+					internalError(c, err)
+					return
+				}
+				result := gin.H{
+					"type":         "match",
+					"trainingId":   trainingRun.ID,
+					"matchGameId":  shadow.ID,
+					"sha":          shadow.Match.CurrentBest.Sha,
+					"candidateSha": shadow.Match.Candidate.Sha,
+					"params":       params,
+					"flip":         shadow.Flip,
+				}
+				if warning != nil {
+					result["warning"] = warning
+				}
+				c.JSON(http.StatusOK, result)
+				return
+			}
+		}
+		for _, match := range matches {
+			if trust < trustEstablished || (match.RevalidationOf != 0 && trust < trustTrusted) {
+				continue
+			}
+			if sprtDecision(&match) != 0 {
+				continue
+			}
+			reserved, err := reserveMatchGame(&match)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if !reserved {
+				continue
+			}
+
 			// Return this match
 			matchGame := db.MatchGame{
-				UserID:  user.ID,
-				MatchID: match[0].ID,
+				UserID:       user.ID,
+				MatchID:      match.ID,
+				ShadowWanted: wantShadow(),
+				Features:     negotiated,
 			}
 			err = db.GetDB().Create(&matchGame).Error
 			// Note, this could cause an imbalance of white/black games for a particular match,
@@ -106,33 +404,209 @@ func nextGame(c *gin.Context) {
 			flip := (matchGame.ID & 1) == 1
 			db.GetDB().Model(&matchGame).Update("flip", flip)
 			if err != nil {
-				log.Println(err)
-				c.String(500, "Internal error 3")
+				internalError(c, err)
 				return
 			}
+			params := match.Parameters
+			if matchGame.ShadowWanted {
+				params, err = shadowParameters(params, matchGame.ID)
+				if err != nil {
+					internalError(c, err)
+					return
+				}
+			}
 			result := gin.H{
 				"type":         "match",
+				"trainingId":   trainingRun.ID,
 				"matchGameId":  matchGame.ID,
-				"sha":          network.Sha,
-				"candidateSha": match[0].Candidate.Sha,
-				"params":       match[0].Parameters,
+				"sha":          match.CurrentBest.Sha,
+				"candidateSha": match.Candidate.Sha,
+				"params":       params,
 				"flip":         flip,
 			}
+			if match.TrainingData && features[featureTrainingData] {
+				result["trainingData"] = true
+			}
+			if warning != nil {
+				result["warning"] = warning
+			}
 			c.JSON(http.StatusOK, result)
 			return
 		}
 	}
 
+	params, err := resolveTrainParameters(trainingRun.TrainParameters, network.GamesPlayed)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	settings, err := runConfig(params)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
 	result := gin.H{
 		"type":       "train",
 		"trainingId": trainingRun.ID,
 		"networkId":  trainingRun.BestNetworkID,
 		"sha":        network.Sha,
-		"params":     trainingRun.TrainParameters,
+		"params":     params,
+	}
+	if features[featureConfig] {
+		result["config"] = settings
+	}
+	if warning != nil {
+		result["warning"] = warning
+	}
+	if len(trainingRun.OpeningBook) > 0 && features[featureOpening] {
+		openings, err := loadOpeningBook(trainingRun.OpeningBook)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		assignment := db.OpeningAssignment{
+			UserID:        user.ID,
+			TrainingRunID: trainingRun.ID,
+			Opening:       openings[rand.Intn(len(openings))],
+		}
+		err = db.GetDB().Create(&assignment).Error
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		result["opening"] = assignment.Opening
+		result["openingId"] = assignment.ID
 	}
 	c.JSON(http.StatusOK, result)
 }
 
+const (
+	gatingParallel   = ""
+	gatingSerialize  = "serialize"
+	gatingRevalidate = "revalidate"
+)
+
+// Only keeps the oldest pending gating match of each architecture track (and
+// any TestOnly ones), so candidates are gated one at a time.  The oldest is
+// looked up among all pending matches, not just the assignable ones in
+// matches, so a match waiting on its last games still holds up the next.  A
+// queued match is pointed at the current best before its first game, as that
+// may have changed since the candidate was uploaded.
+func serializeGatingMatches(trainingRun *db.TrainingRun, matches []db.Match) ([]db.Match, error) {
+	var pending []db.Match
+	err := db.GetDB().Select("id, architecture").
+		Where("training_run_id = ? AND done = false AND test_only = false", trainingRun.ID).
+		Order("id").Find(&pending).Error
+	if err != nil {
+		return nil, err
+	}
+	// Keyed by architecture, "" for the primary track.
+	gating := map[string]uint{}
+	for _, match := range pending {
+		track := match.Architecture
+		if isPrimaryTrack(trainingRun, track) {
+			track = ""
+		}
+		if _, ok := gating[track]; !ok {
+			gating[track] = match.ID
+		}
+	}
+
+	result := []db.Match{}
+	for _, match := range matches {
+		if !match.TestOnly {
+			track := match.Architecture
+			if isPrimaryTrack(trainingRun, track) {
+				track = ""
+			}
+			if gating[track] != match.ID {
+				continue
+			}
+			bestID, err := trackBestNetworkID(trainingRun, match.Architecture)
+			if err != nil {
+				return nil, err
+			}
+			if match.GamesCreated == 0 && match.CurrentBestID != bestID {
+				// Not through Model(&match), whose preloaded baseline gorm
+				// would save back over the new one.
+				err := db.GetDB().Model(&db.Match{}).Where("id = ?", match.ID).Update("current_best_id", bestID).Error
+				if err != nil {
+					return nil, err
+				}
+				// The preloaded baseline is what next_game serves.
+				match.CurrentBestID = bestID
+				match.CurrentBest = db.Network{}
+				err = db.GetDB().Where("id = ?", bestID).First(&match.CurrentBest).Error
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		result = append(result, match)
+	}
+	return result, nil
+}
+
+// Counts the games of a match still filling one of its GameCap slots: played
+// and not excluded, or handed out recently enough to still come back.  The
+// argument is the oldest creation time of a live assignment.
+const liveMatchGames = `(SELECT count(*) FROM match_games WHERE match_id = matches.id AND shadow_of = 0
+AND ((done = true AND excluded = false) OR (done = false AND created_at >= ?)))`
+
+// Resets games_created of the pending matches to their live games, releasing
+// the slots of assignments that went stale and of excluded games.  A game
+// reserved but not yet created while this runs is missed, which costs at most
+// an extra game or two.
+func recountMatchSlots() error {
+	return db.GetDB().Exec("UPDATE matches SET games_created = "+liveMatchGames+" WHERE done = false",
+		time.Now().Add(-staleAssignmentAge)).Error
+}
+
+// Claims one game of match, unless GameCap (plus the assignment buffer) games
+// have been handed out already.  Done as a single conditional UPDATE, so
+// concurrent next_game requests can't over-assign.
+func reserveMatchGame(match *db.Match) (bool, error) {
+	result := db.GetDB().Exec("UPDATE matches SET games_created = games_created + 1 WHERE id = ? AND done = false AND games_created < game_cap + ?",
+		match.ID, config.Config.Matches.AssignmentBuffer)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+var openingBooks = struct {
+	sync.Mutex
+	lines map[string][]string
+}{lines: make(map[string][]string)}
+
+// Opening books are read once and cached, keyed by path.
+func loadOpeningBook(path string) ([]string, error) {
+	openingBooks.Lock()
+	defer openingBooks.Unlock()
+
+	if lines, ok := openingBooks.lines[path]; ok {
+		return lines, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("Opening book %s is empty", path)
+	}
+	openingBooks.lines[path] = lines
+	return lines, nil
+}
+
 // Computes SHA256 of gzip compressed file
 func computeSha(httpFile *multipart.FileHeader) (string, error) {
 	h := sha256.New()
@@ -157,6 +631,94 @@ func computeSha(httpFile *multipart.FileHeader) (string, error) {
 	return sha, nil
 }
 
+// Pages are scoped to the run given by the "run" query parameter, defaulting
+// to the primary (lowest id) active run.  Also returns the choices for the
+// run selector.
+func getScopedTrainingRun(c *gin.Context) (*db.TrainingRun, []gin.H, error) {
+	var trainingRuns []db.TrainingRun
+	err := db.GetReadDB().Order("id").Find(&trainingRuns).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var trainingRun *db.TrainingRun
+	if len(c.Query("run")) > 0 {
+		id, err := strconv.ParseUint(c.Query("run"), 10, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range trainingRuns {
+			if trainingRuns[i].ID == uint(id) {
+				trainingRun = &trainingRuns[i]
+			}
+		}
+	} else {
+		for i := range trainingRuns {
+			if trainingRuns[i].Active {
+				trainingRun = &trainingRuns[i]
+				break
+			}
+		}
+		if trainingRun == nil && len(trainingRuns) > 0 {
+			trainingRun = &trainingRuns[0]
+		}
+	}
+	if trainingRun == nil {
+		return nil, nil, errors.New("No such training run")
+	}
+
+	runs := []gin.H{}
+	for _, run := range trainingRuns {
+		runs = append(runs, gin.H{
+			"id":          run.ID,
+			"description": run.Description,
+			"selected":    run.ID == trainingRun.ID,
+		})
+	}
+	return trainingRun, runs, nil
+}
+
+// Computes SHA256 of a file as stored on disk
+func fileChecksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), size, nil
+}
+
+func updateNetworkChecksum(network *db.Network) error {
+	checksum, size, err := fileChecksum(network.Path)
+	if err != nil {
+		return err
+	}
+	return db.GetDB().Model(network).Updates(db.Network{FileSize: size, FileChecksum: checksum}).Error
+}
+
+// Records the checksums of networks uploaded before they were recorded at
+// upload, for the networks manifest.  Run once in the background at startup.
+func backfillNetworkChecksums() {
+	var networks []db.Network
+	err := db.GetDB().Where("file_checksum = '' OR file_checksum IS NULL").Order("id").Find(&networks).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, network := range networks {
+		err = updateNetworkChecksum(&network)
+		if err != nil {
+			log.Printf("Checksumming network %d: %v\n", network.ID, err)
+		}
+	}
+}
+
 func getTrainingRun(trainingID uint) (*db.TrainingRun, error) {
 	var trainingRun db.TrainingRun
 	err := db.GetDB().Where("id = ?", trainingID).First(&trainingRun).Error
@@ -170,15 +732,18 @@ func uploadNetwork(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
 		log.Println(err.Error())
-		c.String(http.StatusBadRequest, "Missing file")
+		respondError(c, http.StatusBadRequest, "missing_file", "Missing file")
+		return
+	}
+	if file.Size > maxNetworkSize() {
+		respondError(c, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Network too large, limit is %d bytes", maxNetworkSize()))
 		return
 	}
 
 	// Compute hash of network
 	sha, err := computeSha(file)
 	if err != nil {
-		log.Println(err.Error())
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 	network := db.Network{
@@ -189,12 +754,11 @@ func uploadNetwork(c *gin.Context) {
 	var networkCount int
 	err = db.GetDB().Model(&network).Where(&network).Count(&networkCount).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 	if networkCount > 0 {
-		c.String(http.StatusBadRequest, "Network already exists")
+		respondError(c, http.StatusConflict, "duplicate_network", "Network already exists")
 		return
 	}
 
@@ -208,14 +772,12 @@ func uploadNetwork(c *gin.Context) {
 	network.Filters = int(filters)
 	err = db.GetDB().Create(&network).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 	err = db.GetDB().Model(&network).Update("path", filepath.Join("networks", network.Sha)).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -223,10 +785,19 @@ func uploadNetwork(c *gin.Context) {
 
 	// Save the file
 	if err := c.SaveUploadedFile(file, network.Path); err != nil {
-		log.Println(err.Error())
-		c.String(500, "Saving file")
+		internalError(c, err)
 		return
 	}
+	err = updateNetworkChecksum(&network)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	// Clients can still download the text format if conversion fails.
+	err = convertNetwork(&network)
+	if err != nil {
+		log.Printf("Converting network %s: %v", network.Sha, err)
+	}
 
 	// TODO(gary): Make this more generic - upload to s3 for now
 	cmdParams := config.Config.URLs.OnNewNetwork
@@ -240,8 +811,7 @@ func uploadNetwork(c *gin.Context) {
 		cmd := exec.Command(cmdParams[0], cmdParams[1:]...)
 		err = cmd.Run()
 		if err != nil {
-			log.Println(err.Error())
-			c.String(500, "Uploading to s3")
+			internalError(c, err)
 			return
 		}
 	}
@@ -249,82 +819,274 @@ func uploadNetwork(c *gin.Context) {
 	// Create a match to see if this network is better
 	trainingRun, err := getTrainingRun(trainingRunID)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
 	params, err := json.Marshal(config.Config.Matches.Parameters)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
+		return
+	}
+
+	// A candidate of an architecture without a track yet has nothing of its
+	// kind to be gated against, so it starts the track.
+	architecture := networkArchitecture(network.Layers, network.Filters)
+	currentBestID, err := trackBestNetworkID(trainingRun, architecture)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if currentBestID == 0 && !isPrimaryTrack(trainingRun, architecture) {
+		err = setTrackBestNetwork(trainingRun, architecture, network.ID, 0)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		c.String(http.StatusOK, fmt.Sprintf("Network %s uploaded successfully, starting the %s track.", network.Sha, architecture))
 		return
 	}
 
 	match := db.Match{
 		TrainingRunID: trainingRunID,
 		CandidateID:   network.ID,
-		CurrentBestID: trainingRun.BestNetworkID,
+		CurrentBestID: currentBestID,
+		Architecture:  architecture,
 		Done:          false,
 		GameCap:       config.Config.Matches.Games,
 		Parameters:    string(params[:]),
+		TrainingData:  config.Config.Matches.TrainingData,
 	}
 	if c.DefaultPostForm("testonly", "0") == "1" {
 		match.TestOnly = true
 	}
 	err = db.GetDB().Create(&match).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
+	invalidatePages(pageEventNetwork)
 	c.String(http.StatusOK, fmt.Sprintf("Network %s uploaded successfully.", network.Sha))
 }
 
-func checkEngineVersion(engineVersion string) bool {
+// Splits an engine version, e.g. "v0.11.1", into the major, minor and patch
+// numbers it is stored and queried by.  All 0 if it doesn't parse.
+func engineVersionSegments(engineVersion string) (int, int, int) {
 	v, err := version.NewVersion(engineVersion)
 	if err != nil {
-		return false
+		return 0, 0, 0
 	}
+	segments := append(v.Segments(), 0, 0, 0)
+	return segments[0], segments[1], segments[2]
+}
+
+// Narrows q, of a table with engine_major, engine_minor and engine_patch
+// columns, to rows of engineVersion.
+func whereEngineVersion(q *gorm.DB, engineVersion string) *gorm.DB {
+	major, minor, patch := engineVersionSegments(engineVersion)
+	return q.Where("engine_major = ? AND engine_minor = ? AND engine_patch = ?", major, minor, patch)
+}
+
+// Returns an error naming the acceptable versions if engineVersion may not
+// upload games.  Explicit allow/deny rules take precedence over the minimum.
+func checkEngineVersion(engineVersion string) error {
 	target, err := version.NewVersion(config.Config.Clients.MinEngineVersion)
 	if err != nil {
 		log.Println("Invalid comparison version, rejecting all clients!!!")
-		return false
+		return errors.New("Server misconfigured, please try again later")
+	}
+
+	v, err := version.NewVersion(engineVersion)
+	if err == nil {
+		var rules []db.EngineVersionRule
+		err = whereEngineVersion(db.GetDB(), engineVersion).Find(&rules).Error
+		if err != nil {
+			log.Println(err)
+			return errors.New("Internal error")
+		}
+		for _, rule := range rules {
+			// Pre-releases share the numbers of their release.
+			ruleVersion, err := version.NewVersion(rule.Version)
+			if err != nil || !v.Equal(ruleVersion) {
+				continue
+			}
+			if !rule.Denied {
+				return nil
+			}
+			msg := fmt.Sprintf("lczero %s is not accepted: %s. %s", engineVersion, rule.Reason, acceptableVersions())
+			return &clientError{"unsupported_engine", msg, uploadActionUpgrade}
+		}
+		if v.Compare(target) >= 0 {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf("\n\n\n\n\nYou must upgrade to a newer lczero version!!\n%s\n\n\n\n", acceptableVersions())
+	return &clientError{"unsupported_engine", msg, uploadActionUpgrade}
+}
+
+func acceptableVersions() string {
+	var rules []db.EngineVersionRule
+	err := db.GetDB().Order("engine_major, engine_minor, engine_patch").Find(&rules).Error
+	if err != nil {
+		log.Println(err)
+	}
+	denied := []string{}
+	allowed := []string{}
+	for _, rule := range rules {
+		if rule.Denied {
+			denied = append(denied, rule.Version)
+		} else {
+			allowed = append(allowed, rule.Version)
+		}
+	}
+	msg := "Acceptable versions: " + config.Config.Clients.MinEngineVersion + " or newer"
+	if len(denied) > 0 {
+		msg += " except " + strings.Join(denied, ", ")
+	}
+	if len(allowed) > 0 {
+		msg += ", plus " + strings.Join(allowed, ", ")
 	}
-	return v.Compare(target) >= 0
+	return msg + "."
+}
+
+// Cleans up free text reported by clients before it is stored and shown:
+// only printable characters, at most limit of them.
+func sanitizeReported(value string, limit int) string {
+	cleaned := []rune{}
+	for _, r := range strings.TrimSpace(value) {
+		if len(cleaned) >= limit {
+			break
+		}
+		if unicode.IsPrint(r) {
+			cleaned = append(cleaned, r)
+		}
+	}
+	return string(cleaned)
+}
+
+// Older clients don't send any metadata, so all of these fields are optional.
+func parseGameMetadata(c *gin.Context, game *db.TrainingGame) error {
+	plies, err := strconv.ParseUint(c.DefaultPostForm("plies", "0"), 10, 32)
+	if err != nil {
+		return errors.New("Invalid plies")
+	}
+	if plies == 0 {
+		return nil
+	}
+	result, err := strconv.ParseInt(c.PostForm("result"), 10, 32)
+	if err != nil || result < -1 || result > 1 {
+		return errors.New("Invalid result")
+	}
+	timeSpent, err := strconv.ParseUint(c.DefaultPostForm("time_spent", "0"), 10, 32)
+	if err != nil {
+		return errors.New("Invalid time_spent")
+	}
+	game.Plies = int(plies)
+	game.Result = int(result)
+	game.Resigned = c.DefaultPostForm("resigned", "0") == "1"
+	game.TimeSpent = int(timeSpent)
+	return nil
+}
+
+// Fills in the game metadata from the training data itself, for clients that
+// don't send it.  Resignations can't be told apart from the data.
+func extractGameMetadata(game *db.TrainingGame, data []byte) {
+	summary, err := client.ParseTrainingChunk(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Unable to extract metadata from game by user %d: %v", game.UserID, err)
+		return
+	}
+	game.Plies = summary.Plies
+	game.Result = summary.Result
+}
+
+func updateSelfplayStats(game *db.TrainingGame) error {
+	col := ""
+	if game.Result == 0 {
+		col = "draws"
+	} else if game.Result == 1 {
+		col = "white_wins"
+	} else {
+		col = "black_wins"
+	}
+	resigns := 0
+	if game.Resigned {
+		resigns = 1
+	}
+	return db.GetDB().Exec(fmt.Sprintf("UPDATE networks SET %s = %s + 1, resigns = resigns + ?, plies = plies + ? WHERE id = ?", col, col), resigns, game.Plies, game.NetworkID).Error
+}
+
+// Returns how many promotions the run has had since network was created.
+func promotionsSince(network *db.Network) (int, error) {
+	trainingRun, err := getTrainingRun(network.TrainingRunID)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = wherePrimaryTrack(db.GetDB().Model(&db.Match{}), trainingRun).
+		Where("training_run_id = ? AND passed = true AND test_only = false AND candidate_id > ?", network.TrainingRunID, network.ID).
+		Count(&count).Error
+	return count, err
+}
+
+// Applies the stale network policy to game.  Returns an error if the game
+// should be rejected, otherwise flags it as stale when needed.
+func checkStaleNetwork(network *db.Network, game *db.TrainingGame) error {
+	maxPromotions := config.Config.Clients.MaxStalePromotions
+	if maxPromotions <= 0 {
+		return nil
+	}
+	promotions, err := promotionsSince(network)
+	if err != nil {
+		return err
+	}
+	if promotions <= maxPromotions {
+		return nil
+	}
+	if config.Config.Clients.StaleNetworkPolicy == "flag" {
+		game.Stale = true
+		return nil
+	}
+	msg := fmt.Sprintf("Network %d is %d promotions behind, please fetch the current network", network.ID, promotions)
+	return &clientError{"stale_network", msg, uploadActionDrop}
 }
 
 func uploadGame(c *gin.Context) {
 	user, version, err := checkUser(c)
 	if err != nil {
-		log.Println(strings.TrimSpace(err.Error()))
-		c.String(http.StatusBadRequest, err.Error())
+		uploadFailed(c, err)
 		return
 	}
-	if !checkEngineVersion(c.PostForm("engineVersion")) {
-		log.Printf("Rejecting game with old lczero version %s", c.PostForm("engineVersion"))
-		c.String(http.StatusBadRequest, "\n\n\n\n\nYou must upgrade to a newer lczero version!!\n\n\n\n\n")
+	c.Set(reliabilityUserKey, user.ID)
+	err = checkEngineVersion(c.PostForm("engineVersion"))
+	if err != nil {
+		log.Printf("Rejecting game with lczero version %s", c.PostForm("engineVersion"))
+		uploadFailed(c, err)
 		return
 	}
 
 	training_id, err := strconv.ParseUint(c.PostForm("training_id"), 10, 32)
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Invalid training_id")
+		uploadRejected(c, http.StatusBadRequest, "invalid_training_run", "Invalid training_id")
+		return
 	}
 
 	training_run, err := getTrainingRun(uint(training_id))
+	if err == gorm.ErrRecordNotFound {
+		uploadRejected(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		uploadFailed(c, err)
 		return
 	}
 
 	network_id, err := strconv.ParseUint(c.PostForm("network_id"), 10, 32)
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Invalid network_id")
+		uploadRejected(c, http.StatusBadRequest, "invalid_network", "Invalid network_id")
 		return
 	}
 
@@ -332,14 +1094,7 @@ func uploadGame(c *gin.Context) {
 	err = db.GetDB().Where("id = ?", network_id).First(&network).Error
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Invalid network")
-		return
-	}
-
-	err = db.GetDB().Exec("UPDATE networks SET games_played = games_played + 1 WHERE id = ?", network_id).Error
-	if err != nil {
-		log.Println(err)
-		c.String(http.StatusBadRequest, "Internal error")
+		uploadRejected(c, http.StatusBadRequest, "invalid_network", "Invalid network")
 		return
 	}
 
@@ -347,7 +1102,16 @@ func uploadGame(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
 		log.Println(err.Error())
-		c.String(http.StatusBadRequest, "Missing file")
+		uploadRejected(c, http.StatusBadRequest, "missing_file", "Missing file")
+		return
+	}
+	if file.Size > maxGameSize() {
+		uploadRejected(c, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Game too large, limit is %d bytes", maxGameSize()))
+		return
+	}
+	if len(c.PostForm("pgn")) > maxPgnLength() {
+		c.Set(reliabilityKindKey, reliabilityInvalidPgn)
+		uploadRejected(c, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Pgn too long, limit is %d bytes", maxPgnLength()))
 		return
 	}
 
@@ -359,79 +1123,439 @@ func uploadGame(c *gin.Context) {
 		Version:       uint(version),
 		EngineVersion: c.PostForm("engineVersion"),
 	}
-	err = db.GetDB().Create(&game).Error
+	game.EngineMajor, game.EngineMinor, game.EnginePatch = engineVersionSegments(game.EngineVersion)
+	game.Opening, err = assignedOpening(c.PostForm("opening_id"), user, training_run)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	game.Backend = sanitizeReported(c.PostForm("backend"), 16)
+	game.System = sanitizeReported(c.PostForm("system"), 64)
+	game.OriginHash, game.OriginAsnHash = originHashes(c)
+	err = parseGameMetadata(c, &game)
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Internal error")
+		uploadRejected(c, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	err = checkStaleNetwork(&network, &game)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+
+	// The multipart temp file is gone once the request returns, so read it
+	// now in case persisting is deferred to the ingestion queue.
+	data, err := readUploadedFile(file)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	// Resubmissions are acknowledged, so the client moves on, but not counted.
+	game.Sha256 = gameDataSha(data)
+	duplicate, err := isDuplicateGame(&game)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	if duplicate {
+		uploadAccepted(c, http.StatusOK, "duplicate", errDuplicateGame.Error())
 		return
 	}
 
-	err = db.GetDB().Model(&game).Update("path", filepath.Join("games", fmt.Sprintf("run%d/training.%d.gz", training_run.ID, game.ID))).Error
+	if game.Plies == 0 && config.Config.Clients.ExtractMetadata {
+		extractGameMetadata(&game, data)
+	}
+	resign, err := parseResignAnalysis(c.PostForm("resign_analysis"))
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Internal error")
+		uploadRejected(c, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	upload := &gameUpload{game: game, data: data, pgn: c.PostForm("pgn"), resign: resign, resignAnalysis: c.PostForm("resign_analysis")}
+
+	if ingestionEnabled() {
+		err = enqueueIngestion(upload)
+		if err != nil && err != errIngestionBusy {
+			uploadFailed(c, fmt.Errorf("spooling upload: %v", err))
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.Header("Retry-After", strconv.Itoa(ingestionRetryAfter))
+			uploadUnavailable(c, http.StatusServiceUnavailable, "queue_full", err.Error())
+			return
+		}
+		uploadAccepted(c, http.StatusAccepted, "queued", fmt.Sprintf("File %s queued with fields user=%s.", file.Filename, user.Username))
 		return
 	}
 
+	err = persistGame(upload)
+	if err == errDuplicateGame {
+		uploadAccepted(c, http.StatusOK, "duplicate", err.Error())
+		return
+	}
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+
+	uploadAccepted(c, http.StatusOK, "uploaded", fmt.Sprintf("File %s uploaded successfully with fields user=%s.", file.Filename, user.Username))
+}
+
+// Returns the opening line of the selfplay assignment a game was played for,
+// as recorded when it was handed to the user.  Empty if the game wasn't
+// started from an opening.
+func assignedOpening(openingID string, user *db.User, trainingRun *db.TrainingRun) (string, error) {
+	if len(openingID) == 0 {
+		return "", nil
+	}
+	invalid := &clientError{"invalid_metadata", "Invalid opening_id", uploadActionDrop}
+	id, err := strconv.ParseUint(openingID, 10, 32)
+	if err != nil {
+		return "", invalid
+	}
+	assignment := db.OpeningAssignment{}
+	err = db.GetDB().Where("id = ? AND user_id = ? AND training_run_id = ?", id, user.ID, trainingRun.ID).First(&assignment).Error
+	if err == gorm.ErrRecordNotFound {
+		return "", invalid
+	}
+	if err != nil {
+		return "", err
+	}
+	return assignment.Opening, nil
+}
+
+func readUploadedFile(httpFile *multipart.FileHeader) ([]byte, error) {
+	file, err := httpFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+var errDuplicateGame = errors.New("Duplicate game ignored")
+
+// Returns the sha256 of the decompressed training data, or "" if it isn't
+// valid gzip.
+func gameDataSha(data []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	defer zr.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, zr); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func isDuplicateGame(game *db.TrainingGame) (bool, error) {
+	if len(game.Sha256) == 0 {
+		return false, nil
+	}
+	var count int
+	err := db.GetDB().Model(&db.TrainingGame{}).Where("training_run_id = ? AND sha256 = ?", game.TrainingRunID, game.Sha256).Count(&count).Error
+	return count > 0, err
+}
+
+// Stores an accepted game: the database rows, the training data and the pgn.
+func persistGame(upload *gameUpload) error {
+	game := &upload.game
+	// The game and its count are written in one transaction, so retrying
+	// it can't count a game twice.
+	err := db.Retry(func() error {
+		game.ID = 0
+		tx := db.GetDB().Begin()
+		err := tx.Create(game).Error
+		if err == nil {
+			err = tx.Exec("UPDATE networks SET games_played = games_played + 1 WHERE id = ?", game.NetworkID).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit().Error
+	})
+	if err != nil {
+		// Lost a race against an identical upload.
+		if len(game.Sha256) > 0 && strings.Contains(err.Error(), "idx_training_games_run_sha256") {
+			return errDuplicateGame
+		}
+		return err
+	}
+
+	if game.Plies > 0 {
+		err = updateSelfplayStats(game)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = recordResignStats(game.NetworkID, upload.resign)
+	if err != nil {
+		return err
+	}
+
+	err = db.GetDB().Model(game).Update("path", filepath.Join("games", fmt.Sprintf("run%d/training.%d.gz", game.TrainingRunID, game.ID))).Error
+	if err != nil {
+		return err
+	}
+
 	os.MkdirAll(filepath.Dir(game.Path), os.ModePerm)
 
 	// Save the file
-	if err := c.SaveUploadedFile(file, game.Path); err != nil {
-		log.Println(err.Error())
-		c.String(500, "Saving file")
-		return
+	err = ioutil.WriteFile(game.Path, upload.data, 0644)
+	if err != nil {
+		return fmt.Errorf("saving file: %v", err)
 	}
 
 	// Save pgn
-	pgn_path := fmt.Sprintf("pgns/run%d/%d.pgn", training_run.ID, game.ID)
+	pgn_path := fmt.Sprintf("pgns/run%d/%d.pgn", game.TrainingRunID, game.ID)
 	os.MkdirAll(filepath.Dir(pgn_path), os.ModePerm)
-	err = ioutil.WriteFile(pgn_path, []byte(c.PostForm("pgn")), 0644)
+	err = ioutil.WriteFile(pgn_path, []byte(upload.pgn), 0644)
 	if err != nil {
-		log.Println(err.Error())
-		c.String(500, "Saving pgn")
-		return
+		return fmt.Errorf("saving pgn: %v", err)
 	}
+	enqueueReplication(game.ID)
+	invalidatePages(pageEventGame)
+	return nil
+}
 
-	c.String(http.StatusOK, fmt.Sprintf("File %s uploaded successfully with fields user=%s.", file.Filename, user.Username))
+// Network file formats.  Protobuf files are served with protoSuffix appended
+// to the sha, so the CDN caches both formats separately.
+const (
+	networkFormatText  = "text"
+	networkFormatProto = "proto"
+
+	protoSuffix = ".pb.gz"
+)
+
+// Converts an uploaded network to protobuf with the configured command, and
+// records the converted file.
+func convertNetwork(network *db.Network) error {
+	if len(config.Config.URLs.ConvertNetwork) == 0 {
+		return nil
+	}
+	protoPath := network.Path + protoSuffix
+	cmdParams := make([]string, len(config.Config.URLs.ConvertNetwork))
+	for i, param := range config.Config.URLs.ConvertNetwork {
+		param = strings.Replace(param, "%NETWORK_PATH%", network.Path, -1)
+		cmdParams[i] = strings.Replace(param, "%OUTPUT_PATH%", protoPath, -1)
+	}
+	output, err := exec.Command(cmdParams[0], cmdParams[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	checksum, size, err := fileChecksum(protoPath)
+	if err != nil {
+		return err
+	}
+	return db.GetDB().Model(network).Updates(db.Network{ProtoPath: protoPath, ProtoSize: size, ProtoChecksum: checksum}).Error
+}
+
+// Picks the format a client asked for with the format parameter, or else
+// with its Accept header.  Old clients ask for neither and get text.
+func negotiateNetworkFormat(c *gin.Context) (string, error) {
+	switch c.Query("format") {
+	case networkFormatText, networkFormatProto:
+		return c.Query("format"), nil
+	case "":
+		if strings.Contains(c.GetHeader("Accept"), "application/x-protobuf") {
+			return networkFormatProto, nil
+		}
+		return networkFormatText, nil
+	}
+	return "", fmt.Errorf("Unknown network format %q", c.Query("format"))
 }
 
 func getNetwork(c *gin.Context) {
+	format, err := negotiateNetworkFormat(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	location := config.Config.URLs.NetworkLocation + c.Query("sha")
+	if format == networkFormatProto {
+		location += protoSuffix
+	}
+	c.Header("Vary", "Accept")
 	// lczero.org/cached/ is behind the cloudflare CDN.  Redirect to there to ensure
 	// we hit the CDN.
-	c.Redirect(http.StatusMovedPermanently, config.Config.URLs.NetworkLocation+c.Query("sha"))
+	c.Redirect(http.StatusMovedPermanently, location)
 }
 
 func cachedGetNetwork(c *gin.Context) {
+	sha := c.Param("sha")
+	format := networkFormatText
+	if strings.HasSuffix(sha, protoSuffix) {
+		sha = strings.TrimSuffix(sha, protoSuffix)
+		format = networkFormatProto
+	}
 	network := db.Network{
-		Sha: c.Param("sha"),
+		Sha: sha,
 	}
 
 	// Check for existing network
 	err := db.GetDB().Where(&network).First(&network).Error
 	if err != nil {
 		log.Println(err)
-		c.String(400, "Unknown network")
+		respondError(c, http.StatusNotFound, "not_found", "Unknown network")
 		return
 	}
 
-	// Serve the file
-	c.File(network.Path)
+	serveNetworkFile(c, &network, format)
 	// c.Redirect(http.StatusMovedPermanently, "https://s3.amazonaws.com/lczero/" + network.Path)
 }
 
-func setBestNetwork(training_id uint, network_id uint) error {
+// Whether an Accept-Encoding header allows gzip.  Without the header any
+// encoding is acceptable.
+func acceptsGzip(header string) bool {
+	if len(strings.TrimSpace(header)) == 0 {
+		return true
+	}
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(fields[0])) {
+		case "gzip", "x-gzip":
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
+
+// Serves the gzipped network file as is, with Content-Encoding: gzip, to
+// clients accepting it.  It goes with its Content-Length, and honours Range
+// and If-Range requests, so clients on slow links can resume downloads.  The
+// sha is a strong ETag, so unchanged networks are answered with a 304.
+// Other clients get the file decompressed, without range support.
+func serveNetworkFile(c *gin.Context, network *db.Network, format string) {
+	path := network.Path
+	etag := network.Sha
+	contentType := "text/plain; charset=utf-8"
+	if format == networkFormatProto {
+		if len(network.ProtoPath) == 0 {
+			respondError(c, http.StatusNotFound, "not_found", "Network not available in protobuf format")
+			return
+		}
+		path = network.ProtoPath
+		etag += protoSuffix
+		contentType = "application/x-protobuf"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println(err)
+		respondError(c, http.StatusNotFound, "not_found", "Network file not found")
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// A sha always names the same network, so caches can keep it forever.
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("Vary", "Accept-Encoding")
+	c.Header("Content-Type", contentType)
+	if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+		etag = fmt.Sprintf("%q", etag+"-identity")
+		c.Header("ETag", etag)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+		_, err = io.Copy(c.Writer, zr)
+		if err != nil {
+			log.Printf("Serving network %s decompressed: %v", network.Sha, err)
+		}
+		return
+	}
+	c.Header("Content-Encoding", "gzip")
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", fmt.Sprintf("%q", etag))
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), stat.ModTime(), file)
+}
+
+func setBestNetwork(training_id uint, network_id uint, match_id uint) error {
 	// Set the best network of this training_run
 	training_run, err := getTrainingRun(training_id)
 	if err != nil {
 		return err
 	}
-	err = db.GetDB().Model(&training_run).Update("best_network_id", network_id).Error
+	previous_id := training_run.BestNetworkID
+
+	// The promotion and its event are recorded together, so the history
+	// can't miss a promotion.
+	tx := db.GetDB().Begin()
+	err = tx.Model(&training_run).Update("best_network_id", network_id).Error
+	if err == nil {
+		var elos map[uint]float64
+		_, elos, err = getProgress(tx, training_id)
+		if err == nil {
+			err = tx.Create(&db.PromotionEvent{
+				TrainingRunID:     training_id,
+				NetworkID:         network_id,
+				PreviousNetworkID: previous_id,
+				MatchID:           match_id,
+				Elo:               elos[network_id],
+			}).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
 	if err != nil {
 		return err
 	}
+	invalidatePages(pageEventNetwork)
 	return nil
 }
 
+// The candidate of match passed, but against a network that is no longer
+// the best.  Instead of promoting it, match it against the new best.
+func revalidateMatch(match *db.Match, best_id uint) error {
+	log.Printf("Match %d passed against replaced network %d, re-validating against %d\n", match.ID, match.CurrentBestID, best_id)
+	err := db.GetDB().Model(match).Update("passed", false).Error
+	if err != nil {
+		return err
+	}
+	return db.GetDB().Create(&db.Match{
+		TrainingRunID:  match.TrainingRunID,
+		CandidateID:    match.CandidateID,
+		CurrentBestID:  best_id,
+		Architecture:   match.Architecture,
+		GameCap:        match.GameCap,
+		Parameters:     match.Parameters,
+		RevalidationOf: match.ID,
+	}).Error
+}
+
 func checkMatchFinished(match_id uint) error {
 	// Now check to see if match is finished
 	var match db.Match
@@ -445,8 +1569,27 @@ func checkMatchFinished(match_id uint) error {
 		return nil
 	}
 
-	if match.Wins+match.Losses+match.Draws >= match.GameCap {
-		err = db.GetDB().Model(&match).Update("done", true).Error
+	// Once the SPRT is decided no new games are assigned, but the match is
+	// only closed when the games already handed out have come back, or are
+	// too old to still be played.
+	played := match.Wins + match.Losses + match.Draws
+	decision := sprtDecision(&match)
+	finished := played >= match.GameCap
+	if !finished && decision != 0 {
+		var pending int
+		err = db.GetDB().Model(&db.MatchGame{}).
+			Where("match_id = ? AND done = false AND shadow_of = 0 AND created_at >= ?", match.ID, time.Now().Add(-staleAssignmentAge)).
+			Count(&pending).Error
+		if err != nil {
+			return err
+		}
+		finished = pending == 0
+	}
+	if finished {
+		err = db.GetDB().Model(&match).Updates(map[string]interface{}{
+			"done":                      true,
+			"likelihood_of_superiority": calcLOS(match.Wins, match.Losses),
+		}).Error
 		if err != nil {
 			return err
 		}
@@ -454,14 +1597,29 @@ func checkMatchFinished(match_id uint) error {
 			return nil
 		}
 		// Update to our new best network
-		// TODO(SPRT)
-		passed := calcElo(match.Wins, match.Losses, match.Draws) > config.Config.Matches.Threshold
+		// Undecided at its game cap, the SPRT hasn't shown the candidate is
+		// stronger.
+		passed := decision > 0
+		if !sprtEnabled() {
+			passed = calcElo(match.Wins, match.Losses, match.Draws) > config.Config.Matches.Threshold
+		}
 		err = db.GetDB().Model(&match).Update("passed", passed).Error
 		if err != nil {
 			return err
 		}
 		if passed {
-			err = setBestNetwork(match.TrainingRunID, match.CandidateID)
+			training_run, err := getTrainingRun(match.TrainingRunID)
+			if err != nil {
+				return err
+			}
+			best_id, err := trackBestNetworkID(training_run, match.Architecture)
+			if err != nil {
+				return err
+			}
+			if training_run.GatingPolicy == gatingRevalidate && best_id != match.CurrentBestID {
+				return revalidateMatch(&match, best_id)
+			}
+			err = setTrackBestNetwork(training_run, match.Architecture, match.CandidateID, match.ID)
 			if err != nil {
 				return err
 			}
@@ -471,57 +1629,166 @@ func checkMatchFinished(match_id uint) error {
 	return nil
 }
 
+// Returns the outcome of the game a PGN records, from white's side.  The
+// moves are replayed, as the PGN's own termination marker and Result tag
+// are just what the client wrote.  Games that didn't end on the board were
+// adjudicated by the client, which reports those as draws.  Fails for PGNs
+// that don't parse or hold illegal moves.
+func pgnOutcome(pgn string) (int, bool) {
+	if len(strings.TrimSpace(pgn)) == 0 {
+		return 0, false
+	}
+	recorded, err := chess.PGN(strings.NewReader(pgn))
+	if err != nil {
+		return 0, false
+	}
+	// Decoding a PGN takes its outcome from the termination marker, so the
+	// moves are played again on a new board.
+	game := chess.NewGame()
+	for _, move := range chess.NewGame(recorded).Moves() {
+		if err := game.Move(move); err != nil {
+			return 0, false
+		}
+	}
+	switch game.Outcome() {
+	case chess.WhiteWon:
+		return 1, true
+	case chess.BlackWon:
+		return -1, true
+	}
+	return 0, true
+}
+
+// Applies the result mismatch policy to a match game result, which is from
+// the candidate's side.  Returns an error if the result should be rejected,
+// otherwise flags the game when it disagrees with the PGN.  PGNs that can't
+// be replayed aren't checked.
+func checkMatchResult(game *db.MatchGame, result int, pgn string) error {
+	outcome, ok := pgnOutcome(pgn)
+	if !ok {
+		return nil
+	}
+	if game.Flip {
+		outcome = -outcome
+	}
+	if outcome == result {
+		return nil
+	}
+	if config.Config.Matches.ResultMismatchPolicy == "flag" {
+		game.ResultMismatch = true
+		return nil
+	}
+	return &clientError{"result_mismatch", fmt.Sprintf("Result %d doesn't match the PGN", result), uploadActionDrop}
+}
+
 func matchResult(c *gin.Context) {
 	user, version, err := checkUser(c)
 	if err != nil {
-		log.Println(strings.TrimSpace(err.Error()))
-		c.String(http.StatusBadRequest, err.Error())
+		uploadFailed(c, err)
 		return
 	}
-	if !checkEngineVersion(c.PostForm("engineVersion")) {
-		log.Printf("Rejecting game with old lczero version %s", c.PostForm("engineVersion"))
-		c.String(http.StatusBadRequest, "\n\n\n\n\nYou must upgrade to a newer lczero version!!\n\n\n\n\n")
+	c.Set(reliabilityUserKey, user.ID)
+	err = checkEngineVersion(c.PostForm("engineVersion"))
+	if err != nil {
+		log.Printf("Rejecting game with lczero version %s", c.PostForm("engineVersion"))
+		uploadFailed(c, err)
 		return
 	}
 
 	match_game_id, err := strconv.ParseUint(c.PostForm("match_game_id"), 10, 32)
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Invalid match_game_id")
+		uploadRejected(c, http.StatusBadRequest, "invalid_match_game", "Invalid match_game_id")
 		return
 	}
 
 	var match_game db.MatchGame
-	err = db.GetDB().Where("id = ?", match_game_id).First(&match_game).Error
+	err = db.Retry(func() error {
+		return db.GetDB().Where("id = ?", match_game_id).First(&match_game).Error
+	})
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Invalid match_game")
+		uploadRejected(c, http.StatusBadRequest, "invalid_match_game", "Invalid match_game")
 		return
 	}
 
 	result, err := strconv.ParseInt(c.PostForm("result"), 10, 32)
 	if err != nil {
 		log.Println(err)
-		c.String(http.StatusBadRequest, "Unable to parse result")
+		uploadRejected(c, http.StatusBadRequest, "invalid_result", "Unable to parse result")
 		return
 	}
 
 	good_result := result == 0 || result == -1 || result == 1
 	if !good_result {
-		c.String(http.StatusBadRequest, "Bad result")
+		uploadRejected(c, http.StatusBadRequest, "invalid_result", "Bad result")
+		return
+	}
+	err = checkMatchResult(&match_game, int(result), c.PostForm("pgn"))
+	if err != nil {
+		log.Printf("Rejecting result of match game %d from user=%s", match_game.ID, user.Username)
+		c.Set(reliabilityKindKey, reliabilityResultMismatch)
+		uploadFailed(c, err)
 		return
 	}
 
+	timeSpent, err := strconv.ParseUint(c.DefaultPostForm("time_spent", "0"), 10, 32)
+	if err != nil {
+		uploadRejected(c, http.StatusBadRequest, "invalid_metadata", "Invalid time_spent")
+		return
+	}
+	completedAt := time.Now()
+	var startedAt *time.Time
+	if timeSpent > 0 {
+		// A game can't have started before it was assigned.
+		started := completedAt.Add(-time.Duration(timeSpent) * time.Second)
+		if started.Before(match_game.CreatedAt) {
+			started = match_game.CreatedAt
+		}
+		startedAt = &started
+	}
+
+	engineMajor, engineMinor, enginePatch := engineVersionSegments(c.PostForm("engineVersion"))
 	err = db.GetDB().Model(&match_game).Updates(db.MatchGame{
-		Version:       uint(version),
-		Result:        int(result),
-		Done:          true,
-		Pgn:           c.PostForm("pgn"),
-		EngineVersion: c.PostForm("engineVersion"),
+		Version:        uint(version),
+		Result:         int(result),
+		Done:           true,
+		Pgn:            c.PostForm("pgn"),
+		EngineVersion:  c.PostForm("engineVersion"),
+		EngineMajor:    engineMajor,
+		EngineMinor:    engineMinor,
+		EnginePatch:    enginePatch,
+		StartedAt:      startedAt,
+		CompletedAt:    &completedAt,
+		ResultMismatch: match_game.ResultMismatch,
+		Excluded:       match_game.ResultMismatch,
 	}).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		uploadFailed(c, err)
+		return
+	}
+	if match_game.ResultMismatch {
+		recordReliabilityEvent(user.ID, reliabilityResultMismatch, fmt.Sprintf("match game %d", match_game.ID))
+		log.Printf("Result of match game %d from user=%s doesn't match the PGN, not counted", match_game.ID, user.Username)
+		// The game isn't counted, but may still be the last one out.
+		err = checkMatchFinished(match_game.MatchID)
+		if err != nil {
+			uploadFailed(c, err)
+			return
+		}
+		invalidatePages(pageEventMatchResult)
+		uploadAccepted(c, http.StatusOK, "uploaded", fmt.Sprintf("Match game %d successfuly uploaded from user=%s.", match_game.ID, user.Username))
+		return
+	}
+
+	err = reconcileShadowGame(&match_game)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	if match_game.ShadowOf != 0 {
+		// Only played to cross-check the original game.
+		uploadAccepted(c, http.StatusOK, "uploaded", fmt.Sprintf("Match game %d successfuly uploaded from user=%s.", match_game.ID, user.Username))
 		return
 	}
 
@@ -536,28 +1803,72 @@ func matchResult(c *gin.Context) {
 	// Atomic update of game count
 	err = db.GetDB().Exec(fmt.Sprintf("UPDATE matches SET %s = %s + 1 WHERE id = ?", col, col), match_game.MatchID).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		uploadFailed(c, err)
 		return
 	}
 
 	err = checkMatchFinished(match_game.MatchID)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		uploadFailed(c, err)
 		return
 	}
 
-	c.String(http.StatusOK, fmt.Sprintf("Match game %d successfuly uploaded from user=%s.", match_game.ID, user.Username))
+	invalidatePages(pageEventMatchResult)
+	uploadAccepted(c, http.StatusOK, "uploaded", fmt.Sprintf("Match game %d successfuly uploaded from user=%s.", match_game.ID, user.Username))
+}
+
+// Returns the name to show for a user on public pages.
+func publicUsername(username string, anonymous bool) string {
+	if anonymous {
+		return "anonymous"
+	}
+	return username
+}
+
+// Time windows for game counts, all derived from the same instant so the
+// HTML and API outputs agree.  Calendar days are in UTC.
+type statWindows struct {
+	Now      time.Time `json:"now"`
+	Rolling  time.Time `json:"rolling_24h"`
+	TodayUTC time.Time `json:"today_utc"`
+	Week     time.Time `json:"week"`
+}
+
+func currentStatWindows() statWindows {
+	now := time.Now().UTC()
+	return statWindows{
+		Now:      now,
+		Rolling:  now.Add(-24 * time.Hour),
+		TodayUTC: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+		Week:     now.Add(-7 * 24 * time.Hour),
+	}
+}
+
+// Active users and their games in the last 24 hours, per reported backend.
+type backendSummary struct {
+	Backend string `json:"backend"`
+	Users   int    `json:"users"`
+	Games   uint64 `json:"games"`
 }
 
-func getActiveUsers(userLimit int) (gin.H, error) {
-	rows, err := db.GetDB().Raw(`SELECT user_id, username, MAX(version), MAX(SPLIT_PART(engine_version, '.', 2) :: INTEGER), MAX(training_games.created_at), count(*) FROM training_games
+// Users with games in the last 24 hours, with their counts over each of the
+// windows.
+func getActiveUsers(trainingRunID uint, userLimit int) (gin.H, error) {
+	windows := currentStatWindows()
+	rows, err := db.GetReadDB().Raw(`SELECT user_id, username, anonymous, MAX(version), (array_agg(engine_version ORDER BY engine_major DESC, engine_minor DESC, engine_patch DESC))[1], MAX(training_games.created_at),
+  (array_agg(backend ORDER BY training_games.id DESC))[1], (array_agg(system ORDER BY training_games.id DESC))[1],
+  count(*) FILTER (WHERE training_games.created_at >= ?) AS day,
+  count(*) FILTER (WHERE training_games.created_at >= ?) AS today,
+  count(*) AS week
+FROM training_games
 LEFT JOIN users
 ON users.id = training_games.user_id
-WHERE training_games.created_at >= now() - INTERVAL '1 day'
-GROUP BY user_id, username
-ORDER BY count DESC`).Rows()
+WHERE training_games.created_at >= ?
+AND training_games.training_run_id = ?
+AND training_games.excluded = false
+GROUP BY user_id, username, anonymous
+HAVING count(*) FILTER (WHERE training_games.created_at >= ?) > 0
+ORDER BY day DESC`, windows.Rolling, windows.TodayUTC, windows.Week, trainingRunID, windows.Rolling).Rows()
 	if err != nil {
 		return nil, err
 	}
@@ -566,38 +1877,71 @@ ORDER BY count DESC`).Rows()
 	active_users := 0
 	games_played := 0
 	users_json := []gin.H{}
+	backends := map[string]*backendSummary{}
 	for rows.Next() {
 		var user_id uint
 		var username string
+		var anonymous bool
 		var version int
 		var engine_version string
 		var created_at time.Time
-		var count uint64
-		rows.Scan(&user_id, &username, &version, &engine_version, &created_at, &count)
+		var backend, system string
+		var count, today, week uint64
+		rows.Scan(&user_id, &username, &anonymous, &version, &engine_version, &created_at, &backend, &system, &count, &today, &week)
 
 		active_users += 1
 		games_played += int(count)
 
+		if len(backend) == 0 {
+			backend = "unknown"
+		}
+		summary, ok := backends[backend]
+		if !ok {
+			summary = &backendSummary{Backend: backend}
+			backends[backend] = summary
+		}
+		summary.Users++
+		summary.Games += count
+
+		if len(system) > 32 {
+			system = system[0:32] + "..."
+		}
+
 		if len(username) > 32 {
 			username = username[0:32] + "..."
 		}
+		username = publicUsername(username, anonymous)
 
 		if userLimit == -1 || active_users <= userLimit {
 			users_json = append(users_json, gin.H{
-				"user":         username,
-				"games_today":  count,
-				"system":       "",
-				"version":      version,
-				"engine":       engine_version,
-				"last_updated": created_at,
+				"user":            username,
+				"anonymous":       anonymous,
+				"games_today":     count,
+				"games_today_utc": today,
+				"games_week":      week,
+				"system":          system,
+				"backend":         backend,
+				"version":         version,
+				"engine":          engine_version,
+				"last_updated":    created_at,
 			})
 		}
 	}
 
+	backendsJson := []*backendSummary{}
+	for _, summary := range backends {
+		backendsJson = append(backendsJson, summary)
+	}
+	sort.Slice(backendsJson, func(i, j int) bool {
+		return backendsJson[i].Users > backendsJson[j].Users
+	})
+
 	result := gin.H{
 		"active_users": active_users,
 		"games_played": games_played,
 		"users":        users_json,
+		"windows":      windows,
+		"backends":     backendsJson,
 	}
 	return result, nil
 }
@@ -653,17 +1997,35 @@ func calcEloError(wins, losses, draws int) float64 {
 	return error
 }
 
-func getProgress() ([]gin.H, map[uint]float64, error) {
+// Returns the likelihood of superiority, the chance the side with wins is
+// stronger.  Draws tell nothing either way, so only decisive games count.
+func calcLOS(wins, losses int) float64 {
+	if wins+losses == 0 {
+		return 0.5
+	}
+	return 0.5 * (1 + math.Erf(float64(wins-losses)/math.Sqrt(2*float64(wins+losses))))
+}
+
+// Pages pass db.GetReadDB() as conn, promotions need the primary's data.
+func getProgress(conn *gorm.DB, trainingRunID uint) ([]gin.H, map[uint]float64, error) {
 	elos := make(map[uint]float64)
 
+	var trainingRun db.TrainingRun
+	err := conn.Where("id = ?", trainingRunID).First(&trainingRun).Error
+	if err != nil {
+		return nil, elos, err
+	}
+
+	// The Elo chain follows the primary track, other tracks' candidates
+	// were matched against other baselines.
 	var matches []db.Match
-	err := db.GetDB().Order("id").Find(&matches).Error
+	err = wherePrimaryTrack(conn, &trainingRun).Where("training_run_id = ?", trainingRunID).Order("id").Find(&matches).Error
 	if err != nil {
 		return nil, elos, err
 	}
 
 	var networks []db.Network
-	err = db.GetDB().Order("id").Find(&networks).Error
+	err = conn.Where("training_run_id = ?", trainingRunID).Order("id").Find(&networks).Error
 	if err != nil {
 		return nil, elos, err
 	}
@@ -703,7 +2065,7 @@ func getProgress() ([]gin.H, map[uint]float64, error) {
 				"sprt":   sprt,
 				"id":     network.ID,
 			})
-			if !matches[matchIdx].TestOnly && matches[matchIdx].Passed {
+			if !matches[matchIdx].TestOnly && matches[matchIdx].Passed && !matches[matchIdx].Invalidated {
 				elo += matchElo
 			}
 			matchIdx += 1
@@ -752,10 +2114,16 @@ func filterProgress(result []gin.H) []gin.H {
 }
 
 func viewActiveUsers(c *gin.Context) {
-	users, err := getActiveUsers(-1)
+	trainingRun, runs, err := getScopedTrainingRun(c)
 	if err != nil {
 		log.Println(err)
-		c.String(500, "Internal error")
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+
+	users, err := getActiveUsers(trainingRun.ID, -1)
+	if err != nil {
+		internalError(c, err)
 		return
 	}
 
@@ -763,17 +2131,23 @@ func viewActiveUsers(c *gin.Context) {
 		"active_users": users["active_users"],
 		"games_played": users["games_played"],
 		"Users":        users["users"],
+		"windows":      users["windows"],
+		"backends":     users["backends"],
+		"runs":         runs,
 	})
 }
 
 func getTopUsers(table string) ([]gin.H, error) {
 	type Result struct {
-		Username string
-		Count    int
+		Username  string
+		Count     int
+		Anonymous bool
 	}
 
 	var result []Result
-	err := db.GetDB().Table(table).Select("username, count").Order("count desc").Limit(50).Scan(&result).Error
+	err := db.GetReadDB().Table(table).Select(table + ".username, count, users.anonymous").
+		Joins("LEFT JOIN users ON users.id = " + table + ".user_id").
+		Order("count desc").Limit(50).Scan(&result).Error
 	if err != nil {
 		return nil, err
 	}
@@ -781,7 +2155,8 @@ func getTopUsers(table string) ([]gin.H, error) {
 	users_json := []gin.H{}
 	for _, user := range result {
 		users_json = append(users_json, gin.H{
-			"user":        user.Username,
+			"user":        publicUsername(user.Username, user.Anonymous),
+			"anonymous":   user.Anonymous,
 			"games_today": user.Count,
 		})
 	}
@@ -789,17 +2164,22 @@ func getTopUsers(table string) ([]gin.H, error) {
 }
 
 func frontPage(c *gin.Context) {
-	users, err := getActiveUsers(50)
+	trainingRun, runs, err := getScopedTrainingRun(c)
 	if err != nil {
 		log.Println(err)
-		c.String(500, "Internal error")
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
 		return
 	}
 
-	progress, _, err := getProgress()
+	users, err := getActiveUsers(trainingRun.ID, 50)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
+		return
+	}
+
+	progress, _, err := getProgress(db.GetReadDB(), trainingRun.ID)
+	if err != nil {
+		internalError(c, err)
 		return
 	}
 	if c.DefaultQuery("full_elo", "0") == "0" {
@@ -807,24 +2187,24 @@ func frontPage(c *gin.Context) {
 	}
 
 	network := db.Network{}
-	err = db.GetDB().Last(&network).Error
+	err = db.GetReadDB().Where("training_run_id = ?", trainingRun.ID).Last(&network).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
-	trainPercent := int(math.Min(100.0, float64(network.GamesPlayed)/40000.0*100.0))
+	trainPercent := 0
+	if trainingRun.GamesTarget > 0 {
+		trainPercent = int(math.Min(100.0, float64(network.GamesPlayed)/float64(trainingRun.GamesTarget)*100.0))
+	}
 
 	topUsersMonth, err := getTopUsers("games_month")
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 	topUsers, err := getTopUsers("games_all")
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -836,28 +2216,42 @@ func frontPage(c *gin.Context) {
 		"top_users":       topUsers,
 		"progress":        progress,
 		"train_percent":   trainPercent,
-		"progress_info":   fmt.Sprintf("%d/40000", network.GamesPlayed),
+		"progress_info":   fmt.Sprintf("%d/%d", network.GamesPlayed, trainingRun.GamesTarget),
+		"runs":            runs,
 	})
 }
 
-func user(c *gin.Context) {
-	name := c.Param("name")
-	user := db.User{
-		Username: name,
+const userGamesPerPage = 50
+
+// Returns the page (1-based) and network id filter (0 for none) from the query.
+func getUserGamesQuery(c *gin.Context) (int, uint, error) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("Invalid page")
 	}
-	err := db.GetDB().Where(&user).First(&user).Error
+	networkID, err := strconv.ParseUint(c.DefaultQuery("network", "0"), 10, 32)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
-		return
+		return 0, 0, errors.New("Invalid network")
+	}
+	return page, uint(networkID), nil
+}
+
+func getUserGames(user *db.User, page int, networkID uint) ([]gin.H, int, error) {
+	query := db.GetReadDB().Model(&db.TrainingGame{}).Where("user_id = ?", user.ID)
+	if networkID != 0 {
+		query = query.Where("network_id = ?", networkID)
+	}
+
+	var total int
+	err := query.Count(&total).Error
+	if err != nil {
+		return nil, 0, err
 	}
 
 	games := []db.TrainingGame{}
-	err = db.GetDB().Model(&user).Preload("Network").Limit(50).Order("created_at DESC").Related(&games).Error
+	err = query.Preload("Network").Order("created_at DESC").Offset((page - 1) * userGamesPerPage).Limit(userGamesPerPage).Find(&games).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
-		return
+		return nil, 0, err
 	}
 
 	gamesJson := []gin.H{}
@@ -866,20 +2260,59 @@ func user(c *gin.Context) {
 			"id":         game.ID,
 			"created_at": game.CreatedAt.String(),
 			"network":    game.Network.Sha,
+			"network_id": game.NetworkID,
 		})
 	}
+	return gamesJson, total, nil
+}
+
+func user(c *gin.Context) {
+	name := c.Param("name")
+	user := db.User{
+		Username: name,
+	}
+	err := db.GetReadDB().Where(&user).First(&user).Error
+	if err != nil {
+		internalError(c, err)
+		return
+	}
 
+	page, networkID, err := getUserGamesQuery(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	gamesJson, total, err := getUserGames(&user, page, networkID)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	pages := (total + userGamesPerPage - 1) / userGamesPerPage
+	networkQuery := ""
+	if networkID != 0 {
+		networkQuery = fmt.Sprintf("&network=%d", networkID)
+	}
 	c.HTML(http.StatusOK, "user", gin.H{
-		"user":  user.Username,
-		"games": gamesJson,
+		"user":          user.Username,
+		"games":         gamesJson,
+		"total":         total,
+		"page":          page,
+		"pages":         pages,
+		"prev_page":     page - 1,
+		"next_page":     page + 1,
+		"has_prev":      page > 1,
+		"has_next":      page < pages,
+		"network_id":    networkID,
+		"network_query": networkQuery,
 	})
 }
 
 func game(c *gin.Context) {
 	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -888,15 +2321,13 @@ func game(c *gin.Context) {
 	}
 	err = db.GetDB().Where(&game).First(&game).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
 	pgn, err := ioutil.ReadFile(fmt.Sprintf("pgns/run%d/%d.pgn", game.TrainingRunID, id))
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -908,8 +2339,7 @@ func game(c *gin.Context) {
 func viewMatchGame(c *gin.Context) {
 	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -918,8 +2348,7 @@ func viewMatchGame(c *gin.Context) {
 	}
 	err = db.GetDB().Where(&game).First(&game).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -937,19 +2366,28 @@ func getNetworkCounts(networks []db.Network) map[uint]uint64 {
 }
 
 func viewNetworks(c *gin.Context) {
-	// TODO(gary): Whole thing needs to take training_run into account...
-	var networks []db.Network
-	err := db.GetDB().Order("id desc").Find(&networks).Error
+	trainingRun, runs, err := getScopedTrainingRun(c)
 	if err != nil {
 		log.Println(err)
-		c.String(500, "Internal error")
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
 		return
 	}
 
-	_, elos, err := getProgress()
+	q, err := whereNetworkTag(c, db.GetReadDB())
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		respondError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	var networks []db.Network
+	err = q.Where("training_run_id = ?", trainingRun.ID).Order("id desc").Find(&networks).Error
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	_, elos, err := getProgress(db.GetReadDB(), trainingRun.ID)
+	if err != nil {
+		internalError(c, err)
 		return
 	}
 
@@ -965,11 +2403,50 @@ func viewNetworks(c *gin.Context) {
 			"blocks":     network.Layers,
 			"filters":    network.Filters,
 			"created_at": network.CreatedAt,
+			"tags":       networkTags(&network),
+			"notes":      network.Notes,
 		})
 	}
 
 	c.HTML(http.StatusOK, "networks", gin.H{
 		"networks": json,
+		"runs":     runs,
+		"tag":      c.Query("tag"),
+	})
+}
+
+func viewPromotions(c *gin.Context) {
+	trainingRun, runs, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+
+	var events []db.PromotionEvent
+	err = db.GetDB().Where("training_run_id = ?", trainingRun.ID).Order("id").Find(&events).Error
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	json := []gin.H{}
+	for _, event := range events {
+		json = append(json, gin.H{
+			"created_at":  event.CreatedAt,
+			"network_id":  event.NetworkID,
+			"previous_id": event.PreviousNetworkID,
+			"match_id":    event.MatchID,
+			"elo":         fmt.Sprintf("%.2f", event.Elo),
+			"rollback":    event.Rollback,
+			"reason":      event.Reason,
+			"created_by":  event.CreatedBy,
+		})
+	}
+
+	c.HTML(http.StatusOK, "promotions", gin.H{
+		"promotions": json,
+		"runs":       runs,
 	})
 }
 
@@ -977,8 +2454,7 @@ func viewTrainingRuns(c *gin.Context) {
 	training_runs := []db.TrainingRun{}
 	err := db.GetDB().Find(&training_runs).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -990,6 +2466,8 @@ func viewTrainingRuns(c *gin.Context) {
 			"trainParams":   training_run.TrainParameters,
 			"bestNetworkId": training_run.BestNetworkID,
 			"description":   training_run.Description,
+			"weight":        training_run.Weight,
+			"gamesTarget":   training_run.GamesTarget,
 		})
 	}
 
@@ -998,12 +2476,48 @@ func viewTrainingRuns(c *gin.Context) {
 	})
 }
 
+func getSelfplayStats(network db.Network) gin.H {
+	games := network.WhiteWins + network.BlackWins + network.Draws
+	percent := func(count int) float64 {
+		return float64(count) / float64(games) * 100.0
+	}
+	return gin.H{
+		"id":             network.ID,
+		"sha":            network.Sha,
+		"games":          games,
+		"draw_rate":      percent(network.Draws),
+		"white_win_rate": percent(network.WhiteWins),
+		"black_win_rate": percent(network.BlackWins),
+		"resign_rate":    percent(network.Resigns),
+		"avg_plies":      float64(network.Plies) / float64(games),
+	}
+}
+
+func getNetworksWithSelfplayStats() ([]db.Network, error) {
+	var networks []db.Network
+	err := db.GetDB().Order("id").Where("white_wins + black_wins + draws > 0").Find(&networks).Error
+	return networks, err
+}
+
+func apiSelfplayStats(c *gin.Context) {
+	networks, err := getNetworksWithSelfplayStats()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	json := []gin.H{}
+	for _, network := range networks {
+		json = append(json, getSelfplayStats(network))
+	}
+	c.JSON(http.StatusOK, json)
+}
+
 func viewStats(c *gin.Context) {
 	var networks []db.Network
 	err := db.GetDB().Order("id desc").Where("games_played > 0").Limit(3).Find(&networks).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -1014,17 +2528,80 @@ func viewStats(c *gin.Context) {
 		})
 	}
 
+	statNetworks, err := getNetworksWithSelfplayStats()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// Flattened to one row per (network, metric) for the trend chart.
+	rates := []gin.H{}
+	plies := []gin.H{}
+	for _, network := range statNetworks {
+		stats := getSelfplayStats(network)
+		for _, metric := range []string{"draw_rate", "white_win_rate", "resign_rate"} {
+			rates = append(rates, gin.H{
+				"net":    network.ID,
+				"metric": metric,
+				"value":  stats[metric],
+			})
+		}
+		plies = append(plies, gin.H{
+			"net":   network.ID,
+			"value": stats["avg_plies"],
+		})
+	}
+
 	c.HTML(http.StatusOK, "stats", gin.H{
-		"networks": json,
+		"networks":       json,
+		"selfplay_rates": rates,
+		"selfplay_plies": plies,
 	})
 }
 
+// Applies the state and candidate filters from the query string.
+func filterMatches(c *gin.Context, query *gorm.DB) (*gorm.DB, error) {
+	switch c.Query("state") {
+	case "":
+	case "in_progress":
+		query = query.Where("done = false")
+	case "passed":
+		query = query.Where("done = true AND passed = true AND test_only = false")
+	case "failed":
+		query = query.Where("done = true AND passed = false AND test_only = false")
+	case "test":
+		query = query.Where("test_only = true")
+	default:
+		return nil, errors.New("Invalid state")
+	}
+	if len(c.Query("candidate")) > 0 {
+		candidate, err := strconv.ParseUint(c.Query("candidate"), 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid candidate")
+		}
+		query = query.Where("candidate_id = ?", candidate)
+	}
+	return query, nil
+}
+
 func viewMatches(c *gin.Context) {
-	var matches []db.Match
-	err := db.GetDB().Order("id desc").Find(&matches).Error
+	trainingRun, runs, err := getScopedTrainingRun(c)
 	if err != nil {
 		log.Println(err)
-		c.String(500, "Internal error")
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+
+	query, err := filterMatches(c, db.GetReadDB().Where("training_run_id = ?", trainingRun.ID))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	var matches []db.Match
+	err = query.Order("id desc").Find(&matches).Error
+	if err != nil {
+		internalError(c, err)
 		return
 	}
 
@@ -1036,6 +2613,7 @@ func viewMatches(c *gin.Context) {
 		if !math.IsNaN(elo_error) {
 			elo_error_str = fmt.Sprintf("±%.1f", elo_error)
 		}
+		los := calcLOS(match.Wins, match.Losses)
 		table_class := "active"
 		if match.Done {
 			if match.Passed {
@@ -1052,6 +2630,14 @@ func viewMatches(c *gin.Context) {
 		if match.TestOnly {
 			passed = "test"
 		}
+		if match.Invalidated {
+			table_class = "warning"
+			passed = "invalidated"
+		}
+		if match.Cancelled {
+			table_class = "secondary"
+			passed = "cancelled"
+		}
 		json = append(json, gin.H{
 			"id":           match.ID,
 			"current_id":   match.CurrentBestID,
@@ -1059,6 +2645,7 @@ func viewMatches(c *gin.Context) {
 			"score":        fmt.Sprintf("+%d -%d =%d", match.Wins, match.Losses, match.Draws),
 			"elo":          fmt.Sprintf("%.1f", elo),
 			"error":        elo_error_str,
+			"los":          fmt.Sprintf("%.1f%%", 100*los),
 			"done":         match.Done,
 			"table_class":  table_class,
 			"passed":       passed,
@@ -1067,24 +2654,25 @@ func viewMatches(c *gin.Context) {
 	}
 
 	c.HTML(http.StatusOK, "matches", gin.H{
-		"matches": json,
+		"matches":   json,
+		"state":     c.Query("state"),
+		"candidate": c.Query("candidate"),
+		"runs":      runs,
 	})
 }
 
 func viewMatch(c *gin.Context) {
 	match := db.Match{}
-	err := db.GetDB().Where("id = ?", c.Param("id")).First(&match).Error
+	err := db.GetReadDB().Where("id = ?", c.Param("id")).First(&match).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
 	games := []db.MatchGame{}
-	err = db.GetDB().Where(&db.MatchGame{MatchID: match.ID}).Preload("User").Order("id").Find(&games).Error
+	err = db.GetReadDB().Where(&db.MatchGame{MatchID: match.ID}).Preload("User").Order("id").Find(&games).Error
 	if err != nil {
-		log.Println(err)
-		c.String(500, "Internal error")
+		internalError(c, err)
 		return
 	}
 
@@ -1109,21 +2697,80 @@ func viewMatch(c *gin.Context) {
 			"created_at": game.CreatedAt.String(),
 			"result":     result,
 			"done":       game.Done,
-			"user":       game.User.Username,
+			"user":       publicUsername(game.User.Username, game.User.Anonymous),
+			"anonymous":  game.User.Anonymous,
 			"color":      color,
+			"shadow_of":  game.ShadowOf,
 		})
 	}
 
+	colors := getMatchColorStats(games)
 	c.HTML(http.StatusOK, "match", gin.H{
-		"games": gamesJson,
+		"id":             match.ID,
+		"sprt":           sprtStatus(&match),
+		"games":          gamesJson,
+		"colors":         []gin.H{colors.White.row("white"), colors.Black.row("black")},
+		"color_warnings": colors.Warnings,
+	})
+}
+
+func viewSweep(c *gin.Context) {
+	sweep := db.Sweep{}
+	err := db.GetDB().Where("id = ?", c.Param("id")).First(&sweep).Error
+	if err != nil {
+		log.Println(err)
+		respondError(c, http.StatusNotFound, "not_found", "Sweep not found")
+		return
+	}
+
+	var matches []db.Match
+	err = db.GetDB().Where("sweep_id = ?", sweep.ID).Order("id").Find(&matches).Error
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	json := []gin.H{}
+	for _, match := range matches {
+		elo, elo_error := calcEloAndError(match.Wins, match.Losses, match.Draws)
+		elo_str := "Nan"
+		if !math.IsNaN(elo) {
+			elo_str = fmt.Sprintf("%.1f", elo)
+		}
+		elo_error_str := "Nan"
+		if !math.IsNaN(elo_error) {
+			elo_error_str = fmt.Sprintf("±%.1f", elo_error)
+		}
+		json = append(json, gin.H{
+			"id":         match.ID,
+			"parameters": match.Parameters,
+			"games":      match.Wins + match.Losses + match.Draws,
+			"game_cap":   match.GameCap,
+			"score":      fmt.Sprintf("+%d -%d =%d", match.Wins, match.Losses, match.Draws),
+			"elo":        elo_str,
+			"error":      elo_error_str,
+			"done":       match.Done,
+		})
+	}
+
+	c.HTML(http.StatusOK, "sweep", gin.H{
+		"sweep":   sweep,
+		"matches": json,
 	})
 }
 
 func viewTrainingData(c *gin.Context) {
-	rows, err := db.GetDB().Raw(`SELECT MAX(id) FROM training_games WHERE compacted = true`).Rows()
+	trainingRun, runs, err := getScopedTrainingRun(c)
 	if err != nil {
 		log.Println(err)
-		c.String(500, "Internal error")
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+	storage := config.RunStorageOf(trainingRun.ID)
+
+	rows, err := db.GetReadDB().Raw(`SELECT COALESCE(MAX(id), 0) FROM training_games WHERE compacted = true AND training_run_id = ?`, trainingRun.ID).Rows()
+	if err != nil {
+		internalError(c, err)
 		return
 	}
 	defer rows.Close()
@@ -1135,79 +2782,155 @@ func viewTrainingData(c *gin.Context) {
 	}
 
 	files := []gin.H{}
-	game_id := int(id + 1 - 500000)
-	if game_id < 0 {
-		game_id = 0
-	}
-	for game_id < int(id) {
-		files = append([]gin.H{
-			{"url": fmt.Sprintf("https://s3.amazonaws.com/lczero/training/games%d.tar.gz", game_id)},
-		}, files...)
-		game_id += 10000
+	if len(storage.GamesURL) > 0 {
+		game_id := (int(id) + 1 - storage.LeaveGames) / storage.GamesChunkSize * storage.GamesChunkSize
+		if game_id < 0 {
+			game_id = 0
+		}
+		for game_id < int(id) {
+			files = append([]gin.H{
+				{"url": fmt.Sprintf("%sgames%d.tar.gz", storage.GamesURL, game_id)},
+			}, files...)
+			game_id += storage.GamesChunkSize
+		}
 	}
 
 	pgnFiles := []gin.H{}
-	pgnId := 9000000
-	for pgnId < int(id-500000) {
-		pgnFiles = append([]gin.H{
-			{"url": fmt.Sprintf("https://s3.amazonaws.com/lczero/training/run1/pgn%d.tar.gz", pgnId)},
-		}, pgnFiles...)
-		pgnId += 100000
+	if len(storage.PgnURL) > 0 {
+		pgnId := storage.PgnArchivesFrom
+		for pgnId < int(id)-storage.LeaveGames {
+			pgnFiles = append([]gin.H{
+				{"url": fmt.Sprintf("%spgn%d.tar.gz", storage.PgnURL, pgnId)},
+			}, pgnFiles...)
+			pgnId += storage.PgnChunkSize
+		}
 	}
 
 	c.HTML(http.StatusOK, "training_data", gin.H{
 		"files":     files,
 		"pgn_files": pgnFiles,
+		"runs":      runs,
 	})
 }
 
 func createTemplates() multitemplate.Render {
 	r := multitemplate.New()
-	r.AddFromFiles("index", "templates/base.tmpl", "templates/index.tmpl")
+	r.AddFromFiles("index", "templates/base.tmpl", "templates/index.tmpl", "templates/run_selector.tmpl")
 	r.AddFromFiles("user", "templates/base.tmpl", "templates/user.tmpl")
 	r.AddFromFiles("game", "templates/base.tmpl", "templates/game.tmpl")
-	r.AddFromFiles("networks", "templates/base.tmpl", "templates/networks.tmpl")
+	r.AddFromFiles("networks", "templates/base.tmpl", "templates/networks.tmpl", "templates/run_selector.tmpl")
 	r.AddFromFiles("training_runs", "templates/base.tmpl", "templates/training_runs.tmpl")
 	r.AddFromFiles("stats", "templates/base.tmpl", "templates/stats.tmpl")
 	r.AddFromFiles("match", "templates/base.tmpl", "templates/match.tmpl")
-	r.AddFromFiles("matches", "templates/base.tmpl", "templates/matches.tmpl")
-	r.AddFromFiles("training_data", "templates/base.tmpl", "templates/training_data.tmpl")
-	r.AddFromFiles("active_users", "templates/base.tmpl", "templates/active_users.tmpl")
+	r.AddFromFiles("sweep", "templates/base.tmpl", "templates/sweep.tmpl")
+	r.AddFromFiles("tournament", "templates/base.tmpl", "templates/tournament.tmpl")
+	r.AddFromFiles("admin", "templates/base.tmpl", "templates/admin.tmpl")
+	r.AddFromFiles("admin_new_match", "templates/base.tmpl", "templates/admin_new_match.tmpl")
+	r.AddFromFiles("admin_storage", "templates/base.tmpl", "templates/admin_storage.tmpl")
+	r.AddFromFiles("register", "templates/base.tmpl", "templates/register.tmpl")
+	r.AddFromFiles("password_reset", "templates/base.tmpl", "templates/password_reset.tmpl")
+	r.AddFromFiles("matches", "templates/base.tmpl", "templates/matches.tmpl", "templates/run_selector.tmpl")
+	r.AddFromFiles("training_data", "templates/base.tmpl", "templates/training_data.tmpl", "templates/run_selector.tmpl")
+	r.AddFromFiles("active_users", "templates/base.tmpl", "templates/active_users.tmpl", "templates/run_selector.tmpl")
+	r.AddFromFiles("promotions", "templates/base.tmpl", "templates/promotions.tmpl", "templates/run_selector.tmpl")
 	return r
 }
 
 func setupRouter() *gin.Engine {
 	router := gin.Default()
+	router.Use(requestID)
 	router.HTMLRender = createTemplates()
-	router.MaxMultipartMemory = 32 << 20 // 32 MiB
+	router.MaxMultipartMemory = multipartMemory()
 	router.Static("/css", "./public/css")
 	router.Static("/js", "./public/js")
 	router.Static("/stats", "/home/web/netstats")
 
-	router.GET("/", frontPage)
+	router.GET("/", cachePage(pageEventGame, pageEventMatch, pageEventMatchResult, pageEventNetwork), frontPage)
 	router.GET("/get_network", getNetwork)
 	router.GET("/cached/network/sha/:sha", cachedGetNetwork)
 	router.GET("/user/:name", user)
 	router.GET("/game/:id", game)
-	router.GET("/networks", viewNetworks)
+	router.GET("/networks", cachePage(pageEventGame, pageEventNetwork), viewNetworks)
 	router.GET("/stats", viewStats)
 	router.GET("/training_runs", viewTrainingRuns)
 	router.GET("/match/:id", viewMatch)
-	router.GET("/matches", viewMatches)
+	router.GET("/match/:id/pgns.zip", viewMatchPgns)
+	router.GET("/matches", cachePage(pageEventMatch, pageEventMatchResult, pageEventNetwork), viewMatches)
+	router.GET("/sweep/:id", viewSweep)
+	router.GET("/tournament/:id", viewTournament)
 	router.GET("/active_users", viewActiveUsers)
+	router.GET("/promotions", viewPromotions)
 	router.GET("/match_game/:id", viewMatchGame)
 	router.GET("/training_data", viewTrainingData)
+	router.GET("/api/v1/selfplay_stats", apiSelfplayStats)
+	router.GET("/api/v1/resign_stats", apiResignStats)
+	router.GET("/api/v1/active_users", apiActiveUsers)
+	router.GET("/api/v1/users/:name", apiUser)
+	router.GET("/api/v1/users/:name/games", apiUserGames)
+	router.GET("/api/v1/network/id/:id/download", apiDownloadNetworkByID)
+	router.GET("/api/v1/network/id/:id/pgn", apiNetworkPgn)
+	router.GET("/api/v1/best_network", apiBestNetwork)
+	router.GET("/api/v1/work_status", apiWorkStatus)
+	router.GET("/api/v1/progress", apiProgress)
+	router.GET("/api/v1/networks/manifest", apiNetworksManifest)
+	router.GET("/api/v1/ingestion_stats", apiIngestionStats)
+	router.GET("/api/v1/throughput", apiThroughput)
+	router.GET("/api/v1/training_window", apiTrainingWindow)
+	router.GET("/api/v1/upload_metrics", apiUploadMetrics)
+	router.GET("/healthz", healthz)
+	router.GET("/api/v1/tournaments/:id", apiTournament)
+	router.GET("/api/v1/matches/:id", apiMatch)
+	router.GET("/api/v1/matches/:id/training_data", apiMatchTrainingData)
+	router.GET("/api/v1/match_training_data", apiMatchTrainingDataList)
+	router.GET("/register", registerForm)
+	router.POST("/register", register)
+	router.POST("/account/anonymous", setAnonymous)
+	router.GET("/password_reset", passwordResetForm)
+	router.POST("/password_reset", requestPasswordReset)
+	router.GET("/password_reset/:token", passwordResetForm)
+	router.POST("/password_reset/:token", resetPassword)
 	router.POST("/next_game", nextGame)
-	router.POST("/upload_game", uploadGame)
-	router.POST("/upload_network", uploadNetwork)
-	router.POST("/match_result", matchResult)
+	router.POST("/upload_game", uploadMetricsMiddleware, recordRejections, limitBody(maxGameSize()+int64(maxPgnLength())+formOverhead), limitConcurrentUploads, requireDiskSpace, uploadGame)
+	router.POST("/upload_network", uploadMetricsMiddleware, limitBody(maxNetworkSize()+formOverhead), requireDiskSpace, uploadNetwork)
+	router.POST("/match_result", uploadMetricsMiddleware, recordRejections, limitBody(int64(maxPgnLength())+formOverhead), limitConcurrentUploads, matchResult)
+	router.POST("/match_training_data", uploadMetricsMiddleware, recordRejections, limitBody(maxGameSize()+formOverhead), limitConcurrentUploads, requireDiskSpace, uploadMatchTrainingData)
+	router.POST("/crash_report", crashReport)
+
+	if len(config.Config.Admin.Accounts) > 0 {
+		setupAdminRoutes(router.Group("/admin", gin.BasicAuth(config.Config.Admin.Accounts)))
+	}
+	if accounts := trainerAccounts(); len(accounts) > 0 {
+		training := router.Group("/api/v1/training", gin.BasicAuth(accounts))
+		training.POST("/claim", claimTrainingChunks)
+		training.POST("/claims/:id/consume", consumeTrainingClaim)
+	}
 	return router
 }
 
 func main() {
+	rand.Seed(time.Now().UnixNano())
+	log.SetOutput(io.MultiWriter(os.Stderr, &recentLogs))
+
+	err := validateMatchTemplates()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	db.Init()
 	db.SetupDB()
 	defer db.Close()
+	db.StartHealthCheck()
+
+	startReplication()
+	startIngestion()
+	startMatchCleanup()
+	startSpotChecks()
+	startCompaction()
+	startStorageUsage()
+	startThroughputRollups()
+	startGamesWebhooks()
+	startNetworkVerification()
+	go backfillNetworkChecksums()
 
 	router := setupRouter()
 	router.Run(config.Config.WebServer.Address)
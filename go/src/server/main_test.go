@@ -1,22 +1,34 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"server/config"
 	"server/db"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
@@ -31,12 +43,21 @@ type StoreSuite struct {
 }
 
 func (s *StoreSuite) SetupSuite() {
-	db.Init(false)
+	db.Init()
 
+	// The shipped config leaves /admin disabled.
+	config.Config.Admin.Accounts = map[string]string{"admin": "admin"}
+	config.Config.Admin.Trainers = map[string]string{"trainer": "trainer"}
+	// The matches of a few games here are decided on their Elo, the SPRT
+	// leaves them undecided.
+	config.Config.Matches.SPRT.Elo1 = config.Config.Matches.SPRT.Elo0
 	s.router = setupRouter()
 }
 
 func (s *StoreSuite) SetupTest() {
+	// Users are recreated with the same IDs.
+	gameCountsCache.users = make(map[uint]gameCounts)
+	reliabilityCache.users = make(map[uint]recentReliability)
 	err := db.GetDB().DropTable(
 		&db.User{},
 		&db.TrainingRun{},
@@ -44,6 +65,23 @@ func (s *StoreSuite) SetupTest() {
 		&db.Match{},
 		&db.MatchGame{},
 		&db.TrainingGame{},
+		&db.TrainParametersChange{},
+		&db.MatchParametersChange{},
+		&db.EngineVersionRule{},
+		&db.Sweep{},
+		&db.Tournament{},
+		&db.PasswordReset{},
+		&db.PromotionEvent{},
+		&db.ResignStat{},
+		&db.SpotCheck{},
+		&db.JobLock{},
+		&db.ThroughputHour{},
+		&db.GamesWebhook{},
+		&db.TrainingChunk{},
+		&db.TrainingClaim{},
+		&db.ReliabilityEvent{},
+		&db.ArchitectureTrack{},
+		&db.OpeningAssignment{},
 	).Error
 	if err != nil {
 		log.Fatal(err)
@@ -64,6 +102,10 @@ func (s *StoreSuite) SetupTest() {
 	if err := db.GetDB().Create(&user).Error; err != nil {
 		log.Fatal(err)
 	}
+	user = db.User{Username: "default", Password: "1234"}
+	if err := db.GetDB().Create(&user).Error; err != nil {
+		log.Fatal(err)
+	}
 
 	s.w = httptest.NewRecorder()
 }
@@ -78,6 +120,10 @@ func TestStoreSuite(t *testing.T) {
 	suite.Run(t, s)
 }
 
+// The run configuration next_game sends for training runs without
+// parameters.
+const defaultRunConfig = `{"variant":"standard","visits":800,"playouts":0,"resignPercent":-1,"temperature":{"randomize":false,"decay":0},"noise":{"enabled":false,"epsilon":0.25,"alpha":0.3}}`
+
 func postParams(params map[string]string) *strings.Reader {
 	data := url.Values{}
 	for key, val := range params {
@@ -112,7 +158,7 @@ func (s *StoreSuite) TestNextGameNoUser() {
 	s.router.ServeHTTP(s.w, req)
 
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
 }
 
 // Make sure old users don't get match games
@@ -124,7 +170,7 @@ func (s *StoreSuite) TestNextGameNoUserMatch() {
 	s.router.ServeHTTP(s.w, req)
 
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
 }
 
 func (s *StoreSuite) TestNextGameUserNoMatch() {
@@ -133,7 +179,104 @@ func (s *StoreSuite) TestNextGameUserNoMatch() {
 	s.router.ServeHTTP(s.w, req)
 
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
+}
+
+func (s *StoreSuite) TestNextGameTrainingIDs() {
+	second := db.TrainingRun{Description: "FRC", BestNetworkID: 1, Active: true}
+	if err := db.GetDB().Create(&second).Error; err != nil {
+		log.Fatal(err)
+	}
+	nextGame := func(ids string) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2", "training_ids": ids}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	for i := 0; i < 5; i++ {
+		nextGame("2")
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		assert.Contains(s.T(), s.w.Body.String(), `"trainingId":2`)
+	}
+	nextGame("3")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	nextGame("1,x")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestNextGameDeprecatedClient() {
+	oldClients := config.Config.Clients
+	defer func() {
+		config.Config.Clients = oldClients
+	}()
+	config.Config.Clients.DeprecatedBefore = 3
+	config.Config.Clients.DeprecationDeadline = time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	config.Config.Clients.DownloadURL = "https://example.com/client"
+	nextGame := func(version string) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": version, "features": "warning"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	nextGame("2")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var game struct {
+		Warning struct {
+			Message     string
+			DownloadURL string `json:"downloadUrl"`
+		}
+	}
+	json.Unmarshal(s.w.Body.Bytes(), &game)
+	assert.Contains(s.T(), game.Warning.Message, "Client version 2 will stop working")
+	assert.Equal(s.T(), "https://example.com/client", game.Warning.DownloadURL)
+
+	nextGame("3")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.NotContains(s.T(), s.w.Body.String(), "warning")
+
+	config.Config.Clients.DeprecationDeadline = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	nextGame("2")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"unsupported_client"`)
+	assert.Contains(s.T(), s.w.Body.String(), `"message":"Client version 2 is no longer supported, please download the latest client from https://example.com/client"`)
+}
+
+func (s *StoreSuite) TestNextGameFeatures() {
+	nextGame := func(features string) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2", "features": features}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	}
+
+	nextGame("warning,teleport")
+	assert.JSONEq(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String())
+	nextGame("config")
+	assert.JSONEq(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String())
+
+	// Recorded with match assignments.
+	initMatch(false)
+	nextGame("warning,config")
+	assert.Contains(s.T(), s.w.Body.String(), `"type":"match"`)
+	var game db.MatchGame
+	db.GetDB().Order("id desc").First(&game)
+	assert.Equal(s.T(), "config,warning", game.Features)
+
+	// Clients that don't list any only get what they used to, even if they
+	// are deprecated.
+	_, legacy := clientFeatures("")
+	assert.Equal(s.T(), "config,training_data", legacy)
+	oldClients := config.Config.Clients
+	defer func() {
+		config.Config.Clients = oldClients
+	}()
+	config.Config.Clients.DeprecatedBefore = 3
+	config.Config.Clients.DeprecationDeadline = time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	nextGame("")
+	assert.NotContains(s.T(), s.w.Body.String(), "warning")
 }
 
 func (s *StoreSuite) TestNextGameUserMatch() {
@@ -144,7 +287,140 @@ func (s *StoreSuite) TestNextGameUserMatch() {
 	s.router.ServeHTTP(s.w, req)
 
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-	assert.JSONEqf(s.T(), `{"params":"[\"--visits 10\"]","type":"match","matchGameId":1,"sha":"abcd","candidateSha":"efgh","flip":true}`, s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), `{"params":"[\"--visits 10\"]","type":"match","trainingId":1,"matchGameId":1,"sha":"abcd","candidateSha":"efgh","flip":true}`, s.w.Body.String(), "Body incorrect")
+}
+
+func (s *StoreSuite) TestNextGameMatchGameCap() {
+	initMatch(false)
+	config.Config.Matches.AssignmentBuffer = 1
+	defer func() { config.Config.Matches.AssignmentBuffer = 0 }()
+
+	// GameCap is 6, so 7 games get assigned and the next is a training game.
+	for i := 0; i < 8; i++ {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		if i < 7 {
+			assert.Contains(s.T(), s.w.Body.String(), `"type":"match"`)
+		} else {
+			assert.Contains(s.T(), s.w.Body.String(), `"type":"train"`)
+		}
+	}
+
+	match := db.Match{}
+	err := db.GetDB().Where("id = ?", 1).First(&match).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 7, match.GamesCreated)
+}
+
+func (s *StoreSuite) TestNextGameTrust() {
+	initMatch(false)
+	saved := config.Config.Trust
+	defer func() { config.Config.Trust = saved }()
+	config.Config.Trust.EstablishedGames = 1
+	config.Config.Trust.TrustedGames = 2
+
+	nextGame := func() string {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		return s.w.Body.String()
+	}
+
+	// New users only get training games.
+	assert.Contains(s.T(), nextGame(), `"type":"train"`)
+
+	user := db.User{}
+	if err := db.GetDB().Where("username = ?", "default").First(&user).Error; err != nil {
+		log.Fatal(err)
+	}
+	game := db.TrainingGame{UserID: user.ID, TrainingRunID: 1, NetworkID: 1}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+	// Counted again once the cached counts expire.
+	assert.Contains(s.T(), nextGame(), `"type":"train"`)
+	delete(gameCountsCache.users, user.ID)
+	assert.Contains(s.T(), nextGame(), `"type":"match"`)
+
+	// Re-validation matches need a trusted user.
+	if err := db.GetDB().Model(&db.Match{}).Where("id = ?", 1).Update("revalidation_of", 5).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Contains(s.T(), nextGame(), `"type":"train"`)
+
+	game = db.TrainingGame{UserID: user.ID, TrainingRunID: 1, NetworkID: 1}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+	delete(gameCountsCache.users, user.ID)
+	assert.Contains(s.T(), nextGame(), `"type":"match"`)
+}
+
+func (s *StoreSuite) TestShadowMatchGame() {
+	initMatch(false)
+	config.Config.Matches.ShadowRate = 1
+	defer func() { config.Config.Matches.ShadowRate = 0 }()
+
+	nextGame := func(username string) map[string]interface{} {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": username, "password": "1234", "version": "2", "allow_create": "1"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		var game map[string]interface{}
+		json.Unmarshal(s.w.Body.Bytes(), &game)
+		return game
+	}
+	matchResult := func(username string, id float64, result int) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/match_result", postParams(map[string]string{
+			"user":          username,
+			"password":      "1234",
+			"version":       "2",
+			"match_game_id": fmt.Sprintf("%d", int(id)),
+			"result":        fmt.Sprintf("%d", result),
+			"pgn":           "asdf",
+		}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	}
+
+	original := nextGame("default")
+	shadow := nextGame("other")
+	assert.Equal(s.T(), "match", shadow["type"])
+	assert.NotEqual(s.T(), original["matchGameId"], shadow["matchGameId"])
+	assert.Equal(s.T(), original["flip"], shadow["flip"])
+	// Both play with the same seed.
+	assert.Equal(s.T(), original["params"], shadow["params"])
+	assert.Contains(s.T(), shadow["params"], fmt.Sprintf("--seed=%d", int(original["matchGameId"].(float64))))
+
+	matchResult("default", original["matchGameId"].(float64), 1)
+	matchResult("other", shadow["matchGameId"].(float64), -1)
+
+	// Only the original counts in the match score.
+	match := db.Match{}
+	if err := db.GetDB().Where("id = ?", 1).First(&match).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, match.Wins)
+	assert.Equal(s.T(), 0, match.Losses)
+
+	for _, username := range []string{"default", "other"} {
+		user := db.User{}
+		if err := db.GetDB().Where("username = ?", username).First(&user).Error; err != nil {
+			log.Fatal(err)
+		}
+		assert.Equal(s.T(), 1, user.ShadowChecks)
+		assert.Equal(s.T(), 1, user.ShadowDisagreements)
+	}
 }
 
 func (s *StoreSuite) TestNextGameUserMatchDone() {
@@ -156,24 +432,41 @@ func (s *StoreSuite) TestNextGameUserMatchDone() {
 
 	// Shouldn't get a match back
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
 }
 
 func (s *StoreSuite) TestUploadGameNewUser() {
 	extraParams := map[string]string{
-		"user":        "foo",
-		"password":    "asdf",
-		"training_id": "1",
-		"network_id":  "1",
-		"version":     "1",
+		"user":         "foo",
+		"password":     "asdf",
+		"allow_create": "1",
+		"training_id":  "1",
+		"network_id":   "1",
+		"version":      "1",
 	}
 	tmpfile, _ := ioutil.TempFile("", "example")
 	defer os.Remove(tmpfile.Name())
+
+	// Unknown users are only created when the client asks for it.
+	delete(extraParams, "allow_create")
 	req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
 	if err != nil {
 		log.Fatal(err)
 	}
 	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"unknown_user"`)
+	var count int
+	db.GetDB().Model(&db.User{}).Where("username = ?", "foo").Count(&count)
+	assert.Equal(s.T(), 0, count)
+
+	s.w = httptest.NewRecorder()
+	extraParams["allow_create"] = "1"
+	req, err = client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.router.ServeHTTP(s.w, req)
 
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
 
@@ -193,11 +486,114 @@ func (s *StoreSuite) TestUploadGameNewUser() {
 	assert.Equal(s.T(), 1, network.GamesPlayed)
 }
 
+func (s *StoreSuite) TestUploadGameMetadata() {
+	extraParams := map[string]string{
+		"user":          "foo",
+		"password":      "asdf",
+		"allow_create":  "1",
+		"training_id":   "1",
+		"network_id":    "1",
+		"version":       "10",
+		"engineVersion": "v0.10",
+		"result":        "-1",
+		"plies":         "80",
+		"resigned":      "1",
+		"time_spent":    "42",
+	}
+	tmpfile, _ := ioutil.TempFile("", "example")
+	defer os.Remove(tmpfile.Name())
+	req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	network := db.Network{}
+	err = db.GetDB().Where("id = ?", 1).First(&network).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, network.BlackWins)
+	assert.Equal(s.T(), 1, network.Resigns)
+	assert.Equal(s.T(), int64(80), network.Plies)
+
+	game := db.TrainingGame{}
+	err = db.GetDB().Where("network_id = ?", 1).First(&game).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 80, game.Plies)
+	assert.True(s.T(), game.Resigned)
+	assert.Equal(s.T(), 42, game.TimeSpent)
+	assert.Equal(s.T(), "v0.10", game.EngineVersion)
+	assert.Equal(s.T(), []int{0, 10, 0}, []int{game.EngineMajor, game.EngineMinor, game.EnginePatch})
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/selfplay_stats", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `[{"id":1,"sha":"abcd","games":1,"draw_rate":0,"white_win_rate":0,"black_win_rate":100,"resign_rate":100,"avg_plies":80}]`, s.w.Body.String(), "Body incorrect")
+}
+
+func (s *StoreSuite) TestOpeningAssignment() {
+	book, _ := ioutil.TempFile("", "book")
+	defer os.Remove(book.Name())
+	book.WriteString("e2e4 e7e5\n")
+	book.Close()
+	db.GetDB().Model(&db.TrainingRun{}).Where("id = ?", 1).Update("opening_book", book.Name())
+
+	req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2", "features": "opening"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var nextGame client.NextGameResponse
+	err := json.Unmarshal(s.w.Body.Bytes(), &nextGame)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "e2e4 e7e5", nextGame.Opening)
+	assert.NotEqual(s.T(), uint(0), nextGame.OpeningId)
+
+	upload := func(user string) {
+		extraParams := map[string]string{
+			"user":          user,
+			"password":      "1234",
+			"training_id":   "1",
+			"network_id":    "1",
+			"version":       "10",
+			"engineVersion": "v0.10",
+			"opening_id":    fmt.Sprintf("%d", nextGame.OpeningId),
+		}
+		tmpfile, _ := ioutil.TempFile("", "example")
+		defer os.Remove(tmpfile.Name())
+		req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.w = httptest.NewRecorder()
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	// Only the user it was assigned to can claim it.
+	upload("defaut")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+
+	upload("default")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	game := db.TrainingGame{}
+	err = db.GetDB().Where("user_id = ?", 2).First(&game).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "e2e4 e7e5", game.Opening)
+}
+
 func uploadTestNetwork(s *StoreSuite, contentString string, networkId int) {
 	s.w = httptest.NewRecorder()
 	content := []byte(contentString)
 	var buf bytes.Buffer
-	zw := gzip.NewWriterLevel(&buf, BestCompression)
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
 	zw.Write(content)
 	zw.Close()
 
@@ -226,14 +622,15 @@ func uploadTestNetwork(s *StoreSuite, contentString string, networkId int) {
 		log.Fatal(err)
 	}
 	s.router.ServeHTTP(s.w, req)
-	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), 409, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"duplicate_network"`)
 
 	// /next_game shouldn't return new network now, since it hasn't passed yet.
 	s.w = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/next_game", nil)
 	s.router.ServeHTTP(s.w, req)
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-	assert.JSONEqf(s.T(), `{"params":"", "type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), `{"params":"", "type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
 
 	sha := sha256.Sum256(content)
 
@@ -265,7 +662,7 @@ func (s *StoreSuite) TestUploadNetwork() {
 	s.router.ServeHTTP(s.w, req)
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
 	sha := sha256.Sum256([]byte("this_is_a_network"))
-	assert.JSONEqf(s.T(), fmt.Sprintf(`{"params":"","type":"match","matchGameId":1,"sha":"abcd","candidateSha":"%x","flip":true}`, sha), s.w.Body.String(), "Body incorrect")
+	assert.JSONEqf(s.T(), fmt.Sprintf(`{"params":"","type":"match","trainingId":1,"matchGameId":1,"sha":"abcd","candidateSha":"%x","flip":true}`, sha), s.w.Body.String(), "Body incorrect")
 
 	uploadTestNetwork(s, "network2", 3)
 }
@@ -283,7 +680,7 @@ func testMatchResult(s *StoreSuite, promote bool) {
 		match_game_id := fmt.Sprintf("%d", i+1)
 		flip := (i & 1) == 0
 		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
-		assert.JSONEqf(s.T(), fmt.Sprintf(`{"params":"[\"--visits 10\"]","type":"match","matchGameId":%s,"sha":"abcd","candidateSha":"efgh","flip":%t}`, match_game_id, flip), s.w.Body.String(), "Body incorrect")
+		assert.JSONEqf(s.T(), fmt.Sprintf(`{"params":"[\"--visits 10\"]","type":"match","trainingId":1,"matchGameId":%s,"sha":"abcd","candidateSha":"efgh","flip":%t}`, match_game_id, flip), s.w.Body.String(), "Body incorrect")
 
 		// Now, post a result from the match
 		s.w = httptest.NewRecorder()
@@ -300,6 +697,7 @@ func testMatchResult(s *StoreSuite, promote bool) {
 			"match_game_id": match_game_id,
 			"result":        fmt.Sprintf("%d", result),
 			"pgn":           "asdf",
+			"time_spent":    "5",
 		}))
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		s.router.ServeHTTP(s.w, req)
@@ -316,6 +714,11 @@ func testMatchResult(s *StoreSuite, promote bool) {
 		assert.Equal(s.T(), result, match_game.Result)
 		assert.Equal(s.T(), "asdf", match_game.Pgn)
 		assert.Equal(s.T(), true, match_game.Done)
+		// Started 5 seconds before completion, but not before assignment.
+		if assert.NotNil(s.T(), match_game.StartedAt) && assert.NotNil(s.T(), match_game.CompletedAt) {
+			assert.False(s.T(), match_game.StartedAt.Before(match_game.CreatedAt))
+			assert.False(s.T(), match_game.CompletedAt.Before(*match_game.StartedAt))
+		}
 
 		// And now that the match is updated.
 		match := db.Match{}
@@ -332,18 +735,42 @@ func testMatchResult(s *StoreSuite, promote bool) {
 		log.Fatal(err)
 	}
 	assert.Equal(s.T(), true, match.Done)
+	if promote {
+		assert.InDelta(s.T(), 0.993, match.LikelihoodOfSuperiority, 0.001)
+	} else {
+		assert.InDelta(s.T(), 0.007, match.LikelihoodOfSuperiority, 0.001)
+	}
+
+	s.w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/matches/1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var durations struct {
+		Durations matchDurations
+	}
+	assert.Nil(s.T(), json.Unmarshal(s.w.Body.Bytes(), &durations))
+	assert.Equal(s.T(), 6, durations.Durations.Turnaround.Games)
+	assert.Equal(s.T(), 6, durations.Durations.Play.Games)
 
 	// And, now, we shouldn't get a match game back
 	s.w = httptest.NewRecorder()
-	req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+	req, _ = http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	s.router.ServeHTTP(s.w, req)
 
 	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
 	if promote {
-		assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":2,"sha":"efgh"}`, s.w.Body.String(), "Body incorrect")
+		assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":2,"sha":"efgh","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
+	} else {
+		assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+defaultRunConfig+`}`, s.w.Body.String(), "Body incorrect")
+	}
+
+	var promotions int
+	db.GetDB().Model(&db.PromotionEvent{}).Where("training_run_id = 1 AND network_id = 2 AND match_id = 1").Count(&promotions)
+	if promote {
+		assert.Equal(s.T(), 1, promotions)
 	} else {
-		assert.JSONEqf(s.T(), `{"params":"","type":"train","trainingId":1,"networkId":1,"sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+		assert.Equal(s.T(), 0, promotions)
 	}
 }
 
@@ -354,3 +781,2702 @@ func (s *StoreSuite) TestPostMatchResultFailed() {
 func (s *StoreSuite) TestPostMatchResultSuccess() {
 	testMatchResult(s, true)
 }
+
+func (s *StoreSuite) TestAdminMatchAgainstOtherRun() {
+	other := db.TrainingRun{Description: "other", Active: true}
+	if err := db.GetDB().Create(&other).Error; err != nil {
+		log.Fatal(err)
+	}
+	otherBest := db.Network{Sha: "efgh", TrainingRunID: other.ID}
+	candidate := db.Network{Sha: "ijkl", TrainingRunID: 1}
+	for _, network := range []*db.Network{&otherBest, &candidate} {
+		if err := db.GetDB().Create(network).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	db.GetDB().Model(&other).Update("best_network_id", otherBest.ID)
+
+	create := func(currentID uint) db.Match {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/matches", postParams(map[string]string{
+			"candidate_id": fmt.Sprint(candidate.ID),
+			"current_id":   fmt.Sprint(currentID),
+			"parameters":   `["--visits 10"]`,
+		}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "admin")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		match := db.Match{}
+		db.GetDB().Order("id desc").First(&match)
+		return match
+	}
+
+	// The best network of another run can't gate the candidate.
+	assert.True(s.T(), create(otherBest.ID).TestOnly)
+	assert.False(s.T(), create(1).TestOnly)
+}
+
+func (s *StoreSuite) TestSerializedMatchRebased() {
+	initMatch(false)
+	best := db.Network{Sha: "ijkl", TrainingRunID: 1}
+	if err := db.GetDB().Create(&best).Error; err != nil {
+		log.Fatal(err)
+	}
+	db.GetDB().Model(&db.TrainingRun{}).Where("id = ?", 1).Updates(map[string]interface{}{
+		"best_network_id": best.ID, "gating_policy": gatingSerialize,
+	})
+
+	// Before its first game the match is moved onto the new best, and
+	// that's what clients play.
+	req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"sha":"ijkl"`)
+	assert.Contains(s.T(), s.w.Body.String(), `"candidateSha":"efgh"`)
+
+	match := db.Match{}
+	db.GetDB().Where("id = ?", 1).First(&match)
+	assert.Equal(s.T(), best.ID, match.CurrentBestID)
+}
+
+func (s *StoreSuite) TestSerializeWaitsForFullMatch() {
+	// Match 1 has handed out all its games, but isn't finished.
+	initMatch(false)
+	db.GetDB().Model(&db.Match{}).Where("id = ?", 1).Update("games_created", 6)
+	queued := db.Match{TrainingRunID: 1, CandidateID: 2, CurrentBestID: 1, GameCap: 6}
+	if err := db.GetDB().Create(&queued).Error; err != nil {
+		log.Fatal(err)
+	}
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pending, err := serializeGatingMatches(trainingRun, []db.Match{queued})
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 0, len(pending))
+}
+
+func (s *StoreSuite) TestAdminTrainingRunWeight() {
+	req, _ := http.NewRequest("POST", "/admin/training_run/1/weight", postParams(map[string]string{"weight": "0.25"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	training_run := db.TrainingRun{}
+	err := db.GetDB().Where("id = ?", 1).First(&training_run).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 0.25, training_run.Weight)
+
+	// No credentials, no access.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/training_run/1/weight", postParams(map[string]string{"weight": "1"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 401, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestPickTrainingRunWeights() {
+	runs := []db.TrainingRun{{Weight: 0}, {Weight: 1}}
+	runs[0].ID = 1
+	runs[1].ID = 2
+	for i := 0; i < 10; i++ {
+		assert.Equal(s.T(), uint(2), pickTrainingRun(runs).ID)
+	}
+}
+
+func TestResolveTrainParameters(t *testing.T) {
+	params, err := resolveTrainParameters(`["--randomize", "-n"]`, 500)
+	assert.Nil(t, err)
+	assert.Equal(t, `["--randomize", "-n"]`, params)
+
+	schedule := `[{"games": 0, "params": ["--tempdecay=5"]}, {"games": 100000, "params": ["--tempdecay=10", "-n"]}]`
+	params, err = resolveTrainParameters(schedule, 500)
+	assert.Nil(t, err)
+	assert.Equal(t, `["--tempdecay=5"]`, params)
+
+	params, err = resolveTrainParameters(schedule, 100000)
+	assert.Nil(t, err)
+	assert.Equal(t, `["--tempdecay=10","-n"]`, params)
+
+	_, err = resolveTrainParameters(`[{"games": 10, "params": []}]`, 5)
+	assert.NotNil(t, err)
+}
+
+func TestRunConfig(t *testing.T) {
+	config, err := runConfig(`["--randomize", "-n", "-v800", "--tempdecay=10", "-r", "5"]`)
+	assert.Nil(t, err)
+	assert.Equal(t, 800, config.Visits)
+	assert.Equal(t, 5, config.ResignPercent)
+	assert.True(t, config.Temperature.Randomize)
+	assert.Equal(t, 10, config.Temperature.Decay)
+	assert.True(t, config.Noise.Enabled)
+
+	// Limiting playouts alone lifts the visit limit, as in the engine.
+	config, err = runConfig(`["--playouts=1600"]`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, config.Visits)
+	assert.Equal(t, 1600, config.Playouts)
+	assert.False(t, config.Temperature.Randomize)
+	assert.Equal(t, -1, config.ResignPercent)
+}
+
+func (s *StoreSuite) TestAdminSetTrainParameters() {
+	req, _ := http.NewRequest("POST", "/admin/training_run/1/train_parameters", postParams(map[string]string{"params": `["-n"]`}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	// Takes effect on the next assignment.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/next_game", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `{"params":"[\"-n\"]","type":"train","trainingId":1,"networkId":1,"sha":"abcd","config":`+strings.Replace(defaultRunConfig, `"enabled":false`, `"enabled":true`, 1)+`}`, s.w.Body.String(), "Body incorrect")
+
+	change := db.TrainParametersChange{}
+	err := db.GetDB().Where("training_run_id = ?", 1).First(&change).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "", change.OldParameters)
+	assert.Equal(s.T(), `["-n"]`, change.NewParameters)
+	assert.Equal(s.T(), "admin", change.ChangedBy)
+
+	// Garbage is rejected.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/training_run/1/train_parameters", postParams(map[string]string{"params": `-n`}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestEngineVersionDenied() {
+	req, _ := http.NewRequest("POST", "/admin/engine_versions", postParams(map[string]string{"version": "v0.11", "action": "deny", "reason": "broken rule50 handling"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	assert.NotNil(s.T(), checkEngineVersion("v0.11"))
+	assert.Contains(s.T(), checkEngineVersion("v0.11").Error(), "broken rule50 handling")
+	assert.NotNil(s.T(), checkEngineVersion("0.11.0"))
+	assert.Nil(s.T(), checkEngineVersion("v0.12"))
+	assert.NotNil(s.T(), checkEngineVersion("v0.9"))
+}
+
+func (s *StoreSuite) TestBestNetwork() {
+	req, _ := http.NewRequest("GET", "/api/v1/best_network?run=1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `{"run":1,"id":1,"sha":"abcd","url":"/cached/network/sha/abcd"}`, s.w.Body.String(), "Body incorrect")
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/network/id/1/download", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 302, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "/cached/network/sha/abcd", s.w.Header().Get("Location"))
+}
+
+func (s *StoreSuite) TestWorkStatus() {
+	req, _ := http.NewRequest("GET", "/api/v1/work_status?run=1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `{"run":1,"active":true,"best_network_id":1,"best_sha":"abcd"}`, s.w.Body.String(), "Body incorrect")
+	assert.Contains(s.T(), s.w.Header().Get("Cache-Control"), "max-age")
+	etag := s.w.Header().Get("ETag")
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/work_status?run=1", nil)
+	req.Header.Set("If-None-Match", etag)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 304, s.w.Code, s.w.Body.String())
+
+	// A new best network changes the ETag.
+	network := db.Network{Sha: "efgh", Path: "/tmp/network2", TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+	if err := db.GetDB().Model(&db.TrainingRun{}).Where("id = 1").Update("best_network_id", network.ID).Error; err != nil {
+		log.Fatal(err)
+	}
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/work_status?run=1", nil)
+	req.Header.Set("If-None-Match", etag)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"best_sha":"efgh"`)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/work_status?run=7", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func TestParseNetworkTags(t *testing.T) {
+	tags, err := parseNetworkTags(" LR-drop,arch-10x128,, lr-drop")
+	assert.Nil(t, err)
+	assert.Equal(t, "arch-10x128,lr-drop", tags)
+	tags, err = parseNetworkTags("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", tags)
+	_, err = parseNetworkTags("two words")
+	assert.NotNil(t, err)
+}
+
+func (s *StoreSuite) TestNetworkTags() {
+	req, _ := http.NewRequest("POST", "/admin/network/1/tags", postParams(map[string]string{"tags": "bugged-rule50,lr_drop", "notes": "Trained on broken rule50 data"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	// Notes are kept when only the tags change.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/network/1/tags", postParams(map[string]string{"tags": "bugged-rule50, lr_drop"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	network := db.Network{}
+	db.GetDB().Where("id = 1").First(&network)
+	assert.Equal(s.T(), "bugged-rule50,lr_drop", network.Tags)
+	assert.Equal(s.T(), "Trained on broken rule50 data", network.Notes)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/networks?tag=lr_drop", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "Trained on broken rule50 data")
+
+	// The underscore isn't a wildcard.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/networks?tag=lrxdrop", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.NotContains(s.T(), s.w.Body.String(), "Trained on broken rule50 data")
+
+	// Networks without a recorded checksum are left out, not hashed.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/networks/manifest?tag=bugged-rule50", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"networks":[]`)
+
+	db.GetDB().Model(&network).Update("file_checksum", "checksum")
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/networks/manifest?tag=bugged-rule50", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var manifest struct {
+		Networks []struct {
+			ID    uint
+			Tags  []string
+			Notes string
+		}
+	}
+	assert.Nil(s.T(), json.Unmarshal(s.w.Body.Bytes(), &manifest))
+	if assert.Equal(s.T(), 1, len(manifest.Networks)) {
+		assert.Equal(s.T(), []string{"bugged-rule50", "lr_drop"}, manifest.Networks[0].Tags)
+	}
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/networks/manifest?tag=Not+a+tag", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestIngestionStatsDisabled() {
+	req, _ := http.NewRequest("GET", "/api/v1/ingestion_stats", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `{"enabled":false,"depth":0,"capacity":0,"threshold":0,"workers":0,"processed":0,"failed":0,"rejected":0}`, s.w.Body.String(), "Body incorrect")
+}
+
+func (s *StoreSuite) TestUploadGamePgnTooLong() {
+	extraParams := map[string]string{
+		"user":         "foo",
+		"password":     "asdf",
+		"allow_create": "1",
+		"training_id":  "1",
+		"network_id":   "1",
+		"version":      "1",
+		"pgn":          strings.Repeat("e4 ", maxPgnLength()/3+1),
+	}
+	tmpfile, _ := ioutil.TempFile("", "example")
+	defer os.Remove(tmpfile.Name())
+	req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 413, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"too_large"`)
+	assert.Contains(s.T(), s.w.Body.String(), `"action":"drop"`)
+}
+
+func (s *StoreSuite) TestUploadBodyLimits() {
+	// Without a Content-Length the body isn't read at all.
+	req, _ := http.NewRequest("POST", "/upload_game", ioutil.NopCloser(strings.NewReader("user=foo")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = -1
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 411, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"action":"upgrade"`)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/match_result", postParams(map[string]string{
+		"user": "default",
+		"pgn":  strings.Repeat("e4 ", maxPgnLength()/3+formOverhead),
+	}))
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 413, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"too_large"`)
+}
+
+func (s *StoreSuite) TestUploadGameRejections() {
+	tmpfile, _ := ioutil.TempFile("", "example")
+	defer os.Remove(tmpfile.Name())
+	upload := func(password string, trainingID string) {
+		s.w = httptest.NewRecorder()
+		extraParams := map[string]string{
+			"user":        "default",
+			"password":    password,
+			"training_id": trainingID,
+			"network_id":  "1",
+			"version":     "1",
+		}
+		req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("X-Request-Id", "test")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	// Nothing wrong with the game, so the client shouldn't drop it.
+	upload("wrong", "1")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.JSONEq(s.T(), `{"status":"rejected","code":"wrong_password","message":"Wrong password for user default","retryable":false,"action":"stop","request_id":"test"}`, s.w.Body.String())
+
+	upload("1234", "99")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.JSONEq(s.T(), `{"status":"rejected","code":"invalid_training_run","message":"Invalid training run","retryable":false,"action":"drop","request_id":"test"}`, s.w.Body.String())
+
+	upload("1234", "1")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"uploaded"`)
+}
+
+func TestSweepParameters(t *testing.T) {
+	base := []interface{}{"--tempdecay=10", "--noise"}
+	assert.Equal(t, []string{"--noise", "--tempdecay=0"}, sweepParameters(base, []string{"--tempdecay=0"}))
+	assert.Equal(t, []string{"--tempdecay=10", "--noise", "-v800"}, sweepParameters(base, []string{"-v800"}))
+}
+
+func (s *StoreSuite) TestAdminCreateSweep() {
+	initMatch(true)
+
+	req, _ := http.NewRequest("POST", "/admin/sweeps", postParams(map[string]string{
+		"candidate_id": "2",
+		"current_id":   "1",
+		"variations":   `[["--tempdecay=0"], ["--tempdecay=5"], ["--tempdecay=20"]]`,
+		"games":        "100",
+	}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `{"id":1,"matches":3,"url":"/sweep/1"}`, s.w.Body.String(), "Body incorrect")
+
+	var matches []db.Match
+	err := db.GetDB().Where("sweep_id = ?", 1).Order("id").Find(&matches).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 3, len(matches))
+	assert.True(s.T(), matches[0].TestOnly)
+	assert.Equal(s.T(), 100, matches[0].GameCap)
+	assert.Equal(s.T(), `["--tempdecay=0"]`, matches[0].Parameters)
+
+	// Variations are checked against the engine flags.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/sweeps", postParams(map[string]string{
+		"candidate_id": "2",
+		"current_id":   "1",
+		"variations":   `[["--tempdecay=5"], ["--tempdecay=-1"]]`,
+	}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "--tempdecay must be between 0")
+}
+
+func TestShadowParameters(t *testing.T) {
+	params, err := shadowParameters(`["--visits=10","-s","5","-t4","--threads=2","-n"]`, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, `["--visits=10","-n","--seed=7"]`, params)
+	params, err = shadowParameters("", 7)
+	assert.Nil(t, err)
+	assert.Equal(t, `["--seed=7"]`, params)
+}
+
+func TestValidateEngineParameters(t *testing.T) {
+	assert.Nil(t, validateEngineParameters([]string{"--tempdecay=10", "-n", "--randomize", "-v800", "--playouts", "100", "-r", "-1", "--puct=0.85"}))
+
+	assert.EqualError(t, validateEngineParameters([]string{"--tempdecay=ten"}), `--tempdecay must be an integer, got "ten"`)
+	assert.EqualError(t, validateEngineParameters([]string{"-r101"}), "--resignpct must be between -1 and 100, got 101")
+	assert.EqualError(t, validateEngineParameters([]string{"--puct=0"}), "--puct must be between 0.01 and 100, got 0")
+	assert.EqualError(t, validateEngineParameters([]string{"--noise=1"}), "--noise takes no value")
+	assert.EqualError(t, validateEngineParameters([]string{"--visits"}), "--visits needs a value")
+	assert.EqualError(t, validateEngineParameters([]string{"-wnet.gz"}), "Engine flag --weights can't be set by parameters")
+	assert.EqualError(t, validateEngineParameters([]string{"--start=train"}), "Engine flag --start can't be set by parameters")
+	assert.EqualError(t, validateEngineParameters([]string{"--bogus"}), `Unknown engine flag "--bogus"`)
+	assert.EqualError(t, validateEngineParameters([]string{"10"}), `Unexpected engine argument "10"`)
+
+	assert.Nil(t, validateTrainParameters(`[{"games": 0, "params": ["-n"]}]`))
+	assert.EqualError(t, validateTrainParameters(`[{"games": 100, "params": ["-x"]}]`), `Stage from 100 games: Unknown engine flag "-x"`)
+}
+
+func TestTournamentRatings(t *testing.T) {
+	scores := map[uint]map[uint]pairingScore{
+		1: {2: {wins: 70, losses: 30}},
+		2: {1: {wins: 30, losses: 70}},
+	}
+	ratings := tournamentRatings([]uint{1, 2}, scores)
+	assert.Equal(t, 0.0, ratings[1])
+	assert.InDelta(t, -145.6, ratings[2], 0.1)
+}
+
+func (s *StoreSuite) TestAdminCreateTournament() {
+	initMatch(true)
+
+	req, _ := http.NewRequest("POST", "/admin/tournaments", postParams(map[string]string{
+		"network_ids": "1,2",
+		"format":      "round_robin",
+		"games":       "10",
+	}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEqf(s.T(), `{"id":1,"matches":1,"url":"/tournament/1"}`, s.w.Body.String(), "Body incorrect")
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/tournaments/1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"players":[1,2]`)
+}
+
+// Builds a gzipped V3 chunk of plies positions, won by white.
+func buildTestChunk(plies int) []byte {
+	raw := &bytes.Buffer{}
+	for i := 0; i < plies; i++ {
+		record := make([]byte, 8276)
+		binary.LittleEndian.PutUint32(record, 3)
+		binary.LittleEndian.PutUint32(record[4:], math.Float32bits(1))
+		record[8272] = byte(i % 2)
+		result := int8(1)
+		if i%2 == 1 {
+			result = -1
+		}
+		record[8275] = byte(result)
+		raw.Write(record)
+	}
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	zw.Write(raw.Bytes())
+	zw.Close()
+	return compressed.Bytes()
+}
+
+func TestExtractGameMetadata(t *testing.T) {
+	game := db.TrainingGame{}
+	extractGameMetadata(&game, buildTestChunk(5))
+	assert.Equal(t, 5, game.Plies)
+	assert.Equal(t, 1, game.Result)
+
+	// Truncated data is left alone.
+	game = db.TrainingGame{}
+	chunk := buildTestChunk(5)
+	extractGameMetadata(&game, chunk[:len(chunk)/2])
+	assert.Equal(t, 0, game.Plies)
+}
+
+func (s *StoreSuite) TestMatchTrainingData() {
+	initMatch(false)
+	if err := db.GetDB().Model(&db.Match{}).Where("id = 1").Update("training_data", true).Error; err != nil {
+		log.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"trainingData":true`)
+
+	tmpfile, _ := ioutil.TempFile("", "example")
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Write(buildTestChunk(4))
+	tmpfile.Close()
+	defer os.RemoveAll("match_games")
+	upload := func(user string) {
+		s.w = httptest.NewRecorder()
+		params := map[string]string{"user": user, "password": "1234", "version": "2", "match_game_id": "1"}
+		req, err := client.BuildUploadRequest("/match_training_data", params, "file", tmpfile.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	// Only from the user the game was assigned to.
+	upload("defaut")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"invalid_match_game"`)
+	upload("default")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"uploaded"`)
+	upload("default")
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"duplicate"`)
+
+	// Listed once the game has a result.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/match_training_data?run=1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEq(s.T(), `{"run":1,"matches":[]}`, s.w.Body.String())
+	if err := db.GetDB().Model(&db.MatchGame{}).Where("id = 1").Update("done", true).Error; err != nil {
+		log.Fatal(err)
+	}
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/match_training_data?run=1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.JSONEq(s.T(), `{"run":1,"matches":[{"id":1,"candidate_id":2,"current_id":1,"done":false,"games":1,"url":"/api/v1/matches/1/training_data"}]}`, s.w.Body.String())
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/matches/1/training_data", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	zr, err := gzip.NewReader(s.w.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	header, err := tr.Next()
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "training.1", header.Name)
+	assert.Equal(s.T(), int64(4*8276), header.Size)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/matches/7/training_data", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 404, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"not_found"`)
+}
+
+func TestInterleaveTrainingChunks(t *testing.T) {
+	// The positions of each side, as each engine records them.
+	side := func(plies int, first int) []byte {
+		zr, _ := gzip.NewReader(bytes.NewReader(buildTestChunk(plies * 2)))
+		data, _ := ioutil.ReadAll(zr)
+		raw := &bytes.Buffer{}
+		for i := first; i < plies*2; i += 2 {
+			raw.Write(data[i*8276 : (i+1)*8276])
+		}
+		compressed := &bytes.Buffer{}
+		zw := gzip.NewWriter(compressed)
+		zw.Write(raw.Bytes())
+		zw.Close()
+		return compressed.Bytes()
+	}
+
+	out := &bytes.Buffer{}
+	err := client.InterleaveTrainingChunks(bytes.NewReader(side(3, 0)), bytes.NewReader(side(3, 1)), out)
+	assert.Nil(t, err)
+	summary, err := client.ParseTrainingChunk(out)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 6, summary.Plies)
+		assert.Equal(t, 1, summary.Result)
+	}
+
+	// The engines' moves don't add up to one game.
+	err = client.InterleaveTrainingChunks(bytes.NewReader(side(3, 0)), bytes.NewReader(side(1, 1)), out)
+	assert.NotNil(t, err)
+}
+
+func (s *StoreSuite) TestUploadGameDuplicate() {
+	extraParams := map[string]string{
+		"user":         "foo",
+		"password":     "asdf",
+		"allow_create": "1",
+		"training_id":  "1",
+		"network_id":   "1",
+		"version":      "1",
+	}
+	tmpfile, _ := ioutil.TempFile("", "example")
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Write(buildTestChunk(4))
+	tmpfile.Close()
+
+	for i := 0; i < 2; i++ {
+		s.w = httptest.NewRecorder()
+		req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("X-Request-Id", "test")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	}
+	assert.JSONEq(s.T(), `{"status":"ok","code":"duplicate","message":"Duplicate game ignored","retryable":false,"action":"none","request_id":"test"}`, s.w.Body.String())
+
+	network := db.Network{}
+	err := db.GetDB().Where("id = ?", 1).First(&network).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, network.GamesPlayed)
+}
+
+func (s *StoreSuite) TestHealthz() {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"status":"ok"`)
+
+	// Below the threshold uploads are refused.
+	config.Config.Limits.MinFreeSpace = math.MaxInt64
+	defer func() { config.Config.Limits.MinFreeSpace = 0 }()
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/upload_network", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 507, s.w.Code, s.w.Body.String())
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	h.observe(0.5)
+	h.observe(1)
+	h.observe(5)
+	h.observe(50)
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	assert.Equal(t, 56.5, h.Sum)
+}
+
+func (s *StoreSuite) TestAdminDashboard() {
+	req, _ := http.NewRequest("GET", "/admin/", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/training_run/1/active", postParams(map[string]string{"active": "0"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	// No active runs left to assign games from.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Request-Id", "test")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.JSONEq(s.T(), `{"code":"invalid_training_run","message":"Invalid training run","request_id":"test"}`, s.w.Body.String())
+	assert.Equal(s.T(), "test", s.w.Header().Get("X-Request-Id"))
+}
+
+func (s *StoreSuite) TestAdminCreateMatch() {
+	initMatch(true)
+
+	req, _ := http.NewRequest("POST", "/admin/matches", postParams(map[string]string{
+		"candidate_id": "2",
+		"current_id":   "1",
+		"games":        "50",
+	}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	match := db.Match{}
+	err := db.GetDB().Order("id desc").First(&match).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 50, match.GameCap)
+	assert.False(s.T(), match.TestOnly)
+	assert.Equal(s.T(), `["--tempdecay=10"]`, match.Parameters)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/matches", postParams(map[string]string{
+		"candidate_id": "2",
+		"current_id":   "1",
+		"template":     "missing",
+	}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestAdminHeadToHeadMatch() {
+	// Networks 2 and 3, neither of them the run's best.
+	initMatch(true)
+	third := db.Network{Sha: "ijkl", Path: "/tmp/network3", TrainingRunID: 1}
+	if err := db.GetDB().Create(&third).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/matches", postParams(map[string]string{
+		"candidate_id": "3",
+		"current_id":   "2",
+		"games":        "20",
+		"parameters":   `["--visits=10000"]`,
+	}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	match := db.Match{}
+	err := db.GetDB().Order("id desc").First(&match).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.True(s.T(), match.TestOnly)
+	assert.Equal(s.T(), `["--visits=10000"]`, match.Parameters)
+
+	// Clients play the two networks of the match, not the run's best.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"sha":"efgh"`)
+	assert.Contains(s.T(), s.w.Body.String(), `"candidateSha":"ijkl"`)
+
+	for _, params := range []string{`--visits=10000`, `["--weights=x"]`} {
+		s.w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/admin/matches", postParams(map[string]string{
+			"candidate_id": "3",
+			"current_id":   "2",
+			"parameters":   params,
+		}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "admin")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	}
+}
+
+func (s *StoreSuite) TestAdminSetMatchParameters() {
+	initMatch(false)
+
+	nextGame := func() map[string]interface{} {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/next_game", postParams(map[string]string{"user": "default", "password": "1234", "version": "2"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		var game map[string]interface{}
+		json.Unmarshal(s.w.Body.Bytes(), &game)
+		return game
+	}
+	matchResult := func(id float64, result int) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/match_result", postParams(map[string]string{
+			"user":          "default",
+			"password":      "1234",
+			"version":       "2",
+			"match_game_id": fmt.Sprintf("%d", int(id)),
+			"result":        fmt.Sprintf("%d", result),
+			"pgn":           "asdf",
+		}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	}
+	setParams := func(params string) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/match/1/parameters", postParams(map[string]string{"params": params}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "admin")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	before := nextGame()
+	assert.Equal(s.T(), `["--visits 10"]`, before["params"])
+
+	setParams(`["--visits=-5"]`)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	setParams(`["--visits=20"]`)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	// Only games assigned after the change get the new parameters.
+	after := nextGame()
+	assert.Equal(s.T(), `["--visits=20"]`, after["params"])
+	matchResult(before["matchGameId"].(float64), 1)
+	matchResult(after["matchGameId"].(float64), -1)
+
+	s.w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/match/1/parameters", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var history struct {
+		Segments []struct {
+			Parameters string
+			Score      map[string]int
+		}
+	}
+	err := json.Unmarshal(s.w.Body.Bytes(), &history)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 2, len(history.Segments))
+	assert.Equal(s.T(), `["--visits 10"]`, history.Segments[0].Parameters)
+	assert.Equal(s.T(), map[string]int{"wins": 1, "losses": 0, "draws": 0}, history.Segments[0].Score)
+	assert.Equal(s.T(), `["--visits=20"]`, history.Segments[1].Parameters)
+	assert.Equal(s.T(), map[string]int{"wins": 0, "losses": 1, "draws": 0}, history.Segments[1].Score)
+}
+
+func (s *StoreSuite) TestRegister() {
+	req, _ := http.NewRequest("POST", "/register", postParams(map[string]string{"user": "bar", "password": "pw", "email": "bar@example.com"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	user := db.User{}
+	err := db.GetDB().Where("username = ?", "bar").First(&user).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "bar@example.com", user.Email)
+
+	// Taken names can't be registered again.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/register", postParams(map[string]string{"user": "bar", "password": "other"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestSetAnonymous() {
+	req, _ := http.NewRequest("POST", "/account/anonymous", postParams(map[string]string{"user": "defaut", "password": "1234", "anonymous": "1"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	user := db.User{}
+	err := db.GetDB().Where("username = ?", "defaut").First(&user).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.True(s.T(), user.Anonymous)
+	assert.Equal(s.T(), "anonymous", publicUsername(user.Username, user.Anonymous))
+
+	// Wrong password is rejected.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/account/anonymous", postParams(map[string]string{"user": "defaut", "password": "bad", "anonymous": "0"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+
+	// The placeholder name itself can't be registered.
+	assert.NotNil(s.T(), validateRegistration("anonymous", "pw", ""))
+}
+
+func TestValidateRegistration(t *testing.T) {
+	assert.Nil(t, validateRegistration("bob", "pw", "bob@example.com"))
+	assert.NotNil(t, validateRegistration("bob", "pw", "bob@example.com\r\nBcc: eve@example.com"))
+	assert.NotNil(t, validateRegistration("bob\n", "pw", ""))
+	assert.NotNil(t, validateRegistration("bob", "pw", "bob"))
+}
+
+func (s *StoreSuite) TestPasswordReset() {
+	user := db.User{}
+	err := db.GetDB().Where("username = ?", "defaut").First(&user).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	token, err := createPasswordReset(&user)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/password_reset/"+token, postParams(map[string]string{"password": "new"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	err = db.GetDB().Where("username = ?", "defaut").First(&user).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "new", user.Password)
+
+	// Tokens only work once.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/password_reset/"+token, postParams(map[string]string{"password": "again"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestPasswordResetRateLimit() {
+	db.GetDB().Model(&db.User{}).Where("username = ?", "defaut").Update("email", "defaut@example.com")
+	for i := 0; i < maxPasswordResets+2; i++ {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/password_reset", postParams(map[string]string{"user": "defaut"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	}
+	var resets int
+	db.GetDB().Model(&db.PasswordReset{}).Count(&resets)
+	assert.Equal(s.T(), maxPasswordResets, resets)
+}
+
+func TestSendEmailHeaderInjection(t *testing.T) {
+	saved := config.Config.Email
+	defer func() { config.Config.Email = saved }()
+	config.Config.Email.SMTPAddress = "localhost:0"
+	err := sendEmail("bob@example.com\r\nBcc: eve@example.com", "Subject", "Body")
+	assert.EqualError(t, err, "Line break in email header")
+}
+
+func (s *StoreSuite) TestAdminMergeUser() {
+	other := db.User{Username: "defualt", Password: "1234", ShadowChecks: 3, ShadowDisagreements: 1}
+	if err := db.GetDB().Create(&other).Error; err != nil {
+		log.Fatal(err)
+	}
+	game := db.TrainingGame{UserID: other.ID, TrainingRunID: 1, NetworkID: 1}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+	for _, record := range []interface{}{
+		&db.ReliabilityEvent{UserID: other.ID, Kind: reliabilityCrash},
+		&db.SpotCheck{UserID: other.ID},
+		&db.OpeningAssignment{UserID: other.ID, TrainingRunID: 1},
+	} {
+		if err := db.GetDB().Create(record).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/users/defualt/merge", postParams(map[string]string{"into": "defaut"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	user, err := getUserByName("defaut")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.GetDB().Where("id = ?", game.ID).First(&game).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), user.ID, game.UserID)
+	_, err = getUserByName("defualt")
+	assert.NotNil(s.T(), err)
+	for _, model := range []interface{}{&db.ReliabilityEvent{}, &db.SpotCheck{}, &db.OpeningAssignment{}} {
+		var count int
+		db.GetDB().Model(model).Where("user_id = ?", user.ID).Count(&count)
+		assert.Equal(s.T(), 1, count)
+	}
+	assert.Equal(s.T(), 3, user.ShadowChecks)
+	assert.Equal(s.T(), 1, user.ShadowDisagreements)
+}
+
+func (s *StoreSuite) TestAdminExcludeGames() {
+	initMatch(false)
+	for _, version := range []uint{10, 11} {
+		game := db.TrainingGame{UserID: 1, TrainingRunID: 1, NetworkID: 1, Version: version}
+		if err := db.GetDB().Create(&game).Error; err != nil {
+			log.Fatal(err)
+		}
+		matchGame := db.MatchGame{UserID: 1, MatchID: 1, Version: version, Result: 1, Done: true}
+		if err := db.GetDB().Create(&matchGame).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Without any filter, nothing is excluded.
+	req, _ := http.NewRequest("POST", "/admin/exclude_games", postParams(map[string]string{}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/exclude_games", postParams(map[string]string{"user": "defaut", "version": "11"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	var excluded int
+	db.GetDB().Model(&db.TrainingGame{}).Where("excluded = true").Count(&excluded)
+	assert.Equal(s.T(), 1, excluded)
+
+	network := db.Network{}
+	if err := db.GetDB().Where("id = 1").First(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, network.GamesPlayed)
+
+	match := db.Match{}
+	if err := db.GetDB().Where("id = 1").First(&match).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, match.Wins)
+}
+
+func (s *StoreSuite) TestAdminRollbackPromotion() {
+	initMatch(true)
+	if err := db.GetDB().Model(&db.Match{}).Where("id = 1").Update("passed", true).Error; err != nil {
+		log.Fatal(err)
+	}
+	if err := setBestNetwork(1, 2, 1); err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/training_run/1/rollback", postParams(map[string]string{"network_id": "1", "reason": "corrupt match results"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), uint(1), trainingRun.BestNetworkID)
+
+	match := db.Match{}
+	if err := db.GetDB().Where("id = 1").First(&match).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.True(s.T(), match.Invalidated)
+
+	event := db.PromotionEvent{}
+	if err := db.GetDB().Where("training_run_id = 1 AND rollback = true").First(&event).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.True(s.T(), event.Rollback)
+	assert.Equal(s.T(), uint(2), event.PreviousNetworkID)
+	assert.Equal(s.T(), "admin", event.CreatedBy)
+}
+
+func (s *StoreSuite) TestSerializeGatingMatches() {
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	matches := []db.Match{
+		{Model: gorm.Model{ID: 1}, CurrentBestID: 1, GamesCreated: 3},
+		{Model: gorm.Model{ID: 2}, CurrentBestID: 1},
+		{Model: gorm.Model{ID: 3}, CurrentBestID: 1, TestOnly: true},
+	}
+	result, err := serializeGatingMatches(trainingRun, matches)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 2, len(result))
+	assert.Equal(s.T(), uint(1), result[0].ID)
+	assert.Equal(s.T(), uint(3), result[1].ID)
+}
+
+func (s *StoreSuite) TestRevalidateGatingMatch() {
+	initMatch(false)
+	if err := db.GetDB().Model(&db.Match{}).Where("id = 1").Updates(map[string]interface{}{"wins": 6}).Error; err != nil {
+		log.Fatal(err)
+	}
+	newBest := db.Network{Sha: "ijkl", Path: "/tmp/network3", TrainingRunID: 1}
+	if err := db.GetDB().Create(&newBest).Error; err != nil {
+		log.Fatal(err)
+	}
+	if err := db.GetDB().Model(&db.TrainingRun{}).Where("id = 1").Updates(map[string]interface{}{"best_network_id": newBest.ID, "gating_policy": gatingRevalidate}).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	err := checkMatchFinished(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), newBest.ID, trainingRun.BestNetworkID)
+
+	revalidation := db.Match{}
+	if err := db.GetDB().Where("revalidation_of = 1").First(&revalidation).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), newBest.ID, revalidation.CurrentBestID)
+	assert.Equal(s.T(), uint(2), revalidation.CandidateID)
+}
+
+func (s *StoreSuite) TestArchitectureTracks() {
+	if err := db.GetDB().Model(&db.Network{}).Where("id = 1").Updates(map[string]interface{}{"layers": 10, "filters": 128}).Error; err != nil {
+		log.Fatal(err)
+	}
+	setPrimary := func(architecture string) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/training_run/1/primary_architecture", postParams(map[string]string{"architecture": architecture}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "admin")
+		s.router.ServeHTTP(s.w, req)
+	}
+	// A match from before tracks, of a candidate that wasn't promoted.
+	legacy := db.Network{Sha: "qrst", Path: "/tmp/network5", TrainingRunID: 1, Layers: 6, Filters: 64}
+	if err := db.GetDB().Create(&legacy).Error; err != nil {
+		log.Fatal(err)
+	}
+	legacyMatch := db.Match{TrainingRunID: 1, CandidateID: legacy.ID, CurrentBestID: 1, GameCap: 6, GamesCreated: 6, Losses: 6, Done: true}
+	if err := db.GetDB().Create(&legacyMatch).Error; err != nil {
+		log.Fatal(err)
+	}
+	setPrimary("10x128")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	if err := db.GetDB().Where("id = ?", legacyMatch.ID).First(&legacyMatch).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "6x64", legacyMatch.Architecture)
+	setPrimary("6x64")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	setPrimary("big")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+
+	small := db.Network{Sha: "ijkl", Path: "/tmp/network3", TrainingRunID: 1, Layers: 6, Filters: 64}
+	if err := db.GetDB().Create(&small).Error; err != nil {
+		log.Fatal(err)
+	}
+	candidate := db.Network{Sha: "mnop", Path: "/tmp/network4", TrainingRunID: 1, Layers: 6, Filters: 64}
+	if err := db.GetDB().Create(&candidate).Error; err != nil {
+		log.Fatal(err)
+	}
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setTrackBestNetwork(trainingRun, "6x64", small.ID, 0); err != nil {
+		log.Fatal(err)
+	}
+
+	// Gating on one track doesn't hold up the other.
+	if err := db.GetDB().Model(trainingRun).Update("gating_policy", gatingSerialize).Error; err != nil {
+		log.Fatal(err)
+	}
+	matches := []db.Match{
+		{TrainingRunID: 1, CandidateID: candidate.ID, CurrentBestID: small.ID, Architecture: "6x64", GameCap: 6, GamesCreated: 6, Wins: 6},
+		{TrainingRunID: 1, CandidateID: candidate.ID, CurrentBestID: small.ID, Architecture: "6x64", GameCap: 6},
+		{TrainingRunID: 1, CandidateID: 2, CurrentBestID: 1, Architecture: "10x128", GameCap: 6},
+	}
+	for i := range matches {
+		if err := db.GetDB().Create(&matches[i]).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	pending, err := serializeGatingMatches(trainingRun, matches)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if assert.Equal(s.T(), 2, len(pending)) {
+		assert.Equal(s.T(), matches[0].ID, pending[0].ID)
+		assert.Equal(s.T(), matches[2].ID, pending[1].ID)
+	}
+
+	// Passing promotes on the candidate's track only.
+	if err := checkMatchFinished(matches[0].ID); err != nil {
+		log.Fatal(err)
+	}
+	trainingRun, err = getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), uint(1), trainingRun.BestNetworkID)
+	bestID, err := trackBestNetworkID(trainingRun, "6x64")
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), candidate.ID, bestID)
+
+	// Switching the primary architecture serves selfplay from the other
+	// track's best.
+	setPrimary("6x64")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	trainingRun, err = getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "6x64", trainingRun.PrimaryArchitecture)
+	assert.Equal(s.T(), candidate.ID, trainingRun.BestNetworkID)
+	bestID, err = trackBestNetworkID(trainingRun, "10x128")
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), uint(1), bestID)
+}
+
+func TestReplicationCommand(t *testing.T) {
+	saved := config.Config.Replication.Command
+	defer func() { config.Config.Replication.Command = saved }()
+	config.Config.Replication.Command = []string{"aws", "s3", "cp", "%FILE_PATH%", "s3://bucket/%KEY%"}
+	cmd := replicationCommand(filepath.Join("games", "run1", "training.7.gz"))
+	assert.Equal(t, []string{"aws", "s3", "cp", filepath.Join("games", "run1", "training.7.gz"), "s3://bucket/games/run1/training.7.gz"}, cmd.Args)
+}
+
+func TestSpoolUpload(t *testing.T) {
+	defer os.RemoveAll(ingestionSpoolDir)
+	upload := &gameUpload{
+		game:           db.TrainingGame{UserID: 2, NetworkID: 1, Plies: 80},
+		data:           []byte("game"),
+		pgn:            "1. e4 *",
+		resignAnalysis: "5:1:0",
+	}
+	upload.resign, _ = parseResignAnalysis(upload.resignAnalysis)
+	if err := spoolUpload(upload); err != nil {
+		t.Fatal(err)
+	}
+
+	spooled := spooledUploads()
+	if assert.Equal(t, 1, len(spooled)) {
+		assert.Equal(t, upload.spoolPath, spooled[0].spoolPath)
+		assert.Equal(t, 80, spooled[0].game.Plies)
+		assert.Equal(t, upload.data, spooled[0].data)
+		assert.Equal(t, upload.pgn, spooled[0].pgn)
+		assert.Equal(t, upload.resign, spooled[0].resign)
+	}
+}
+
+func TestCalcLOS(t *testing.T) {
+	assert.Equal(t, 0.5, calcLOS(0, 0))
+	assert.Equal(t, 0.5, calcLOS(10, 10))
+	assert.InDelta(t, 0.841, calcLOS(10, 6), 0.001)
+	assert.InDelta(t, 0.159, calcLOS(6, 10), 0.001)
+	assert.InDelta(t, 1.0, calcLOS(100, 0), 0.001)
+}
+
+func TestSprtDecision(t *testing.T) {
+	saved := config.Config.Matches.SPRT
+	defer func() { config.Config.Matches.SPRT = saved }()
+
+	// Disabled unless Elo1 > Elo0.
+	config.Config.Matches.SPRT.Elo0 = 0
+	config.Config.Matches.SPRT.Elo1 = 0
+	match := db.Match{Wins: 60, Losses: 30, Draws: 10}
+	assert.Equal(t, 0, sprtDecision(&match))
+
+	config.Config.Matches.SPRT.Elo1 = 35
+	assert.Equal(t, 1, sprtDecision(&match))
+	assert.Equal(t, -1, sprtDecision(&db.Match{Wins: 30, Losses: 60, Draws: 10}))
+	assert.Equal(t, 0, sprtDecision(&db.Match{Wins: 6, Losses: 4, Draws: 2}))
+	assert.Equal(t, 0, sprtDecision(&db.Match{Wins: 60, Losses: 30, Draws: 10, TestOnly: true}))
+}
+
+func TestSprtStatus(t *testing.T) {
+	saved := config.Config.Matches.SPRT
+	defer func() { config.Config.Matches.SPRT = saved }()
+
+	config.Config.Matches.SPRT.Elo0 = 0
+	config.Config.Matches.SPRT.Elo1 = 0
+	match := db.Match{Wins: 60, Losses: 30, Draws: 10}
+	assert.Nil(t, sprtStatus(&match))
+
+	config.Config.Matches.SPRT.Elo1 = 35
+	status := sprtStatus(&match)
+	assert.Equal(t, "accepted H1", status["state"])
+	assert.InDelta(t, math.Log(19), status["upper"], 0.001)
+	assert.Equal(t, "running", sprtStatus(&db.Match{Wins: 6, Losses: 4, Draws: 2})["state"])
+	assert.Nil(t, sprtStatus(&db.Match{TestOnly: true}))
+}
+
+func (s *StoreSuite) TestCancelStaleMatches() {
+	saved := config.Config.Matches
+	defer func() { config.Config.Matches = saved }()
+	config.Config.Matches.IdleHours = 1
+	config.Config.Matches.CancelSuperseded = true
+
+	initMatch(false)
+	idle := db.Match{TrainingRunID: 1, CandidateID: 2, CurrentBestID: 1, GameCap: 6}
+	idle.CreatedAt = time.Now().Add(-2 * time.Hour)
+	if err := db.GetDB().Create(&idle).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	// Match 1 is recent, so only the idle one is cancelled.
+	err := cancelStaleMatches()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var matches []db.Match
+	db.GetDB().Order("id").Find(&matches)
+	assert.False(s.T(), matches[0].Cancelled)
+	assert.True(s.T(), matches[1].Cancelled)
+	assert.True(s.T(), matches[1].Done)
+
+	// Promoting another network supersedes match 1.
+	if err := setBestNetwork(1, 2, 0); err != nil {
+		log.Fatal(err)
+	}
+	err = cancelStaleMatches()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.GetDB().Order("id").Find(&matches)
+	assert.True(s.T(), matches[0].Cancelled)
+}
+
+func (s *StoreSuite) TestRecountMatchSlots() {
+	initMatch(false)
+	db.GetDB().Model(&db.Match{}).Where("id = ?", 1).Update("games_created", 6)
+	games := []db.MatchGame{
+		{UserID: 1, MatchID: 1, Done: true},
+		{UserID: 1, MatchID: 1, Done: true, Excluded: true},
+		{UserID: 1, MatchID: 1},
+		{UserID: 1, MatchID: 1},
+	}
+	for i := range games {
+		if err := db.GetDB().Create(&games[i]).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	db.GetDB().Model(&games[3]).Update("created_at", time.Now().Add(-2*staleAssignmentAge))
+
+	// Only the played game and the recent assignment keep their slots.
+	err := cancelStaleMatches()
+	if err != nil {
+		log.Fatal(err)
+	}
+	match := db.Match{}
+	db.GetDB().Where("id = ?", 1).First(&match)
+	assert.Equal(s.T(), 2, match.GamesCreated)
+}
+
+func (s *StoreSuite) TestSprtStaleAssignments() {
+	saved := config.Config.Matches.SPRT
+	defer func() { config.Config.Matches.SPRT = saved }()
+	config.Config.Matches.SPRT.Elo0 = 0
+	config.Config.Matches.SPRT.Elo1 = 35
+
+	initMatch(false)
+	err := db.GetDB().Model(&db.Match{}).Where("id = ?", 1).Updates(map[string]interface{}{
+		"game_cap": 400, "games_created": 101, "wins": 60, "losses": 30, "draws": 10,
+	}).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	game := db.MatchGame{UserID: 1, MatchID: 1}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	// Decided, but a game is still out.
+	err = cancelStaleMatches()
+	if err != nil {
+		log.Fatal(err)
+	}
+	match := db.Match{}
+	db.GetDB().Where("id = ?", 1).First(&match)
+	assert.False(s.T(), match.Done)
+
+	// Once it's lost, the match closes with the SPRT's result.
+	db.GetDB().Model(&game).Update("created_at", time.Now().Add(-2*staleAssignmentAge))
+	err = cancelStaleMatches()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.GetDB().Where("id = ?", 1).First(&match)
+	assert.True(s.T(), match.Done)
+	assert.True(s.T(), match.Passed)
+	assert.False(s.T(), match.Cancelled)
+}
+
+func (s *StoreSuite) TestSprtUndecidedAtGameCap() {
+	saved := config.Config.Matches.SPRT
+	defer func() { config.Config.Matches.SPRT = saved }()
+	config.Config.Matches.SPRT.Elo0 = 0
+	config.Config.Matches.SPRT.Elo1 = 35
+
+	// Ahead on Elo, but not enough for the SPRT.
+	initMatch(false)
+	err := db.GetDB().Model(&db.Match{}).Where("id = ?", 1).Updates(map[string]interface{}{
+		"game_cap": 12, "games_created": 12, "wins": 6, "losses": 4, "draws": 2,
+	}).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := checkMatchFinished(1); err != nil {
+		log.Fatal(err)
+	}
+	match := db.Match{}
+	db.GetDB().Where("id = ?", 1).First(&match)
+	assert.True(s.T(), match.Done)
+	assert.False(s.T(), match.Passed)
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), uint(1), trainingRun.BestNetworkID)
+}
+
+func (s *StoreSuite) TestNetworkPgn() {
+	game := db.TrainingGame{UserID: 1, TrainingRunID: 1, NetworkID: 1}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+	pgnPath := fmt.Sprintf("pgns/run1/%d.pgn", game.ID)
+	os.MkdirAll("pgns/run1", os.ModePerm)
+	if err := ioutil.WriteFile(pgnPath, []byte("1. e4 e5 1/2-1/2"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(pgnPath)
+	defer os.RemoveAll(networkPgnDir)
+
+	req, _ := http.NewRequest("GET", "/api/v1/network/id/1/pgn", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	zr, err := gzip.NewReader(s.w.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pgn, err := ioutil.ReadAll(zr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "1. e4 e5 1/2-1/2\n\n", string(pgn))
+
+	// Once the game count changes a new file is built, reading compacted
+	// PGNs back from their archive.  Network 1 is the best, whose file is
+	// otherwise kept for an hour.
+	archive := &bytes.Buffer{}
+	gw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gw)
+	archived := []byte("1. d4 d5 1/2-1/2")
+	tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("%d.pgn", game.ID), Size: int64(len(archived)), Mode: 0644})
+	tw.Write(archived)
+	tw.Close()
+	gw.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pgn0.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive.Bytes())
+	}))
+	defer server.Close()
+	saved := config.Config.Storage.Runs
+	defer func() { config.Config.Storage.Runs = saved }()
+	config.Config.Storage.Runs = map[string]config.RunStorage{"1": {PgnURL: server.URL + "/"}}
+	os.Remove(pgnPath)
+	cached, err := cachedNetworkPgns(&db.Network{ID: 1})
+	if err != nil || len(cached) != 1 {
+		log.Fatal(cached, err)
+	}
+	old := filepath.Join(networkPgnDir, cached[0].Name())
+	os.Chtimes(old, time.Now().Add(-2*networkPgnMaxAge), time.Now().Add(-2*networkPgnMaxAge))
+
+	other := db.TrainingGame{UserID: 1, TrainingRunID: 1, NetworkID: 1}
+	if err := db.GetDB().Create(&other).Error; err != nil {
+		log.Fatal(err)
+	}
+	path, err := getNetworkPgn(&db.Network{ID: 1, TrainingRunID: 1})
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), networkPgnPath(&db.Network{ID: 1}, 2), path)
+	_, err = os.Stat(old)
+	assert.True(s.T(), os.IsNotExist(err))
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	zr, err = gzip.NewReader(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pgn, err = ioutil.ReadAll(zr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "1. d4 d5 1/2-1/2\n\n", string(pgn))
+}
+
+func (s *StoreSuite) TestResignStats() {
+	samples, err := parseResignAnalysis("5:1:0,10:1:1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := recordResignStats(1, samples); err != nil {
+			log.Fatal(err)
+		}
+	}
+	_, err = parseResignAnalysis("5:1")
+	assert.NotNil(s.T(), err)
+
+	req, _ := http.NewRequest("GET", "/api/v1/resign_stats", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEq(s.T(), `{"run":1,"networks":[{"network_id":1,"sha":"abcd","thresholds":[
+{"threshold":5,"games":2,"resign_rate":1,"false_positive_rate":0,"false_positives":0},
+{"threshold":10,"games":2,"resign_rate":1,"false_positive_rate":1,"false_positives":2}]}]}`, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestAdminTrainingRunGamesTarget() {
+	trainingRun, err := getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 40000, trainingRun.GamesTarget)
+
+	req, _ := http.NewRequest("POST", "/admin/training_run/1/games_target", postParams(map[string]string{"games_target": "250000"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	trainingRun, err = getTrainingRun(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 250000, trainingRun.GamesTarget)
+}
+
+func (s *StoreSuite) TestApiActiveUsers() {
+	game := db.TrainingGame{UserID: 1, TrainingRunID: 1, NetworkID: 1, Version: 10, EngineVersion: "v0.9.2", EngineMinor: 9, EnginePatch: 2}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+	old := db.TrainingGame{UserID: 1, TrainingRunID: 1, NetworkID: 1, Version: 10, EngineVersion: "v0.10", EngineMinor: 10}
+	old.CreatedAt = time.Now().Add(-3 * 24 * time.Hour)
+	if err := db.GetDB().Create(&old).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/active_users", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	var result struct {
+		ActiveUsers int `json:"active_users"`
+		Users       []struct {
+			User       string `json:"user"`
+			GamesToday int    `json:"games_today"`
+			GamesWeek  int    `json:"games_week"`
+			Engine     string `json:"engine"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(s.w.Body.Bytes(), &result); err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, result.ActiveUsers)
+	assert.Equal(s.T(), "defaut", result.Users[0].User)
+	assert.Equal(s.T(), 1, result.Users[0].GamesToday)
+	assert.Equal(s.T(), 2, result.Users[0].GamesWeek)
+	// The newest version, not the lexically greatest.
+	assert.Equal(s.T(), "v0.10", result.Users[0].Engine)
+}
+
+func TestEngineVersionSegments(t *testing.T) {
+	major, minor, patch := engineVersionSegments("v0.11.2")
+	assert.Equal(t, []int{0, 11, 2}, []int{major, minor, patch})
+	major, minor, patch = engineVersionSegments("1.2")
+	assert.Equal(t, []int{1, 2, 0}, []int{major, minor, patch})
+	major, minor, patch = engineVersionSegments("broken")
+	assert.Equal(t, []int{0, 0, 0}, []int{major, minor, patch})
+}
+
+func TestSanitizeReported(t *testing.T) {
+	assert.Equal(t, "linux/amd64 GTX", sanitizeReported(" linux/amd64\x00 GTX\n", 64))
+	assert.Equal(t, "open", sanitizeReported("opencl", 4))
+}
+
+func (s *StoreSuite) TestActiveUsersBackends() {
+	game := db.TrainingGame{UserID: 1, TrainingRunID: 1, NetworkID: 1, Backend: "opencl", System: "linux/amd64 GTX 1080"}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	users, err := getActiveUsers(1, -1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), "linux/amd64 GTX 1080", users["users"].([]gin.H)[0]["system"])
+	backends := users["backends"].([]*backendSummary)
+	assert.Equal(s.T(), 1, len(backends))
+	assert.Equal(s.T(), backendSummary{Backend: "opencl", Users: 1, Games: 1}, *backends[0])
+}
+
+func (s *StoreSuite) TestCachedGetNetworkRange() {
+	tmpfile, _ := ioutil.TempFile("", "network")
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write([]byte("0123456789")); err != nil {
+		log.Fatal(err)
+	}
+	tmpfile.Close()
+	network := db.Network{Sha: "range", Path: tmpfile.Name(), TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/cached/network/sha/range", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "10", s.w.Header().Get("Content-Length"))
+	assert.Equal(s.T(), "bytes", s.w.Header().Get("Accept-Ranges"))
+
+	// Resuming after the first 5 bytes.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cached/network/sha/range", nil)
+	req.Header.Set("Range", "bytes=5-")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 206, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "56789", s.w.Body.String())
+	assert.Equal(s.T(), "bytes 5-9/10", s.w.Header().Get("Content-Range"))
+
+	// The file changed since the partial download, so it's sent whole.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cached/network/sha/range", nil)
+	req.Header.Set("Range", "bytes=5-")
+	req.Header.Set("If-Range", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "0123456789", s.w.Body.String())
+}
+
+func (s *StoreSuite) TestCachedGetNetworkETag() {
+	tmpfile, _ := ioutil.TempFile("", "network")
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write([]byte("0123456789")); err != nil {
+		log.Fatal(err)
+	}
+	tmpfile.Close()
+	network := db.Network{Sha: "etag", Path: tmpfile.Name(), TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/cached/network/sha/etag", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), `"etag"`, s.w.Header().Get("ETag"))
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cached/network/sha/etag", nil)
+	req.Header.Set("If-None-Match", `"etag"`)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 304, s.w.Code)
+	assert.Equal(s.T(), "", s.w.Body.String())
+}
+
+func (s *StoreSuite) TestCachedGetNetworkEncoding() {
+	tmpfile, _ := ioutil.TempFile("", "network")
+	defer os.Remove(tmpfile.Name())
+	zw := gzip.NewWriter(tmpfile)
+	zw.Write([]byte("weights"))
+	zw.Close()
+	tmpfile.Close()
+	compressed, _ := ioutil.ReadFile(tmpfile.Name())
+	network := db.Network{Sha: "encoding", Path: tmpfile.Name(), TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/cached/network/sha/encoding", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), compressed, s.w.Body.Bytes())
+	assert.Equal(s.T(), "gzip", s.w.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), "text/plain; charset=utf-8", s.w.Header().Get("Content-Type"))
+	assert.Equal(s.T(), "Accept-Encoding", s.w.Header().Get("Vary"))
+	assert.Contains(s.T(), s.w.Header().Get("Cache-Control"), "immutable")
+
+	// Sent decompressed to clients refusing gzip.
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cached/network/sha/encoding", nil)
+	req.Header.Set("Accept-Encoding", "identity, gzip;q=0")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "weights", s.w.Body.String())
+	assert.Equal(s.T(), "", s.w.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), `"encoding-identity"`, s.w.Header().Get("ETag"))
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cached/network/sha/encoding", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("If-None-Match", `"encoding-identity"`)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 304, s.w.Code)
+}
+
+func (s *StoreSuite) TestAcceptsGzip() {
+	assert.True(s.T(), acceptsGzip(""))
+	assert.True(s.T(), acceptsGzip("gzip"))
+	assert.True(s.T(), acceptsGzip("deflate, GZIP;q=0.5"))
+	assert.True(s.T(), acceptsGzip("*"))
+	assert.False(s.T(), acceptsGzip("identity"))
+	assert.False(s.T(), acceptsGzip("gzip;q=0, *"))
+	assert.False(s.T(), acceptsGzip("*;q=0"))
+}
+
+func (s *StoreSuite) TestNetworkFormats() {
+	oldConvert := config.Config.URLs.ConvertNetwork
+	defer func() {
+		config.Config.URLs.ConvertNetwork = oldConvert
+	}()
+	config.Config.URLs.ConvertNetwork = []string{"cp", "%NETWORK_PATH%", "%OUTPUT_PATH%"}
+
+	tmpfile, _ := ioutil.TempFile("", "network")
+	defer os.Remove(tmpfile.Name())
+	defer os.Remove(tmpfile.Name() + protoSuffix)
+	if _, err := tmpfile.Write([]byte("0123456789")); err != nil {
+		log.Fatal(err)
+	}
+	tmpfile.Close()
+	network := db.Network{Sha: "formats", Path: tmpfile.Name(), TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	// Not converted yet.
+	req, _ := http.NewRequest("GET", "/cached/network/sha/formats.pb.gz", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 404, s.w.Code, s.w.Body.String())
+
+	assert.Nil(s.T(), convertNetwork(&network))
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cached/network/sha/formats.pb.gz", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "0123456789", s.w.Body.String())
+	assert.Equal(s.T(), `"formats.pb.gz"`, s.w.Header().Get("ETag"))
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/get_network?sha=formats", nil)
+	req.Header.Set("Accept", "application/x-protobuf")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 301, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), config.Config.URLs.NetworkLocation+"formats.pb.gz", s.w.Header().Get("Location"))
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/get_network?sha=formats", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), config.Config.URLs.NetworkLocation+"formats", s.w.Header().Get("Location"))
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/get_network?sha=formats&format=onnx", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestVerifyNetworks() {
+	writeNetwork := func(path string, content string) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(content))
+		zw.Close()
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	tmpfile, _ := ioutil.TempFile("", "network")
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+	writeNetwork(tmpfile.Name(), "weights")
+	network := db.Network{Sha: fmt.Sprintf("%x", sha256.Sum256([]byte("weights"))), Path: tmpfile.Name(), TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Nil(s.T(), updateNetworkChecksum(&network))
+
+	verifyNetworks()
+	db.GetDB().First(&network, network.ID)
+	assert.NotNil(s.T(), network.VerifiedAt)
+	assert.Equal(s.T(), "", network.VerifyError)
+
+	// Overwritten by another network.
+	writeNetwork(tmpfile.Name(), "other weights")
+	verifyNetworks()
+	db.GetDB().First(&network, network.ID)
+	assert.Contains(s.T(), network.VerifyError, "hashes to")
+
+	s.w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "Networks failing verification")
+}
+
+func (s *StoreSuite) TestProgressETag() {
+	req, _ := http.NewRequest("GET", "/api/v1/progress", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	etag := s.w.Header().Get("ETag")
+	assert.NotEqual(s.T(), "", etag)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/progress", nil)
+	req.Header.Set("If-None-Match", etag)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 304, s.w.Code)
+
+	// A new match changes the progress, and so the ETag.
+	candidate := db.Network{Sha: "efgh", Path: "/tmp/network2", TrainingRunID: 1}
+	if err := db.GetDB().Create(&candidate).Error; err != nil {
+		log.Fatal(err)
+	}
+	match := db.Match{TrainingRunID: 1, CandidateID: candidate.ID, CurrentBestID: 1, Wins: 10, Done: true, Passed: true}
+	if err := db.GetDB().Create(&match).Error; err != nil {
+		log.Fatal(err)
+	}
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/progress", nil)
+	req.Header.Set("If-None-Match", etag)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code)
+	assert.NotEqual(s.T(), etag, s.w.Header().Get("ETag"))
+}
+
+func (s *StoreSuite) TestSpotCheckComparison() {
+	probs, err := parseEngineProbabilities("probs 0:0.750000 5:0.250000", 8)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), []float32{0.75, 0, 0, 0, 0, 0.25, 0, 0}, probs)
+	_, err = parseEngineProbabilities("probs 9:1.0", 8)
+	assert.NotNil(s.T(), err)
+
+	uploaded := []float32{0.25, 0, 0, 0, 0, 0.75, 0, 0}
+	assert.InDelta(s.T(), 0.5, probabilityDistance(uploaded, probs), 1e-6)
+	assert.InDelta(s.T(), 0.0, probabilityDistance(probs, probs), 1e-6)
+}
+
+func (s *StoreSuite) TestSpotCheckSummary() {
+	checks := []db.SpotCheck{
+		{TrainingGameID: 1, UserID: 1, EngineVersion: "v0.10", Positions: 3, Discrepancies: 0, MaxDistance: 0.1},
+		{TrainingGameID: 2, UserID: 1, EngineVersion: "v0.9", Positions: 3, Discrepancies: 3, MaxDistance: 0.9},
+	}
+	for _, check := range checks {
+		if err := db.GetDB().Create(&check).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/spot_checks", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	var result struct {
+		SpotChecks []struct {
+			EngineVersion   string  `json:"engine_version"`
+			Discrepancies   int     `json:"discrepancies"`
+			DiscrepancyRate float64 `json:"discrepancy_rate"`
+		} `json:"spot_checks"`
+	}
+	json.Unmarshal(s.w.Body.Bytes(), &result)
+	assert.Equal(s.T(), 2, len(result.SpotChecks))
+	assert.Equal(s.T(), "v0.9", result.SpotChecks[0].EngineVersion)
+	assert.Equal(s.T(), 3, result.SpotChecks[0].Discrepancies)
+	assert.Equal(s.T(), 1.0, result.SpotChecks[0].DiscrepancyRate)
+}
+
+func TestOriginAddress(t *testing.T) {
+	saved := config.Config.Clients.TrustedProxies
+	defer func() { config.Config.Clients.TrustedProxies = saved }()
+	origin := func(remote string, forwarded string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("POST", "/upload_game", nil)
+		c.Request.RemoteAddr = remote
+		c.Request.Header.Set("X-Forwarded-For", forwarded)
+		return originAddress(c).String()
+	}
+
+	// Without trusted proxies, the header is ignored.
+	assert.Equal(t, "192.0.2.1", origin("192.0.2.1:1234", "198.51.100.7"))
+	config.Config.Clients.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+	assert.Equal(t, "198.51.100.7", origin("127.0.0.1:1234", "198.51.100.7"))
+	// Only what the trusted proxies added counts, not what the client sent.
+	assert.Equal(t, "198.51.100.7", origin("127.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.1.2.3"))
+	assert.Equal(t, "192.0.2.1", origin("192.0.2.1:1234", "198.51.100.7"))
+}
+
+func TestLookupAsn(t *testing.T) {
+	file, err := ioutil.TempFile("", "asn")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("192.0.2.0\t192.0.2.255\t64500\tZZ\tEXAMPLE\n198.51.100.0\t198.51.100.255\t0\tNone\tNot routed\n2001:db8::\t2001:db8::ffff\t64501\tZZ\tEXAMPLE6\n")
+	file.Close()
+
+	ranges, err := loadAsnDatabase(file.Name())
+	assert.Nil(t, err)
+	saved := asnDatabase.ranges
+	defer func() { asnDatabase.ranges = saved }()
+	asnDatabase.Do(func() {})
+	asnDatabase.ranges = ranges
+	assert.Equal(t, uint32(64500), lookupAsn(net.ParseIP("192.0.2.77")))
+	assert.Equal(t, uint32(0), lookupAsn(net.ParseIP("198.51.100.1")))
+	assert.Equal(t, uint32(64501), lookupAsn(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, uint32(0), lookupAsn(net.ParseIP("203.0.113.1")))
+}
+
+func (s *StoreSuite) TestUploadGameOrigin() {
+	config.Config.Clients.OriginSalt = "salt"
+	config.Config.Clients.MaxAccountsPerOrigin = 1
+	defer func() {
+		config.Config.Clients.OriginSalt = ""
+		config.Config.Clients.MaxAccountsPerOrigin = 0
+	}()
+
+	for _, username := range []string{"foo", "bar"} {
+		s.w = httptest.NewRecorder()
+		extraParams := map[string]string{
+			"user":         username,
+			"password":     "asdf",
+			"allow_create": "1",
+			"training_id":  "1",
+			"network_id":   "1",
+			"version":      "1",
+		}
+		tmpfile, _ := ioutil.TempFile("", "example")
+		defer os.Remove(tmpfile.Name())
+		req, err := client.BuildUploadRequest("/upload_game", extraParams, "file", tmpfile.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	}
+
+	var games []db.TrainingGame
+	if err := db.GetDB().Order("id").Find(&games).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 2, len(games))
+	assert.NotEqual(s.T(), "", games[0].OriginHash)
+	assert.NotContains(s.T(), games[0].OriginHash, "192.0.2.1")
+	assert.Equal(s.T(), games[0].OriginHash, games[1].OriginHash)
+
+	sharedOrigins, roamingUsers, err := suspiciousOrigins()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, len(sharedOrigins))
+	assert.Equal(s.T(), 2, sharedOrigins[0]["accounts"])
+	assert.Equal(s.T(), 0, len(roamingUsers))
+}
+
+func (s *StoreSuite) TestDatabaseRetry() {
+	assert.True(s.T(), db.IsTransient(&pq.Error{Code: "40001"}))
+	assert.True(s.T(), db.IsTransient(&pq.Error{Code: "57P01"}))
+	assert.True(s.T(), db.IsTransient(driver.ErrBadConn))
+	assert.False(s.T(), db.IsTransient(&pq.Error{Code: "23505"}))
+	assert.False(s.T(), db.IsTransient(gorm.ErrRecordNotFound))
+
+	attempts := 0
+	err := db.Retry(func() error {
+		attempts++
+		if attempts < 3 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 3, attempts)
+
+	attempts = 0
+	err = db.Retry(func() error {
+		attempts++
+		return gorm.ErrRecordNotFound
+	})
+	assert.Equal(s.T(), gorm.ErrRecordNotFound, err)
+	assert.Equal(s.T(), 1, attempts)
+}
+
+func (s *StoreSuite) TestReadDBWithoutReplicas() {
+	assert.True(s.T(), db.GetReadDB() == db.GetDB())
+
+	req, _ := http.NewRequest("GET", "/networks", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestConnectionPoolConfig() {
+	stats := db.GetDB().DB().Stats()
+	assert.Equal(s.T(), config.Config.Database.MaxOpenConns, stats.MaxOpenConnections)
+}
+
+func (s *StoreSuite) TestTrainingDataStorage() {
+	game := db.TrainingGame{ID: 520000, TrainingRunID: 1, Compacted: true}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/training_data?run=1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	// Archives of the compacted chunks, minus the games kept on the server.
+	assert.Contains(s.T(), s.w.Body.String(), "https://s3.amazonaws.com/lczero/training/games510000.tar.gz")
+	assert.Contains(s.T(), s.w.Body.String(), "https://s3.amazonaws.com/lczero/training/games20000.tar.gz")
+	assert.NotContains(s.T(), s.w.Body.String(), "games520000.tar.gz")
+	assert.NotContains(s.T(), s.w.Body.String(), "games10000.tar.gz")
+
+	storage := config.RunStorageOf(2)
+	assert.Equal(s.T(), "", storage.GamesDestination)
+	assert.Equal(s.T(), 10000, storage.GamesChunkSize)
+}
+
+func (s *StoreSuite) TestTrainingWindow() {
+	games := []db.TrainingGame{
+		{ID: 5, TrainingRunID: 1, Compacted: true},
+		{ID: 10005, TrainingRunID: 1, Compacted: true},
+		{ID: 10006, TrainingRunID: 1, Compacted: true, Excluded: true},
+		{ID: 10007, TrainingRunID: 2},
+		{ID: 20001, TrainingRunID: 1},
+	}
+	for i := range games {
+		if err := db.GetDB().Create(&games[i]).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/training_window?run=1&games=2", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.JSONEq(s.T(), `{"run": 1, "first_id": 10005, "last_id": 20001, "games": 2, "chunks": [
+  {"first_id": 10000, "games": 1, "compacted": true, "url": "https://s3.amazonaws.com/lczero/training/games10000.tar.gz"},
+  {"first_id": 20000, "games": 1, "compacted": false, "url": ""}
+]}`, s.w.Body.String())
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/training_window?run=1&games=0", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestGamesWebhook() {
+	var payloads []gamesWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload gamesWebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			log.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	oldWebhooks := config.Config.Webhooks
+	defer func() {
+		config.Config.Webhooks = oldWebhooks
+	}()
+	config.Config.Webhooks.NewGamesURLs = []string{server.URL}
+	config.Config.Webhooks.NewGames = 2
+
+	createGames := func(n int, excluded bool) {
+		for i := 0; i < n; i++ {
+			if err := db.GetDB().Create(&db.TrainingGame{TrainingRunID: 1, Excluded: excluded}).Error; err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	createGames(2, false)
+	createGames(1, true)
+	createGames(3, false)
+	assert.Nil(s.T(), checkGamesWebhook(1))
+	assert.Equal(s.T(), []gamesWebhookPayload{
+		{Run: 1, Network: 1, FirstGame: 1, LastGame: 2, Games: 2, GamesSinceNetwork: 2},
+		{Run: 1, Network: 1, FirstGame: 4, LastGame: 5, Games: 2, GamesSinceNetwork: 4},
+	}, payloads)
+
+	// Fires once the next games come in, not again for the same ones.
+	assert.Nil(s.T(), checkGamesWebhook(1))
+	assert.Equal(s.T(), 2, len(payloads))
+	createGames(1, false)
+	assert.Nil(s.T(), checkGamesWebhook(1))
+	assert.Equal(s.T(), 3, len(payloads))
+	assert.Equal(s.T(), gamesWebhookPayload{Run: 1, Network: 1, FirstGame: 6, LastGame: 7, Games: 2, GamesSinceNetwork: 6}, payloads[2])
+
+	// Counting starts over with a new network.
+	network := db.Network{Sha: "efgh", Path: "/tmp/network2", TrainingRunID: 1}
+	if err := db.GetDB().Create(&network).Error; err != nil {
+		log.Fatal(err)
+	}
+	createGames(2, false)
+	assert.Nil(s.T(), checkGamesWebhook(1))
+	assert.Equal(s.T(), 4, len(payloads))
+	assert.Equal(s.T(), gamesWebhookPayload{Run: 1, Network: network.ID, FirstGame: 8, LastGame: 9, Games: 2, GamesSinceNetwork: 2}, payloads[3])
+
+	// Nothing is posted once another process took the lock over.
+	assert.Nil(s.T(), db.Unlock(gamesWebhookLock, compactionHolder()))
+	locked, err := db.TryLock(gamesWebhookLock, "other", time.Minute)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), locked)
+	createGames(2, false)
+	assert.Equal(s.T(), errLockLost, checkGamesWebhook(1))
+	assert.Equal(s.T(), 4, len(payloads))
+}
+
+func (s *StoreSuite) TestTrainingClaims() {
+	for _, first := range []uint64{0, 10000, 20000} {
+		chunk := db.TrainingChunk{TrainingRunID: 1, FirstGameID: first, LastGameID: first + 9999, Games: 10000}
+		if err := db.GetDB().Create(&chunk).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	claim := func(chunks string) []uint64 {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/training/claim?run=1", postParams(map[string]string{"chunks": chunks, "claimed_by": "trainer"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("trainer", "trainer")
+		s.router.ServeHTTP(s.w, req)
+		var result struct {
+			Chunks []struct {
+				FirstGameID uint64 `json:"first_game_id"`
+			}
+		}
+		json.Unmarshal(s.w.Body.Bytes(), &result)
+		firsts := []uint64{}
+		for _, chunk := range result.Chunks {
+			firsts = append(firsts, chunk.FirstGameID)
+		}
+		return firsts
+	}
+	consume := func(claim uint) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/v1/training/claims/%d/consume", claim), postParams(map[string]string{"network": "abcd"}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "admin")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	// Clients can't claim chunks.
+	req, _ := http.NewRequest("POST", "/api/v1/training/claim?run=1", postParams(map[string]string{"chunks": "1"}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 401, s.w.Code)
+
+	assert.Equal(s.T(), []uint64{0, 10000}, claim("2"))
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), []uint64{20000}, claim("2"))
+	claim("2")
+	assert.Equal(s.T(), 404, s.w.Code, s.w.Body.String())
+	claim("0")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+
+	consume(1)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	consume(1)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	var consumed db.TrainingClaim
+	db.GetDB().First(&consumed, 1)
+	assert.Equal(s.T(), "abcd", consumed.NetworkSha)
+	assert.Equal(s.T(), "trainer", consumed.ClaimedBy)
+
+	// The chunks of an expired claim are up for grabs again.
+	db.GetDB().Model(&db.TrainingClaim{}).Where("id = 2").Update("expires_at", time.Now().Add(-time.Minute))
+	consume(2)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), []uint64{20000}, claim("2"))
+}
+
+func (s *StoreSuite) TestCompaction() {
+	dir, err := ioutil.TempDir("", "compaction")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRuns := config.Config.Storage.Runs
+	oldCommand := config.Config.Compaction.UploadCommand
+	defer func() {
+		config.Config.Storage.Runs = oldRuns
+		config.Config.Compaction.UploadCommand = oldCommand
+	}()
+	config.Config.Storage.Runs = map[string]config.RunStorage{
+		"1": {GamesDestination: dir + "/", GamesChunkSize: 10},
+	}
+	config.Config.Compaction.UploadCommand = []string{"cp", "%FILE_PATH%", "%DESTINATION%"}
+
+	for _, id := range []uint64{10, 11, 12, 20} {
+		path := filepath.Join(dir, fmt.Sprintf("training.%d.gz", id))
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(fmt.Sprintf("game %d", id)))
+		zw.Close()
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+		game := db.TrainingGame{ID: id, TrainingRunID: 1, Path: path}
+		if err := db.GetDB().Create(&game).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Another server holds the lock.
+	locked, err := db.TryLock(compactionLock, "other", time.Minute)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), locked)
+	compactAll()
+	_, err = os.Stat(filepath.Join(dir, "games10.tar.gz"))
+	assert.True(s.T(), os.IsNotExist(err))
+	assert.Nil(s.T(), db.Unlock(compactionLock, "other"))
+
+	compactAll()
+	_, err = os.Stat(filepath.Join(dir, "games10.tar.gz"))
+	assert.Nil(s.T(), err)
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, "games10.tar.gz.sha256"))
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), string(manifest), fmt.Sprintf("%x  training.11\n", sha256.Sum256([]byte("game 11"))))
+
+	// The chunk of game 20 isn't complete yet.
+	var compacted []uint64
+	db.GetDB().Model(&db.TrainingGame{}).Where("compacted = true").Order("id").Pluck("id", &compacted)
+	assert.Equal(s.T(), []uint64{10, 11, 12}, compacted)
+	var chunks []db.TrainingChunk
+	db.GetDB().Find(&chunks)
+	assert.Equal(s.T(), 1, len(chunks))
+	assert.Equal(s.T(), uint64(10), chunks[0].FirstGameID)
+	assert.Equal(s.T(), uint64(12), chunks[0].LastGameID)
+	assert.Equal(s.T(), 1, compaction.summary()["archives"])
+	assert.Equal(s.T(), "", compaction.summary()["last_error"])
+
+	// A compaction that lost its lock stops after the archive in progress.
+	assert.Nil(s.T(), db.GetDB().Create(&db.TrainingGame{ID: 30, TrainingRunID: 1}).Error)
+	locked, err = db.TryLock(compactionLock, "other", time.Minute)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), locked)
+	err = compactRun(1, config.RunStorageOf(1))
+	assert.Equal(s.T(), errLockLost, err)
+	assert.Nil(s.T(), db.Unlock(compactionLock, "other"))
+	db.GetDB().Model(&db.TrainingGame{}).Where("compacted = true").Order("id").Pluck("id", &compacted)
+	assert.Equal(s.T(), []uint64{10, 11, 12, 20}, compacted)
+}
+
+func (s *StoreSuite) TestStorageStats() {
+	game := db.TrainingGame{TrainingRunID: 1}
+	if err := db.GetDB().Create(&game).Error; err != nil {
+		log.Fatal(err)
+	}
+	storageUsageCache.runs = nil
+
+	// The filesystem walk is for admins only.
+	req, _ := http.NewRequest("GET", "/admin/storage_stats", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 401, s.w.Code)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/storage_stats", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var stats struct {
+		Runs []runStorageUsage
+	}
+	err := json.Unmarshal(s.w.Body.Bytes(), &stats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 1, len(stats.Runs))
+	assert.Equal(s.T(), uint(1), stats.Runs[0].Run)
+	assert.Equal(s.T(), 1, stats.Runs[0].UncompactedGames)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/storage", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "Uncompacted games")
+}
+
+func (s *StoreSuite) TestMatchResultPgnMismatch() {
+	oldPolicy := config.Config.Matches.ResultMismatchPolicy
+	defer func() {
+		config.Config.Matches.ResultMismatchPolicy = oldPolicy
+	}()
+	initMatch(false)
+	games := []db.MatchGame{
+		{UserID: 1, MatchID: 1, Flip: true},
+		{UserID: 1, MatchID: 1},
+	}
+	for i := range games {
+		if err := db.GetDB().Create(&games[i]).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	postResult := func(id uint64, result string, pgn string) {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/match_result", postParams(map[string]string{
+			"user":          "default",
+			"password":      "1234",
+			"version":       "2",
+			"match_game_id": fmt.Sprintf("%d", id),
+			"result":        result,
+			"pgn":           pgn,
+		}))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	// The candidate played black, so white winning is a loss.
+	postResult(games[0].ID, "1", "1. e4 e5 2. Qh5 Nc6 3. Bc4 Nf6 4. Qxf7# 1-0")
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), `"code":"result_mismatch"`)
+	assert.Contains(s.T(), s.w.Body.String(), `"action":"drop"`)
+	postResult(games[0].ID, "1", "[Result \"0-1\"]\n\n1. f3 e5 2. g4 Qh4# 0-1\n")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+
+	config.Config.Matches.ResultMismatchPolicy = "flag"
+	postResult(games[1].ID, "1", "1. f3 e5 2. g4 Qh4# 0-1")
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	game := db.MatchGame{}
+	db.GetDB().Where("id = ?", games[1].ID).First(&game)
+	assert.True(s.T(), game.Done)
+	assert.True(s.T(), game.ResultMismatch)
+	assert.True(s.T(), game.Excluded)
+
+	match := db.Match{}
+	db.GetDB().Where("id = 1").First(&match)
+	assert.Equal(s.T(), 1, match.Wins)
+	assert.Equal(s.T(), 0, match.Losses)
+}
+
+func (s *StoreSuite) TestPgnOutcome() {
+	outcome, ok := pgnOutcome("1. e4 e5 1/2-1/2\n")
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 0, outcome)
+	outcome, ok = pgnOutcome("[Result \"1-0\"]\n\n1. e4 e5 2. Qh5 Nc6 3. Bc4 Nf6 4. Qxf7# 1-0")
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 1, outcome)
+	// The board decides, not the marker.
+	outcome, ok = pgnOutcome("[Result \"1-0\"]\n\n1. f3 e5 2. g4 Qh4# 1-0")
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), -1, outcome)
+	// Unfinished games were adjudicated as draws.
+	outcome, ok = pgnOutcome("[Result \"1-0\"]\n\n1. e4 e5 1-0")
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 0, outcome)
+	_, ok = pgnOutcome("1. e4 e4 1-0")
+	assert.False(s.T(), ok)
+	_, ok = pgnOutcome("")
+	assert.False(s.T(), ok)
+}
+
+func (s *StoreSuite) TestReliability() {
+	saved := config.Config.Reliability
+	defer func() { config.Config.Reliability = saved }()
+	post := func(uri string, params map[string]string) {
+		s.w = httptest.NewRecorder()
+		params["user"] = "flaky"
+		params["password"] = "1234"
+		params["allow_create"] = "1"
+		params["version"] = "2"
+		req, _ := http.NewRequest("POST", uri, postParams(params))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		s.router.ServeHTTP(s.w, req)
+	}
+
+	post("/crash_report", map[string]string{"message": "engine exited"})
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	post("/match_result", map[string]string{"match_game_id": "99", "result": "1", "pgn": ""})
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+
+	user := db.User{}
+	db.GetDB().Where("username = ?", "flaky").First(&user)
+	r, err := userReliability(user.ID)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, r.Crashes)
+	assert.Equal(s.T(), 1, r.UploadRejections)
+	assert.Equal(s.T(), 0.0, r.Score)
+
+	for i := 0; i < 8; i++ {
+		if err := db.GetDB().Create(&db.TrainingGame{TrainingRunID: 1, UserID: user.ID}).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	r, err = userReliability(user.ID)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 80.0, r.Score)
+
+	// Everyone is trusted by contributions with the default trust config.
+	config.Config.Reliability.MinEstablishedScore = 50
+	config.Config.Reliability.MinTrustedScore = 90
+	trust, err := userTrust(&user)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), trustEstablished, trust)
+	config.Config.Reliability.MinEstablishedScore = 90
+	trust, err = userTrust(&user)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), trustNew, trust)
+
+	s.w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "Least reliable users")
+	assert.Contains(s.T(), s.w.Body.String(), "80.0%")
+}
+
+func (s *StoreSuite) TestFailureRates() {
+	saved := config.Config.Reliability
+	defer func() { config.Config.Reliability = saved }()
+	user := db.User{}
+	db.GetDB().Where("id = 1").First(&user)
+	for i := 0; i < 9; i++ {
+		if err := db.GetDB().Create(&db.TrainingGame{TrainingRunID: 1, UserID: user.ID}).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	recordReliabilityEvent(user.ID, reliabilityCrash, "engine exited")
+
+	r, err := userReliability(user.ID)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), failureRates{Crashes: 10}, r.rates())
+	// Too few attempts to judge.
+	assert.Equal(s.T(), 0.0, failureRate(1, 2))
+
+	exceeded, err := exceededFailureRates(user.ID)
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), exceeded)
+	config.Config.Reliability.MaxCrashRate = 5
+	exceeded, err = exceededFailureRates(user.ID)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), []string{"crashes 10% (24h)", "crashes 10% (7d)"}, exceeded)
+
+	trust, err := userTrust(&user)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), trustTrusted, trust)
+	config.Config.Reliability.ThrottleMatches = true
+	trust, err = userTrust(&user)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), trustNew, trust)
+
+	req, _ := http.NewRequest("GET", "/admin/", nil)
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "Users over failure thresholds")
+	assert.Contains(s.T(), s.w.Body.String(), "crashes 10% (24h)")
+}
+
+func (s *StoreSuite) TestMatchColorStats() {
+	initMatch(false)
+	// A client with the flip backwards: the candidate wins every game as
+	// white and loses every one as black.
+	for i := 0; i < 50; i++ {
+		game := db.MatchGame{MatchID: 1, Done: true, Flip: i%2 == 1, Result: 1, Pgn: "1. e4 e5 2. Nf3 1-0"}
+		if game.Flip {
+			game.Result = -1
+			game.Pgn = "1. e4 e5 0-1"
+		}
+		if err := db.GetDB().Create(&game).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/matches/1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var match struct {
+		Colors matchColorStats
+		Elo    *float64
+		LOS    float64 `json:"los"`
+	}
+	assert.Nil(s.T(), json.Unmarshal(s.w.Body.Bytes(), &match))
+	// Games added straight to the database aren't in the match score.
+	assert.Nil(s.T(), match.Elo)
+	assert.Equal(s.T(), 0.5, match.LOS)
+	assert.Equal(s.T(), colorStats{Games: 25, Wins: 25, AveragePlies: 3}, match.Colors.White)
+	assert.Equal(s.T(), colorStats{Games: 25, Losses: 25, AveragePlies: 2}, match.Colors.Black)
+	assert.Equal(s.T(), []string{"White scored 100% with the candidate and 100% with the baseline, about 55% is expected"}, match.Colors.Warnings)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/match/1", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), s.w.Body.String(), "100% with the baseline")
+
+	// A much stronger candidate scores better with both colors.
+	games := []db.MatchGame{}
+	for i := 0; i < 40; i++ {
+		game := db.MatchGame{Done: true, Flip: i%2 == 1, Result: 1}
+		if i%4 == 0 {
+			game.Result = 0
+		}
+		games = append(games, game)
+	}
+	assert.Equal(s.T(), []string{}, getMatchColorStats(games).Warnings)
+}
+
+func TestDurationStats(t *testing.T) {
+	assert.Equal(t, durationStats{}, getDurationStats([]float64{}))
+	stats := getDurationStats([]float64{10, 1, 4, 3, 2, 5, 6, 7, 8, 9})
+	assert.Equal(t, durationStats{Games: 10, Mean: 5.5, Median: 5, P90: 9, Max: 10}, stats)
+}
+
+func (s *StoreSuite) TestPgnPlies() {
+	assert.Equal(s.T(), 4, pgnPlies("[Event \"?\"]\n\n1.e4 e5 2.Nf3 {book} Nc6 (2...d6 3.d4) $1 1-0"))
+	assert.Equal(s.T(), 3, pgnPlies("1. e4 e5 2. Nf3 *"))
+	assert.Equal(s.T(), 0, pgnPlies(""))
+}
+
+func (s *StoreSuite) TestMatchPgnsZip() {
+	initMatch(false)
+	games := []db.MatchGame{
+		{MatchID: 1, Done: true, Result: 1, Pgn: "1. e4 e5 1-0"},
+		// The candidate won with black.
+		{MatchID: 1, Done: true, Result: 1, Flip: true, Pgn: "1. f3 e5 0-1"},
+		{MatchID: 1, Done: true, Result: 0, ShadowOf: 1, Pgn: "1. e4 e5 1/2-1/2"},
+		{MatchID: 1, Pgn: ""},
+	}
+	for i := range games {
+		if err := db.GetDB().Create(&games[i]).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/match/1/pgns.zip", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Equal(s.T(), "application/zip", s.w.Header().Get("Content-Type"))
+	body := s.w.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.Nil(s.T(), err)
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+	assert.Equal(s.T(), map[string]string{
+		"game1_net2-vs-net1_1-0.pgn": "1. e4 e5 1-0",
+		"game2_net1-vs-net2_0-1.pgn": "1. f3 e5 0-1",
+	}, files)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/match/5/pgns.zip", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 404, s.w.Code)
+}
+
+func (s *StoreSuite) TestThroughput() {
+	for i := 0; i < 3; i++ {
+		if err := db.GetDB().Create(&db.TrainingGame{TrainingRunID: 1}).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+	initMatch(false)
+	if err := db.GetDB().Create(&db.MatchGame{MatchID: 1, Done: true}).Error; err != nil {
+		log.Fatal(err)
+	}
+	// Not counted until it has a result.
+	if err := db.GetDB().Create(&db.MatchGame{MatchID: 1}).Error; err != nil {
+		log.Fatal(err)
+	}
+	assert.Nil(s.T(), rollupThroughput(time.Now().Add(-time.Hour)))
+	// Recounting doesn't add up.
+	assert.Nil(s.T(), rollupThroughput(time.Now().Add(-time.Hour)))
+
+	req, _ := http.NewRequest("GET", "/api/v1/throughput?run=1&hours=3", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	var throughput struct {
+		Hours []struct {
+			TrainingGames int `json:"training_games"`
+			MatchGames    int `json:"match_games"`
+		}
+	}
+	err := json.Unmarshal(s.w.Body.Bytes(), &throughput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(s.T(), 3, len(throughput.Hours))
+	assert.Equal(s.T(), 0, throughput.Hours[0].TrainingGames)
+	assert.Equal(s.T(), 3, throughput.Hours[2].TrainingGames)
+	assert.Equal(s.T(), 1, throughput.Hours[2].MatchGames)
+
+	s.w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/throughput?run=1&hours=0", nil)
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 400, s.w.Code, s.w.Body.String())
+}
+
+func (s *StoreSuite) TestPageCache() {
+	config.Config.PageCache.TTLSeconds = 60
+	defer func() {
+		config.Config.PageCache.TTLSeconds = 0
+		pageCache.pages = make(map[string]*cachedPage)
+	}()
+	getMatches := func() string {
+		s.w = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/matches", nil)
+		s.router.ServeHTTP(s.w, req)
+		assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+		return s.w.Body.String()
+	}
+
+	assert.NotContains(s.T(), getMatches(), `href="/match/1"`)
+	initMatch(false)
+	assert.NotContains(s.T(), getMatches(), `href="/match/1"`)
+
+	// Uploads don't change the matches list.
+	invalidatePages(pageEventGame)
+	assert.NotContains(s.T(), getMatches(), `href="/match/1"`)
+
+	invalidatePages(pageEventMatchResult)
+	assert.Contains(s.T(), getMatches(), `href="/match/1"`)
+
+	// Nor does creating a match have to wait for the TTL.
+	s.w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/matches", postParams(map[string]string{"candidate_id": "2", "current_id": "1", "parameters": `["--visits 10"]`}))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "admin")
+	s.router.ServeHTTP(s.w, req)
+	assert.Equal(s.T(), 200, s.w.Code, s.w.Body.String())
+	assert.Contains(s.T(), getMatches(), `href="/match/2"`)
+}
+
+func TestPageCacheMinAge(t *testing.T) {
+	saved := config.Config.PageCache
+	defer func() {
+		config.Config.PageCache = saved
+		pageCache.events = make(map[string]time.Time)
+	}()
+	config.Config.PageCache.TTLSeconds = 60
+	config.Config.PageCache.MinAgeSeconds = 10
+
+	now := time.Now()
+	page := &cachedPage{createdAt: now.Add(-20 * time.Second), events: []string{pageEventGame}}
+	pageCache.events[pageEventGame] = now.Add(-30 * time.Second)
+	assert.True(t, page.fresh(now))
+	// An event soon after the page was rendered counts once it is old
+	// enough.
+	pageCache.events[pageEventGame] = page.createdAt.Add(time.Second)
+	assert.False(t, page.fresh(now))
+	assert.True(t, page.fresh(page.createdAt.Add(5*time.Second)))
+	assert.False(t, page.fresh(now.Add(time.Minute)))
+}
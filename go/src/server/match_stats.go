@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"server/db"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Color checks need this many scored games, per color for the results.
+	minColorCheckGames = 20
+	// White scores further than this many standard errors from
+	// expectedWhiteScore are flagged.
+	colorScoreMaxDeviation = 3.0
+	// Score of the side to move first between equal networks.
+	expectedWhiteScore = 0.55
+)
+
+// Strips move numbers, like "12." or "12...", from a movetext token.
+var moveNumber = regexp.MustCompile(`^\d+\.+`)
+
+// Results of a match's candidate with one color.
+type colorStats struct {
+	Games        int     `json:"games"`
+	Wins         int     `json:"wins"`
+	Losses       int     `json:"losses"`
+	Draws        int     `json:"draws"`
+	AveragePlies float64 `json:"average_plies"`
+}
+
+// Candidate score, counting draws as half a win.
+func (s *colorStats) score() float64 {
+	return (float64(s.Wins) + float64(s.Draws)/2) / float64(s.Games)
+}
+
+// Row of the colors table of the match page.
+func (s *colorStats) row(color string) gin.H {
+	return gin.H{
+		"color":         color,
+		"games":         s.Games,
+		"wins":          s.Wins,
+		"losses":        s.Losses,
+		"draws":         s.Draws,
+		"average_plies": fmt.Sprintf("%.1f", s.AveragePlies),
+	}
+}
+
+type matchColorStats struct {
+	White colorStats `json:"white"`
+	Black colorStats `json:"black"`
+	// Hints of a client mixing up the colors, empty when all looks fine.
+	Warnings []string `json:"warnings"`
+}
+
+// Counts the moves of a PGN's movetext, skipping tags, comments and
+// variations.
+func pgnPlies(pgn string) int {
+	var movetext bytes.Buffer
+	depth := 0
+	for _, line := range strings.Split(pgn, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			continue
+		}
+		for _, r := range line {
+			switch {
+			case r == '{' || r == '(':
+				depth++
+			case (r == '}' || r == ')') && depth > 0:
+				depth--
+			case depth == 0:
+				movetext.WriteRune(r)
+			}
+		}
+		movetext.WriteRune(' ')
+	}
+
+	plies := 0
+	for _, token := range strings.Fields(movetext.String()) {
+		token = moveNumber.ReplaceAllString(token, "")
+		switch {
+		case len(token) == 0, strings.HasPrefix(token, "$"):
+		case token == "1-0", token == "0-1", token == "1/2-1/2", token == "*":
+		default:
+			plies++
+		}
+	}
+	return plies
+}
+
+// Splits the scored games of a match by the candidate's color.  Games are
+// alternated between colors, so a skewed split or results swinging with the
+// color suggest a client handling the flip wrongly.
+func getMatchColorStats(games []db.MatchGame) matchColorStats {
+	stats := matchColorStats{Warnings: []string{}}
+	var whitePlies, blackPlies int
+	for _, game := range games {
+		if !game.Done || game.Excluded || game.ShadowOf != 0 {
+			continue
+		}
+		color, plies := &stats.White, &whitePlies
+		if game.Flip {
+			color, plies = &stats.Black, &blackPlies
+		}
+		color.Games++
+		if game.Result == 1 {
+			color.Wins++
+		} else if game.Result == -1 {
+			color.Losses++
+		} else {
+			color.Draws++
+		}
+		*plies += pgnPlies(game.Pgn)
+	}
+	if stats.White.Games > 0 {
+		stats.White.AveragePlies = float64(whitePlies) / float64(stats.White.Games)
+	}
+	if stats.Black.Games > 0 {
+		stats.Black.AveragePlies = float64(blackPlies) / float64(stats.Black.Games)
+	}
+
+	total := stats.White.Games + stats.Black.Games
+	if total >= minColorCheckGames {
+		imbalance := stats.White.Games - stats.Black.Games
+		if imbalance < 0 {
+			imbalance = -imbalance
+		}
+		if imbalance > total/10+2 {
+			stats.Warnings = append(stats.Warnings, fmt.Sprintf("The candidate played white in %d of %d games", stats.White.Games, total))
+		}
+	}
+	if stats.White.Games >= minColorCheckGames && stats.Black.Games >= minColorCheckGames {
+		// White's score with the candidate and with the baseline differ by
+		// the networks' strength, which averaging them cancels out.  What
+		// is left is the first move advantage, unless the colors are mixed
+		// up.  A score's variance is at most 1/4, so this errs towards quiet.
+		candidateWhite, baselineWhite := stats.White.score(), 1-stats.Black.score()
+		white := (candidateWhite + baselineWhite) / 2
+		stderr := math.Sqrt(0.25/float64(stats.White.Games)+0.25/float64(stats.Black.Games)) / 2
+		if math.Abs(white-expectedWhiteScore) > colorScoreMaxDeviation*stderr {
+			stats.Warnings = append(stats.Warnings, fmt.Sprintf("White scored %.0f%% with the candidate and %.0f%% with the baseline, about %.0f%% is expected", 100*candidateWhite, 100*baselineWhite, 100*expectedWhiteScore))
+		}
+	}
+	return stats
+}
+
+// Distribution of how long games took, in seconds.
+type durationStats struct {
+	Games  int     `json:"games"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+	Max    float64 `json:"max"`
+}
+
+func getDurationStats(seconds []float64) durationStats {
+	stats := durationStats{Games: len(seconds)}
+	if len(seconds) == 0 {
+		return stats
+	}
+	sort.Float64s(seconds)
+	total := 0.0
+	for _, s := range seconds {
+		total += s
+	}
+	// Nearest rank percentiles.
+	percentile := func(p int) float64 {
+		return seconds[(len(seconds)*p+99)/100-1]
+	}
+	stats.Mean = total / float64(len(seconds))
+	stats.Median = percentile(50)
+	stats.P90 = percentile(90)
+	stats.Max = seconds[len(seconds)-1]
+	return stats
+}
+
+type matchDurations struct {
+	// From assignment to result.
+	Turnaround durationStats `json:"turnaround"`
+	// From the client starting the game to its result, for clients
+	// reporting it.
+	Play durationStats `json:"play"`
+}
+
+// Durations of a match's games with a result, leaving out games completed
+// before completion times were recorded.  A slow turnaround with a quick
+// play time points at clients sitting on their assignments.
+func getMatchDurations(games []db.MatchGame) matchDurations {
+	turnaround, play := []float64{}, []float64{}
+	for _, game := range games {
+		if !game.Done || game.CompletedAt == nil {
+			continue
+		}
+		turnaround = append(turnaround, game.CompletedAt.Sub(game.CreatedAt).Seconds())
+		if game.StartedAt != nil {
+			play = append(play, game.CompletedAt.Sub(*game.StartedAt).Seconds())
+		}
+	}
+	return matchDurations{Turnaround: getDurationStats(turnaround), Play: getDurationStats(play)}
+}
+
+// NaN and infinities, e.g. the Elo of a match without losses, have no JSON
+// encoding, so they become null.
+func finiteOrNil(x float64) interface{} {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil
+	}
+	return x
+}
+
+func apiMatch(c *gin.Context) {
+	match := db.Match{}
+	err := db.GetReadDB().Where("id = ?", c.Param("id")).First(&match).Error
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown match"})
+		return
+	}
+	games := []db.MatchGame{}
+	err = db.GetReadDB().Where("match_id = ?", match.ID).Find(&games).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	elo, eloError := calcEloAndError(match.Wins, match.Losses, match.Draws)
+	c.JSON(http.StatusOK, gin.H{
+		"id":            match.ID,
+		"run":           match.TrainingRunID,
+		"candidate_id":  match.CandidateID,
+		"current_id":    match.CurrentBestID,
+		"wins":          match.Wins,
+		"losses":        match.Losses,
+		"draws":         match.Draws,
+		"games_created": match.GamesCreated,
+		"game_cap":      match.GameCap,
+		"done":          match.Done,
+		"passed":        match.Passed,
+		"test_only":     match.TestOnly,
+		"architecture":  match.Architecture,
+		"elo":           finiteOrNil(elo),
+		"error":         finiteOrNil(eloError),
+		"los":           calcLOS(match.Wins, match.Losses),
+		"colors":        getMatchColorStats(games),
+		"durations":     getMatchDurations(games),
+		"sprt":          sprtStatus(&match),
+	})
+}
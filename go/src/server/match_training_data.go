@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"client/http"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/db"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receives the training data of a match game, for matches collecting it.
+// Stored next to, not among, the selfplay games, so it stays out of the
+// compacted chunks.
+func uploadMatchTrainingData(c *gin.Context) {
+	user, _, err := checkUser(c)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	c.Set(reliabilityUserKey, user.ID)
+
+	matchGameID, err := strconv.ParseUint(c.PostForm("match_game_id"), 10, 32)
+	if err != nil {
+		uploadRejected(c, http.StatusBadRequest, "invalid_match_game", "Invalid match_game_id")
+		return
+	}
+	var matchGame db.MatchGame
+	err = db.GetDB().Preload("Match").Where("id = ? AND user_id = ?", matchGameID, user.ID).First(&matchGame).Error
+	if err != nil {
+		log.Println(err)
+		uploadRejected(c, http.StatusBadRequest, "invalid_match_game", "Invalid match_game")
+		return
+	}
+	if !matchGame.Match.TrainingData || matchGame.ShadowOf != 0 {
+		uploadRejected(c, http.StatusBadRequest, "not_collected", "Training data of this match game isn't collected")
+		return
+	}
+	if len(matchGame.TrainingDataPath) > 0 {
+		uploadAccepted(c, http.StatusOK, "duplicate", "Training data already uploaded")
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		log.Println(err.Error())
+		uploadRejected(c, http.StatusBadRequest, "missing_file", "Missing file")
+		return
+	}
+	if file.Size > maxGameSize() {
+		uploadRejected(c, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Game too large, limit is %d bytes", maxGameSize()))
+		return
+	}
+	data, err := readUploadedFile(file)
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	_, err = client.ParseTrainingChunk(bytes.NewReader(data))
+	if err != nil {
+		uploadRejected(c, http.StatusBadRequest, "invalid_training_data", fmt.Sprintf("Invalid training data: %v", err))
+		return
+	}
+
+	path := filepath.Join("match_games", fmt.Sprintf("run%d/training.%d.gz", matchGame.Match.TrainingRunID, matchGame.ID))
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		uploadFailed(c, fmt.Errorf("saving file: %v", err))
+		return
+	}
+	err = db.GetDB().Model(&matchGame).Update("training_data_path", path).Error
+	if err != nil {
+		uploadFailed(c, err)
+		return
+	}
+	uploadAccepted(c, http.StatusOK, "uploaded", fmt.Sprintf("Training data of match game %d uploaded successfully.", matchGame.ID))
+}
+
+// Match games whose training data may be trained on: with a counted result,
+// and not shadow duplicates.
+func matchTrainingGames(matchID uint) ([]db.MatchGame, error) {
+	var games []db.MatchGame
+	err := db.GetReadDB().Select("id, training_data_path").
+		Where("match_id = ? AND done = true AND excluded = false AND result_mismatch = false AND shadow_of = 0 AND training_data_path != ''", matchID).
+		Order("id").Find(&games).Error
+	return games, err
+}
+
+// Lists the matches of a run that collected training data, with how many
+// games have it, for the training pipeline to pick from.
+func apiMatchTrainingDataList(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		respondError(c, http.StatusBadRequest, "invalid_training_run", "Invalid training run")
+		return
+	}
+	rows, err := db.GetReadDB().Table("match_games").
+		Select("matches.id, matches.candidate_id, matches.current_best_id, matches.done, count(*)").
+		Joins("JOIN matches ON matches.id = match_games.match_id").
+		Where("matches.training_run_id = ? AND match_games.done = true AND match_games.excluded = false AND match_games.result_mismatch = false AND match_games.shadow_of = 0 AND match_games.training_data_path != ''", trainingRun.ID).
+		Group("matches.id").Order("matches.id").Rows()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	matches := []gin.H{}
+	for rows.Next() {
+		var id, candidateID, currentID uint
+		var done bool
+		var games int
+		err = rows.Scan(&id, &candidateID, &currentID, &done, &games)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		matches = append(matches, gin.H{
+			"id":           id,
+			"candidate_id": candidateID,
+			"current_id":   currentID,
+			"done":         done,
+			"games":        games,
+			"url":          fmt.Sprintf("/api/v1/matches/%d/training_data", id),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"run": trainingRun.ID, "matches": matches})
+}
+
+// Serves the training data of a match's games as a tar.gz of uncompressed
+// training.<match game id> members, the layout of the compacted selfplay
+// chunks.
+func apiMatchTrainingData(c *gin.Context) {
+	match := db.Match{}
+	err := db.GetReadDB().Where("id = ?", c.Param("id")).First(&match).Error
+	if err != nil {
+		log.Println(err)
+		respondError(c, http.StatusNotFound, "not_found", "Unknown match")
+		return
+	}
+	games, err := matchTrainingGames(match.ID)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"match%d_training.tar.gz\"", match.ID))
+	gzw := gzip.NewWriter(c.Writer)
+	tw := tar.NewWriter(gzw)
+	for _, game := range games {
+		data, err := readGzipFile(game.TrainingDataPath)
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", game.TrainingDataPath, err)
+			continue
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    fmt.Sprintf("training.%d", game.ID),
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		})
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		if err != nil {
+			// The response is under way, all that's left is to cut it short.
+			log.Println(err)
+			return
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gzw.Close()
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func readGzipFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	return ioutil.ReadAll(gzr)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upper bounds of the histogram buckets, the last bucket is unbounded.
+var (
+	durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+	sizeBuckets     = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+)
+
+type histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{Buckets: buckets, Counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(value float64) {
+	i := 0
+	for i < len(h.Buckets) && value > h.Buckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += value
+}
+
+// Metrics of one endpoint for one client version.
+type uploadMetric struct {
+	Requests uint64     `json:"requests"`
+	Failures uint64     `json:"validation_failures"`
+	Duration *histogram `json:"duration_seconds"`
+	Size     *histogram `json:"size_bytes"`
+}
+
+// Keyed by endpoint, then client version.
+var uploadMetrics = struct {
+	sync.Mutex
+	endpoints map[string]map[string]*uploadMetric
+}{endpoints: make(map[string]map[string]*uploadMetric)}
+
+func recordUpload(endpoint string, version string, duration time.Duration, size int64, status int) {
+	uploadMetrics.Lock()
+	defer uploadMetrics.Unlock()
+
+	versions, ok := uploadMetrics.endpoints[endpoint]
+	if !ok {
+		versions = make(map[string]*uploadMetric)
+		uploadMetrics.endpoints[endpoint] = versions
+	}
+	metric, ok := versions[version]
+	if !ok {
+		metric = &uploadMetric{
+			Duration: newHistogram(durationBuckets),
+			Size:     newHistogram(sizeBuckets),
+		}
+		versions[version] = metric
+	}
+
+	metric.Requests++
+	if status >= 400 && status < 500 {
+		metric.Failures++
+	}
+	metric.Duration.observe(duration.Seconds())
+	if size >= 0 {
+		metric.Size.observe(float64(size))
+	}
+}
+
+// Records the duration, size and outcome of requests to an upload endpoint,
+// broken down by the client version in the "version" form field.
+func uploadMetricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	// Only look at an already parsed form, never read the body here, as it
+	// may have been rejected for being too large.
+	version := c.Request.PostForm.Get("version")
+	if _, err := strconv.ParseUint(version, 10, 16); err != nil {
+		version = "unknown"
+	}
+	recordUpload(c.Request.URL.Path, version, time.Since(start), c.Request.ContentLength, c.Writer.Status())
+}
+
+func apiUploadMetrics(c *gin.Context) {
+	uploadMetrics.Lock()
+	defer uploadMetrics.Unlock()
+	c.JSON(http.StatusOK, uploadMetrics.endpoints)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"server/db"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// Tags are short labels, e.g. "lr-drop", "bugged-rule50" or "arch-10x128".
+var validNetworkTag = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+const (
+	maxNetworkTags        = 16
+	maxNetworkNotesLength = 2000
+)
+
+// Parses a comma separated list of tags into the sorted list, without
+// duplicates, stored in Network.Tags.
+func parseNetworkTags(value string) (string, error) {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) == 0 || seen[tag] {
+			continue
+		}
+		if !validNetworkTag.MatchString(tag) {
+			return "", fmt.Errorf("Invalid tag %q", tag)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxNetworkTags {
+		return "", fmt.Errorf("At most %d tags", maxNetworkTags)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ","), nil
+}
+
+// Empty rather than nil for networks without tags, so JSON gets a list.
+func networkTags(network *db.Network) []string {
+	if len(network.Tags) == 0 {
+		return []string{}
+	}
+	return strings.Split(network.Tags, ",")
+}
+
+// Narrows q, a query of networks, to those with the tag asked for in the
+// request's tag parameter, if any.
+func whereNetworkTag(c *gin.Context, q *gorm.DB) (*gorm.DB, error) {
+	tag := c.Query("tag")
+	if len(tag) == 0 {
+		return q, nil
+	}
+	if !validNetworkTag.MatchString(tag) {
+		return nil, errors.New("Invalid tag")
+	}
+	// Underscores are LIKE wildcards.
+	pattern := "%," + strings.Replace(tag, "_", `\_`, -1) + ",%"
+	return q.Where("',' || tags || ',' LIKE ?", pattern), nil
+}
+
+// Sets the tags, replacing the previous ones, and the notes of a network.
+// Either may be left out to keep it as is.
+func setNetworkTags(c *gin.Context) {
+	networkID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid network id")
+		return
+	}
+	network := db.Network{}
+	err = db.GetDB().Where("id = ?", networkID).First(&network).Error
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusNotFound, "Unknown network")
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if value, ok := c.GetPostForm("tags"); ok {
+		tags, err := parseNetworkTags(value)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		updates["tags"] = tags
+	}
+	if notes, ok := c.GetPostForm("notes"); ok {
+		notes = strings.TrimSpace(notes)
+		if len(notes) > maxNetworkNotesLength {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Notes too long, limit is %d bytes", maxNetworkNotesLength))
+			return
+		}
+		updates["notes"] = notes
+	}
+	if len(updates) == 0 {
+		c.String(http.StatusBadRequest, "Specify tags or notes")
+		return
+	}
+
+	err = db.GetDB().Model(&network).Updates(updates).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	invalidatePages(pageEventNetwork)
+
+	log.Printf("%s updated network %d: %v\n", c.GetString(gin.AuthUserKey), network.ID, updates)
+	c.String(http.StatusOK, fmt.Sprintf("Network %d updated.", network.ID))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"server/config"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Whether addr is one of the configured reverse proxies.
+func isTrustedProxy(addr net.IP) bool {
+	for _, proxy := range config.Config.Clients.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			_, network, err := net.ParseCIDR(proxy)
+			if err == nil && network.Contains(addr) {
+				return true
+			}
+		} else if ip := net.ParseIP(proxy); ip != nil && ip.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address a request came from.  X-Forwarded-For is only
+// followed through trusted proxies, from the right, as the entries left of
+// the last one a trusted proxy added are whatever the client sent.
+func originAddress(c *gin.Context) net.IP {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return nil
+	}
+	forwarded := strings.Split(c.Request.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(addr); i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			break
+		}
+		addr = next
+	}
+	return addr
+}
+
+// A range of addresses announced by one autonomous system.
+type asnRange struct {
+	start, end net.IP
+	asn        uint32
+}
+
+var asnDatabase struct {
+	sync.Once
+	ranges []asnRange
+}
+
+// Reads an ip2asn style TSV file, skipping the ranges of no AS.
+func loadAsnDatabase(path string) ([]asnRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranges := []asnRange{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || err != nil || asn == 0 {
+			continue
+		}
+		ranges = append(ranges, asnRange{start.To16(), end.To16(), uint32(asn)})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start, ranges[j].start) < 0 })
+	return ranges, scanner.Err()
+}
+
+// Returns the AS number of addr, 0 if unknown.
+func lookupAsn(addr net.IP) uint32 {
+	asnDatabase.Do(func() {
+		path := config.Config.Clients.AsnDatabase
+		if len(path) == 0 {
+			return
+		}
+		ranges, err := loadAsnDatabase(path)
+		if err != nil {
+			log.Printf("Loading ASN database %s: %v", path, err)
+			return
+		}
+		asnDatabase.ranges = ranges
+	})
+	ranges := asnDatabase.ranges
+	addr = addr.To16()
+	i := sort.Search(len(ranges), func(i int) bool { return bytes.Compare(ranges[i].start, addr) > 0 })
+	if i == 0 || bytes.Compare(addr, ranges[i-1].end) > 0 {
+		return 0
+	}
+	return ranges[i-1].asn
+}
+
+func saltedHash(value string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(config.Config.Clients.OriginSalt+value)))
+}
+
+// Returns the salted hashes of the address of the request and of its AS
+// number, "" if origins aren't recorded or the AS isn't known.  Only used
+// to tell origins apart, not to find them.
+func originHashes(c *gin.Context) (string, string) {
+	if len(config.Config.Clients.OriginSalt) == 0 {
+		return "", ""
+	}
+	addr := originAddress(c)
+	if addr == nil {
+		return "", ""
+	}
+	asnHash := ""
+	if asn := lookupAsn(addr); asn != 0 {
+		asnHash = saltedHash(fmt.Sprintf("AS%d", asn))
+	}
+	return saltedHash(addr.String()), asnHash
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"server/config"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Events invalidating the cached pages that depend on them.
+const (
+	pageEventGame        = "game"
+	pageEventMatch       = "match"
+	pageEventMatchResult = "match_result"
+	pageEventNetwork     = "network"
+)
+
+// Bounds the memory of pages cached for many different query strings.
+const maxCachedPages = 1000
+
+type cachedPage struct {
+	body        []byte
+	contentType string
+	createdAt   time.Time
+	events      []string
+}
+
+var pageCache = struct {
+	sync.Mutex
+	// Keyed by request URI.
+	pages map[string]*cachedPage
+	// Time each event last happened.
+	events map[string]time.Time
+}{pages: make(map[string]*cachedPage), events: make(map[string]time.Time)}
+
+// Records the response body while it is written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Whether page may still be served.  Events since the page was rendered only
+// count once it is MinAgeSeconds old, so a steady stream of uploads doesn't
+// empty the cache.
+func (page *cachedPage) fresh(now time.Time) bool {
+	age := now.Sub(page.createdAt)
+	if age >= time.Duration(config.Config.PageCache.TTLSeconds)*time.Second {
+		return false
+	}
+	if age < time.Duration(config.Config.PageCache.MinAgeSeconds)*time.Second {
+		return true
+	}
+	for _, event := range page.events {
+		if pageCache.events[event].After(page.createdAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// Serves successful renders of a page from memory for up to
+// PageCache.TTLSeconds, until one of events happens.
+func cachePage(events ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.Config.PageCache.TTLSeconds <= 0 || c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		key := c.Request.URL.RequestURI()
+		pageCache.Lock()
+		page, ok := pageCache.pages[key]
+		if ok && !page.fresh(time.Now()) {
+			delete(pageCache.pages, key)
+			ok = false
+		}
+		pageCache.Unlock()
+		if ok {
+			c.Data(http.StatusOK, page.contentType, page.body)
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		createdAt := time.Now()
+		c.Next()
+		if writer.Status() != http.StatusOK {
+			return
+		}
+		pageCache.Lock()
+		defer pageCache.Unlock()
+		if len(pageCache.pages) >= maxCachedPages {
+			now := time.Now()
+			for stale, cached := range pageCache.pages {
+				if !cached.fresh(now) {
+					delete(pageCache.pages, stale)
+				}
+			}
+			if len(pageCache.pages) >= maxCachedPages {
+				return
+			}
+		}
+		pageCache.pages[key] = &cachedPage{
+			body:        writer.body.Bytes(),
+			contentType: writer.Header().Get("Content-Type"),
+			createdAt:   createdAt,
+			events:      events,
+		}
+	}
+}
+
+// Marks the pages depending on event as out of date.
+func invalidatePages(event string) {
+	pageCache.Lock()
+	defer pageCache.Unlock()
+	pageCache.events[event] = time.Now()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"client/http"
+)
+
+// Kinds of values taken by engine flags.
+const (
+	flagSwitch = iota
+	flagInt
+	flagFloat
+)
+
+type engineFlag struct {
+	short string
+	kind  int
+	min   float64
+	max   float64
+}
+
+// The engine flags that matches and training runs may set, with the range of
+// values lc0 accepts for them.
+var engineFlags = map[string]engineFlag{
+	"threads":       {"t", flagInt, 1, 256},
+	"playouts":      {"p", flagInt, 1, math32Max},
+	"nodes":         {"v", flagInt, 1, math32Max},
+	"visits":        {"", flagInt, 1, math32Max},
+	"resignpct":     {"r", flagInt, -1, 100},
+	"noise":         {"n", flagSwitch, 0, 0},
+	"randomize":     {"m", flagSwitch, 0, 0},
+	"tempdecay":     {"d", flagInt, 0, math32Max},
+	"seed":          {"s", flagInt, 0, math32Max},
+	"quiet":         {"q", flagSwitch, 0, 0},
+	"puct":          {"", flagFloat, 0.01, 100},
+	"fpu_reduction": {"", flagFloat, -10, 10},
+	"softmax_temp":  {"", flagFloat, 0.01, 100},
+}
+
+// Engine flags the client sets itself, or that only make sense on the
+// command line.
+var reservedEngineFlags = map[string]string{
+	"weights":    "w",
+	"syzygypath": "e",
+	"logfile":    "l",
+	"start":      "",
+	"supervise":  "",
+	"uci":        "",
+	"gpu":        "",
+	"full-tuner": "",
+	"tune-only":  "",
+	"help":       "h",
+}
+
+const math32Max = 1<<31 - 1
+
+func lookupEngineFlag(name string, short bool) (string, *engineFlag, bool) {
+	for long, flag := range engineFlags {
+		if (short && flag.short == name) || (!short && long == name) {
+			flag := flag
+			return long, &flag, false
+		}
+	}
+	for long, s := range reservedEngineFlags {
+		if (short && s == name) || (!short && long == name) {
+			return long, nil, true
+		}
+	}
+	return "", nil, false
+}
+
+func checkEngineFlagValue(name string, flag *engineFlag, value string) error {
+	var v float64
+	var err error
+	if flag.kind == flagInt {
+		var i int64
+		i, err = strconv.ParseInt(value, 10, 64)
+		v = float64(i)
+	} else {
+		v, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		kind := "an integer"
+		if flag.kind == flagFloat {
+			kind = "a number"
+		}
+		return fmt.Errorf("--%s must be %s, got %q", name, kind, value)
+	}
+	if v < flag.min || v > flag.max {
+		return fmt.Errorf("--%s must be between %g and %g, got %s", name, flag.min, flag.max, value)
+	}
+	return nil
+}
+
+// Checks engine parameters against engineFlags, in the forms lc0 parses:
+// "--name=value", "--name value", "-xvalue" and "-x value".
+func validateEngineParameters(params []string) error {
+	_, err := parseEngineParameters(params)
+	return err
+}
+
+// Returns the value of each flag set in params by its long name, "" for
+// switches.
+func parseEngineParameters(params []string) (map[string]string, error) {
+	flags := map[string]string{}
+	for i := 0; i < len(params); i++ {
+		arg := params[i]
+		var name, value string
+		var hasValue, short bool
+		switch {
+		case strings.HasPrefix(arg, "--") && len(arg) > 2:
+			name = arg[2:]
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value, hasValue = name[:eq], name[eq+1:], true
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			name, short = arg[1:2], true
+			if len(arg) > 2 {
+				value, hasValue = arg[2:], true
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected engine argument %q", arg)
+		}
+
+		long, flag, reserved := lookupEngineFlag(name, short)
+		if reserved {
+			return nil, fmt.Errorf("Engine flag --%s can't be set by parameters", long)
+		}
+		if flag == nil {
+			return nil, fmt.Errorf("Unknown engine flag %q", arg)
+		}
+		if flag.kind == flagSwitch {
+			if hasValue {
+				return nil, fmt.Errorf("--%s takes no value", long)
+			}
+			flags[long] = ""
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(params) {
+				return nil, fmt.Errorf("--%s needs a value", long)
+			}
+			i++
+			value = params[i]
+		}
+		err := checkEngineFlagValue(long, flag, value)
+		if err != nil {
+			return nil, err
+		}
+		flags[long] = value
+	}
+	return flags, nil
+}
+
+// Engine defaults for the settings in client.RunConfig, see Parameters.cpp
+// and UCTSearch.cpp.
+const (
+	engineVariant       = "standard"
+	engineDefaultVisits = 800
+	engineNoiseEpsilon  = 0.25
+	engineNoiseAlpha    = 0.3
+)
+
+// Describes how the engine plays with the JSON array of engine parameters
+// params, following the option handling in main.cpp.
+func runConfig(params string) (*client.RunConfig, error) {
+	var args []string
+	if len(params) > 0 {
+		err := json.Unmarshal([]byte(params), &args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	flags, err := parseEngineParameters(args)
+	if err != nil {
+		return nil, err
+	}
+	intFlag := func(name string, value int) int {
+		if v, ok := flags[name]; ok {
+			value, _ = strconv.Atoi(v)
+		}
+		return value
+	}
+	_, hasVisits := flags["visits"]
+	_, hasNodes := flags["nodes"]
+	_, hasPlayouts := flags["playouts"]
+	_, noise := flags["noise"]
+	_, randomize := flags["randomize"]
+	_, hasTempDecay := flags["tempdecay"]
+
+	result := client.RunConfig{
+		Variant:       engineVariant,
+		Visits:        engineDefaultVisits,
+		Playouts:      intFlag("playouts", 0),
+		ResignPercent: intFlag("resignpct", -1),
+		Temperature: client.TemperatureConfig{
+			Randomize: randomize || hasTempDecay,
+			Decay:     intFlag("tempdecay", 0),
+		},
+		Noise: client.NoiseConfig{
+			Enabled: noise,
+			Epsilon: engineNoiseEpsilon,
+			Alpha:   engineNoiseAlpha,
+		},
+	}
+	// Limiting playouts alone lifts the default visit limit.
+	if hasPlayouts && !hasVisits && !hasNodes {
+		result.Visits = 0
+	}
+	result.Visits = intFlag("visits", result.Visits)
+	result.Visits = intFlag("nodes", result.Visits)
+	return &result, nil
+}
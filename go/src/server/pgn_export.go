@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/config"
+	"server/db"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Combined selfplay PGNs are cached here, one file per network and count of
+// games in it, so excluding or restoring games builds a new one.
+const networkPgnDir = "pgns/networks"
+
+// The best network still gets games, so its cached file is only rebuilt for
+// new games once older than this.
+const networkPgnMaxAge = time.Hour
+
+// Archived PGNs are fetched over HTTP, these can be large.
+var pgnArchiveClient = &http.Client{Timeout: 10 * time.Minute}
+
+// Builds are serialized per network, so concurrent requests for one network
+// wait for a single build without holding up requests for the others.
+var networkPgnBuilds = struct {
+	sync.Mutex
+	networks map[uint]*sync.Mutex
+}{networks: make(map[uint]*sync.Mutex)}
+
+func networkPgnLock(network *db.Network) *sync.Mutex {
+	networkPgnBuilds.Lock()
+	defer networkPgnBuilds.Unlock()
+	lock, ok := networkPgnBuilds.networks[network.ID]
+	if !ok {
+		lock = &sync.Mutex{}
+		networkPgnBuilds.networks[network.ID] = lock
+	}
+	return lock
+}
+
+func networkPgnPath(network *db.Network, games int) string {
+	return filepath.Join(networkPgnDir, fmt.Sprintf("network%d_%d.pgn.gz", network.ID, games))
+}
+
+// Returns the cached combined PGNs of network, newest first.
+func cachedNetworkPgns(network *db.Network) ([]os.FileInfo, error) {
+	paths, err := filepath.Glob(filepath.Join(networkPgnDir, fmt.Sprintf("network%d_*.pgn.gz", network.ID)))
+	if err != nil {
+		return nil, err
+	}
+	files := []os.FileInfo{}
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err == nil {
+			files = append(files, stat)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	return files, nil
+}
+
+// Reads the PGNs of the games in ids from the run's archive of the chunk
+// starting at start.  A missing archive holds none of them.
+func readPgnArchive(storage config.RunStorage, start int, ids map[uint64]bool) (map[uint64][]byte, error) {
+	url := fmt.Sprintf("%spgn%d.tar.gz", storage.PgnURL, start)
+	resp, err := pgnArchiveClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	pgns := map[uint64][]byte{}
+	if resp.StatusCode == http.StatusNotFound {
+		log.Printf("PGN archive %s is missing\n", url)
+		return pgns, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	gzr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return pgns, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(header.Name, ".pgn"), 10, 64)
+		if err != nil || !ids[id] {
+			continue
+		}
+		pgns[id], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Concatenates the PGNs of games into a gzipped file at path.  PGNs that were
+// compacted away are read back from the run's archives, games whose PGN is
+// in neither place are skipped.
+func buildNetworkPgn(games []db.TrainingGame, path string) (int, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	count := 0
+	// The games are in id order, so each archive is fetched once.
+	archived := map[uint64][]byte{}
+	archivedChunk := -1
+	for i, game := range games {
+		pgn, err := ioutil.ReadFile(fmt.Sprintf("pgns/run%d/%d.pgn", game.TrainingRunID, game.ID))
+		if os.IsNotExist(err) {
+			storage := config.RunStorageOf(game.TrainingRunID)
+			if len(storage.PgnURL) == 0 || game.ID < uint64(storage.PgnArchivesFrom) {
+				continue
+			}
+			chunkSize := uint64(storage.PgnChunkSize)
+			chunk := int(game.ID / chunkSize * chunkSize)
+			if chunk != archivedChunk {
+				ids := map[uint64]bool{}
+				for _, other := range games[i:] {
+					if other.ID/chunkSize*chunkSize != uint64(chunk) {
+						break
+					}
+					ids[other.ID] = true
+				}
+				archived, err = readPgnArchive(storage, chunk, ids)
+				if err != nil {
+					return 0, err
+				}
+				archivedChunk = chunk
+			}
+			var ok bool
+			pgn, ok = archived[game.ID]
+			if !ok {
+				continue
+			}
+		} else if err != nil {
+			return 0, err
+		}
+		_, err = zw.Write(append(pgn, '\n', '\n'))
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	err = zw.Close()
+	if err != nil {
+		return 0, err
+	}
+	err = file.Close()
+	if err != nil {
+		return 0, err
+	}
+	return count, os.Rename(tmpPath, path)
+}
+
+// Returns the path of the cached combined PGN of network, building it first
+// if the network's games changed since.  For the best network, which keeps
+// getting games, a file younger than networkPgnMaxAge is served regardless.
+func getNetworkPgn(network *db.Network) (string, error) {
+	lock := networkPgnLock(network)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var games []db.TrainingGame
+	err := db.GetDB().Select("id, training_run_id").
+		Where("network_id = ? AND excluded = false", network.ID).Order("id").Find(&games).Error
+	if err != nil {
+		return "", err
+	}
+	path := networkPgnPath(network, len(games))
+
+	cached, err := cachedNetworkPgns(network)
+	if err != nil {
+		return "", err
+	}
+	if len(cached) > 0 {
+		newest := filepath.Join(networkPgnDir, cached[0].Name())
+		if newest == path {
+			return path, nil
+		}
+		trainingRun, err := getTrainingRun(network.TrainingRunID)
+		if err != nil {
+			return "", err
+		}
+		if trainingRun.BestNetworkID == network.ID && time.Since(cached[0].ModTime()) < networkPgnMaxAge {
+			return newest, nil
+		}
+	}
+
+	count, err := buildNetworkPgn(games, path)
+	if err != nil {
+		return "", err
+	}
+	for _, stale := range cached {
+		if stale.Name() != filepath.Base(path) {
+			os.Remove(filepath.Join(networkPgnDir, stale.Name()))
+		}
+	}
+	log.Printf("Built combined PGN of network %d from %d games\n", network.ID, count)
+	return path, nil
+}
+
+func apiNetworkPgn(c *gin.Context) {
+	network := db.Network{}
+	err := db.GetDB().Where("id = ?", c.Param("id")).First(&network).Error
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown network"})
+		return
+	}
+
+	path, err := getNetworkPgn(&network)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	c.File(path)
+}
+
+// Names a match game's PGN in a match archive after its players and result,
+// e.g. "game12_net5-vs-net3_1-0.pgn" with network 5 playing white.
+func matchGamePgnName(game *db.MatchGame, match *db.Match) string {
+	white, black := match.CandidateID, match.CurrentBestID
+	// Results are from the candidate's side.
+	result := game.Result
+	if game.Flip {
+		white, black = black, white
+		result = -result
+	}
+	outcome := "draw"
+	if result == 1 {
+		outcome = "1-0"
+	} else if result == -1 {
+		outcome = "0-1"
+	}
+	return fmt.Sprintf("game%d_net%d-vs-net%d_%s.pgn", game.ID, white, black, outcome)
+}
+
+// Streams a zip of the PGNs of all finished games of a match, leaving out
+// shadow duplicates.
+func viewMatchPgns(c *gin.Context) {
+	match := db.Match{}
+	err := db.GetReadDB().Where("id = ?", c.Param("id")).First(&match).Error
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusNotFound, "Match not found")
+		return
+	}
+
+	rows, err := db.GetReadDB().Model(&db.MatchGame{}).Select("id, result, flip, pgn").
+		Where("match_id = ? AND done = true AND shadow_of = 0 AND pgn != ''", match.ID).Order("id").Rows()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"match%d_pgns.zip\"", match.ID))
+	zw := zip.NewWriter(c.Writer)
+	for rows.Next() {
+		var game db.MatchGame
+		err = rows.Scan(&game.ID, &game.Result, &game.Flip, &game.Pgn)
+		if err != nil {
+			break
+		}
+		var w io.Writer
+		w, err = zw.Create(matchGamePgnName(&game, &match))
+		if err != nil {
+			break
+		}
+		_, err = io.WriteString(w, strings.Replace(game.Pgn, "e.p.", "", -1))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	// Too late for an error response, the client sees a truncated zip.
+	if err != nil {
+		log.Printf("Streaming the PGNs of match %d: %v", match.ID, err)
+	}
+}
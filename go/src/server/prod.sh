@@ -1,6 +1,6 @@
 #!/bin/bash
 
-# You must have run `go build main.go` prior to running this
+# You must have run `go build -o main` prior to running this
 
 export GIN_MODE=release
 ./main
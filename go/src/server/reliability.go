@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"server/config"
+	"server/db"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of db.ReliabilityEvent.
+const (
+	reliabilityUploadRejected     = "upload_rejected"
+	reliabilityInvalidPgn         = "invalid_pgn"
+	reliabilityResultMismatch     = "result_mismatch"
+	reliabilityShadowDisagreement = "shadow_disagreement"
+	reliabilityCrash              = "crash"
+)
+
+// Set in the gin context by upload handlers once they know the user, and
+// optionally the kind of event a rejection counts as, see recordRejections.
+const (
+	reliabilityUserKey = "reliability_user"
+	reliabilityKindKey = "reliability_kind"
+)
+
+const (
+	defaultReliabilityWindowDays = 7
+	maxCrashReportLength         = 500
+	// Failure rates are also checked over this window, to catch a client
+	// that just broke.
+	shortFailureWindow = 24 * time.Hour
+	// Failure rates aren't judged on fewer attempts.
+	minFailureRateAttempts = 10
+)
+
+// A user's track record over the reliability window.
+type reliability struct {
+	TrainingGames       int `json:"training_games"`
+	MatchGames          int `json:"match_games"`
+	UploadRejections    int `json:"upload_rejections"`
+	InvalidPgns         int `json:"invalid_pgns"`
+	Crashes             int `json:"crashes"`
+	ResultMismatches    int `json:"result_mismatches"`
+	ShadowDisagreements int `json:"shadow_disagreements"`
+	// Match games assigned without a result coming back.
+	StaleAssignments int `json:"stale_assignments"`
+	// Percentage of selfplay or match work that went right, whichever is
+	// lower, 100 for users without either.
+	Score float64 `json:"score"`
+}
+
+func reliabilityWindow() time.Duration {
+	days := config.Config.Reliability.WindowDays
+	if days <= 0 {
+		days = defaultReliabilityWindowDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func recordReliabilityEvent(userID uint, kind string, detail string) {
+	err := db.GetDB().Create(&db.ReliabilityEvent{UserID: userID, Kind: kind, Detail: detail}).Error
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Records uploads of known users rejected as invalid.  Rate limiting and
+// server errors aren't the client's fault, so only count the other 4xx.
+func recordRejections(c *gin.Context) {
+	c.Next()
+	status := c.Writer.Status()
+	if status < 400 || status >= 500 || status == http.StatusTooManyRequests {
+		return
+	}
+	userID, ok := c.Get(reliabilityUserKey)
+	if !ok {
+		return
+	}
+	kind := c.GetString(reliabilityKindKey)
+	if len(kind) == 0 {
+		kind = reliabilityUploadRejected
+	}
+	recordReliabilityEvent(userID.(uint), kind, c.Request.URL.Path)
+}
+
+func successRate(good int, bad int) float64 {
+	if good+bad == 0 {
+		return 1
+	}
+	return float64(good) / float64(good+bad)
+}
+
+func userReliability(userID uint) (reliability, error) {
+	return userReliabilitySince(userID, time.Now().Add(-reliabilityWindow()))
+}
+
+func userReliabilitySince(userID uint, since time.Time) (reliability, error) {
+	r := reliability{}
+	row := db.GetDB().Raw(`SELECT
+  (SELECT count(*) FROM training_games WHERE user_id = ? AND created_at >= ?),
+  (SELECT count(*) FROM match_games WHERE user_id = ? AND created_at >= ? AND done = true),
+  (SELECT count(*) FROM match_games WHERE user_id = ? AND created_at >= ? AND created_at < ? AND done = false)`,
+		userID, since, userID, since, userID, since, time.Now().Add(-staleAssignmentAge)).Row()
+	err := row.Scan(&r.TrainingGames, &r.MatchGames, &r.StaleAssignments)
+	if err != nil {
+		return r, err
+	}
+
+	rows, err := db.GetDB().Model(&db.ReliabilityEvent{}).Select("kind, count(*)").
+		Where("user_id = ? AND created_at >= ?", userID, since).Group("kind").Rows()
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var count int
+		err = rows.Scan(&kind, &count)
+		if err != nil {
+			return r, err
+		}
+		switch kind {
+		case reliabilityUploadRejected:
+			r.UploadRejections = count
+		case reliabilityInvalidPgn:
+			r.InvalidPgns = count
+		case reliabilityCrash:
+			r.Crashes = count
+		case reliabilityResultMismatch:
+			r.ResultMismatches = count
+		case reliabilityShadowDisagreement:
+			r.ShadowDisagreements = count
+		}
+	}
+
+	// Match games are few next to selfplay games, so they're scored on
+	// their own rather than drowned out.
+	selfplay := successRate(r.TrainingGames, r.UploadRejections+r.InvalidPgns+r.Crashes)
+	matches := successRate(r.MatchGames, r.ResultMismatches+r.ShadowDisagreements+r.StaleAssignments)
+	if matches < selfplay {
+		selfplay = matches
+	}
+	r.Score = 100 * selfplay
+	return r, nil
+}
+
+// Percentages of a user's attempts at something that failed.
+type failureRates struct {
+	// Of uploaded training games.
+	Rejections float64 `json:"rejections"`
+	// Of uploaded training games and match results.
+	InvalidPgns float64 `json:"invalid_pgns"`
+	// Of assigned match games.
+	Timeouts float64 `json:"timeouts"`
+	// Of games played.
+	Crashes float64 `json:"crashes"`
+}
+
+// 0 with too few attempts to tell.
+func failureRate(failures int, attempts int) float64 {
+	if attempts < minFailureRateAttempts {
+		return 0
+	}
+	return 100 * float64(failures) / float64(attempts)
+}
+
+func (r *reliability) rates() failureRates {
+	uploads := r.TrainingGames + r.UploadRejections + r.InvalidPgns
+	return failureRates{
+		Rejections:  failureRate(r.UploadRejections, uploads),
+		InvalidPgns: failureRate(r.InvalidPgns+r.ResultMismatches, uploads+r.MatchGames),
+		Timeouts:    failureRate(r.StaleAssignments, r.MatchGames+r.StaleAssignments),
+		Crashes:     failureRate(r.Crashes, r.TrainingGames+r.MatchGames+r.Crashes),
+	}
+}
+
+// Describes the rates above the configured maximums, e.g. "crashes 12%".
+func (rates failureRates) exceeded() []string {
+	limits := config.Config.Reliability
+	exceeded := []string{}
+	check := func(name string, rate float64, max float64) {
+		if max > 0 && rate > max {
+			exceeded = append(exceeded, fmt.Sprintf("%s %.0f%%", name, rate))
+		}
+	}
+	check("rejected uploads", rates.Rejections, limits.MaxRejectionRate)
+	check("invalid PGNs", rates.InvalidPgns, limits.MaxInvalidPgnRate)
+	check("lost assignments", rates.Timeouts, limits.MaxTimeoutRate)
+	check("crashes", rates.Crashes, limits.MaxCrashRate)
+	return exceeded
+}
+
+func failureThresholdsSet() bool {
+	limits := config.Config.Reliability
+	return limits.MaxRejectionRate > 0 || limits.MaxInvalidPgnRate > 0 || limits.MaxTimeoutRate > 0 || limits.MaxCrashRate > 0
+}
+
+// A user's reliability over the last shortFailureWindow and over the whole
+// reliability window.
+type recentReliability struct {
+	day        reliability
+	window     reliability
+	computedAt time.Time
+}
+
+// Reliability is checked whenever a user asks for work, but changes slowly,
+// so like game counts it's computed at most every trustCacheTTL.
+var reliabilityCache = struct {
+	sync.Mutex
+	users map[uint]recentReliability
+}{users: make(map[uint]recentReliability)}
+
+// Returns the user's reliability, as computed within the last trustCacheTTL.
+func cachedReliability(userID uint) (recentReliability, error) {
+	reliabilityCache.Lock()
+	r, ok := reliabilityCache.users[userID]
+	reliabilityCache.Unlock()
+	if ok && time.Since(r.computedAt) < trustCacheTTL {
+		return r, nil
+	}
+
+	var err error
+	r.day, err = userReliabilitySince(userID, time.Now().Add(-shortFailureWindow))
+	if err != nil {
+		return r, err
+	}
+	r.window, err = userReliability(userID)
+	if err != nil {
+		return r, err
+	}
+	r.computedAt = time.Now()
+	reliabilityCache.Lock()
+	reliabilityCache.users[userID] = r
+	reliabilityCache.Unlock()
+	return r, nil
+}
+
+// Describes the failure rates over the last day and over the window that
+// are above the configured maximums, empty if none are.
+func (r *recentReliability) exceeded() []string {
+	exceeded := []string{}
+	for _, rate := range r.day.rates().exceeded() {
+		exceeded = append(exceeded, fmt.Sprintf("%s (24h)", rate))
+	}
+	for _, rate := range r.window.rates().exceeded() {
+		exceeded = append(exceeded, fmt.Sprintf("%s (%dd)", rate, int(reliabilityWindow().Hours()/24)))
+	}
+	return exceeded
+}
+
+func exceededFailureRates(userID uint) ([]string, error) {
+	r, err := cachedReliability(userID)
+	if err != nil {
+		return nil, err
+	}
+	return r.exceeded(), nil
+}
+
+// Lowers a trust tier earned from contributions to what the user's
+// reliability score and failure rates allow.
+func capTrustByReliability(user *db.User, trust int) (int, error) {
+	if trust == trustNew {
+		return trust, nil
+	}
+	throttle := config.Config.Reliability.ThrottleMatches && failureThresholdsSet()
+	minEstablished := config.Config.Reliability.MinEstablishedScore
+	minTrusted := config.Config.Reliability.MinTrustedScore
+	if !throttle && minEstablished <= 0 && minTrusted <= 0 {
+		return trust, nil
+	}
+	r, err := cachedReliability(user.ID)
+	if err != nil {
+		return trustNew, err
+	}
+	if throttle && len(r.exceeded()) > 0 {
+		return trustNew, nil
+	}
+	if r.window.Score < minEstablished {
+		return trustNew, nil
+	}
+	if trust == trustTrusted && r.window.Score < minTrusted {
+		return trustEstablished, nil
+	}
+	return trust, nil
+}
+
+// Users with something against them over the window.  Match games of
+// deleted or unknown users are left out.
+func usersWithFailures() ([]db.User, error) {
+	since := time.Now().Add(-reliabilityWindow())
+	var users []db.User
+	err := db.GetDB().Where(`id IN (SELECT user_id FROM reliability_events WHERE created_at >= ?
+UNION
+SELECT user_id FROM match_games WHERE created_at >= ? AND created_at < ? AND done = false)`,
+		since, since, time.Now().Add(-staleAssignmentAge)).Find(&users).Error
+	return users, err
+}
+
+// Returns the least reliable users of the window, up to limit of them.
+// Only users with something against them are considered.
+func leastReliableUsers(limit int) ([]gin.H, error) {
+	failing, err := usersWithFailures()
+	if err != nil {
+		return nil, err
+	}
+
+	type scored struct {
+		user        db.User
+		reliability reliability
+	}
+	users := []scored{}
+	for _, user := range failing {
+		r, err := cachedReliability(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, scored{user, r.window})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].reliability.Score < users[j].reliability.Score
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+
+	result := []gin.H{}
+	for _, u := range users {
+		result = append(result, gin.H{
+			"user":                 u.user.Username,
+			"score":                fmt.Sprintf("%.1f", u.reliability.Score),
+			"training_games":       u.reliability.TrainingGames,
+			"match_games":          u.reliability.MatchGames,
+			"upload_rejections":    u.reliability.UploadRejections,
+			"invalid_pgns":         u.reliability.InvalidPgns,
+			"crashes":              u.reliability.Crashes,
+			"result_mismatches":    u.reliability.ResultMismatches,
+			"shadow_disagreements": u.reliability.ShadowDisagreements,
+			"stale_assignments":    u.reliability.StaleAssignments,
+		})
+	}
+	return result, nil
+}
+
+// Returns the users whose failure rates are above the configured maximums,
+// with the rates, none if no maximum is set.
+func usersOverFailureThresholds() ([]gin.H, error) {
+	result := []gin.H{}
+	if !failureThresholdsSet() {
+		return result, nil
+	}
+	users, err := usersWithFailures()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		exceeded, err := exceededFailureRates(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(exceeded) == 0 {
+			continue
+		}
+		result = append(result, gin.H{
+			"user":      user.Username,
+			"failures":  strings.Join(exceeded, ", "),
+			"throttled": config.Config.Reliability.ThrottleMatches,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["user"].(string) < result[j]["user"].(string)
+	})
+	return result, nil
+}
+
+// Clients report engine crashes here, counted against their reliability.
+func crashReport(c *gin.Context) {
+	user, _, err := checkUser(c)
+	if err != nil {
+		requestFailed(c, err)
+		return
+	}
+	recordReliabilityEvent(user.ID, reliabilityCrash, sanitizeReported(c.PostForm("message"), maxCrashReportLength))
+	c.String(http.StatusOK, "Crash report received")
+}
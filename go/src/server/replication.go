@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"server/config"
+	"server/db"
+	"strings"
+	"time"
+)
+
+// Games waiting to be copied to object storage.  Uploads only enqueue, so a
+// slow or unavailable storage backend never delays clients.
+var replicationQueue chan uint64
+
+const (
+	replicationQueueSize  = 10000
+	maxReplicationRetries = 5
+
+	replicationRetryInterval = 10 * time.Minute
+)
+
+func replicationEnabled() bool {
+	return len(config.Config.Replication.Command) > 0
+}
+
+// Builds the copy command for a single file.  Paths are relative to the
+// server directory, so with forward slashes they double as object keys.
+func replicationCommand(path string) *exec.Cmd {
+	cmdParams := make([]string, len(config.Config.Replication.Command))
+	for i, param := range config.Config.Replication.Command {
+		param = strings.Replace(param, "%FILE_PATH%", path, -1)
+		cmdParams[i] = strings.Replace(param, "%KEY%", filepath.ToSlash(path), -1)
+	}
+	return exec.Command(cmdParams[0], cmdParams[1:]...)
+}
+
+func replicateGame(gameID uint64) error {
+	var game db.TrainingGame
+	err := db.GetDB().Where("id = ?", gameID).First(&game).Error
+	if err != nil {
+		return err
+	}
+	if game.Replicated {
+		return nil
+	}
+
+	pgnPath := fmt.Sprintf("pgns/run%d/%d.pgn", game.TrainingRunID, game.ID)
+	for _, path := range []string{game.Path, pgnPath} {
+		err = replicationCommand(path).Run()
+		if err != nil {
+			db.GetDB().Model(&game).Update("replication_retries", game.ReplicationRetries+1)
+			return fmt.Errorf("replicating %s: %v", path, err)
+		}
+	}
+	return db.GetDB().Model(&game).Update("replicated", true).Error
+}
+
+// Queues an accepted game for replication.  If the queue is full the game is
+// left unreplicated, and picked up again by requeueUnreplicatedGames.
+func enqueueReplication(gameID uint64) {
+	if !replicationEnabled() {
+		return
+	}
+	select {
+	case replicationQueue <- gameID:
+	default:
+		log.Printf("Replication queue full, deferring game %d", gameID)
+	}
+}
+
+// Requeues games still on disk whose replication hasn't succeeded yet, e.g.
+// because the server restarted or the storage backend was down.  Recent games
+// are skipped, as they are most likely still waiting in the queue.
+func requeueUnreplicatedGames() {
+	var ids []uint64
+	err := db.GetDB().Model(&db.TrainingGame{}).
+		Where("replicated = false AND compacted = false AND path != '' AND replication_retries < ?", maxReplicationRetries).
+		Where("created_at < ?", time.Now().Add(-replicationRetryInterval)).
+		Order("id asc").
+		Limit(replicationQueueSize/2).
+		Pluck("id", &ids).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, id := range ids {
+		enqueueReplication(id)
+	}
+}
+
+func replicationWorker() {
+	for gameID := range replicationQueue {
+		err := replicateGame(gameID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Starts the replication workers, if a replication command is configured.
+func startReplication() {
+	if !replicationEnabled() {
+		return
+	}
+	replicationQueue = make(chan uint64, replicationQueueSize)
+	workers := config.Config.Replication.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go replicationWorker()
+	}
+	go func() {
+		for {
+			requeueUnreplicatedGames()
+			time.Sleep(replicationRetryInterval)
+		}
+	}()
+}
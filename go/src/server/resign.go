@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"server/db"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Outcome of resigning at one threshold, for one played out game.
+type resignSample struct {
+	threshold int
+	would     bool
+	wrong     bool
+}
+
+// Parses the "resign_analysis" field, "pct:would:wrong,..." as sent by the
+// client.
+func parseResignAnalysis(value string) ([]resignSample, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	samples := []resignSample{}
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 {
+			return nil, errors.New("Invalid resign_analysis")
+		}
+		threshold, err := strconv.Atoi(fields[0])
+		if err != nil || threshold < 1 || threshold > 50 {
+			return nil, errors.New("Invalid resign_analysis")
+		}
+		samples = append(samples, resignSample{
+			threshold: threshold,
+			would:     fields[1] == "1",
+			wrong:     fields[2] == "1",
+		})
+	}
+	return samples, nil
+}
+
+func recordResignStats(networkID uint, samples []resignSample) error {
+	for _, sample := range samples {
+		resigns, wrong := 0, 0
+		if sample.would {
+			resigns = 1
+		}
+		if sample.wrong {
+			wrong = 1
+		}
+		err := db.GetDB().Exec(`INSERT INTO resign_stats (network_id, threshold, games, resigns, false_positives) VALUES (?, ?, 1, ?, ?)
+ON CONFLICT (network_id, threshold) DO UPDATE SET
+games = resign_stats.games + 1,
+resigns = resign_stats.resigns + EXCLUDED.resigns,
+false_positives = resign_stats.false_positives + EXCLUDED.false_positives`,
+			networkID, sample.threshold, resigns, wrong).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports, for the latest networks of a run, how often each resign threshold
+// would have ended played out games, and how often wrongly.
+func apiResignStats(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+
+	var networks []db.Network
+	err = db.GetDB().Where("training_run_id = ?", trainingRun.ID).Order("id desc").Limit(20).Find(&networks).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	ids := []uint{}
+	for _, network := range networks {
+		ids = append(ids, network.ID)
+	}
+
+	var stats []db.ResignStat
+	err = db.GetDB().Where("network_id IN (?)", ids).Order("network_id desc, threshold").Find(&stats).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	byNetwork := map[uint][]gin.H{}
+	for _, stat := range stats {
+		byNetwork[stat.NetworkID] = append(byNetwork[stat.NetworkID], gin.H{
+			"threshold":           stat.Threshold,
+			"games":               stat.Games,
+			"resign_rate":         float64(stat.Resigns) / float64(stat.Games),
+			"false_positive_rate": float64(stat.FalsePositives) / float64(stat.Games),
+			"false_positives":     stat.FalsePositives,
+		})
+	}
+	result := []gin.H{}
+	for _, network := range networks {
+		if thresholds, ok := byNetwork[network.ID]; ok {
+			result = append(result, gin.H{
+				"network_id": network.ID,
+				"sha":        network.Sha,
+				"thresholds": thresholds,
+			})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"run": trainingRun.ID, "networks": result})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"server/config"
+	"server/db"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A user's shadow disagreements only count once they have been cross-checked
+// this many times, a single differing result is expected now and then.
+const minShadowChecks = 5
+
+// Whether a newly assigned match game should also be played by another user.
+func wantShadow() bool {
+	return config.Config.Matches.ShadowRate > 0 && rand.Float64() < config.Config.Matches.ShadowRate
+}
+
+// Engine parameters for a game played by two users, the match's with a seed
+// shared by both, so honest clients play the same moves.  The client runs
+// the engine with one thread, more would make the search nondeterministic.
+func shadowParameters(params string, seed uint64) (string, error) {
+	var args []string
+	if len(params) > 0 {
+		err := json.Unmarshal([]byte(params), &args)
+		if err != nil {
+			return "", err
+		}
+	}
+	kept := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var name string
+		var hasValue, short bool
+		if strings.HasPrefix(arg, "--") {
+			name = strings.TrimPrefix(arg, "--")
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, hasValue = name[:eq], true
+			}
+		} else if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			name, short, hasValue = arg[1:2], true, len(arg) > 2
+		}
+		long, _, _ := lookupEngineFlag(name, short)
+		if long != "seed" && long != "threads" {
+			kept = append(kept, arg)
+			continue
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	kept = append(kept, fmt.Sprintf("--seed=%d", seed))
+	result, err := json.Marshal(kept)
+	return string(result), err
+}
+
+// Assigns user a duplicate of a match game waiting for one, with the same
+// match and colors, or returns nil if there is none.  The returned game has
+// its Match and Match.Candidate loaded.
+func assignShadowGame(user *db.User, trainingRun *db.TrainingRun, features string) (*db.MatchGame, error) {
+	var originals []db.MatchGame
+	err := db.GetDB().Joins("JOIN matches ON matches.id = match_games.match_id").
+		Where("match_games.shadow_wanted = true AND match_games.user_id <> ? AND matches.training_run_id = ? AND matches.done = false", user.ID, trainingRun.ID).
+		Order("match_games.id").Limit(1).Find(&originals).Error
+	if err != nil || len(originals) == 0 {
+		return nil, err
+	}
+	original := originals[0]
+
+	// Another request may be assigning the same shadow.
+	result := db.GetDB().Model(&db.MatchGame{}).Where("id = ? AND shadow_wanted = true", original.ID).Update("shadow_wanted", false)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return nil, result.Error
+	}
+
+	shadow := db.MatchGame{
+		UserID:   user.ID,
+		MatchID:  original.MatchID,
+		Flip:     original.Flip,
+		ShadowOf: original.ID,
+		Features: features,
+	}
+	err = db.GetDB().Create(&shadow).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.GetDB().Preload("Candidate").Preload("CurrentBest").Where("id = ?", shadow.MatchID).First(&shadow.Match).Error
+	if err != nil {
+		return nil, err
+	}
+	return &shadow, nil
+}
+
+// Once both a match game and its shadow duplicate have a result, records the
+// check, and any disagreement, against both users.  Neither can tell which
+// of them was wrong, that only shows in how often each disagrees with others.
+func reconcileShadowGame(game *db.MatchGame) error {
+	var pair []db.MatchGame
+	var err error
+	if game.ShadowOf != 0 {
+		err = db.GetDB().Where("id = ? AND done = true", game.ShadowOf).Find(&pair).Error
+	} else {
+		err = db.GetDB().Where("shadow_of = ? AND done = true", game.ID).Find(&pair).Error
+	}
+	if err != nil || len(pair) == 0 {
+		return err
+	}
+	other := pair[0]
+
+	disagreement := 0
+	if other.Result != game.Result {
+		disagreement = 1
+		// Which of the two is wrong isn't known, so both are counted.
+		for _, userID := range []uint{game.UserID, other.UserID} {
+			recordReliabilityEvent(userID, reliabilityShadowDisagreement, fmt.Sprintf("match game %d", game.ID))
+		}
+	}
+	return db.GetDB().Model(&db.User{}).Where("id IN (?)", []uint{game.UserID, other.UserID}).Updates(map[string]interface{}{
+		"shadow_checks":        gorm.Expr("shadow_checks + 1"),
+		"shadow_disagreements": gorm.Expr("shadow_disagreements + ?", disagreement),
+	}).Error
+}
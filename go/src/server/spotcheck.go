@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"server/config"
+	"server/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"client/http"
+)
+
+const (
+	// Moves in the engine's policy output, and so in the probabilities of
+	// a training record.
+	policySize = 1858
+
+	defaultSpotCheckPositions = 3
+	defaultSpotCheckTolerance = 0.3
+
+	// Only recent games are checked, older ones may be compacted soon.
+	spotCheckMaxAge  = 24 * time.Hour
+	spotCheckTimeout = 10 * time.Minute
+)
+
+func spotChecksEnabled() bool {
+	return len(config.Config.SpotCheck.Command) > 0 && config.Config.SpotCheck.GamesPerHour > 0
+}
+
+// Total variation distance between two probability distributions.
+func probabilityDistance(a []float32, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += math.Abs(float64(a[i]) - float64(b[i]))
+	}
+	return sum / 2
+}
+
+// Parses a "probs index:probability ..." line printed by the engine's
+// spotcheck command.
+func parseEngineProbabilities(line string, size int) ([]float32, error) {
+	probs := make([]float32, size)
+	for _, entry := range strings.Fields(strings.TrimPrefix(line, "probs")) {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid probability %s", entry)
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil || index < 0 || index >= size {
+			return nil, fmt.Errorf("invalid probability %s", entry)
+		}
+		prob, err := strconv.ParseFloat(fields[1], 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probability %s", entry)
+		}
+		probs[index] = float32(prob)
+	}
+	return probs, nil
+}
+
+// Replays plies of the game in pgnPath with the server side engine, and
+// returns the probabilities it found for each.
+func replayPositions(network *db.Network, params []string, pgnPath string, plies []int) ([][]float32, error) {
+	args := append([]string{}, config.Config.SpotCheck.Command[1:]...)
+	args = append(args, "--weights="+network.Path)
+	args = append(args, params...)
+	args = append(args, "--quiet")
+
+	commands := ""
+	for _, ply := range plies {
+		commands += fmt.Sprintf("spotcheck %s %d\n", pgnPath, ply)
+	}
+	commands += "quit\n"
+
+	ctx, cancel := context.WithTimeout(context.Background(), spotCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.Config.SpotCheck.Command[0], args...)
+	cmd.Stdin = strings.NewReader(commands)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	result := [][]float32{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "probs" && !strings.HasPrefix(line, "probs ") {
+			continue
+		}
+		probs, err := parseEngineProbabilities(line, policySize)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, probs)
+	}
+	if len(result) != len(plies) {
+		return nil, fmt.Errorf("engine replayed %d of %d positions", len(result), len(plies))
+	}
+	return result, nil
+}
+
+// Replays a few random positions of game and records how far the uploaded
+// probabilities are from the server's.
+func spotCheckGame(game *db.TrainingGame) error {
+	file, err := os.Open(game.Path)
+	if err != nil {
+		return err
+	}
+	uploaded, err := client.ChunkProbabilities(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if len(uploaded) == 0 {
+		return errors.New("no training records")
+	}
+
+	network := db.Network{}
+	err = db.GetDB().Where("id = ?", game.NetworkID).First(&network).Error
+	if err != nil {
+		return err
+	}
+	trainingRun, err := getTrainingRun(game.TrainingRunID)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveTrainParameters(trainingRun.TrainParameters, network.GamesPlayed)
+	if err != nil {
+		return err
+	}
+	var params []string
+	if len(resolved) > 0 {
+		err = json.Unmarshal([]byte(resolved), &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	positions := config.Config.SpotCheck.Positions
+	if positions <= 0 {
+		positions = defaultSpotCheckPositions
+	}
+	if positions > len(uploaded) {
+		positions = len(uploaded)
+	}
+	records := rand.Perm(len(uploaded))[:positions]
+	// Records start after the opening line, if the game had one.
+	openingPlies := len(strings.Fields(game.Opening))
+	plies := make([]int, len(records))
+	for i, record := range records {
+		plies[i] = openingPlies + record
+	}
+
+	pgnPath, err := filepath.Abs(fmt.Sprintf("pgns/run%d/%d.pgn", game.TrainingRunID, game.ID))
+	if err != nil {
+		return err
+	}
+	replayed, err := replayPositions(&network, params, pgnPath, plies)
+	if err != nil {
+		return err
+	}
+
+	tolerance := config.Config.SpotCheck.Tolerance
+	if tolerance <= 0 {
+		tolerance = defaultSpotCheckTolerance
+	}
+	check := db.SpotCheck{
+		TrainingGameID: game.ID,
+		UserID:         game.UserID,
+		Version:        game.Version,
+		EngineVersion:  game.EngineVersion,
+		Positions:      len(records),
+	}
+	for i, record := range records {
+		distance := probabilityDistance(uploaded[record], replayed[i])
+		if distance > tolerance {
+			check.Discrepancies++
+		}
+		check.MaxDistance = math.Max(check.MaxDistance, distance)
+	}
+	if check.Discrepancies > 0 {
+		log.Printf("Spot check of game %d by user %d found %d discrepancies, max distance %.2f\n", game.ID, game.UserID, check.Discrepancies, check.MaxDistance)
+	}
+	return db.GetDB().Create(&check).Error
+}
+
+// Picks a random recent game that hasn't been checked yet.
+func pickSpotCheckGame() (*db.TrainingGame, error) {
+	var games []db.TrainingGame
+	err := db.GetDB().
+		Where("excluded = false AND compacted = false AND path != '' AND created_at > ?", time.Now().Add(-spotCheckMaxAge)).
+		Where("NOT EXISTS (SELECT 1 FROM spot_checks WHERE spot_checks.training_game_id = training_games.id)").
+		Order("random()").Limit(1).Find(&games).Error
+	if err != nil || len(games) == 0 {
+		return nil, err
+	}
+	return &games[0], nil
+}
+
+// Starts the spot check worker, if a server side engine is configured.
+func startSpotChecks() {
+	if !spotChecksEnabled() {
+		return
+	}
+	interval := time.Hour / time.Duration(config.Config.SpotCheck.GamesPerHour)
+	go func() {
+		for {
+			time.Sleep(interval)
+			game, err := pickSpotCheckGame()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if game == nil {
+				continue
+			}
+			err = spotCheckGame(game)
+			if err != nil {
+				log.Printf("Spot check of game %d failed: %v\n", game.ID, err)
+			}
+		}
+	}()
+}
+
+// Spot check results per user and engine version, worst first.
+func spotCheckSummary(c *gin.Context) {
+	rows, err := db.GetDB().Raw(`SELECT users.username, spot_checks.engine_version, count(*),
+  SUM(spot_checks.positions), SUM(spot_checks.discrepancies), MAX(spot_checks.max_distance)
+FROM spot_checks
+JOIN users ON users.id = spot_checks.user_id
+GROUP BY users.username, spot_checks.engine_version
+ORDER BY SUM(spot_checks.discrepancies)::float / SUM(spot_checks.positions) DESC, users.username`).Rows()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	defer rows.Close()
+
+	summary := []gin.H{}
+	for rows.Next() {
+		var username, engineVersion string
+		var games, positions, discrepancies int
+		var maxDistance float64
+		err = rows.Scan(&username, &engineVersion, &games, &positions, &discrepancies, &maxDistance)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		summary = append(summary, gin.H{
+			"user":             username,
+			"engine_version":   engineVersion,
+			"games":            games,
+			"positions":        positions,
+			"discrepancies":    discrepancies,
+			"discrepancy_rate": float64(discrepancies) / float64(positions),
+			"max_distance":     maxDistance,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"spot_checks": summary})
+}
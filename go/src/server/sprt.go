@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"server/config"
+	"server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sprtEnabled() bool {
+	return config.Config.Matches.SPRT.Elo1 > config.Config.Matches.SPRT.Elo0
+}
+
+// Expected score of a player rated elo above its opponent.
+func eloToScore(elo float64) float64 {
+	return 1 / (1 + math.Pow(10, -elo/400))
+}
+
+// Log-likelihood ratio of H1 (elo1) against H0 (elo0), using the normal
+// approximation of the trinomial model.
+func sprtLLR(wins, losses, draws int, elo0, elo1 float64) float64 {
+	n := float64(wins + losses + draws)
+	if n == 0 {
+		return 0
+	}
+	w := float64(wins) / n
+	d := float64(draws) / n
+	l := float64(losses) / n
+	mu := w + d/2
+	variance := w*math.Pow(1-mu, 2) + d*math.Pow(0.5-mu, 2) + l*math.Pow(mu, 2)
+	if variance == 0 {
+		// All games had the same outcome, wait for more.
+		return 0
+	}
+
+	s0, s1 := eloToScore(elo0), eloToScore(elo1)
+	return n * (s1 - s0) * (2*mu - s0 - s1) / (2 * variance)
+}
+
+func sprtBounds() (lower, upper float64) {
+	alpha := config.Config.Matches.SPRT.Alpha
+	if alpha <= 0 {
+		alpha = 0.05
+	}
+	beta := config.Config.Matches.SPRT.Beta
+	if beta <= 0 {
+		beta = 0.05
+	}
+	return math.Log(beta / (1 - alpha)), math.Log((1 - beta) / alpha)
+}
+
+// Returns 1 if the SPRT of match accepted H1 (the candidate is stronger), -1
+// if it accepted H0 and 0 while undecided.  Always 0 for TestOnly matches.
+func sprtDecision(match *db.Match) int {
+	if !sprtEnabled() || match.TestOnly {
+		return 0
+	}
+	sprt := config.Config.Matches.SPRT
+	llr := sprtLLR(match.Wins, match.Losses, match.Draws, sprt.Elo0, sprt.Elo1)
+	lower, upper := sprtBounds()
+	if llr >= upper-sprt.Epsilon {
+		return 1
+	}
+	if llr <= lower+sprt.Epsilon {
+		return -1
+	}
+	return 0
+}
+
+// Progress of the SPRT of match, for the match page and API.  nil for
+// matches that aren't decided by one.
+func sprtStatus(match *db.Match) gin.H {
+	if !sprtEnabled() || match.TestOnly {
+		return nil
+	}
+	sprt := config.Config.Matches.SPRT
+	llr := sprtLLR(match.Wins, match.Losses, match.Draws, sprt.Elo0, sprt.Elo1)
+	lower, upper := sprtBounds()
+	state := "running"
+	switch sprtDecision(match) {
+	case 1:
+		state = "accepted H1"
+	case -1:
+		state = "accepted H0"
+	}
+	return gin.H{
+		"elo0":  sprt.Elo0,
+		"elo1":  sprt.Elo1,
+		"llr":   llr,
+		"lower": lower,
+		"upper": upper,
+		"state": state,
+		"summary": fmt.Sprintf("SPRT elo0=%g elo1=%g: LLR %.2f (%.2f, %.2f), %s",
+			sprt.Elo0, sprt.Elo1, llr, lower, upper, state),
+	}
+}
@@ -1,5 +1,5 @@
 #!/bin/bash
 
-go build main.go
+go build -o main
 pkill -f main
 nohup ./prod.sh & >server.out
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// Free space isn't monitored on Windows, which is only used for development.
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space not supported on windows")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/db"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Walking the game directories takes a while with millions of files, so
+// usage is computed in the background this often.
+const storageUsageMaxAge = 10 * time.Minute
+
+type storageUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+type runStorageUsage struct {
+	Run      uint         `json:"run"`
+	Games    storageUsage `json:"games"`
+	Pgns     storageUsage `json:"pgns"`
+	Networks storageUsage `json:"networks"`
+	// Games not archived by compaction yet.
+	UncompactedGames int `json:"uncompacted_games"`
+	// Upload time of the oldest game file not copied to object storage,
+	// nil if there is none or replication is disabled.
+	OldestUnreplicated *time.Time `json:"oldest_unreplicated"`
+}
+
+var storageUsageCache struct {
+	sync.Mutex
+	runs       []runStorageUsage
+	computedAt time.Time
+}
+
+// Sums the sizes of the files under dir, which may not exist yet.
+func dirUsage(dir string) (storageUsage, error) {
+	usage := storageUsage{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			usage.Bytes += info.Size()
+			usage.Files++
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return usage, err
+}
+
+func computeRunStorageUsage(trainingRun *db.TrainingRun) (runStorageUsage, error) {
+	usage := runStorageUsage{Run: trainingRun.ID}
+	var err error
+	usage.Games, err = dirUsage(fmt.Sprintf("games/run%d", trainingRun.ID))
+	if err != nil {
+		return usage, err
+	}
+	usage.Pgns, err = dirUsage(fmt.Sprintf("pgns/run%d", trainingRun.ID))
+	if err != nil {
+		return usage, err
+	}
+
+	// Networks of all runs share a directory.
+	var paths []string
+	err = db.GetDB().Model(&db.Network{}).Where("training_run_id = ? AND path != ''", trainingRun.ID).Pluck("path", &paths).Error
+	if err != nil {
+		return usage, err
+	}
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		usage.Networks.Bytes += stat.Size()
+		usage.Networks.Files++
+	}
+
+	err = db.GetDB().Model(&db.TrainingGame{}).Where("training_run_id = ? AND compacted = false", trainingRun.ID).Count(&usage.UncompactedGames).Error
+	if err != nil {
+		return usage, err
+	}
+
+	if replicationEnabled() {
+		var oldest []db.TrainingGame
+		err = db.GetDB().Where("training_run_id = ? AND replicated = false AND compacted = false AND path != ''", trainingRun.ID).
+			Order("id").Limit(1).Find(&oldest).Error
+		if err != nil {
+			return usage, err
+		}
+		if len(oldest) > 0 {
+			usage.OldestUnreplicated = &oldest[0].CreatedAt
+		}
+	}
+	return usage, nil
+}
+
+// Recomputes the storage usage of every training run.  The cache is only
+// locked to store the result, so requests aren't held up by the walk.
+func refreshStorageUsage() error {
+	var trainingRuns []db.TrainingRun
+	err := db.GetDB().Order("id").Find(&trainingRuns).Error
+	if err != nil {
+		return err
+	}
+	runs := []runStorageUsage{}
+	for i := range trainingRuns {
+		usage, err := computeRunStorageUsage(&trainingRuns[i])
+		if err != nil {
+			return err
+		}
+		runs = append(runs, usage)
+	}
+	storageUsageCache.Lock()
+	storageUsageCache.runs = runs
+	storageUsageCache.computedAt = time.Now()
+	storageUsageCache.Unlock()
+	return nil
+}
+
+// Returns the storage usage last computed, computing it first if the
+// background job hasn't yet.
+func getStorageUsage() ([]runStorageUsage, time.Time, error) {
+	storageUsageCache.Lock()
+	runs, computedAt := storageUsageCache.runs, storageUsageCache.computedAt
+	storageUsageCache.Unlock()
+	if runs != nil {
+		return runs, computedAt, nil
+	}
+	err := refreshStorageUsage()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return getStorageUsage()
+}
+
+// Starts recomputing the storage usage every storageUsageMaxAge.
+func startStorageUsage() {
+	go func() {
+		for {
+			err := refreshStorageUsage()
+			if err != nil {
+				log.Println(err)
+			}
+			time.Sleep(storageUsageMaxAge)
+		}
+	}()
+}
+
+func apiStorageStats(c *gin.Context) {
+	runs, computedAt, err := getStorageUsage()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"runs":        runs,
+		"computed_at": computedAt,
+	})
+}
+
+func viewStorageStats(c *gin.Context) {
+	runs, computedAt, err := getStorageUsage()
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	disk := []gin.H{}
+	for _, dir := range uploadVolumes {
+		free, err := volumeFreeSpace(dir)
+		disk = append(disk, gin.H{
+			"dir":     dir,
+			"known":   err == nil,
+			"free_mb": free / (1024 * 1024),
+		})
+	}
+
+	mb := func(usage storageUsage) string {
+		return fmt.Sprintf("%.1f MiB in %d files", float64(usage.Bytes)/(1024*1024), usage.Files)
+	}
+	rows := []gin.H{}
+	for _, run := range runs {
+		oldest := ""
+		if run.OldestUnreplicated != nil {
+			oldest = run.OldestUnreplicated.Format("2006-01-02 15:04")
+		}
+		rows = append(rows, gin.H{
+			"run":                 run.Run,
+			"games":               mb(run.Games),
+			"pgns":                mb(run.Pgns),
+			"networks":            mb(run.Networks),
+			"uncompacted_games":   run.UncompactedGames,
+			"oldest_unreplicated": oldest,
+		})
+	}
+
+	c.HTML(http.StatusOK, "admin_storage", gin.H{
+		"runs":        rows,
+		"disk":        disk,
+		"computed_at": computedAt.Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"server/db"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	throughputRollupInterval = 10 * time.Minute
+	// History rolled up when the server first starts with an empty table.
+	throughputBackfill = 30 * 24 * time.Hour
+
+	defaultThroughputHours = 7 * 24
+	maxThroughputHours     = 365 * 24
+)
+
+// Recounts the hourly rollups from the hour containing since onwards.  Match
+// games count in the hour they were assigned, once they have a result.
+func rollupThroughput(since time.Time) error {
+	since = since.Truncate(time.Hour)
+	return db.GetDB().Exec(`INSERT INTO throughput_hours (training_run_id, hour, training_games, match_games)
+SELECT training_run_id, hour, SUM(training_games), SUM(match_games) FROM (
+  SELECT training_run_id, date_trunc('hour', created_at) AS hour, count(*) AS training_games, 0 AS match_games
+  FROM training_games WHERE created_at >= ?
+  GROUP BY 1, 2
+  UNION ALL
+  SELECT matches.training_run_id, date_trunc('hour', match_games.created_at), 0, count(*)
+  FROM match_games JOIN matches ON matches.id = match_games.match_id
+  WHERE match_games.created_at >= ? AND match_games.done = true AND match_games.shadow_of = 0
+  GROUP BY 1, 2
+) counts
+GROUP BY training_run_id, hour
+ON CONFLICT (training_run_id, hour) DO UPDATE SET
+training_games = EXCLUDED.training_games,
+match_games = EXCLUDED.match_games`, since, since).Error
+}
+
+// Starts keeping the hourly rollups up to date, picking up after the latest
+// one on restart.
+func startThroughputRollups() {
+	var latest []db.ThroughputHour
+	err := db.GetDB().Order("hour desc").Limit(1).Find(&latest).Error
+	if err != nil {
+		log.Println(err)
+	}
+	since := time.Now().Add(-throughputBackfill)
+	if len(latest) > 0 {
+		since = latest[0].Hour
+	}
+	go func() {
+		for {
+			// Results of the previous hour's match games keep coming in.
+			next := time.Now().Add(-time.Hour)
+			err := rollupThroughput(since)
+			if err != nil {
+				log.Println(err)
+			} else {
+				since = next
+			}
+			time.Sleep(throughputRollupInterval)
+		}
+	}()
+}
+
+// Games per hour of a run over the last hours hours, oldest first, with
+// hours without games included as zeros.
+func apiThroughput(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+	hours := defaultThroughputHours
+	if len(c.Query("hours")) > 0 {
+		hours, err = strconv.Atoi(c.Query("hours"))
+		if err != nil || hours <= 0 || hours > maxThroughputHours {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hours"})
+			return
+		}
+	}
+
+	end := time.Now().Truncate(time.Hour)
+	start := end.Add(-time.Duration(hours-1) * time.Hour)
+	var rollups []db.ThroughputHour
+	err = db.GetReadDB().Where("training_run_id = ? AND hour >= ?", trainingRun.ID, start).Order("hour").Find(&rollups).Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	byHour := map[int64]db.ThroughputHour{}
+	for _, rollup := range rollups {
+		byHour[rollup.Hour.Unix()] = rollup
+	}
+	result := []gin.H{}
+	for hour := start; !hour.After(end); hour = hour.Add(time.Hour) {
+		rollup := byHour[hour.Unix()]
+		result = append(result, gin.H{
+			"hour":           hour.UTC(),
+			"training_games": rollup.TrainingGames,
+			"match_games":    rollup.MatchGames,
+		})
+	}
+	respondJSONWithETag(c, gin.H{
+		"run":   trainingRun.ID,
+		"hours": result,
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scores of one network against another, summed over the tournament.
+type pairingScore struct {
+	wins, losses, draws int
+}
+
+func (p pairingScore) games() int {
+	return p.wins + p.losses + p.draws
+}
+
+func (p pairingScore) points() float64 {
+	return float64(p.wins) + float64(p.draws)/2
+}
+
+// Computes ratings from the pairwise scores with the Bradley-Terry model,
+// relative to players[0].  Each played pairing gets one virtual draw, so
+// networks that won or lost every game still get a finite rating.
+func tournamentRatings(players []uint, scores map[uint]map[uint]pairingScore) map[uint]float64 {
+	gamma := map[uint]float64{}
+	for _, p := range players {
+		gamma[p] = 1
+	}
+
+	for iter := 0; iter < 100; iter++ {
+		next := map[uint]float64{}
+		for _, i := range players {
+			var points, denom float64
+			for _, j := range players {
+				score := scores[i][j]
+				if i == j || score.games() == 0 {
+					continue
+				}
+				points += score.points() + 0.5
+				denom += float64(score.games()+1) / (gamma[i] + gamma[j])
+			}
+			next[i] = gamma[i]
+			if denom > 0 {
+				next[i] = points / denom
+			}
+		}
+		gamma = next
+	}
+
+	ratings := map[uint]float64{}
+	for _, p := range players {
+		ratings[p] = 400 * math.Log10(gamma[p]/gamma[players[0]])
+	}
+	return ratings
+}
+
+func getCrosstable(tournament *db.Tournament) (gin.H, error) {
+	var matches []db.Match
+	err := db.GetDB().Where("tournament_id = ?", tournament.ID).Order("id").Find(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+
+	players := []uint{}
+	scores := map[uint]map[uint]pairingScore{}
+	addPlayer := func(id uint) {
+		if _, ok := scores[id]; !ok {
+			players = append(players, id)
+			scores[id] = map[uint]pairingScore{}
+		}
+	}
+
+	pairings := []gin.H{}
+	for _, match := range matches {
+		a, b := match.CandidateID, match.CurrentBestID
+		addPlayer(a)
+		addPlayer(b)
+		ab, ba := scores[a][b], scores[b][a]
+		ab.wins += match.Wins
+		ab.losses += match.Losses
+		ab.draws += match.Draws
+		ba.wins += match.Losses
+		ba.losses += match.Wins
+		ba.draws += match.Draws
+		scores[a][b], scores[b][a] = ab, ba
+
+		pairings = append(pairings, gin.H{
+			"match_id": match.ID,
+			"white":    a,
+			"black":    b,
+			"score":    fmt.Sprintf("+%d -%d =%d", match.Wins, match.Losses, match.Draws),
+			"games":    match.Wins + match.Losses + match.Draws,
+			"game_cap": match.GameCap,
+			"done":     match.Done,
+		})
+	}
+
+	ratings := tournamentRatings(players, scores)
+	rows := []gin.H{}
+	for _, i := range players {
+		cells := []string{}
+		var points float64
+		var games int
+		for _, j := range players {
+			score, ok := scores[i][j]
+			if i == j || !ok {
+				cells = append(cells, "")
+				continue
+			}
+			cells = append(cells, fmt.Sprintf("%g/%d", score.points(), score.games()))
+			points += score.points()
+			games += score.games()
+		}
+		rows = append(rows, gin.H{
+			"network": i,
+			"cells":   cells,
+			"points":  points,
+			"games":   games,
+			"rating":  math.Round(ratings[i]*10) / 10,
+		})
+	}
+
+	return gin.H{
+		"id":          tournament.ID,
+		"format":      tournament.Format,
+		"description": tournament.Description,
+		"players":     players,
+		"crosstable":  rows,
+		"pairings":    pairings,
+	}, nil
+}
+
+func getTournament(c *gin.Context) (*db.Tournament, error) {
+	tournament := &db.Tournament{}
+	err := db.GetDB().Where("id = ?", c.Param("id")).First(tournament).Error
+	return tournament, err
+}
+
+func viewTournament(c *gin.Context) {
+	tournament, err := getTournament(c)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusNotFound, "Tournament not found")
+		return
+	}
+
+	crosstable, err := getCrosstable(tournament)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.HTML(http.StatusOK, "tournament", crosstable)
+}
+
+func apiTournament(c *gin.Context) {
+	tournament, err := getTournament(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown tournament"})
+		return
+	}
+
+	crosstable, err := getCrosstable(tournament)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	c.JSON(http.StatusOK, crosstable)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"server/db"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+var validArchitecture = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
+// Architecture of a network, e.g. "10x128" for 10 residual blocks of 128
+// filters.  Empty if the trainer didn't tell.
+func networkArchitecture(layers int, filters int) string {
+	if layers <= 0 || filters <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", layers, filters)
+}
+
+// Whether candidates of architecture are gated against the run's
+// BestNetworkID, rather than on a track of their own.
+func isPrimaryTrack(trainingRun *db.TrainingRun, architecture string) bool {
+	return len(trainingRun.PrimaryArchitecture) == 0 || len(architecture) == 0 || architecture == trainingRun.PrimaryArchitecture
+}
+
+// Narrows q, a query of matches, to those of the run's primary track.
+func wherePrimaryTrack(q *gorm.DB, trainingRun *db.TrainingRun) *gorm.DB {
+	if len(trainingRun.PrimaryArchitecture) == 0 {
+		return q
+	}
+	return q.Where("architecture IN (?)", []string{"", trainingRun.PrimaryArchitecture})
+}
+
+// Records the candidate's architecture on matches from before tracks were
+// enabled, which would otherwise all count as matches of the primary track.
+// Candidates of unknown architecture keep theirs empty.
+func backfillMatchArchitectures(tx *gorm.DB, trainingRunID uint) error {
+	return tx.Exec(`UPDATE matches SET architecture = networks.layers::text || 'x' || networks.filters::text
+FROM networks
+WHERE matches.candidate_id = networks.id AND matches.training_run_id = ? AND matches.architecture = ''
+  AND networks.layers > 0 AND networks.filters > 0`, trainingRunID).Error
+}
+
+// Returns the best network candidates of architecture are gated against, 0
+// if none of that architecture was uploaded yet.
+func trackBestNetworkID(trainingRun *db.TrainingRun, architecture string) (uint, error) {
+	if isPrimaryTrack(trainingRun, architecture) {
+		return trainingRun.BestNetworkID, nil
+	}
+	track := db.ArchitectureTrack{}
+	err := db.GetDB().Where("training_run_id = ? AND architecture = ?", trainingRun.ID, architecture).First(&track).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	return track.BestNetworkID, err
+}
+
+// Makes networkID the best of its architecture's track, promoting it for
+// selfplay if that is the primary one.
+func setTrackBestNetwork(trainingRun *db.TrainingRun, architecture string, networkID uint, matchID uint) error {
+	if isPrimaryTrack(trainingRun, architecture) {
+		return setBestNetwork(trainingRun.ID, networkID, matchID)
+	}
+	track := db.ArchitectureTrack{}
+	err := db.GetDB().Where(db.ArchitectureTrack{TrainingRunID: trainingRun.ID, Architecture: architecture}).
+		Assign(db.ArchitectureTrack{BestNetworkID: networkID}).FirstOrCreate(&track).Error
+	if err != nil {
+		return err
+	}
+	invalidatePages(pageEventNetwork)
+	log.Printf("Network %d is the best %s network of training run %d (match %d)\n", networkID, architecture, trainingRun.ID, matchID)
+	return nil
+}
+
+// Switches the architecture selfplay is served from to the one in the
+// architecture parameter.  The best network of its track becomes the run's
+// best network, and the previous best network starts a track of its own.
+// The first call with the best network's architecture just enables tracks.
+func setPrimaryArchitecture(c *gin.Context) {
+	trainingID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training_id")
+		return
+	}
+	trainingRun, err := getTrainingRun(uint(trainingID))
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusBadRequest, "Invalid training run")
+		return
+	}
+	architecture := c.PostForm("architecture")
+	if !validArchitecture.MatchString(architecture) {
+		c.String(http.StatusBadRequest, "Invalid architecture, expected e.g. 10x128")
+		return
+	}
+	if architecture == trainingRun.PrimaryArchitecture {
+		c.String(http.StatusBadRequest, "Architecture is already the primary one")
+		return
+	}
+
+	previous := trainingRun.PrimaryArchitecture
+	if len(previous) == 0 {
+		best := db.Network{}
+		err = db.GetDB().Where("id = ?", trainingRun.BestNetworkID).First(&best).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		previous = networkArchitecture(best.Layers, best.Filters)
+	}
+	enabling := len(trainingRun.PrimaryArchitecture) == 0
+	if architecture == previous {
+		tx := db.GetDB().Begin()
+		err = backfillMatchArchitectures(tx, trainingRun.ID)
+		if err == nil {
+			err = tx.Model(trainingRun).Update("primary_architecture", architecture).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			log.Println(err)
+			c.String(500, "Internal error")
+			return
+		}
+		log.Printf("%s set primary architecture of training run %d to %s\n", c.GetString(gin.AuthUserKey), trainingRun.ID, architecture)
+		c.String(http.StatusOK, fmt.Sprintf("Training run %d primary architecture set to %s.", trainingRun.ID, architecture))
+		return
+	}
+	if len(previous) == 0 {
+		c.String(http.StatusBadRequest, "Architecture of the best network is unknown")
+		return
+	}
+
+	track := db.ArchitectureTrack{}
+	err = db.GetDB().Where("training_run_id = ? AND architecture = ?", trainingRun.ID, architecture).First(&track).Error
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("No %s network was uploaded to training run %d", architecture, trainingRun.ID))
+		return
+	}
+
+	// Updates also sets the fields of the models.
+	previousBestID, bestID := trainingRun.BestNetworkID, track.BestNetworkID
+	tx := db.GetDB().Begin()
+	if enabling {
+		err = backfillMatchArchitectures(tx, trainingRun.ID)
+	}
+	if err == nil {
+		err = tx.Model(trainingRun).Updates(map[string]interface{}{
+			"best_network_id":      bestID,
+			"primary_architecture": architecture,
+		}).Error
+	}
+	if err == nil {
+		err = tx.Model(&track).Updates(map[string]interface{}{
+			"architecture":    previous,
+			"best_network_id": previousBestID,
+		}).Error
+	}
+	// Progress follows the primary track, so the Elo is read after the switch.
+	var elos map[uint]float64
+	if err == nil {
+		_, elos, err = getProgress(tx, trainingRun.ID)
+	}
+	if err == nil {
+		err = tx.Create(&db.PromotionEvent{
+			TrainingRunID:     trainingRun.ID,
+			NetworkID:         bestID,
+			PreviousNetworkID: previousBestID,
+			Elo:               elos[bestID],
+			Reason:            fmt.Sprintf("Primary architecture changed from %s to %s", previous, architecture),
+			CreatedBy:         c.GetString(gin.AuthUserKey),
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	invalidatePages(pageEventNetwork)
+
+	log.Printf("%s set primary architecture of training run %d to %s, best network %d\n", c.GetString(gin.AuthUserKey), trainingRun.ID, architecture, bestID)
+	c.String(http.StatusOK, fmt.Sprintf("Training run %d primary architecture set to %s, best network is now %d.", trainingRun.ID, architecture, bestID))
+}
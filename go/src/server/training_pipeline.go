@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"server/config"
+	"server/db"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Chunks of claims not consumed within this long can be claimed again,
+	// in case the training step died.
+	trainingClaimTTL = 24 * time.Hour
+
+	maxClaimChunks = 1000
+)
+
+func trainingChunkJSON(chunk *db.TrainingChunk) gin.H {
+	return gin.H{
+		"id":            chunk.ID,
+		"first_game_id": chunk.FirstGameID,
+		"last_game_id":  chunk.LastGameID,
+		"games":         chunk.Games,
+		"url":           chunk.URL,
+	}
+}
+
+// Accounts allowed to claim training chunks: the trainers and the admins.
+func trainerAccounts() gin.Accounts {
+	accounts := gin.Accounts{}
+	for user, password := range config.Config.Admin.Trainers {
+		accounts[user] = password
+	}
+	for user, password := range config.Config.Admin.Accounts {
+		accounts[user] = password
+	}
+	return accounts
+}
+
+// Claims up to chunks of the oldest unclaimed compacted chunks of a run for
+// a training step.  Concurrent claims never get the same chunk.
+func claimTrainingChunks(c *gin.Context) {
+	trainingRun, _, err := getScopedTrainingRun(c)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid training run"})
+		return
+	}
+	count, err := strconv.Atoi(c.PostForm("chunks"))
+	if err != nil || count <= 0 || count > maxClaimChunks {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chunks"})
+		return
+	}
+
+	claim := db.TrainingClaim{
+		TrainingRunID: trainingRun.ID,
+		ClaimedBy:     sanitizeReported(c.PostForm("claimed_by"), 64),
+		ExpiresAt:     time.Now().Add(trainingClaimTTL),
+	}
+	var chunks []db.TrainingChunk
+	tx := db.GetDB().Begin()
+	err = tx.Exec(`UPDATE training_chunks SET claim_id = 0 WHERE claim_id IN (
+  SELECT id FROM training_claims WHERE consumed_at IS NULL AND expires_at < ?
+)`, time.Now()).Error
+	if err == nil {
+		err = tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+			Where("training_run_id = ? AND claim_id = 0", trainingRun.ID).
+			Order("first_game_id").Limit(count).Find(&chunks).Error
+	}
+	if err == nil && len(chunks) == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "No unclaimed chunks"})
+		return
+	}
+	if err == nil {
+		err = tx.Create(&claim).Error
+	}
+	ids := []uint{}
+	for _, chunk := range chunks {
+		ids = append(ids, chunk.ID)
+	}
+	if err == nil {
+		err = tx.Model(&db.TrainingChunk{}).Where("id IN (?)", ids).Update("claim_id", claim.ID).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	result := []gin.H{}
+	for i := range chunks {
+		result = append(result, trainingChunkJSON(&chunks[i]))
+	}
+	log.Printf("Training claim %d of run %d took %d chunks for %q\n", claim.ID, trainingRun.ID, len(chunks), claim.ClaimedBy)
+	c.JSON(http.StatusOK, gin.H{
+		"claim":      claim.ID,
+		"expires_at": claim.ExpiresAt,
+		"chunks":     result,
+	})
+}
+
+// Marks a claim's chunks as trained on, recording the sha of the network the
+// training step produced.
+func consumeTrainingClaim(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid claim"})
+		return
+	}
+	sha := c.PostForm("network")
+	if len(sha) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing network"})
+		return
+	}
+
+	tx := db.GetDB().Begin()
+	var claims []db.TrainingClaim
+	err = tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", id).Find(&claims).Error
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	if len(claims) == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown claim"})
+		return
+	}
+	claim := claims[0]
+	if claim.ConsumedAt != nil {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Claim already consumed"})
+		return
+	}
+	if claim.ExpiresAt.Before(time.Now()) {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Claim expired"})
+		return
+	}
+	now := time.Now()
+	err = tx.Model(&claim).Updates(map[string]interface{}{"consumed_at": now, "network_sha": sha}).Error
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Println(err)
+		c.String(500, "Internal error")
+		return
+	}
+
+	log.Printf("Training claim %d consumed by network %s\n", claim.ID, sha)
+	c.JSON(http.StatusOK, gin.H{
+		"claim":       claim.ID,
+		"network":     sha,
+		"consumed_at": now,
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"server/config"
+	"server/db"
+	"sync"
+	"time"
+)
+
+// Trust tiers of users, computed from their contribution history.  Only
+// established users get match games, and only trusted users get the
+// re-validation matches.
+const (
+	trustNew = iota
+	trustEstablished
+	trustTrusted
+)
+
+var trustNames = []string{"new", "established", "trusted"}
+
+// A user's game counts change slowly next to how often the user asks for
+// work, so they're counted at most this often.
+const trustCacheTTL = 5 * time.Minute
+
+type gameCounts struct {
+	games     int
+	excluded  int
+	countedAt time.Time
+}
+
+var gameCountsCache = struct {
+	sync.Mutex
+	users map[uint]gameCounts
+}{users: make(map[uint]gameCounts)}
+
+// Returns the user's accepted and excluded training games, as counted within
+// the last trustCacheTTL.
+func userGameCounts(userID uint) (int, int, error) {
+	gameCountsCache.Lock()
+	counts, ok := gameCountsCache.users[userID]
+	gameCountsCache.Unlock()
+	if ok && time.Since(counts.countedAt) < trustCacheTTL {
+		return counts.games, counts.excluded, nil
+	}
+
+	row := db.GetDB().Raw(`SELECT count(*) FILTER (WHERE excluded = false), count(*) FILTER (WHERE excluded = true)
+FROM training_games
+WHERE user_id = ?`, userID).Row()
+	err := row.Scan(&counts.games, &counts.excluded)
+	if err != nil {
+		return 0, 0, err
+	}
+	counts.countedAt = time.Now()
+	gameCountsCache.Lock()
+	gameCountsCache.users[userID] = counts
+	gameCountsCache.Unlock()
+	return counts.games, counts.excluded, nil
+}
+
+func meetsTrust(games int, days int, minGames int, minDays int) bool {
+	return games >= minGames && days >= minDays
+}
+
+func userTrust(user *db.User) (int, error) {
+	trust, err := contributionTrust(user)
+	if err != nil {
+		return trust, err
+	}
+	return capTrustByReliability(user, trust)
+}
+
+// The trust tier a user's contributions earn, before their reliability is
+// taken into account.
+func contributionTrust(user *db.User) (int, error) {
+	trust := config.Config.Trust
+	// Users whose match results keep disagreeing with other users' don't
+	// move up.
+	if trust.MaxDisagreementPercent > 0 && user.ShadowChecks >= minShadowChecks &&
+		float64(100*user.ShadowDisagreements) > trust.MaxDisagreementPercent*float64(user.ShadowChecks) {
+		return trustNew, nil
+	}
+	if trust.EstablishedGames == 0 && trust.EstablishedDays == 0 && trust.TrustedGames == 0 && trust.TrustedDays == 0 && trust.MaxExcludedPercent == 0 {
+		return trustTrusted, nil
+	}
+
+	games, excluded, err := userGameCounts(user.ID)
+	if err != nil {
+		return trustNew, err
+	}
+
+	// Users whose games keep getting excluded don't move up.
+	if trust.MaxExcludedPercent > 0 && excluded > 0 && float64(100*excluded) > trust.MaxExcludedPercent*float64(games+excluded) {
+		return trustNew, nil
+	}
+
+	days := int(time.Since(user.CreatedAt).Hours() / 24)
+	if !meetsTrust(games, days, trust.EstablishedGames, trust.EstablishedDays) {
+		return trustNew, nil
+	}
+	if !meetsTrust(games, days, trust.TrustedGames, trust.TrustedDays) {
+		return trustEstablished, nil
+	}
+	return trustTrusted, nil
+}
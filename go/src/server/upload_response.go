@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What a client should do about an upload after the server responded.
+const (
+	// Done with, nothing more to send.
+	uploadActionNone = "none"
+	// Keep it and send it again later.
+	uploadActionRetry = "retry"
+	// Rejected for good, discard it.
+	uploadActionDrop = "drop"
+	// The client or engine is too old, nothing it sends is accepted until
+	// it's updated.
+	uploadActionUpgrade = "upgrade"
+	// The account is refused, stop until the user fixes its settings.
+	uploadActionStop = "stop"
+)
+
+// Body of every upload_game and match_result response, an errorResponse
+// with what the client should do about the upload.
+type uploadResponse struct {
+	// "ok", "rejected" or "error".
+	Status    string `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	Action    string `json:"action"`
+	RequestID string `json:"request_id"`
+}
+
+// An error caused by what a client sent rather than by the server, with the
+// action asked of the client when an upload is refused for it.
+type clientError struct {
+	code    string
+	message string
+	action  string
+}
+
+func (e *clientError) Error() string {
+	return e.message
+}
+
+func respondUpload(c *gin.Context, status int, response uploadResponse) {
+	response.RequestID = c.GetString(requestIDKey)
+	c.JSON(status, response)
+}
+
+func uploadAccepted(c *gin.Context, status int, code string, message string) {
+	respondUpload(c, status, uploadResponse{Status: "ok", Code: code, Message: message, Action: uploadActionNone})
+}
+
+func uploadRejected(c *gin.Context, status int, code string, message string) {
+	respondUpload(c, status, uploadResponse{Status: "rejected", Code: code, Message: message, Action: uploadActionDrop})
+}
+
+// For failures that go away on their own.  Set Retry-After before calling
+// to tell the client when.
+func uploadUnavailable(c *gin.Context, status int, code string, message string) {
+	respondUpload(c, status, uploadResponse{Status: "error", Code: code, Message: message, Retryable: true, Action: uploadActionRetry})
+}
+
+// Responds to err, a *clientError refusing the upload or else a server
+// error.
+func uploadFailed(c *gin.Context, err error) {
+	if e, ok := err.(*clientError); ok {
+		log.Println(strings.TrimSpace(e.message))
+		respondUpload(c, http.StatusBadRequest, uploadResponse{Status: "rejected", Code: e.code, Message: e.message, Action: e.action})
+		return
+	}
+	log.Printf("Request %s: %s", c.GetString(requestIDKey), strings.TrimSpace(err.Error()))
+	uploadUnavailable(c, http.StatusInternalServerError, "internal_error", "Internal error")
+}
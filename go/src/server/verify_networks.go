@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"server/config"
+	"server/db"
+	"strings"
+	"time"
+)
+
+const (
+	networkVerificationLock = "network_verification"
+	// Renewed after every network, so only needs to cover hashing one.
+	networkVerificationLockTTL = time.Hour
+)
+
+// Hashes the decompressed contents of a network file, which is what the Sha
+// column holds.
+func networkContentSha(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, zr); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Asks the storage backend for the sha256 of its copy of path.
+func backendChecksum(path string) (string, error) {
+	cmdParams := make([]string, len(config.Config.NetworkVerification.ChecksumCommand))
+	for i, param := range config.Config.NetworkVerification.ChecksumCommand {
+		cmdParams[i] = strings.Replace(param, "%FILE_PATH%", path, -1)
+	}
+	output, err := exec.Command(cmdParams[0], cmdParams[1:]...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSpace(string(output))), nil
+}
+
+// Checks the stored files of a network against its recorded hashes,
+// returning what doesn't match.  Errors reading the database are returned
+// separately, and don't count as a failed verification.
+func verifyNetwork(network *db.Network) (string, error) {
+	sha, err := networkContentSha(network.Path)
+	if err != nil {
+		return fmt.Sprintf("reading %s: %v", network.Path, err), nil
+	}
+	if sha != network.Sha {
+		return fmt.Sprintf("%s hashes to %s", network.Path, sha), nil
+	}
+
+	checksum, _, err := fileChecksum(network.Path)
+	if err != nil {
+		return fmt.Sprintf("reading %s: %v", network.Path, err), nil
+	}
+	if len(network.FileChecksum) == 0 {
+		// Recorded lazily for networks uploaded before checksums.
+		return "", updateNetworkChecksum(network)
+	}
+	if checksum != network.FileChecksum {
+		return fmt.Sprintf("%s has checksum %s, recorded %s", network.Path, checksum, network.FileChecksum), nil
+	}
+
+	if len(network.ProtoPath) > 0 {
+		protoChecksum, _, err := fileChecksum(network.ProtoPath)
+		if err != nil {
+			return fmt.Sprintf("reading %s: %v", network.ProtoPath, err), nil
+		}
+		if protoChecksum != network.ProtoChecksum {
+			return fmt.Sprintf("%s has checksum %s, recorded %s", network.ProtoPath, protoChecksum, network.ProtoChecksum), nil
+		}
+	}
+
+	if len(config.Config.NetworkVerification.ChecksumCommand) > 0 {
+		remote, err := backendChecksum(network.Path)
+		if err != nil {
+			return fmt.Sprintf("checksum of the stored copy of %s: %v", network.Path, err), nil
+		}
+		if remote != network.FileChecksum {
+			return fmt.Sprintf("stored copy of %s has checksum %s, recorded %s", network.Path, remote, network.FileChecksum), nil
+		}
+	}
+	return "", nil
+}
+
+// Emails the configured addresses about a network that failed verification.
+func alertNetworkVerification(network *db.Network, problem string) {
+	for _, to := range config.Config.NetworkVerification.AlertEmails {
+		err := sendEmail(to, fmt.Sprintf("Network %d failed verification", network.ID), problem)
+		if err != nil {
+			log.Printf("Unable to send network verification alert to %s: %v", to, err)
+		}
+	}
+}
+
+// Verifies every stored network, unless another server process is already
+// doing so.  Alerts go out when a network starts failing, not on every run.
+func verifyNetworks() {
+	holder := compactionHolder()
+	locked, err := db.TryLock(networkVerificationLock, holder, networkVerificationLockTTL)
+	if err != nil {
+		log.Printf("Unable to take the network verification lock: %v", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer db.Unlock(networkVerificationLock, holder)
+
+	var networks []db.Network
+	err = db.GetDB().Where("path != ''").Order("id desc").Find(&networks).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	failed := 0
+	for i := range networks {
+		network := &networks[i]
+		problem, err := verifyNetwork(network)
+		if err != nil {
+			log.Printf("Verifying network %d: %v", network.ID, err)
+			continue
+		}
+		if len(problem) > 0 {
+			failed++
+			log.Printf("Network %d failed verification: %s", network.ID, problem)
+			if problem != network.VerifyError {
+				alertNetworkVerification(network, problem)
+			}
+		}
+		now := time.Now()
+		err = db.GetDB().Model(network).Updates(map[string]interface{}{"verified_at": now, "verify_error": problem}).Error
+		if err != nil {
+			log.Println(err)
+		}
+		err = renewLock(networkVerificationLock, networkVerificationLockTTL)
+		if err != nil {
+			log.Printf("Stopping network verification after network %d: %v", network.ID, err)
+			return
+		}
+	}
+	log.Printf("Verified %d networks, %d failed", len(networks), failed)
+}
+
+func startNetworkVerification() {
+	if config.Config.NetworkVerification.IntervalHours <= 0 {
+		return
+	}
+	interval := time.Duration(config.Config.NetworkVerification.IntervalHours) * time.Hour
+	go func() {
+		for {
+			verifyNetworks()
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"server/config"
+	"server/db"
+	"time"
+)
+
+const (
+	gamesWebhookInterval = time.Minute
+	gamesWebhookTimeout  = 10 * time.Second
+
+	gamesWebhookLock    = "games_webhooks"
+	gamesWebhookLockTTL = 5 * time.Minute
+)
+
+var webhookClient = &http.Client{Timeout: gamesWebhookTimeout}
+
+func gamesWebhooksEnabled() bool {
+	return len(config.Config.Webhooks.NewGamesURLs) > 0 && config.Config.Webhooks.NewGames > 0
+}
+
+// Body of the new games webhook, covering the games accumulated since the
+// previous one for the same network.
+type gamesWebhookPayload struct {
+	Run       uint   `json:"run"`
+	Network   uint   `json:"network"`
+	FirstGame uint64 `json:"first_game_id"`
+	LastGame  uint64 `json:"last_game_id"`
+	Games     int    `json:"games"`
+	// Games accepted since the network, up to LastGame.
+	GamesSinceNetwork int `json:"games_since_network"`
+}
+
+func postWebhook(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Fires the new games webhook of a run once for every NewGames games accepted
+// since its latest network that it wasn't fired for yet.  When a URL fails,
+// the games are reported again on the next check, so receivers may see the
+// same range twice.
+func checkGamesWebhook(trainingRunID uint) error {
+	every := config.Config.Webhooks.NewGames
+	var networks []db.Network
+	err := db.GetDB().Where("training_run_id = ?", trainingRunID).Order("id desc").Limit(1).Find(&networks).Error
+	if err != nil {
+		return err
+	}
+	// Runs without networks yet count from their first game.
+	network := db.Network{}
+	if len(networks) > 0 {
+		network = networks[0]
+	}
+
+	var states []db.GamesWebhook
+	err = db.GetDB().Where("training_run_id = ?", trainingRunID).Find(&states).Error
+	if err != nil {
+		return err
+	}
+	state := db.GamesWebhook{TrainingRunID: trainingRunID, NetworkID: network.ID}
+	if len(states) > 0 {
+		state = states[0]
+	}
+	if state.NetworkID != network.ID {
+		state.NetworkID = network.ID
+		state.Fired = 0
+		state.LastGameID = 0
+	}
+
+	for {
+		games := db.GetDB().Model(&db.TrainingGame{}).
+			Where("training_run_id = ? AND excluded = false AND created_at > ? AND id > ?", trainingRunID, network.CreatedAt, state.LastGameID).
+			Order("id")
+		var first, last []uint64
+		err = games.Limit(1).Pluck("id", &first).Error
+		if err != nil {
+			return err
+		}
+		err = games.Offset(every-1).Limit(1).Pluck("id", &last).Error
+		if err != nil {
+			return err
+		}
+		if len(last) == 0 {
+			break
+		}
+		// Renewed before each post, so a process that took the lock over
+		// doesn't post the same games again.
+		err = renewLock(gamesWebhookLock, gamesWebhookLockTTL)
+		if err != nil {
+			return err
+		}
+
+		payload := gamesWebhookPayload{
+			Run:               trainingRunID,
+			Network:           network.ID,
+			FirstGame:         first[0],
+			LastGame:          last[0],
+			Games:             every,
+			GamesSinceNetwork: (state.Fired + 1) * every,
+		}
+		for _, url := range config.Config.Webhooks.NewGamesURLs {
+			err = postWebhook(url, payload)
+			if err != nil {
+				return err
+			}
+		}
+		state.Fired++
+		state.LastGameID = last[0]
+		if len(states) > 0 {
+			err = db.GetDB().Save(&state).Error
+		} else {
+			err = db.GetDB().Create(&state).Error
+			states = append(states, state)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks every run for new games, unless another server process is already
+// doing so.
+func checkGamesWebhooks() {
+	holder := compactionHolder()
+	locked, err := db.TryLock(gamesWebhookLock, holder, gamesWebhookLockTTL)
+	if err != nil {
+		log.Printf("Unable to take the games webhook lock: %v", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer db.Unlock(gamesWebhookLock, holder)
+
+	var trainingRuns []db.TrainingRun
+	err = db.GetDB().Where("active = true").Order("id").Find(&trainingRuns).Error
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, trainingRun := range trainingRuns {
+		err = checkGamesWebhook(trainingRun.ID)
+		if err == errLockLost {
+			log.Printf("Games webhook lock lost, stopping at training run %d", trainingRun.ID)
+			return
+		}
+		if err != nil {
+			log.Printf("New games webhook of training run %d failed: %v", trainingRun.ID, err)
+		}
+	}
+}
+
+func startGamesWebhooks() {
+	if !gamesWebhooksEnabled() {
+		return
+	}
+	go func() {
+		for {
+			checkGamesWebhooks()
+			time.Sleep(gamesWebhookInterval)
+		}
+	}()
+}
@@ -1097,7 +1097,8 @@ void OpenCL::initialize(const int channels, const std::vector<int> & gpus,
 
     myprintf("Selected platform: %s\n",
         best_platform.getInfo<CL_PLATFORM_NAME>().c_str());
-    myprintf("Selected device: %s\n",
+    // Always on stdout, the client reports it to the server.
+    myprintf_so("Selected device: %s\n",
         trim(best_device.getInfo<CL_DEVICE_NAME>()).c_str());
     myprintf("with OpenCL %2.1f capability.\n", best_version);
 
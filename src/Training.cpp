@@ -159,6 +159,23 @@ void Training::record(const BoardHistory& state, UCTNode& root) {
     m_data.emplace_back(step);
 }
 
+// Prints the probabilities of the last recorded position as "probs" followed
+// by index:probability pairs, for the server to compare with uploaded data.
+void Training::dump_probabilities() {
+    std::string out = "probs";
+    if (!m_data.empty()) {
+        const auto& probabilities = m_data.back().probabilities;
+        for (size_t i = 0; i < probabilities.size(); i++) {
+            if (probabilities[i] > 0.0f) {
+                char entry[32];
+                std::snprintf(entry, sizeof(entry), " %zu:%.6f", i, probabilities[i]);
+                out += entry;
+            }
+        }
+    }
+    Utils::myprintf_so("%s\n", out.c_str());
+}
+
 void Training::dump_training(int game_score, const std::string& out_filename) {
     auto chunker = OutputChunker{out_filename, true};
     dump_training(game_score, chunker);
@@ -66,6 +66,7 @@ public:
     static void dump_stats(const std::string& out_filename);
     static void record(const BoardHistory& state, Move move);
     static void record(const BoardHistory& state, UCTNode& node);
+    static void dump_probabilities();
 
 private:
     static void dump_stats(OutputChunker& outchunker);
@@ -20,11 +20,13 @@
 
 #include <boost/filesystem.hpp>
 #include <cassert>
+#include <fstream>
 #include <iostream>
 #include <sstream>
 #include <string>
 #include <mutex>
 #include <thread>
+#include <vector>
 
 #include "Movegen.h"
 #include "Parameters.h"
@@ -153,7 +155,7 @@ namespace {
       Move move = search->think(bh.shallow_clone());
 
       if (move != MOVE_NONE) {
-        myprintf_so("move played %s\n", UCI::move(move).c_str());
+        myprintf_so("move played %s eval %.4f ply %d\n", UCI::move(move).c_str(), search->best_eval(), bh.cur().game_ply());
         bh.do_move(move);
       } else {
         // Resign - so whoever is current, has lost.
@@ -179,10 +181,30 @@ namespace {
     return 0;
   }
 
-  int play_one_game() {
+  // Plays a selfplay game from the position after the opening moves, in UCI
+  // notation, or from the start position if they aren't legal.  A game
+  // started from the opening confirms it on an "opening" line, so callers
+  // can tell it was used.
+  int play_one_game(const std::vector<std::string>& opening) {
     BoardHistory bh;
     bh.set(Position::StartFEN);
 
+    std::string played;
+    for (const auto& token : opening) {
+      Move m = UCI::to_move(bh.cur(), token);
+      if (m == MOVE_NONE) {
+        myprintf_so("Illegal opening move %s\n", token.c_str());
+        bh.set(Position::StartFEN);
+        played.clear();
+        break;
+      }
+      bh.do_move(m);
+      played += (played.empty() ? "" : " ") + token;
+    }
+    if (!played.empty()) {
+      myprintf_so("opening %s\n", played.c_str());
+    }
+
     Training::clear_training();
     int game_score = play_one_game(bh);
 
@@ -204,6 +226,12 @@ namespace {
     }
     int64_t num_games = std::numeric_limits<int64_t>::max();
     is >> num_games;
+    // Optionally followed by the moves of an opening to start each game from.
+    std::vector<std::string> opening;
+    std::string token;
+    while (is >> token) {
+      opening.push_back(token);
+    }
 
     fs::path dir("data-" + suffix);
     if (!fs::exists(dir)) {
@@ -212,8 +240,58 @@ namespace {
     }
     auto chunker = OutputChunker{dir.string() + "/training", true};
     for (int64_t i = 0; i < num_games; i++) {
-      Training::dump_training_v2(play_one_game(), chunker);
+      Training::dump_training_v2(play_one_game(opening), chunker);
+    }
+  }
+
+  // Writes the training data recorded by this engine's searches since the
+  // game started to <dir>/training.0.gz, with the game result from white's
+  // point of view.  Used by the client to collect training data from match
+  // games, where each engine only records its own moves.
+  void save_training(istringstream& is) {
+    std::string dir;
+    int game_score;
+    if (!(is >> dir >> game_score)) {
+      myprintf_so("usage: savetraining <dir> <result>\n");
+      return;
     }
+
+    namespace fs = boost::filesystem;
+    fs::create_directories(fs::path(dir));
+    auto chunker = OutputChunker{dir + "/training", true, 1};
+    Training::dump_training_v2(game_score, chunker);
+  }
+
+  // Searches the position after ply moves of the game in a PGN file, with the
+  // engine's selfplay settings, and prints the resulting probabilities.  Used
+  // by the server to spot check uploaded training data.
+  void spot_check(istringstream& is) {
+    std::string path;
+    size_t ply;
+    if (!(is >> path >> ply)) {
+      myprintf_so("usage: spotcheck <pgn file> <ply>\n");
+      return;
+    }
+
+    std::ifstream file(path);
+    PGNParser parser(file);
+    auto game = parser.parse();
+    if (!game || ply + 1 >= game->bh.positions.size()) {
+      // Out of the game, or the final position which has no search.
+      Training::clear_training();
+      Training::dump_probabilities();
+      return;
+    }
+    while (game->bh.positions.size() > ply + 1) {
+      game->bh.undo_move();
+    }
+
+    Network::initialize();
+    Training::clear_training();
+    auto search = std::make_unique<UCTSearch>(game->bh.shallow_clone());
+    Limits.startTime = now();
+    search->think(game->bh.shallow_clone());
+    Training::dump_probabilities();
   }
 
   void bench() {
@@ -393,6 +471,16 @@ void UCI::loop(const std::string& start) {
 
           generate_training_games(is);
       }
+      else if (token == "spotcheck") {
+          stop_and_wait_search();
+
+          spot_check(is);
+      }
+      else if (token == "savetraining") {
+          stop_and_wait_search();
+
+          save_training(is);
+      }
       else if (token == "bench") {
           stop_and_wait_search();
 
@@ -222,6 +222,7 @@ Move UCTSearch::get_best_move() {
 
     // should we consider resigning?
     float bestscore = m_root->get_first_child()->get_eval(color);
+    m_best_eval = bestscore;
     // bad score
     if (bestscore < ((float)cfg_resignpct / 100.0f)
         && bh_.cur().game_ply() > cfg_min_resign_moves) {
@@ -19,6 +19,7 @@
 #ifndef UCTSEARCH_H_INCLUDED
 #define UCTSEARCH_H_INCLUDED
 
+#include <limits>
 #include <memory>
 #include <atomic>
 #include <tuple>
@@ -82,6 +83,10 @@ public:
     bool should_halt_search();
     void please_stop();
     SearchResult play_simulation(BoardHistory& bh, UCTNode* const node, int sdepth);
+    // Eval of the move returned by think, from the side to move's view.
+    // NaN if the move had no visits, in which case resigning wasn't
+    // considered either.
+    float best_eval() const { return m_best_eval; }
 
 private:
     void dump_stats(BoardHistory& pos, UCTNode& parent);
@@ -103,6 +108,7 @@ private:
     std::atomic<bool> m_run{false};
     int m_maxplayouts;
     int m_maxnodes;
+    float m_best_eval{std::numeric_limits<float>::quiet_NaN()};
 
     bool quiet_ = true;
     std::atomic<bool> uci_stop{false};